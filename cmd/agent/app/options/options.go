@@ -61,9 +61,12 @@ type GrpcProxyAgentOptions struct {
 
 	AgentID          string
 	AgentIdentifiers string
-	SyncInterval     time.Duration
-	ProbeInterval    time.Duration
-	SyncIntervalCap  time.Duration
+	// Derive topology identifiers from the POD_ZONE, POD_REGION and POD_NODE
+	// environment variables.
+	AutoIdentifiers bool
+	SyncInterval    time.Duration
+	ProbeInterval   time.Duration
+	SyncIntervalCap time.Duration
 	// After a duration of this time if the agent doesn't see any activity it
 	// pings the server to see if the transport is still alive.
 	KeepaliveTime time.Duration
@@ -77,22 +80,40 @@ type GrpcProxyAgentOptions struct {
 	// blocking call has its own problems, so it cannot easily be made race condition safe.
 	// The check is an "unlocked" read but is still use at your own peril.
 	WarnOnChannelLimit bool
+	// With WarnOnChannelLimit, the number of times a tunnel may find its
+	// transfer channel full within ChannelLimitWindow before an error is
+	// logged. Zero disables the budget.
+	ChannelLimitBudget int
+	ChannelLimitWindow time.Duration
+	// Close a tunnel which exceeds ChannelLimitBudget.
+	CloseOnChannelLimit bool
 
 	SyncForever bool
+
+	// How long a draining agent waits for endpoint connections to finish
+	// before closing its connections to the proxy server.
+	DrainGracePeriod time.Duration
 }
 
 func (o *GrpcProxyAgentOptions) ClientSetConfig(dialOptions ...grpc.DialOption) *agent.ClientSetConfig {
 	return &agent.ClientSetConfig{
-		Address:                 net.JoinHostPort(o.ProxyServerHost, strconv.Itoa(o.ProxyServerPort)),
-		AgentID:                 o.AgentID,
-		AgentIdentifiers:        o.AgentIdentifiers,
-		SyncInterval:            o.SyncInterval,
-		ProbeInterval:           o.ProbeInterval,
-		SyncIntervalCap:         o.SyncIntervalCap,
-		DialOptions:             dialOptions,
-		ServiceAccountTokenPath: o.ServiceAccountTokenPath,
-		WarnOnChannelLimit:      o.WarnOnChannelLimit,
-		SyncForever:             o.SyncForever,
+		Address:                      net.JoinHostPort(o.ProxyServerHost, strconv.Itoa(o.ProxyServerPort)),
+		AgentID:                      o.AgentID,
+		AgentIdentifiers:             o.AgentIdentifiers,
+		AutoIdentifiers:              o.AutoIdentifiers,
+		SyncInterval:                 o.SyncInterval,
+		ProbeInterval:                o.ProbeInterval,
+		SyncIntervalCap:              o.SyncIntervalCap,
+		DialOptions:                  dialOptions,
+		KeepaliveTime:                o.KeepaliveTime,
+		KeepalivePermitWithoutStream: true,
+		ServiceAccountTokenPath:      o.ServiceAccountTokenPath,
+		WarnOnChannelLimit:           o.WarnOnChannelLimit,
+		ChannelLimitBudget:           o.ChannelLimitBudget,
+		ChannelLimitWindow:           o.ChannelLimitWindow,
+		CloseOnChannelLimit:          o.CloseOnChannelLimit,
+		SyncForever:                  o.SyncForever,
+		DrainGracePeriod:             o.DrainGracePeriod,
 	}
 }
 
@@ -117,8 +138,13 @@ func (o *GrpcProxyAgentOptions) Flags() *pflag.FlagSet {
 	flags.DurationVar(&o.KeepaliveTime, "keepalive-time", o.KeepaliveTime, "Time for gRPC agent server keepalive.")
 	flags.StringVar(&o.ServiceAccountTokenPath, "service-account-token-path", o.ServiceAccountTokenPath, "If non-empty proxy agent uses this token to prove its identity to the proxy server.")
 	flags.StringVar(&o.AgentIdentifiers, "agent-identifiers", o.AgentIdentifiers, "Identifiers of the agent that will be used by the server when choosing agent. N.B. the list of identifiers must be in URL encoded format. e.g.,host=localhost&host=node1.mydomain.com&cidr=127.0.0.1/16&ipv4=1.2.3.4&ipv4=5.6.7.8&ipv6=:::::&default-route=true")
+	flags.BoolVar(&o.AutoIdentifiers, "auto-identifiers", o.AutoIdentifiers, "If true, the agent adds zone, region and node identifiers from the POD_ZONE, POD_REGION and POD_NODE environment variables. Values set via --agent-identifiers take priority.")
 	flags.BoolVar(&o.WarnOnChannelLimit, "warn-on-channel-limit", o.WarnOnChannelLimit, "Turns on a warning if the system is going to push to a full channel. The check involves an unsafe read.")
+	flags.IntVar(&o.ChannelLimitBudget, "channel-limit-budget", o.ChannelLimitBudget, "With --warn-on-channel-limit, the number of times a tunnel may push to a full channel within --channel-limit-window before an error is logged. Zero disables the budget.")
+	flags.DurationVar(&o.ChannelLimitWindow, "channel-limit-window", o.ChannelLimitWindow, "The rolling window of --channel-limit-budget.")
+	flags.BoolVar(&o.CloseOnChannelLimit, "close-on-channel-limit", o.CloseOnChannelLimit, "If true, a tunnel which exceeds --channel-limit-budget is closed.")
 	flags.BoolVar(&o.SyncForever, "sync-forever", o.SyncForever, "If true, the agent continues syncing, in order to support server count changes.")
+	flags.DurationVar(&o.DrainGracePeriod, "drain-grace-period", o.DrainGracePeriod, "After receiving SIGTERM or SIGINT, the time the agent rejects new dial requests while waiting for open connections to finish before closing its connections to the proxy server.")
 	return flags
 }
 
@@ -142,8 +168,13 @@ func (o *GrpcProxyAgentOptions) Print() {
 	klog.V(1).Infof("Keepalive time set to %v.\n", o.KeepaliveTime)
 	klog.V(1).Infof("ServiceAccountTokenPath set to %q.\n", o.ServiceAccountTokenPath)
 	klog.V(1).Infof("AgentIdentifiers set to %s.\n", util.PrettyPrintURL(o.AgentIdentifiers))
+	klog.V(1).Infof("AutoIdentifiers set to %t.\n", o.AutoIdentifiers)
 	klog.V(1).Infof("WarnOnChannelLimit set to %t.\n", o.WarnOnChannelLimit)
+	klog.V(1).Infof("ChannelLimitBudget set to %d.\n", o.ChannelLimitBudget)
+	klog.V(1).Infof("ChannelLimitWindow set to %v.\n", o.ChannelLimitWindow)
+	klog.V(1).Infof("CloseOnChannelLimit set to %t.\n", o.CloseOnChannelLimit)
 	klog.V(1).Infof("SyncForever set to %v.\n", o.SyncForever)
+	klog.V(1).Infof("DrainGracePeriod set to %v.\n", o.DrainGracePeriod)
 }
 
 func (o *GrpcProxyAgentOptions) Validate() error {
@@ -183,6 +214,15 @@ func (o *GrpcProxyAgentOptions) Validate() error {
 	if o.SyncInterval > o.SyncIntervalCap {
 		return fmt.Errorf("sync interval %v must be less than sync interval cap %v", o.SyncInterval, o.SyncIntervalCap)
 	}
+	if o.DrainGracePeriod < 0 {
+		return fmt.Errorf("drain grace period %v must not be negative", o.DrainGracePeriod)
+	}
+	if o.ChannelLimitBudget < 0 {
+		return fmt.Errorf("channel limit budget %d must not be negative", o.ChannelLimitBudget)
+	}
+	if o.ChannelLimitWindow <= 0 {
+		return fmt.Errorf("channel limit window %v must be positive", o.ChannelLimitWindow)
+	}
 	if o.ServiceAccountTokenPath != "" {
 		if _, err := os.Stat(o.ServiceAccountTokenPath); os.IsNotExist(err) {
 			return fmt.Errorf("error checking service account token path %s, got %v", o.ServiceAccountTokenPath, err)
@@ -206,6 +246,10 @@ func validateAgentIdentifiers(agentIdentifiers string) error {
 		case header.CIDR:
 		case header.Host:
 		case header.DefaultRoute:
+		case header.Zone:
+		case header.Region:
+		case header.Node:
+		case header.QoS:
 		default:
 			return fmt.Errorf("unknown address type: %s", idType)
 		}
@@ -228,13 +272,18 @@ func NewGrpcProxyAgentOptions() *GrpcProxyAgentOptions {
 		EnableContentionProfiling: false,
 		AgentID:                   defaultAgentID(),
 		AgentIdentifiers:          "",
+		AutoIdentifiers:           false,
 		SyncInterval:              1 * time.Second,
 		ProbeInterval:             1 * time.Second,
 		SyncIntervalCap:           10 * time.Second,
 		KeepaliveTime:             1 * time.Hour,
 		ServiceAccountTokenPath:   "",
 		WarnOnChannelLimit:        false,
+		ChannelLimitBudget:        0,
+		ChannelLimitWindow:        time.Minute,
+		CloseOnChannelLimit:       false,
 		SyncForever:               false,
+		DrainGracePeriod:          0,
 	}
 	return &o
 }
@@ -42,13 +42,18 @@ func TestDefaultServerOptions(t *testing.T) {
 	assertDefaultValue(t, "EnableProfiling", defaultAgentOptions.EnableProfiling, false)
 	assertDefaultValue(t, "EnableContentionProfiling", defaultAgentOptions.EnableContentionProfiling, false)
 	assertDefaultValue(t, "AgentIdentifiers", defaultAgentOptions.AgentIdentifiers, "")
+	assertDefaultValue(t, "AutoIdentifiers", defaultAgentOptions.AutoIdentifiers, false)
 	assertDefaultValue(t, "SyncInterval", defaultAgentOptions.SyncInterval, 1*time.Second)
 	assertDefaultValue(t, "ProbeInterval", defaultAgentOptions.ProbeInterval, 1*time.Second)
 	assertDefaultValue(t, "SyncIntervalCap", defaultAgentOptions.SyncIntervalCap, 10*time.Second)
 	assertDefaultValue(t, "KeepaliveTime", defaultAgentOptions.KeepaliveTime, 1*time.Hour)
 	assertDefaultValue(t, "ServiceAccountTokenPath", defaultAgentOptions.ServiceAccountTokenPath, "")
 	assertDefaultValue(t, "WarnOnChannelLimit", defaultAgentOptions.WarnOnChannelLimit, false)
+	assertDefaultValue(t, "ChannelLimitBudget", defaultAgentOptions.ChannelLimitBudget, 0)
+	assertDefaultValue(t, "ChannelLimitWindow", defaultAgentOptions.ChannelLimitWindow, time.Minute)
+	assertDefaultValue(t, "CloseOnChannelLimit", defaultAgentOptions.CloseOnChannelLimit, false)
 	assertDefaultValue(t, "SyncForever", defaultAgentOptions.SyncForever, false)
+	assertDefaultValue(t, "DrainGracePeriod", defaultAgentOptions.DrainGracePeriod, time.Duration(0))
 }
 
 func assertDefaultValue(t *testing.T, fieldName string, actual, expected interface{}) {
@@ -20,21 +20,25 @@ import (
 	"bytes"
 	"context"
 	"crypto/tls"
+	"encoding/json"
 	"fmt"
 	"net"
 	"net/http"
 	"net/http/pprof"
+	"os"
+	"os/signal"
 	"runtime"
 	runpprof "runtime/pprof"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/spf13/cobra"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
-	"google.golang.org/grpc/keepalive"
 	"k8s.io/klog/v2"
 
 	"sigs.k8s.io/apiserver-network-proxy/cmd/agent/app/options"
@@ -44,33 +48,58 @@ import (
 
 const ReadHeaderTimeout = 60 * time.Second
 
+// HealthCheckTimeout is how long the liveness handler waits for unhealthy
+// server connections to recover before reporting them.
+const HealthCheckTimeout = 1 * time.Second
+
 func NewAgentCommand(a *Agent, o *options.GrpcProxyAgentOptions) *cobra.Command {
 	cmd := &cobra.Command{
 		Use:  "agent",
 		Long: `A gRPC agent, Connects to the proxy and then allows traffic to be forwarded to it.`,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			stopCh := make(chan struct{})
-			return a.Run(o, stopCh)
+			drainCh, stopCh := SetupSignalHandler()
+			return a.Run(o, drainCh, stopCh)
 		},
 	}
 
 	return cmd
 }
 
+// SetupSignalHandler returns a drain channel which is closed on the first
+// SIGTERM or SIGINT, and a stop channel which is closed on the second.
+func SetupSignalHandler() (drainCh, stopCh <-chan struct{}) {
+	drain := make(chan struct{})
+	stop := make(chan struct{})
+	c := make(chan os.Signal, 2)
+	signal.Notify(c, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		<-c
+		klog.V(1).Infoln("Received shutdown signal, draining agent.")
+		close(drain)
+		<-c
+		close(stop)
+	}()
+	return drain, stop
+}
+
 type Agent struct {
 	adminServer  *http.Server
 	healthServer *http.Server
 
 	cs *agent.ClientSet
+
+	// TracerProvider, if set, provides the tracer for the tunnel spans,
+	// instead of the global one. It must be set before Run.
+	TracerProvider trace.TracerProvider
 }
 
-func (a *Agent) Run(o *options.GrpcProxyAgentOptions, stopCh <-chan struct{}) error {
+func (a *Agent) Run(o *options.GrpcProxyAgentOptions, drainCh, stopCh <-chan struct{}) error {
 	o.Print()
 	if err := o.Validate(); err != nil {
 		return fmt.Errorf("failed to validate agent options with %v", err)
 	}
 
-	cs, err := a.runProxyConnection(o, stopCh)
+	cs, err := a.runProxyConnection(o, drainCh, stopCh)
 	if err != nil {
 		return fmt.Errorf("failed to run proxy connection with %v", err)
 	}
@@ -81,18 +110,21 @@ func (a *Agent) Run(o *options.GrpcProxyAgentOptions, stopCh <-chan struct{}) er
 	}
 	defer a.healthServer.Close()
 
-	if err := a.runAdminServer(o); err != nil {
+	if err := a.runAdminServer(o, cs); err != nil {
 		return fmt.Errorf("failed to run admin server with %v", err)
 	}
 	defer a.adminServer.Close()
 
-	<-stopCh
+	select {
+	case <-stopCh:
+	case <-cs.Drained():
+	}
 	klog.V(1).Infoln("Shutting down agent.")
 
 	return nil
 }
 
-func (a *Agent) runProxyConnection(o *options.GrpcProxyAgentOptions, stopCh <-chan struct{}) (*agent.ClientSet, error) {
+func (a *Agent) runProxyConnection(o *options.GrpcProxyAgentOptions, drainCh, stopCh <-chan struct{}) (*agent.ClientSet, error) {
 	var tlsConfig *tls.Config
 	var err error
 	if tlsConfig, err = util.GetClientTLSConfig(o.CaCert, o.AgentCert, o.AgentKey, o.ProxyServerHost, o.AlpnProtos); err != nil {
@@ -100,21 +132,58 @@ func (a *Agent) runProxyConnection(o *options.GrpcProxyAgentOptions, stopCh <-ch
 	}
 	dialOptions := []grpc.DialOption{
 		grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)),
-		grpc.WithKeepaliveParams(keepalive.ClientParameters{
-			Time:                o.KeepaliveTime,
-			PermitWithoutStream: true,
-		}),
 	}
 	cc := o.ClientSetConfig(dialOptions...)
-	cs := cc.NewAgentClientSet(stopCh)
+	cc.TracerProvider = a.TracerProvider
+	// Reload the certificates for every new connection, so rotated
+	// certificates are picked up without restarting the agent.
+	cc.CredentialsReloader = func() (credentials.TransportCredentials, error) {
+		tlsConfig, err := util.GetClientTLSConfig(o.CaCert, o.AgentCert, o.AgentKey, o.ProxyServerHost, o.AlpnProtos)
+		if err != nil {
+			return nil, err
+		}
+		return credentials.NewTLS(tlsConfig), nil
+	}
+	cs, err := cc.NewAgentClientSetChecked(drainCh, stopCh)
+	if err != nil {
+		return nil, err
+	}
 	cs.Serve()
 
 	return cs, nil
 }
 
-func (a *Agent) runHealthServer(o *options.GrpcProxyAgentOptions, cs agent.ReadinessManager) error {
+func (a *Agent) runHealthServer(o *options.GrpcProxyAgentOptions, cs *agent.ClientSet) error {
 	livenessHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprintf(w, "ok")
+		if err := cs.RecentSyncError(o.ProbeInterval); err != nil {
+			klog.V(0).InfoS("liveness check failed", "syncError", err)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, "sync failed: %v", err)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), HealthCheckTimeout)
+		defer cancel()
+		results := cs.HealthCheck(ctx)
+		body := make(map[string]interface{}, len(results))
+		healthy := true
+		for serverID, err := range results {
+			if err != nil {
+				healthy = false
+				body[serverID] = err.Error()
+			} else {
+				body[serverID] = nil
+			}
+		}
+		if healthy {
+			fmt.Fprintf(w, "ok")
+			return
+		}
+		klog.V(0).InfoS("liveness check failed", "servers", body)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		if err := json.NewEncoder(w).Encode(body); err != nil {
+			klog.ErrorS(err, "failed to write liveness check response")
+		}
 	})
 
 	checks := []agent.HealthChecker{agent.Ping, agent.NewServerConnected(cs)}
@@ -129,6 +198,7 @@ func (a *Agent) runHealthServer(o *options.GrpcProxyAgentOptions, cs agent.Readi
 				fmt.Fprintf(&individualCheckOutput, "[+]%s ok\n", check.Name())
 			}
 		}
+		fmt.Fprintf(&individualCheckOutput, "%s\n", cs.SyncSummary())
 
 		// Always be verbose if the check has failed
 		if len(failedChecks) > 0 {
@@ -180,7 +250,7 @@ func (a *Agent) serveHealth(healthServer *http.Server) {
 	klog.V(0).Infoln("Health server stopped listening")
 }
 
-func (a *Agent) runAdminServer(o *options.GrpcProxyAgentOptions) error {
+func (a *Agent) runAdminServer(o *options.GrpcProxyAgentOptions, cs *agent.ClientSet) error {
 	muxHandler := http.NewServeMux()
 	muxHandler.Handle("/metrics", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		host, _, err := net.SplitHostPort(r.Host)
@@ -203,6 +273,7 @@ func (a *Agent) runAdminServer(o *options.GrpcProxyAgentOptions) error {
 			runtime.SetBlockProfileRate(1)
 		}
 	}
+	cs.ServeDebugHTTP(muxHandler)
 
 	a.adminServer = &http.Server{
 		Addr:              net.JoinHostPort(o.AdminBindAddress, strconv.Itoa(o.AdminServerPort)),
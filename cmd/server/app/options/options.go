@@ -56,6 +56,9 @@ type ProxyRunOptions struct {
 	AdminPort int
 	// Bind address for the admin connections.
 	AdminBindAddress string
+	// Port we listen for admin gRPC connections on, which share the
+	// AdminBindAddress.
+	AdminGRPCPort int
 	// Port we listen for health connections on.
 	HealthPort int
 	// Bind address for the health connections.
@@ -95,6 +98,12 @@ type ProxyRunOptions struct {
 	// it will choose a random backend.
 	ProxyStrategies string
 
+	// QoS class of agents which do not set one in their identifiers.
+	DefaultQoSClass string
+
+	// Maximum number of agent connections, 0 for no limit.
+	MaxAgents int
+
 	// Cipher suites used by the server.
 	// If empty, the default suite will be used from tls.CipherSuites(),
 	// also checks if given comma separated list contains cipher from tls.InsecureCipherSuites().
@@ -120,6 +129,7 @@ func (o *ProxyRunOptions) Flags() *pflag.FlagSet {
 	flags.StringVar(&o.AgentBindAddress, "agent-bind-address", o.AgentBindAddress, "Bind address for agent connections. If empty, we will bind to all interfaces.")
 	flags.IntVar(&o.AdminPort, "admin-port", o.AdminPort, "Port we listen for admin connections on.")
 	flags.StringVar(&o.AdminBindAddress, "admin-bind-address", o.AdminBindAddress, "Bind address for admin connections. If empty, we will bind to localhost.")
+	flags.IntVar(&o.AdminGRPCPort, "admin-grpc-port", o.AdminGRPCPort, "Port we listen for admin gRPC connections on, e.g. to resize the agent pool.")
 	flags.IntVar(&o.HealthPort, "health-port", o.HealthPort, "Port we listen for health connections on.")
 	flags.StringVar(&o.HealthBindAddress, "health-bind-address", o.HealthBindAddress, "Bind address for health connections. If empty, we will bind to all interfaces.")
 	flags.DurationVar(&o.KeepaliveTime, "keepalive-time", o.KeepaliveTime, "Time for gRPC agent server keepalive.")
@@ -135,6 +145,8 @@ func (o *ProxyRunOptions) Flags() *pflag.FlagSet {
 	flags.IntVar(&o.KubeconfigBurst, "kubeconfig-burst", o.KubeconfigBurst, "Maximum client burst (proxy server uses this client to authenticate agent tokens).")
 	flags.StringVar(&o.AuthenticationAudience, "authentication-audience", o.AuthenticationAudience, "Expected agent's token authentication audience (used with agent-namespace, agent-service-account, kubeconfig).")
 	flags.StringVar(&o.ProxyStrategies, "proxy-strategies", o.ProxyStrategies, "The list of proxy strategies used by the server to pick an agent/tunnel, available strategies are: default, destHost, defaultRoute.")
+	flags.StringVar(&o.DefaultQoSClass, "default-qos-class", o.DefaultQoSClass, "The QoS class of agents which do not set the qos identifier. Agents of class system are preferred over agents of class default when several match a request.")
+	flags.IntVar(&o.MaxAgents, "max-agents", o.MaxAgents, "The maximum number of agent connections. Agents connecting beyond it are rejected. 0 means no limit.")
 	flags.StringSliceVar(&o.CipherSuites, "cipher-suites", o.CipherSuites, "The comma separated list of allowed cipher suites. Has no effect on TLS1.3. Empty means allow default list.")
 
 	flags.Bool("warn-on-channel-limit", true, "This behavior is now thread safe and always on. This flag will be removed in a future release.")
@@ -159,6 +171,7 @@ func (o *ProxyRunOptions) Print() {
 	klog.V(1).Infof("Agent bind address set to %q.\n", o.AgentBindAddress)
 	klog.V(1).Infof("Admin port set to %d.\n", o.AdminPort)
 	klog.V(1).Infof("Admin bind address set to %q.\n", o.AdminBindAddress)
+	klog.V(1).Infof("Admin gRPC port set to %d.\n", o.AdminGRPCPort)
 	klog.V(1).Infof("Health port set to %d.\n", o.HealthPort)
 	klog.V(1).Infof("Health bind address set to %q.\n", o.HealthBindAddress)
 	klog.V(1).Infof("Keepalive time set to %v.\n", o.KeepaliveTime)
@@ -174,6 +187,8 @@ func (o *ProxyRunOptions) Print() {
 	klog.V(1).Infof("KubeconfigQPS set to %f.\n", o.KubeconfigQPS)
 	klog.V(1).Infof("KubeconfigBurst set to %d.\n", o.KubeconfigBurst)
 	klog.V(1).Infof("ProxyStrategies set to %q.\n", o.ProxyStrategies)
+	klog.V(1).Infof("DefaultQoSClass set to %q.\n", o.DefaultQoSClass)
+	klog.V(1).Infof("MaxAgents set to %d.\n", o.MaxAgents)
 	klog.V(1).Infof("CipherSuites set to %q.\n", o.CipherSuites)
 }
 
@@ -249,6 +264,9 @@ func (o *ProxyRunOptions) Validate() error {
 	if o.HealthPort > 49151 {
 		return fmt.Errorf("please do not try to use ephemeral port %d for the health port", o.HealthPort)
 	}
+	if o.AdminGRPCPort > 49151 {
+		return fmt.Errorf("please do not try to use ephemeral port %d for the admin gRPC port", o.AdminGRPCPort)
+	}
 
 	if o.ServerPort < 1024 {
 		if o.UdsName == "" {
@@ -264,6 +282,9 @@ func (o *ProxyRunOptions) Validate() error {
 	if o.HealthPort < 1024 {
 		return fmt.Errorf("please do not try to use reserved port %d for the health port", o.HealthPort)
 	}
+	if o.AdminGRPCPort < 1024 {
+		return fmt.Errorf("please do not try to use reserved port %d for the admin gRPC port", o.AdminGRPCPort)
+	}
 	if o.EnableContentionProfiling && !o.EnableProfiling {
 		return fmt.Errorf("if --enable-contention-profiling is set, --enable-profiling must also be set")
 	}
@@ -297,6 +318,12 @@ func (o *ProxyRunOptions) Validate() error {
 	if _, err := server.ParseProxyStrategies(o.ProxyStrategies); err != nil {
 		return fmt.Errorf("invalid proxy strategies: %v", err)
 	}
+	if err := server.ValidateQoSClass(o.DefaultQoSClass); err != nil {
+		return fmt.Errorf("invalid default QoS class: %v", err)
+	}
+	if o.MaxAgents < 0 {
+		return fmt.Errorf("max agents must not be negative, got %d", o.MaxAgents)
+	}
 
 	// validate the cipher suites
 	if len(o.CipherSuites) != 0 {
@@ -331,6 +358,7 @@ func NewProxyRunOptions() *ProxyRunOptions {
 		HealthBindAddress:         "",
 		AdminPort:                 8095,
 		AdminBindAddress:          "127.0.0.1",
+		AdminGRPCPort:             8096,
 		KeepaliveTime:             1 * time.Hour,
 		FrontendKeepaliveTime:     1 * time.Hour,
 		EnableProfiling:           false,
@@ -344,6 +372,8 @@ func NewProxyRunOptions() *ProxyRunOptions {
 		KubeconfigBurst:           0,
 		AuthenticationAudience:    "",
 		ProxyStrategies:           "default",
+		DefaultQoSClass:           server.QoSClassDefault,
+		MaxAgents:                 0,
 		CipherSuites:              make([]string, 0),
 	}
 	return &o
@@ -48,6 +48,7 @@ func TestDefaultServerOptions(t *testing.T) {
 	assertDefaultValue(t, "HealthBindAddress", defaultServerOptions.HealthBindAddress, "")
 	assertDefaultValue(t, "AdminPort", defaultServerOptions.AdminPort, 8095)
 	assertDefaultValue(t, "AdminBindAddress", defaultServerOptions.AdminBindAddress, "127.0.0.1")
+	assertDefaultValue(t, "AdminGRPCPort", defaultServerOptions.AdminGRPCPort, 8096)
 	assertDefaultValue(t, "KeepaliveTime", defaultServerOptions.KeepaliveTime, 1*time.Hour)
 	assertDefaultValue(t, "FrontendKeepaliveTime", defaultServerOptions.FrontendKeepaliveTime, 1*time.Hour)
 	assertDefaultValue(t, "EnableProfiling", defaultServerOptions.EnableProfiling, false)
@@ -60,6 +61,8 @@ func TestDefaultServerOptions(t *testing.T) {
 	assertDefaultValue(t, "KubeconfigBurst", defaultServerOptions.KubeconfigBurst, 0)
 	assertDefaultValue(t, "AuthenticationAudience", defaultServerOptions.AuthenticationAudience, "")
 	assertDefaultValue(t, "ProxyStrategies", defaultServerOptions.ProxyStrategies, "default")
+	assertDefaultValue(t, "DefaultQoSClass", defaultServerOptions.DefaultQoSClass, "default")
+	assertDefaultValue(t, "MaxAgents", defaultServerOptions.MaxAgents, 0)
 	assertDefaultValue(t, "CipherSuites", defaultServerOptions.CipherSuites, make([]string, 0))
 }
 
@@ -120,6 +123,16 @@ func TestValidate(t *testing.T) {
 			value:    49152,
 			expected: fmt.Errorf("please do not try to use ephemeral port 49152 for the admin port"),
 		},
+		"ReservedAdminGRPCPort": {
+			field:    "AdminGRPCPort",
+			value:    1023,
+			expected: fmt.Errorf("please do not try to use reserved port 1023 for the admin gRPC port"),
+		},
+		"StartEphemeralAdminGRPCPort": {
+			field:    "AdminGRPCPort",
+			value:    49152,
+			expected: fmt.Errorf("please do not try to use ephemeral port 49152 for the admin gRPC port"),
+		},
 		"ReservedHealthPort": {
 			field:    "HealthPort",
 			value:    1023,
@@ -150,6 +163,16 @@ func TestValidate(t *testing.T) {
 			value:    "",
 			expected: fmt.Errorf("ProxyStrategies cannot be empty"),
 		},
+		"Invalid default QoS class": {
+			field:    "DefaultQoSClass",
+			value:    "gold",
+			expected: fmt.Errorf("invalid default QoS class: unknown QoS class \"gold\", available classes are: system, default"),
+		},
+		"Negative max agents": {
+			field:    "MaxAgents",
+			value:    -1,
+			expected: fmt.Errorf("max agents must not be negative, got -1"),
+		},
 		"Invalid proxy strategies": {
 			field:    "ProxyStrategies",
 			value:    "invalid",
@@ -36,6 +36,7 @@ import (
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/spf13/cobra"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/keepalive"
@@ -47,6 +48,7 @@ import (
 	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
 	"sigs.k8s.io/apiserver-network-proxy/pkg/server"
 	"sigs.k8s.io/apiserver-network-proxy/pkg/util"
+	"sigs.k8s.io/apiserver-network-proxy/proto/admin"
 	"sigs.k8s.io/apiserver-network-proxy/proto/agent"
 )
 
@@ -82,11 +84,16 @@ func tlsCipherSuites(cipherNames []string) []uint16 {
 }
 
 type Proxy struct {
-	agentServer  *grpc.Server
-	adminServer  *http.Server
-	healthServer *http.Server
+	agentServer     *grpc.Server
+	adminServer     *http.Server
+	adminGRPCServer *grpc.Server
+	healthServer    *http.Server
 
 	server *server.ProxyServer
+
+	// TracerProvider, if set, provides the tracer for the tunnel spans,
+	// instead of the global one. It must be set before Run.
+	TracerProvider trace.TracerProvider
 }
 
 type StopFunc func()
@@ -133,6 +140,11 @@ func (p *Proxy) Run(o *options.ProxyRunOptions, stopCh <-chan struct{}) error {
 		return err
 	}
 	p.server = server.NewProxyServer(o.ServerID, ps, int(o.ServerCount), authOpt)
+	p.server.DefaultQoSClass = o.DefaultQoSClass
+	if o.MaxAgents > 0 {
+		p.server.ResizePool(o.MaxAgents)
+	}
+	p.server.TracerProvider = p.TracerProvider
 
 	frontendStop, err := p.runFrontendServer(ctx, o, p.server)
 	if err != nil {
@@ -156,6 +168,13 @@ func (p *Proxy) Run(o *options.ProxyRunOptions, stopCh <-chan struct{}) error {
 	}
 	defer p.adminServer.Close()
 
+	klog.V(1).Infoln("Starting admin gRPC server for admin requests.")
+	err = p.runAdminGRPCServer(o, p.server)
+	if err != nil {
+		return fmt.Errorf("failed to run the admin gRPC server: %v", err)
+	}
+	defer p.adminGRPCServer.Stop()
+
 	klog.V(1).Infoln("Starting health server for healthchecks.")
 	err = p.runHealthServer(o, p.server)
 	if err != nil {
@@ -428,6 +447,24 @@ func (p *Proxy) runAdminServer(o *options.ProxyRunOptions, _ *server.ProxyServer
 	return nil
 }
 
+func (p *Proxy) runAdminGRPCServer(o *options.ProxyRunOptions, s *server.ProxyServer) error {
+	addr := net.JoinHostPort(o.AdminBindAddress, strconv.Itoa(o.AdminGRPCPort))
+	grpcServer := grpc.NewServer()
+	admin.RegisterAdminServiceServer(grpcServer, server.NewAdminServer(s))
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %v", addr, err)
+	}
+	labels := runpprof.Labels(
+		"core", "adminGRPCListener",
+		"port", strconv.FormatUint(uint64(o.AdminGRPCPort), 10),
+	)
+	go runpprof.Do(context.Background(), labels, func(context.Context) { grpcServer.Serve(lis) })
+	p.adminGRPCServer = grpcServer
+
+	return nil
+}
+
 func (p *Proxy) runHealthServer(o *options.ProxyRunOptions, server *server.ProxyServer) error {
 	livenessHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(w, "ok")
@@ -172,6 +172,9 @@ func CreateSingleUseGrpcTunnel(tunnelCtx context.Context, address string, opts .
 // The tunnel is normally closed when the connection is terminated.
 // If createCtx is cancelled before tunnel creation, an error will be returned.
 // If tunnelCtx is cancelled while the tunnel is still in use, the tunnel (and any in flight connections) will be closed.
+// The tunnel stream is opened with tunnelCtx, so the proxy server can join the trace of tunnelCtx when a gRPC
+// stats handler which propagates the W3C trace context in the stream metadata, such as otelgrpc.NewClientHandler,
+// is passed in opts.
 // The Dial() method of the returned tunnel should only be called once
 func CreateSingleUseGrpcTunnelWithContext(createCtx, tunnelCtx context.Context, address string, opts ...grpc.DialOption) (Tunnel, error) {
 	c, err := grpc.DialContext(createCtx, address, opts...)
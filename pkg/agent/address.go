@@ -0,0 +1,263 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sort"
+	"strings"
+
+	"sigs.k8s.io/apiserver-network-proxy/pkg/agent/metrics"
+)
+
+// Address families supported by ClientSetConfig.AddressFamilyPreference.
+const (
+	AddressFamilyAny  = ""
+	AddressFamilyIPv4 = "ipv4"
+	AddressFamilyIPv6 = "ipv6"
+)
+
+// normalizeAddress returns address with an IP literal host in its canonical
+// form, e.g. [2001:db8::1]:8091 for [2001:DB8:0::1]:8091. Target URIs,
+// hostnames and addresses which do not parse are returned unchanged.
+func normalizeAddress(address string) string {
+	if strings.Contains(address, "://") {
+		return address
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return address
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return address
+	}
+	return net.JoinHostPort(ip.Unmap().String(), port)
+}
+
+// validateAddressFamily checks that preference is one of the supported
+// address families.
+func validateAddressFamily(preference string) error {
+	switch preference {
+	case AddressFamilyAny, AddressFamilyIPv4, AddressFamilyIPv6:
+		return nil
+	default:
+		return fmt.Errorf("AddressFamilyPreference must be %q, %q or empty, got %q", AddressFamilyIPv4, AddressFamilyIPv6, preference)
+	}
+}
+
+// familyDialer dials the addresses a host resolves to, those of the
+// preferred family first, until a connection succeeds.
+type familyDialer struct {
+	preference string
+	// lookup resolves a host; net.DefaultResolver.LookupNetIP if nil.
+	lookup func(ctx context.Context, network, host string) ([]netip.Addr, error)
+}
+
+func (fd *familyDialer) dial(ctx context.Context, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	lookup := fd.lookup
+	if lookup == nil {
+		lookup = net.DefaultResolver.LookupNetIP
+	}
+	ips, err := lookup(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no addresses found for %q", host)
+	}
+	sortByFamily(ips, fd.preference)
+	var d net.Dialer
+	var errs []error
+	for _, ip := range ips {
+		conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		errs = append(errs, err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, errors.Join(errs...)
+}
+
+// sortByFamily moves the IPs of the preferred family to the front, keeping
+// the resolver order otherwise.
+func sortByFamily(ips []netip.Addr, preference string) {
+	preferred := func(ip netip.Addr) bool {
+		switch preference {
+		case AddressFamilyIPv4:
+			return ip.Unmap().Is4()
+		case AddressFamilyIPv6:
+			return !ip.Unmap().Is4()
+		default:
+			return false
+		}
+	}
+	sort.SliceStable(ips, func(i, j int) bool {
+		return preferred(ips[i]) && !preferred(ips[j])
+	})
+}
+
+// ServerPicker chooses the address the sync loop dials for its next
+// connection, e.g. to spread connections over the addresses behind a DNS
+// round-robin name.
+type ServerPicker interface {
+	// PickAddress returns the address to dial, given the configured
+	// address and the IDs of the servers already connected. Returning ""
+	// dials the configured address.
+	PickAddress(address string, connectedServerIDs []string) string
+}
+
+// nextAddress returns the address for the next connection attempt. Of
+// several static addresses, those of permanently failed servers are
+// skipped; if all of them are, a FailedServerError is returned.
+func (cs *ClientSet) nextAddress() (string, error) {
+	if cs.serverPicker != nil {
+		if address := cs.serverPicker.PickAddress(cs.currentAddress(), cs.ListServerIDs()); address != "" {
+			return address, nil
+		}
+	}
+	if addresses := cs.currentAddresses(); len(addresses) > 1 {
+		var failedServerID string
+		candidates := make([]string, 0, len(addresses))
+		for _, address := range addresses {
+			if serverID := cs.failedAddressServer(address); serverID != "" {
+				failedServerID = serverID
+				continue
+			}
+			candidates = append(candidates, address)
+		}
+		if len(candidates) == 0 {
+			return "", &FailedServerError{ServerID: failedServerID}
+		}
+		return cs.leastConnectedAddress(candidates), nil
+	}
+	return cs.currentAddress(), nil
+}
+
+// currentAddress returns the address the sync loop dials: the configured
+// one, or the fallback one while it is in use.
+func (cs *ClientSet) currentAddress() string {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.address
+}
+
+func (cs *ClientSet) setAddress(address string) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.address = address
+}
+
+// currentAddresses returns the addresses the sync loop spreads its
+// connections over. The slice is replaced, never modified, so it may be
+// read without the lock.
+func (cs *ClientSet) currentAddresses() []string {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.addresses
+}
+
+// usingFallback returns true while the fallback address is in use.
+func (cs *ClientSet) usingFallback() bool {
+	return cs.fallbackAddress != "" && cs.currentAddress() == cs.fallbackAddress
+}
+
+// updateFallback counts the consecutive failed sync attempts against the
+// primary address, and switches to the fallback address once there are
+// fallbackAfterFailures of them. It is called by the sync loop.
+func (cs *ClientSet) updateFallback(result connectResult) {
+	if cs.fallbackAddress == "" || cs.usingFallback() {
+		return
+	}
+	switch result.syncResult() {
+	case metrics.SyncResultFailure:
+		cs.primaryFailures++
+	case metrics.SyncResultSuccess:
+		cs.primaryFailures = 0
+	}
+	if cs.primaryFailures < cs.fallbackAfterFailures {
+		return
+	}
+	cs.logger.Info("Proxy server address unreachable, switching to the fallback address",
+		"agentID", cs.agentID, "address", cs.primaryAddress, "fallbackAddress", cs.fallbackAddress, "failures", cs.primaryFailures)
+	cs.setAddress(cs.fallbackAddress)
+	cs.primaryFailures = 0
+	cs.lastPrimaryProbe = cs.clock.Now()
+}
+
+// probePrimary dials the primary address while the fallback address is in
+// use, at most once per syncIntervalCap. If the dial succeeds, the primary
+// address is used again and the new client is kept. It is called by the
+// sync loop.
+func (cs *ClientSet) probePrimary() {
+	if !cs.usingFallback() || cs.clock.Since(cs.lastPrimaryProbe) < cs.syncIntervalCap {
+		return
+	}
+	cs.lastPrimaryProbe = cs.clock.Now()
+	c, _, err := cs.newAgentClient(cs.primaryAddress)
+	if err != nil {
+		cs.logger.V(2).Info("Proxy server address still unreachable, keeping the fallback address",
+			"agentID", cs.agentID, "address", cs.primaryAddress, "err", err)
+		return
+	}
+	cs.logger.Info("Proxy server address reachable again, switching back from the fallback address",
+		"agentID", cs.agentID, "address", cs.primaryAddress, "fallbackAddress", cs.fallbackAddress)
+	cs.setAddress(cs.primaryAddress)
+	if err := cs.AddClient(c.serverID, c); err != nil {
+		c.Close()
+		return
+	}
+	cs.serveClient(c)
+}
+
+// leastConnectedAddress returns one of addresses with the fewest clients.
+// Addresses with equally few clients take turns, so that an unreachable
+// address does not keep the others from being dialed.
+func (cs *ClientSet) leastConnectedAddress(addresses []string) string {
+	counts := cs.ClientsPerAddress()
+	best := -1
+	for i := range addresses {
+		j := (cs.nextAddressIndex + i) % len(addresses)
+		if best < 0 || counts[addresses[j]] < counts[addresses[best]] {
+			best = j
+		}
+	}
+	cs.nextAddressIndex = (best + 1) % len(addresses)
+	return addresses[best]
+}
+
+// ClientsPerAddress returns the number of clients connected through each
+// address they were dialed at.
+func (cs *ClientSet) ClientsPerAddress() map[string]int {
+	counts := make(map[string]int)
+	cs.ForEachClient(func(_ string, c *Client) bool {
+		counts[c.address]++
+		return true
+	})
+	return counts
+}
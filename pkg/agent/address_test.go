@@ -0,0 +1,261 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"k8s.io/apimachinery/pkg/util/wait"
+	clocktesting "k8s.io/utils/clock/testing"
+
+	"sigs.k8s.io/apiserver-network-proxy/proto/agent"
+)
+
+func TestNormalizeAddress(t *testing.T) {
+	testCases := []struct {
+		address  string
+		expected string
+	}{
+		{address: "localhost:8091", expected: "localhost:8091"},
+		{address: "10.0.0.1:8091", expected: "10.0.0.1:8091"},
+		{address: "[2001:db8::1]:8091", expected: "[2001:db8::1]:8091"},
+		{address: "[2001:DB8:0:0::1]:8091", expected: "[2001:db8::1]:8091"},
+		{address: "[::ffff:10.0.0.1]:8091", expected: "10.0.0.1:8091"},
+		{address: "dns:///[2001:DB8::1]:8091", expected: "dns:///[2001:DB8::1]:8091"},
+		{address: "2001:db8::1:8091", expected: "2001:db8::1:8091"},
+	}
+	for _, tc := range testCases {
+		if got := normalizeAddress(tc.address); got != tc.expected {
+			t.Errorf("normalizeAddress(%q): expected %q, got %q", tc.address, tc.expected, got)
+		}
+	}
+}
+
+func TestSortByFamily(t *testing.T) {
+	v4a, v4b := netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("10.0.0.2")
+	v6a, v6b := netip.MustParseAddr("2001:db8::1"), netip.MustParseAddr("2001:db8::2")
+	testCases := []struct {
+		preference string
+		expected   []netip.Addr
+	}{
+		{preference: AddressFamilyAny, expected: []netip.Addr{v6a, v4a, v6b, v4b}},
+		{preference: AddressFamilyIPv4, expected: []netip.Addr{v4a, v4b, v6a, v6b}},
+		{preference: AddressFamilyIPv6, expected: []netip.Addr{v6a, v6b, v4a, v4b}},
+	}
+	for _, tc := range testCases {
+		ips := []netip.Addr{v6a, v4a, v6b, v4b}
+		sortByFamily(ips, tc.preference)
+		if !reflect.DeepEqual(ips, tc.expected) {
+			t.Errorf("preference %q: expected %v, got %v", tc.preference, tc.expected, ips)
+		}
+	}
+}
+
+func TestFamilyDialer(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	_, port, _ := net.SplitHostPort(lis.Addr().String())
+	// Nothing listens on the IPv6 address, so an IPv6 preference has to fall
+	// back to the IPv4 one.
+	lookup := func(ctx context.Context, network, host string) ([]netip.Addr, error) {
+		if host != "proxy.example" {
+			return nil, errors.New("no such host")
+		}
+		return []netip.Addr{netip.MustParseAddr("127.0.0.1"), netip.MustParseAddr("::1")}, nil
+	}
+	for _, preference := range []string{AddressFamilyIPv4, AddressFamilyIPv6} {
+		fd := &familyDialer{preference: preference, lookup: lookup}
+		conn, err := fd.dial(context.Background(), net.JoinHostPort("proxy.example", port))
+		if err != nil {
+			t.Errorf("preference %q: unexpected error: %v", preference, err)
+			continue
+		}
+		if got := conn.RemoteAddr().String(); got != lis.Addr().String() {
+			t.Errorf("preference %q: expected a connection to %s, got %s", preference, lis.Addr(), got)
+		}
+		conn.Close()
+	}
+
+	fd := &familyDialer{preference: AddressFamilyIPv6, lookup: lookup}
+	if _, err := fd.dial(context.Background(), net.JoinHostPort("unknown.example", port)); err == nil || !strings.Contains(err.Error(), "no such host") {
+		t.Errorf("expected a lookup error, got %v", err)
+	}
+}
+
+func TestSync_IPv6Address(t *testing.T) {
+	lis, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 loopback is not available: %v", err)
+	}
+	server := grpc.NewServer()
+	agent.RegisterAgentServiceServer(server, &testProxyServer{serverID: "server1", serverCount: 1})
+	go server.Serve(lis)
+	defer server.Stop()
+	_, port, _ := net.SplitHostPort(lis.Addr().String())
+
+	cs := withTestDefaults(&ClientSetConfig{
+		Address:                 net.JoinHostPort("0:0:0:0:0:0:0:1", port),
+		AddressFamilyPreference: AddressFamilyIPv6,
+		SyncInterval:            10 * time.Millisecond,
+		SyncIntervalCap:         10 * time.Millisecond,
+		ProbeInterval:           time.Hour,
+		DialOptions:             []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())},
+	}).NewAgentClientSet(nil, make(chan struct{}))
+	defer cs.Wait()
+	defer cs.Shutdown()
+	cs.Serve()
+
+	if err := wait.PollImmediate(10*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		return cs.ClientsCount() == 1, nil
+	}); err != nil {
+		t.Fatalf("expected a client, got %v", cs.ListServerIDs())
+	}
+	expected := net.JoinHostPort("::1", port)
+	if got, _ := cs.AddressOf("server1"); got != expected {
+		t.Errorf("expected address %s, got %s", expected, got)
+	}
+}
+
+func TestServerPicker(t *testing.T) {
+	picker := &stubServerPicker{address: newTestProxyServer(t, "", 2)}
+	// Nothing listens on the configured address, so connecting shows the
+	// picked address was dialed.
+	cs := withTestDefaults(&ClientSetConfig{
+		Address:       "localhost:0",
+		ProbeInterval: time.Hour,
+		ServerPicker:  picker,
+		DialOptions:   []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())},
+	}).NewAgentClientSet(nil, make(chan struct{}))
+	defer cs.Wait()
+	defer cs.Shutdown()
+
+	for i := 0; i < 2; i++ {
+		if result := cs.connectOnce(); !result.added {
+			t.Fatalf("expected connectOnce to add a client, got %+v", result)
+		}
+	}
+	expected := [][]string{{}, {"server1"}}
+	if !reflect.DeepEqual(picker.connected, expected) {
+		t.Errorf("expected the picker to be given connected servers %v, got %v", expected, picker.connected)
+	}
+	for _, c := range cs.clients {
+		if c.address != picker.address {
+			t.Errorf("expected client to dial %s, got %s", picker.address, c.address)
+		}
+	}
+}
+
+func TestLeastConnectedAddress(t *testing.T) {
+	cs := withTestDefaults(&ClientSetConfig{
+		Addresses: []string{"proxy-0:8091", "proxy-1:8091", "proxy-2:8091"},
+	}).NewAgentClientSet(nil, make(chan struct{}))
+	if cs.address != "proxy-0:8091" {
+		t.Errorf("expected address to be the first address, got %s", cs.address)
+	}
+
+	// Addresses without clients take turns.
+	var picked []string
+	for i := 0; i < 4; i++ {
+		address, err := cs.nextAddress()
+		if err != nil {
+			t.Fatal(err)
+		}
+		picked = append(picked, address)
+	}
+	expected := []string{"proxy-0:8091", "proxy-1:8091", "proxy-2:8091", "proxy-0:8091"}
+	if !reflect.DeepEqual(picked, expected) {
+		t.Errorf("expected addresses %v, got %v", expected, picked)
+	}
+
+	cs.clients["server1"] = &Client{serverID: "server1", address: "proxy-1:8091"}
+	cs.clients["server2"] = &Client{serverID: "server2", address: "proxy-2:8091"}
+	cs.clients["server3"] = &Client{serverID: "server3", address: "proxy-2:8091"}
+	if got, _ := cs.nextAddress(); got != "proxy-0:8091" {
+		t.Errorf("expected the address without clients, got %s", got)
+	}
+	expectedCounts := map[string]int{"proxy-1:8091": 1, "proxy-2:8091": 2}
+	if got := cs.ClientsPerAddress(); !reflect.DeepEqual(got, expectedCounts) {
+		t.Errorf("expected clients per address %v, got %v", expectedCounts, got)
+	}
+}
+
+func TestFallbackAddress(t *testing.T) {
+	primary := &failingProxyServer{testProxyServer: &testProxyServer{serverID: "primary1", serverCount: 1}}
+	primary.failing.Store(true)
+	primaryAddress := serveTestProxyServer(t, primary)
+	fallbackAddress := newTestProxyServer(t, "fallback1", 1)
+	cs := withTestDefaults(&ClientSetConfig{
+		Address:               primaryAddress,
+		FallbackAddress:       fallbackAddress,
+		FallbackAfterFailures: 2,
+		SyncIntervalCap:       time.Minute,
+		DialOptions:           []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())},
+	}).NewAgentClientSet(nil, make(chan struct{}))
+	defer cs.Wait()
+	defer cs.Shutdown()
+	fakeClock := clocktesting.NewFakeClock(time.Now())
+	cs.clock = fakeClock
+
+	// attempt runs the part of a sync loop iteration which picks the address.
+	attempt := func() connectResult {
+		result := cs.connectOnce()
+		cs.updateFallback(result)
+		cs.probePrimary()
+		return result
+	}
+	if result := attempt(); result.err == nil {
+		t.Fatalf("expected the primary address to fail, got %+v", result)
+	}
+	if cs.currentAddress() != primaryAddress {
+		t.Fatalf("expected the primary address after one failure, got %s", cs.currentAddress())
+	}
+	attempt()
+	if cs.currentAddress() != fallbackAddress {
+		t.Fatalf("expected the fallback address after two failures, got %s", cs.currentAddress())
+	}
+	if result := attempt(); !result.added || !cs.HasID("fallback1") {
+		t.Fatalf("expected a client for the fallback server, got %+v", result)
+	}
+
+	// The primary address is probed every SyncIntervalCap.
+	primary.failing.Store(false)
+	fakeClock.Step(time.Second)
+	attempt()
+	if cs.currentAddress() != fallbackAddress || cs.HasID("primary1") {
+		t.Fatal("expected the primary address not to be probed before SyncIntervalCap")
+	}
+	fakeClock.Step(time.Minute)
+	attempt()
+	if cs.currentAddress() != primaryAddress {
+		t.Fatalf("expected the primary address once it recovered, got %s", cs.currentAddress())
+	}
+	if !cs.HasID("primary1") || !cs.HasID("fallback1") {
+		t.Errorf("expected clients for both servers, got %v", cs.ListServerIDs())
+	}
+}
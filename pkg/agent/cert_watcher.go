@@ -0,0 +1,128 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"time"
+
+	"google.golang.org/grpc/credentials"
+)
+
+// certFilesStat identifies a version of the client certificate and key
+// files.
+type certFilesStat struct {
+	cert, key tokenFileStat
+}
+
+// initTLSCredentials builds the TLS credentials loading the client
+// certificate from tlsCertFile and tlsKeyFile, if they are set.
+func (cs *ClientSet) initTLSCredentials() {
+	if cs.tlsCertFile == "" {
+		return
+	}
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cs.tlsConfig != nil {
+		config = cs.tlsConfig.Clone()
+	}
+	config.Certificates = nil
+	config.GetClientCertificate = cs.clientCertificate
+	cs.tlsCredentials = credentials.NewTLS(config)
+}
+
+// clientCertificate loads the client certificate for a TLS handshake, so
+// that each new connection uses the certificate currently on disk. If it
+// cannot be loaded, the certificate last loaded is used, if there is one.
+func (cs *ClientSet) clientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(cs.tlsCertFile, cs.tlsKeyFile)
+	cs.certMu.Lock()
+	defer cs.certMu.Unlock()
+	if err != nil {
+		if cs.lastCert != nil {
+			cs.logger.Error(err, "Failed to load the client certificate, using the last loaded one", "certFile", cs.tlsCertFile, "keyFile", cs.tlsKeyFile)
+			return cs.lastCert, nil
+		}
+		return nil, fmt.Errorf("failed to load the client certificate: %w", err)
+	}
+	cs.lastCert = &cert
+	return &cert, nil
+}
+
+// watchCertificate polls the client certificate and key files every
+// tlsCertWatchInterval until the ClientSet stops, and logs when they
+// change. The new certificate is used by the next connection.
+func (cs *ClientSet) watchCertificate() {
+	var last certFilesStat
+	cs.checkCertificate(&last)
+	ticker := time.NewTicker(cs.tlsCertWatchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-cs.stopCh:
+			return
+		case <-cs.stopping.C():
+			return
+		case <-ticker.C:
+			cs.checkCertificate(&last)
+		}
+	}
+}
+
+// checkCertificate logs the client certificate if the files have changed
+// since last, which is updated. It returns true if previously seen files
+// were replaced by a valid certificate.
+func (cs *ClientSet) checkCertificate(last *certFilesStat) bool {
+	var stat certFilesStat
+	for _, f := range []struct {
+		path string
+		stat *tokenFileStat
+	}{{cs.tlsCertFile, &stat.cert}, {cs.tlsKeyFile, &stat.key}} {
+		fi, err := os.Stat(f.path)
+		if err != nil {
+			cs.logger.Error(err, "Failed to stat the client certificate", "path", f.path)
+			return false
+		}
+		*f.stat = tokenFileStat{modTime: fi.ModTime(), size: fi.Size()}
+	}
+	if stat == *last {
+		return false
+	}
+	cert, err := tls.LoadX509KeyPair(cs.tlsCertFile, cs.tlsKeyFile)
+	if err != nil {
+		// The files may be written one at a time; check again later.
+		cs.logger.Error(err, "Failed to load the client certificate", "certFile", cs.tlsCertFile, "keyFile", cs.tlsKeyFile)
+		return false
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		cs.logger.Error(err, "Failed to parse the client certificate", "certFile", cs.tlsCertFile)
+		return false
+	}
+	rotated := *last != certFilesStat{}
+	*last = stat
+	if rotated {
+		cs.logger.Info("Client certificate rotated, new connections will use it",
+			"agentID", cs.agentID, "certFile", cs.tlsCertFile, "subject", leaf.Subject.String(), "serialNumber", leaf.SerialNumber.String(), "notAfter", leaf.NotAfter)
+	} else {
+		cs.logger.V(2).Info("Loaded the client certificate",
+			"agentID", cs.agentID, "certFile", cs.tlsCertFile, "subject", leaf.Subject.String(), "serialNumber", leaf.SerialNumber.String(), "notAfter", leaf.NotAfter)
+	}
+	return rotated
+}
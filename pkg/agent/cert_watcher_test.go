@@ -0,0 +1,225 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+
+	"sigs.k8s.io/apiserver-network-proxy/proto/agent"
+)
+
+// testCA issues short-lived client certificates.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key}
+}
+
+// issue writes a client certificate for commonName, valid for lifetime, and
+// its key to certFile and keyFile, with the given modification time.
+func (ca *testCA) issue(t *testing.T, commonName string, lifetime time.Duration, certFile, keyFile string, modTime time.Time) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(lifetime),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{certFile, keyFile} {
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestTLSCertFile(t *testing.T) {
+	dir := t.TempDir()
+	serverCertFile, serverKeyFile := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	agentCertFile, agentKeyFile := filepath.Join(dir, "agent.crt"), filepath.Join(dir, "agent.key")
+	writeTestCert(t, "proxy-server", serverCertFile, serverKeyFile)
+	ca := newTestCA(t)
+	now := time.Now()
+	ca.issue(t, "agent-1", time.Minute, agentCertFile, agentKeyFile, now)
+
+	serverCert, err := tls.LoadX509KeyPair(serverCertFile, serverKeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.cert)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer(grpc.Creds(credentials.NewTLS(&tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+		MinVersion:   tls.VersionTLS12,
+	})))
+	ps := &peerRecordingProxyServer{testProxyServer: &testProxyServer{serverCount: 1}, peers: make(chan string, 3)}
+	agent.RegisterAgentServiceServer(server, ps)
+	go server.Serve(lis)
+	defer server.Stop()
+
+	rootCAs := x509.NewCertPool()
+	serverPEM, err := os.ReadFile(serverCertFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootCAs.AppendCertsFromPEM(serverPEM)
+	cc := withTestDefaults(&ClientSetConfig{
+		Address: lis.Addr().String(),
+		// The insecure credentials are replaced by the TLS ones.
+		DialOptions: []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())},
+		TLSCertFile: agentCertFile,
+		TLSKeyFile:  agentKeyFile,
+		TLSConfig:   &tls.Config{RootCAs: rootCAs, MinVersion: tls.VersionTLS12},
+	})
+	cs := cc.NewAgentClientSet(nil, make(chan struct{}))
+
+	var last certFilesStat
+	if cs.checkCertificate(&last) {
+		t.Error("expected the first certificate not to count as a rotation")
+	}
+	connect := func(expected string) {
+		t.Helper()
+		c, _, err := cs.newAgentClient(cs.address)
+		if err != nil {
+			t.Fatalf("failed to connect with the certificate for %s: %v", expected, err)
+		}
+		defer c.Close()
+		if got := <-ps.peers; got != expected {
+			t.Errorf("expected the server to see certificate %q, got %q", expected, got)
+		}
+	}
+	connect("agent-1")
+
+	// The next connection uses the rotated certificate.
+	ca.issue(t, "agent-2", time.Minute, agentCertFile, agentKeyFile, now.Add(time.Second))
+	if !cs.checkCertificate(&last) {
+		t.Error("expected the certificate rotation to be detected")
+	}
+	if cs.checkCertificate(&last) {
+		t.Error("expected an unchanged certificate not to count as a rotation")
+	}
+	connect("agent-2")
+
+	// If the certificate cannot be loaded, the last one is used.
+	if err := os.Remove(agentKeyFile); err != nil {
+		t.Fatal(err)
+	}
+	if cs.checkCertificate(&last) {
+		t.Error("expected a missing key not to count as a rotation")
+	}
+	connect("agent-2")
+}
+
+func TestTLSCertFile_Validate(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		config ClientSetConfig
+		errMsg string
+	}{{
+		name:   "cert without key",
+		config: ClientSetConfig{TLSCertFile: "agent.crt"},
+		errMsg: "TLSCertFile and TLSKeyFile must be set together",
+	}, {
+		name: "with CredentialsReloader",
+		config: ClientSetConfig{
+			TLSCertFile: "agent.crt",
+			TLSKeyFile:  "agent.key",
+			CredentialsReloader: func() (credentials.TransportCredentials, error) {
+				return insecure.NewCredentials(), nil
+			},
+		},
+		errMsg: "TLSCertFile must not be set together with CredentialsReloader",
+	}, {
+		name:   "negative watch interval",
+		config: ClientSetConfig{TLSCertWatchInterval: -time.Second},
+		errMsg: "TLSCertWatchInterval must not be negative",
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := withTestDefaults(&tc.config).Validate()
+			if err == nil || !strings.Contains(err.Error(), tc.errMsg) {
+				t.Errorf("expected error containing %q, got %v", tc.errMsg, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,171 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+	"k8s.io/utils/clock"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/agent/metrics"
+)
+
+// DefaultCircuitOpenDuration is the OpenDuration used when a circuit
+// breaker is enabled without one.
+const DefaultCircuitOpenDuration = 30 * time.Second
+
+// CircuitBreakerConfig configures the circuit breaker the sync loop keeps
+// for each proxy server address.
+type CircuitBreakerConfig struct {
+	// FailureThreshold is the number of consecutive failures to connect to
+	// an address after which its breaker opens. Zero disables the breaker.
+	FailureThreshold int
+	// SuccessThreshold is the number of consecutive successful connections
+	// a half-open breaker needs to close again. Defaults to 1 when zero.
+	SuccessThreshold int
+	// OpenDuration is how long a breaker stays open before it lets a
+	// connection attempt through. Defaults to DefaultCircuitOpenDuration
+	// when zero.
+	OpenDuration time.Duration
+}
+
+// CircuitState is the state of a circuit breaker.
+type CircuitState int
+
+const (
+	// CircuitClosed lets connection attempts through.
+	CircuitClosed CircuitState = iota
+	// CircuitOpen rejects connection attempts.
+	CircuitOpen
+	// CircuitHalfOpen lets connection attempts through to probe whether
+	// the server has recovered. A single failure opens the breaker again.
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "Closed"
+	case CircuitOpen:
+		return "Open"
+	case CircuitHalfOpen:
+		return "HalfOpen"
+	default:
+		return fmt.Sprintf("CircuitState(%d)", int(s))
+	}
+}
+
+// CircuitOpenError is returned by the sync loop when it does not try to
+// connect to Address because its circuit breaker is open.
+type CircuitOpenError struct {
+	Address string
+	// RetryAfter is how long until the breaker lets an attempt through.
+	RetryAfter time.Duration
+}
+
+func (coe *CircuitOpenError) Error() string {
+	return fmt.Sprintf("circuit breaker open for %s, retrying in %v", coe.Address, coe.RetryAfter)
+}
+
+// circuitBreaker tracks the connection attempts to one address.
+type circuitBreaker struct {
+	address string
+	config  CircuitBreakerConfig
+	clock   clock.Clock
+	metrics *metrics.AgentMetrics
+
+	mu        sync.Mutex
+	state     CircuitState
+	failures  int       // consecutive failures while closed.
+	successes int       // consecutive successes while half-open.
+	openedAt  time.Time // when the breaker last opened.
+}
+
+func newCircuitBreaker(address string, config CircuitBreakerConfig, clock clock.Clock, m *metrics.AgentMetrics) *circuitBreaker {
+	if config.SuccessThreshold <= 0 {
+		config.SuccessThreshold = 1
+	}
+	if config.OpenDuration <= 0 {
+		config.OpenDuration = DefaultCircuitOpenDuration
+	}
+	cb := &circuitBreaker{address: address, config: config, clock: clock, metrics: m}
+	m.SetCircuitBreakerState(address, int(CircuitClosed))
+	return cb
+}
+
+// allow returns a CircuitOpenError if a connection attempt must not be
+// made. An open breaker turns half-open once OpenDuration has passed.
+func (cb *circuitBreaker) allow() error {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if cb.state != CircuitOpen {
+		return nil
+	}
+	if remaining := cb.config.OpenDuration - cb.clock.Since(cb.openedAt); remaining > 0 {
+		return &CircuitOpenError{Address: cb.address, RetryAfter: remaining}
+	}
+	cb.setStateLocked(CircuitHalfOpen)
+	return nil
+}
+
+// recordSuccess records a successful connection attempt.
+func (cb *circuitBreaker) recordSuccess() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	switch cb.state {
+	case CircuitClosed:
+		cb.failures = 0
+	case CircuitHalfOpen:
+		cb.successes++
+		if cb.successes >= cb.config.SuccessThreshold {
+			cb.setStateLocked(CircuitClosed)
+		}
+	}
+}
+
+// recordFailure records a failed connection attempt.
+func (cb *circuitBreaker) recordFailure() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	switch cb.state {
+	case CircuitClosed:
+		cb.failures++
+		if cb.failures >= cb.config.FailureThreshold {
+			cb.setStateLocked(CircuitOpen)
+		}
+	case CircuitHalfOpen:
+		cb.setStateLocked(CircuitOpen)
+	}
+}
+
+func (cb *circuitBreaker) currentState() CircuitState {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.state
+}
+
+func (cb *circuitBreaker) setStateLocked(state CircuitState) {
+	klog.V(2).InfoS("Circuit breaker changed state", "address", cb.address, "from", cb.state, "to", state)
+	cb.state = state
+	cb.failures, cb.successes = 0, 0
+	if state == CircuitOpen {
+		cb.openedAt = cb.clock.Now()
+	}
+	cb.metrics.SetCircuitBreakerState(cb.address, int(state))
+}
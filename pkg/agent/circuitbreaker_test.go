@@ -0,0 +1,207 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	clocktesting "k8s.io/utils/clock/testing"
+
+	"sigs.k8s.io/apiserver-network-proxy/pkg/agent/metrics"
+	"sigs.k8s.io/apiserver-network-proxy/proto/agent"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	type step struct {
+		fail    bool          // record a failure instead of a success.
+		advance time.Duration // advance the clock before the attempt.
+		allowed bool          // whether the attempt is allowed.
+		state   CircuitState  // the state after the attempt.
+	}
+	testCases := []struct {
+		name   string
+		config CircuitBreakerConfig
+		steps  []step
+	}{
+		{
+			name:   "opens after consecutive failures",
+			config: CircuitBreakerConfig{FailureThreshold: 2, OpenDuration: time.Minute},
+			steps: []step{
+				{fail: true, allowed: true, state: CircuitClosed},
+				{fail: true, allowed: true, state: CircuitOpen},
+				{allowed: false, state: CircuitOpen},
+				{advance: 30 * time.Second, allowed: false, state: CircuitOpen},
+			},
+		},
+		{
+			name:   "success resets the failure count",
+			config: CircuitBreakerConfig{FailureThreshold: 2, OpenDuration: time.Minute},
+			steps: []step{
+				{fail: true, allowed: true, state: CircuitClosed},
+				{allowed: true, state: CircuitClosed},
+				{fail: true, allowed: true, state: CircuitClosed},
+			},
+		},
+		{
+			name:   "half-open closes after enough successes",
+			config: CircuitBreakerConfig{FailureThreshold: 1, SuccessThreshold: 2, OpenDuration: time.Minute},
+			steps: []step{
+				{fail: true, allowed: true, state: CircuitOpen},
+				{advance: time.Minute, allowed: true, state: CircuitHalfOpen},
+				{allowed: true, state: CircuitClosed},
+			},
+		},
+		{
+			name:   "half-open reopens on failure",
+			config: CircuitBreakerConfig{FailureThreshold: 1, SuccessThreshold: 2, OpenDuration: time.Minute},
+			steps: []step{
+				{fail: true, allowed: true, state: CircuitOpen},
+				{advance: time.Minute, allowed: true, state: CircuitHalfOpen},
+				{fail: true, allowed: true, state: CircuitOpen},
+				{allowed: false, state: CircuitOpen},
+			},
+		},
+		{
+			name:   "default open duration",
+			config: CircuitBreakerConfig{FailureThreshold: 1},
+			steps: []step{
+				{fail: true, allowed: true, state: CircuitOpen},
+				{advance: DefaultCircuitOpenDuration - time.Second, allowed: false, state: CircuitOpen},
+				{advance: time.Second, allowed: true, state: CircuitClosed},
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			fakeClock := clocktesting.NewFakeClock(time.Now())
+			cb := newCircuitBreaker("proxy:8091", tc.config, fakeClock, metrics.Metrics)
+			for i, s := range tc.steps {
+				fakeClock.Step(s.advance)
+				err := cb.allow()
+				if allowed := err == nil; allowed != s.allowed {
+					t.Fatalf("step %d: expected allowed %v, got error %v", i, s.allowed, err)
+				}
+				if err != nil {
+					var coe *CircuitOpenError
+					if !errors.As(err, &coe) || coe.Address != "proxy:8091" || coe.RetryAfter <= 0 {
+						t.Errorf("step %d: expected a CircuitOpenError, got %v", i, err)
+					}
+				} else if s.fail {
+					cb.recordFailure()
+				} else {
+					cb.recordSuccess()
+				}
+				if state := cb.currentState(); state != s.state {
+					t.Fatalf("step %d: expected state %v, got %v", i, s.state, state)
+				}
+			}
+		})
+	}
+}
+
+// failingProxyServer is a testProxyServer which fails Connect calls while
+// failing is set.
+type failingProxyServer struct {
+	*testProxyServer
+	failing  atomic.Bool
+	attempts atomic.Int64
+}
+
+func (s *failingProxyServer) Connect(stream agent.AgentService_ConnectServer) error {
+	s.attempts.Add(1)
+	if s.failing.Load() {
+		return status.Error(codes.Unavailable, "unavailable")
+	}
+	return s.testProxyServer.Connect(stream)
+}
+
+func TestConnectOnce_CircuitBreaker(t *testing.T) {
+	metrics.Metrics.Reset()
+	server := &failingProxyServer{testProxyServer: &testProxyServer{serverID: "server1", serverCount: 1}}
+	server.failing.Store(true)
+	address := serveTestProxyServer(t, server)
+
+	cs := withTestDefaults(&ClientSetConfig{
+		Address:        address,
+		DialOptions:    []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())},
+		CircuitBreaker: CircuitBreakerConfig{FailureThreshold: 2, OpenDuration: time.Minute},
+	}).NewAgentClientSet(nil, make(chan struct{}))
+	defer cs.Wait()
+	defer cs.Shutdown()
+	fakeClock := clocktesting.NewFakeClock(time.Now())
+	cs.clock = fakeClock
+
+	for i := 0; i < 2; i++ {
+		var cfe *ConnectionFailedError
+		if result := cs.connectOnce(); !errors.As(result.err, &cfe) {
+			t.Fatalf("attempt %d: expected a ConnectionFailedError, got %v", i, result.err)
+		}
+	}
+	if got := circuitBreakerGauge(t, address); got != float64(CircuitOpen) {
+		t.Errorf("expected the breaker gauge to be open, got %v", got)
+	}
+
+	// The open breaker fails the attempt without contacting the server.
+	var coe *CircuitOpenError
+	if result := cs.connectOnce(); !errors.As(result.err, &coe) {
+		t.Fatalf("expected a CircuitOpenError, got %v", result.err)
+	}
+	if got := server.attempts.Load(); got != 2 {
+		t.Errorf("expected 2 attempts to reach the server, got %d", got)
+	}
+
+	server.failing.Store(false)
+	fakeClock.Step(time.Minute)
+	if result := cs.connectOnce(); result.err != nil || !result.added {
+		t.Fatalf("expected the half-open breaker to let a connection through, got %+v", result)
+	}
+	if got := circuitBreakerGauge(t, address); got != float64(CircuitClosed) {
+		t.Errorf("expected the breaker gauge to be closed, got %v", got)
+	}
+}
+
+// circuitBreakerGauge returns the circuit breaker state metric for address.
+func circuitBreakerGauge(t *testing.T, address string) float64 {
+	t.Helper()
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := prometheus.BuildFQName(metrics.Namespace, metrics.Subsystem, "circuit_breaker_state")
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			for _, label := range m.GetLabel() {
+				if label.GetName() == "address" && label.GetValue() == address {
+					return m.GetGauge().GetValue()
+				}
+			}
+		}
+	}
+	t.Fatalf("no circuit breaker state for %s", address)
+	return 0
+}
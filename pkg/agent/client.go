@@ -18,16 +18,18 @@ package agent
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"math/rand"
 	"net"
-	"os"
 	runpprof "runtime/pprof"
 	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"golang.org/x/time/rate"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/connectivity"
@@ -43,7 +45,6 @@ import (
 )
 
 const dialTimeout = 5 * time.Second
-const xfrChannelSize = 150
 
 // endpointConn tracks a connection from agent to node network.
 type endpointConn struct {
@@ -54,6 +55,26 @@ type endpointConn struct {
 	cleanOnce sync.Once
 	warnChLim bool
 	dialDone  chan struct{}
+	logger    klog.Logger
+	// onOverflow, if set, is called whenever send finds dataCh full.
+	onOverflow func()
+	// onChannelFull, if set, is called whenever send finds dataCh full
+	// while warnChLim is set.
+	onChannelFull func()
+	// limit bounds how often send may find dataCh full while warnChLim is
+	// set.
+	limit channelLimit
+	// fullTimes are the times within limit.window send found dataCh full.
+	// send is only called from the Serve loop, so they need no lock.
+	fullTimes []time.Time
+}
+
+// channelLimit is a budget of the number of times the data channel of an
+// endpoint connection may be found full within a rolling window.
+type channelLimit struct {
+	budget      int // zero disables the budget.
+	window      time.Duration
+	closeTunnel bool // close the tunnel when the budget is exceeded.
 }
 
 func (e *endpointConn) cleanup() {
@@ -65,16 +86,51 @@ func (e *endpointConn) send(msg []byte) {
 	defer func() {
 		// Handles the race condition where we write to a closed channel
 		if err := recover(); err != nil {
-			klog.InfoS("Recovered from attempt to write to closed channel")
+			e.logger.Info("Recovered from attempt to write to closed channel")
 		}
 	}()
-	if e.warnChLim && len(e.dataCh) >= xfrChannelSize {
-		klog.V(2).InfoS("Data channel on agent is full", "connectionID", e.connID)
+	if len(e.dataCh) >= cap(e.dataCh) {
+		if e.onOverflow != nil {
+			e.onOverflow()
+		}
+		if e.warnChLim {
+			e.logger.V(2).Info("Data channel on agent is full, consider raising XfrChannelSize", "connectionID", e.connID, "capacity", cap(e.dataCh))
+			if e.onChannelFull != nil {
+				e.onChannelFull()
+			}
+			if e.exceedsChannelLimit(time.Now()) {
+				e.logger.Error(nil, "Data channel on agent was full too often", "connectionID", e.connID, "budget", e.limit.budget, "window", e.limit.window, "closeTunnel", e.limit.closeTunnel)
+				if e.limit.closeTunnel {
+					e.cleanup()
+					return
+				}
+			}
+		}
 	}
 
 	e.dataCh <- msg
 }
 
+// exceedsChannelLimit records that dataCh was found full at now, and
+// reports whether that happened more than limit.budget times within
+// limit.window. The count starts over once the budget is exceeded.
+func (e *endpointConn) exceedsChannelLimit(now time.Time) bool {
+	if e.limit.budget <= 0 {
+		return false
+	}
+	cutoff := now.Add(-e.limit.window)
+	expired := 0
+	for expired < len(e.fullTimes) && !e.fullTimes[expired].After(cutoff) {
+		expired++
+	}
+	e.fullTimes = append(e.fullTimes[expired:], now)
+	if len(e.fullTimes) <= e.limit.budget {
+		return false
+	}
+	e.fullTimes = nil
+	return true
+}
+
 type connectionManager struct {
 	mu          sync.RWMutex
 	connections map[int64]*endpointConn
@@ -83,7 +139,6 @@ type connectionManager struct {
 func (cm *connectionManager) Add(connID int64, eConn *endpointConn) {
 	cm.mu.Lock()
 	defer cm.mu.Unlock()
-	metrics.Metrics.EndpointConnectionInc()
 	cm.connections[connID] = eConn
 }
 
@@ -97,9 +152,6 @@ func (cm *connectionManager) Get(connID int64) (*endpointConn, bool) {
 func (cm *connectionManager) Delete(connID int64) {
 	cm.mu.Lock()
 	defer cm.mu.Unlock()
-	// Delete for a connID is called from cleanFunc, which is
-	// protected by cleanOnce.
-	metrics.Metrics.EndpointConnectionDec()
 	delete(cm.connections, connID)
 }
 
@@ -126,42 +178,96 @@ type Client struct {
 
 	connManager *connectionManager
 
-	cs *ClientSet // the clientset that includes this AgentClient.
+	cs     *ClientSet  // the clientset that includes this AgentClient.
+	logger klog.Logger // the ClientSet's logger.
 
 	stream           agent.AgentService_ConnectClient
 	agentID          string
 	agentIdentifiers string
 	serverID         string // the id of the proxy server this client connects to.
+	serverIDHint     string // if set, sent to the server as the expected server ID.
 
 	// connect opts
 	address string
 	opts    []grpc.DialOption
 	conn    *grpc.ClientConn
 	stopCh  chan struct{}
+	// cancelStream cancels the Connect stream. Closing conn also ends the
+	// stream, but a pooled conn may outlive the client.
+	cancelStream context.CancelFunc
+	// connectedAt is the time the stream to the proxy server was established.
+	connectedAt time.Time
+	// unhealthySince is when the ClientSet reaper first saw the connection
+	// in a non-Ready state, or zero if it was Ready. Protected by cs.mu.
+	unhealthySince time.Time
 	// locks
 	sendLock      sync.Mutex
 	recvLock      sync.Mutex
 	probeInterval time.Duration // interval between probe pings
+	// connectTimeout bounds how long Connect waits for the server to
+	// accept the stream. Zero means no limit.
+	connectTimeout time.Duration
 
 	// file path contains service account token.
 	// token's value is auto-rotated by kubernetes, based on projected volume configuration.
 	serviceAccountTokenPath string
 
 	warnOnChannelLimit bool
+	xfrChannelSize     int // zero means DefaultXfrChannelSize.
+
+	packetObserver PacketObserver // nil disables packet observation.
+
+	// inFlight is the number of tunnels which have been accepted and not
+	// yet closed, including those still dialing.
+	inFlight atomic.Int64
+	// draining is set by Drain to reject new dial requests.
+	draining atomic.Bool
+	// drainMu makes setting draining atomic with beginTunnel, so that Drain
+	// waits for every tunnel accepted before it.
+	drainMu sync.Mutex
+	// lastActivity is the time, in Unix nanoseconds, a DATA packet was last
+	// sent or received, or zero if there has been none.
+	lastActivity atomic.Int64
+	// channelOverflows is the number of DATA packets from the server which
+	// found the data channel of their endpoint connection full.
+	channelOverflows atomic.Int64
+	// lastHeartbeat is the time, in Unix nanoseconds, a HEARTBEAT packet was
+	// last sent, or zero if there has been none.
+	lastHeartbeat atomic.Int64
+
+	limiterOnce sync.Once
+	limiter     *rate.Limiter // rate limiter of new tunnels; use tunnelLimiter.
+
+	doneOnce sync.Once
+	done     chan struct{} // closed when Serve returns; use doneCh.
 }
 
-func newAgentClient(address, agentID, agentIdentifiers string, cs *ClientSet, opts ...grpc.DialOption) (*Client, int, error) {
+// PacketObserver is called with a packet a Client sent to, or received
+// from, the proxy server serverID, in the given direction. It is called on
+// the Client's send or receive path, so it must be quick, and it must not
+// modify the packet.
+type PacketObserver func(serverID string, pkt *client.Packet, direction metrics.Direction)
+
+// newAgentClient creates a client and connects it to the proxy server at
+// address. serverIDHint, if set, is sent to the server as the expected
+// server ID; the client may still be connected to another server.
+func newAgentClient(address, agentID, agentIdentifiers, serverIDHint string, cs *ClientSet, opts ...grpc.DialOption) (*Client, int, error) {
 	a := &Client{
 		cs:                      cs,
+		logger:                  cs.logger,
 		address:                 address,
 		agentID:                 agentID,
 		agentIdentifiers:        agentIdentifiers,
+		serverIDHint:            serverIDHint,
 		opts:                    opts,
 		probeInterval:           cs.probeInterval,
+		connectTimeout:          cs.connectTimeout,
 		stopCh:                  make(chan struct{}),
 		serviceAccountTokenPath: cs.serviceAccountTokenPath,
 		connManager:             newConnectionManager(),
 		warnOnChannelLimit:      cs.warnOnChannelLimit,
+		xfrChannelSize:          cs.xfrChannelSize,
+		packetObserver:          cs.packetObserver,
 	}
 	serverCount, err := a.Connect()
 	if err != nil {
@@ -173,71 +279,308 @@ func newAgentClient(address, agentID, agentIdentifiers string, cs *ClientSet, op
 // Connect makes the grpc dial to the proxy server. It returns the serverID
 // it connects to.
 func (a *Client) Connect() (int, error) {
-	conn, err := grpc.Dial(a.address, a.opts...)
+	connectCtx := context.Background()
+	if a.connectTimeout > 0 {
+		var connectCancel context.CancelFunc
+		connectCtx, connectCancel = context.WithTimeout(connectCtx, a.connectTimeout)
+		defer connectCancel()
+	}
+	conn, err := a.dial(connectCtx)
 	if err != nil {
-		return 0, err
+		return 0, a.connectError(connectCtx, err)
 	}
-	ctx := metadata.AppendToOutgoingContext(context.Background(),
+	streamCtx, cancel := context.WithCancel(context.Background())
+	// The stream outlives Connect, so it is only canceled if the server
+	// does not accept it before connectCtx expires.
+	stopTimeout := context.AfterFunc(connectCtx, cancel)
+	closeConn := func() {
+		cancel()
+		a.closeConn(conn) /* #nosec G104 */
+	}
+	ctx := metadata.AppendToOutgoingContext(streamCtx,
 		header.AgentID, a.agentID,
 		header.AgentIdentifiers, a.agentIdentifiers)
+	if a.serverIDHint != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, header.ServerIDHint, a.serverIDHint)
+	}
 	if a.serviceAccountTokenPath != "" {
 		if ctx, err = a.initializeAuthContext(ctx); err != nil {
-			err := conn.Close()
+			cancel()
+			err := a.closeConn(conn)
 			if err != nil {
-				klog.ErrorS(err, "failed to close gRPC connection", "agentID", a.agentID)
+				a.logger.Error(err, "failed to close gRPC connection", "agentID", a.agentID)
 			}
 			return 0, err
 		}
 	}
 	stream, err := agent.NewAgentServiceClient(conn).Connect(ctx)
 	if err != nil {
-		conn.Close() /* #nosec G104 */
-		return 0, err
+		closeConn()
+		return 0, a.connectError(connectCtx, err)
 	}
 	serverID, err := serverID(stream)
 	if err != nil {
-		conn.Close() /* #nosec G104 */
-		return 0, err
+		closeConn()
+		return 0, a.connectError(connectCtx, err)
 	}
 	serverCount, err := serverCount(stream)
 	if err != nil {
-		conn.Close() /* #nosec G104 */
+		closeConn()
 		return 0, err
 	}
+	if !stopTimeout() {
+		// The stream was canceled just as the server accepted it.
+		closeConn()
+		return 0, a.connectError(connectCtx, context.Canceled)
+	}
 	a.conn = conn
+	a.cancelStream = cancel
 	a.stream = stream
 	a.serverID = serverID
-	klog.V(2).InfoS("Connect to server", "serverID", serverID)
+	a.connectedAt = time.Now()
+	a.logger.V(2).Info("Connect to server", "serverID", serverID)
 	return serverCount, nil
 }
 
+// dial returns a connection to the proxy server, borrowed from the
+// ClientSet's connection pool if it has one.
+func (a *Client) dial(ctx context.Context) (*grpc.ClientConn, error) {
+	if a.cs != nil && a.cs.connPool != nil {
+		return a.cs.connPool.get(a.cs, a.address, a.opts...)
+	}
+	return grpc.DialContext(ctx, a.address, a.opts...)
+}
+
+// connectError returns err, annotated if it was caused by ctx reaching the
+// connect timeout.
+func (a *Client) connectError(ctx context.Context, err error) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("could not connect to %s within %v: %w", a.address, a.connectTimeout, err)
+	}
+	return err
+}
+
+// closeConn closes conn, or returns it to the pool it was borrowed from.
+func (a *Client) closeConn(conn *grpc.ClientConn) error {
+	if a.cs != nil && a.cs.connPool != nil {
+		return a.cs.connPool.put(a.cs, a.address, conn)
+	}
+	return conn.Close()
+}
+
+// agentMetrics returns the metrics of the ClientSet the client belongs to.
+func (a *Client) agentMetrics() *metrics.AgentMetrics {
+	if a.cs == nil {
+		return metrics.Metrics
+	}
+	return a.cs.agentMetrics()
+}
+
+// recordChannelOverflow records a DATA packet from the server which found
+// the data channel of its endpoint connection full.
+func (a *Client) recordChannelOverflow() {
+	a.channelOverflows.Add(1)
+	a.agentMetrics().IncChannelOverflow(a.serverID, metrics.DirectionFromServer)
+}
+
+// recordChannelFull records a DATA packet from the server which found the
+// data channel of its endpoint connection full while WarnOnChannelLimit
+// was set.
+func (a *Client) recordChannelFull() {
+	a.agentMetrics().IncChannelFull(a.serverID)
+}
+
+// ActiveTunnels returns the number of tunnels which have been accepted on
+// the stream and not yet closed, including those still dialing.
+func (a *Client) ActiveTunnels() int64 {
+	return a.inFlight.Load()
+}
+
+// TunnelRateLimitedError is the error of a dial request rejected because its
+// client exceeded ClientSetConfig.MaxTunnelsPerSecond.
+type TunnelRateLimitedError struct {
+	ServerID string
+	Limit    int
+}
+
+func (e *TunnelRateLimitedError) Error() string {
+	return fmt.Sprintf("agent tunnel rate limit of %d per second exceeded", e.Limit)
+}
+
+// tunnelLimiter returns the rate limiter of new tunnels, or nil if the
+// ClientSet does not limit their rate.
+func (a *Client) tunnelLimiter() *rate.Limiter {
+	a.limiterOnce.Do(func() {
+		if limit := a.cs.maxTunnelsPerSecond; limit > 0 {
+			a.limiter = rate.NewLimiter(rate.Limit(limit), limit)
+		}
+	})
+	return a.limiter
+}
+
+// reserveTunnel takes a new tunnel from the rate limiter. It returns how
+// long the dial must be delayed, or a TunnelRateLimitedError if the rate is
+// exceeded and the ClientSet does not block on it.
+func (a *Client) reserveTunnel() (time.Duration, error) {
+	limiter := a.tunnelLimiter()
+	if limiter == nil {
+		return 0, nil
+	}
+	if !a.cs.blockOnTunnelLimit {
+		if limiter.Allow() {
+			return 0, nil
+		}
+		a.agentMetrics().IncTunnelRateLimited(a.serverID)
+		return 0, &TunnelRateLimitedError{ServerID: a.serverID, Limit: a.cs.maxTunnelsPerSecond}
+	}
+	delay := limiter.Reserve().Delay()
+	if delay > 0 {
+		a.agentMetrics().IncTunnelRateLimited(a.serverID)
+	}
+	return delay, nil
+}
+
+// waitForTunnel waits for the delay returned by reserveTunnel, unless the
+// client is stopped first.
+func (a *Client) waitForTunnel(delay time.Duration) error {
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-a.stopCh:
+		return errors.New("client stopped while waiting for the tunnel rate limit")
+	}
+}
+
+// dataChannelSize returns the buffer size of each endpoint connection.
+func (a *Client) dataChannelSize() int {
+	if a.xfrChannelSize <= 0 {
+		return DefaultXfrChannelSize
+	}
+	return a.xfrChannelSize
+}
+
+// ConnectedAt returns the time the stream to the proxy server was
+// established.
+func (a *Client) ConnectedAt() time.Time {
+	return a.connectedAt
+}
+
+// LastActivity returns the time a DATA packet was last sent or received on
+// the stream, or the time the stream was established if there has been none.
+func (a *Client) LastActivity() time.Time {
+	if last := a.lastActivity.Load(); last != 0 {
+		return time.Unix(0, last)
+	}
+	return a.connectedAt
+}
+
+func (a *Client) recordActivity() {
+	a.lastActivity.Store(time.Now().UnixNano())
+}
+
+// Done returns a channel which is closed when Serve returns.
+func (a *Client) Done() <-chan struct{} {
+	return a.doneCh()
+}
+
+func (a *Client) doneCh() chan struct{} {
+	a.doneOnce.Do(func() { a.done = make(chan struct{}) })
+	return a.done
+}
+
 // Close closes the Connect gRPC connection.
 func (a *Client) Close() {
 	if a.conn == nil {
-		klog.Errorln("Unexpected empty AgentClient.conn")
+		a.logger.Error(nil, "Unexpected empty AgentClient.conn")
 	}
-	err := a.conn.Close()
+	if a.cancelStream != nil {
+		a.cancelStream()
+	}
+	err := a.closeConn(a.conn)
 	if err != nil {
-		klog.ErrorS(err, "failed to close gRPC connection", "serverID", a.serverID, "agentID", a.agentID)
+		a.logger.Error(err, "failed to close gRPC connection", "serverID", a.serverID, "agentID", a.agentID)
 	}
 	close(a.stopCh)
 }
 
+// Drain stops the client from accepting new dial requests and waits for its
+// in-flight tunnels to finish, or for ctx to be done, before closing it. It
+// returns the ctx error if tunnels were still open when the client was closed.
+func (a *Client) Drain(ctx context.Context) error {
+	a.drainMu.Lock()
+	a.draining.Store(true)
+	a.drainMu.Unlock()
+	defer a.Close()
+	for a.inFlight.Load() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(drainCheckInterval):
+		}
+	}
+	return nil
+}
+
+// beginTunnel counts a new tunnel in flight and returns true, unless the
+// client is draining.
+func (a *Client) beginTunnel() bool {
+	a.drainMu.Lock()
+	defer a.drainMu.Unlock()
+	if a.draining.Load() {
+		return false
+	}
+	a.inFlight.Add(1)
+	return true
+}
+
 func (a *Client) Send(pkt *client.Packet) error {
 	a.sendLock.Lock()
 	defer a.sendLock.Unlock()
 
 	const segment = commonmetrics.SegmentFromAgent
-	metrics.Metrics.ObservePacket(segment, pkt.Type)
+	a.agentMetrics().ObservePacket(segment, pkt.Type)
 	err := a.stream.Send(pkt)
 	if err != nil && err != io.EOF {
-		metrics.Metrics.ObserveServerFailureDeprecated(metrics.DirectionToServer)
-		metrics.Metrics.ObserveStreamError(segment, err, pkt.Type)
-		a.cs.RemoveClient(a.serverID)
+		a.agentMetrics().ObserveServerFailureDeprecated(metrics.DirectionToServer)
+		a.agentMetrics().ObserveStreamError(segment, err, pkt.Type)
+		a.removeFromClientSet()
+	}
+	if err == nil && a.packetObserver != nil {
+		a.packetObserver(a.serverID, pkt, metrics.DirectionToServer)
 	}
 	return err
 }
 
+// sendDrain tells the proxy server that the agent is draining. Servers which
+// do not recognize the DRAIN packet ignore it.
+func (a *Client) sendDrain() error {
+	return a.Send(&client.Packet{Type: client.PacketType_DRAIN})
+}
+
+// sendHeartbeat sends a HEARTBEAT packet to the proxy server, and records the
+// time on success. Servers which do not recognize the packet ignore it.
+func (a *Client) sendHeartbeat() error {
+	if err := a.Send(&client.Packet{Type: client.PacketType_HEARTBEAT}); err != nil {
+		return err
+	}
+	a.lastHeartbeat.Store(time.Now().UnixNano())
+	return nil
+}
+
+// LastHeartbeatTime returns the time a HEARTBEAT packet was last sent on the
+// stream, or the zero time if there has been none.
+func (a *Client) LastHeartbeatTime() time.Time {
+	if last := a.lastHeartbeat.Load(); last != 0 {
+		return time.Unix(0, last)
+	}
+	return time.Time{}
+}
+
 func (a *Client) Recv() (*client.Packet, error) {
 	a.recvLock.Lock()
 	defer a.recvLock.Unlock()
@@ -246,12 +589,15 @@ func (a *Client) Recv() (*client.Packet, error) {
 	pkt, err := a.stream.Recv()
 	if err != nil {
 		if err != io.EOF {
-			metrics.Metrics.ObserveServerFailureDeprecated(metrics.DirectionFromServer)
-			metrics.Metrics.ObserveStreamErrorNoPacket(segment, err)
+			a.agentMetrics().ObserveServerFailureDeprecated(metrics.DirectionFromServer)
+			a.agentMetrics().ObserveStreamErrorNoPacket(segment, err)
 		}
 		return nil, err
 	}
-	metrics.Metrics.ObservePacket(segment, pkt.Type)
+	a.agentMetrics().ObservePacket(segment, pkt.Type)
+	if a.packetObserver != nil {
+		a.packetObserver(a.serverID, pkt, metrics.DirectionFromServer)
+	}
 	return pkt, nil
 }
 
@@ -274,6 +620,14 @@ func serverID(stream agent.AgentService_ConnectClient) (string, error) {
 	if err != nil {
 		return "", err
 	}
+	if md == nil {
+		// The stream ended without headers, e.g. the server rejected it.
+		// Recv returns its status without blocking.
+		if _, err := stream.Recv(); err != nil && err != io.EOF {
+			return "", err
+		}
+		return "", fmt.Errorf("stream ended before the server sent its headers")
+	}
 	sids := md.Get(header.ServerID)
 	if len(sids) != 1 {
 		return "", fmt.Errorf("expected one server ID in the context, got %v", sids)
@@ -282,15 +636,12 @@ func serverID(stream agent.AgentService_ConnectClient) (string, error) {
 }
 
 func (a *Client) initializeAuthContext(ctx context.Context) (context.Context, error) {
-	var err error
-	var b []byte
-
-	// load current service account's token value
-	if b, err = os.ReadFile(a.serviceAccountTokenPath); err != nil {
-		klog.ErrorS(err, "Failed to read token", "path", a.serviceAccountTokenPath)
+	token, err := a.cs.tokenForDial(a.serviceAccountTokenPath)
+	if err != nil {
+		a.logger.Error(err, "Failed to read token", "path", a.serviceAccountTokenPath)
 		return nil, err
 	}
-	ctx = metadata.AppendToOutgoingContext(ctx, header.AuthenticationTokenContextKey, header.AuthenticationTokenContextSchemePrefix+string(b))
+	ctx = metadata.AppendToOutgoingContext(ctx, header.AuthenticationTokenContextKey, header.AuthenticationTokenContextSchemePrefix+token)
 
 	return ctx, nil
 }
@@ -309,21 +660,22 @@ func (a *Client) initializeAuthContext(ctx context.Context) (context.Context, er
 // The requests include things like opening a connection to a server,
 // streaming data and close the connection.
 func (a *Client) Serve() {
-	defer a.cs.RemoveClient(a.serverID)
+	defer close(a.doneCh())
+	defer a.removeFromClientSet()
 	defer func() {
 		// close all of conns with remote when Client exits
 		for _, eConn := range a.connManager.List() {
 			eConn.cleanup()
 		}
-		klog.V(2).InfoS("cleanup all of conn contexts when client exits")
+		a.logger.V(2).Info("cleanup all of conn contexts when client exits")
 	}()
 
-	klog.V(2).InfoS("Start serving", "serverID", a.serverID, "agentID", a.agentID)
+	a.logger.V(2).Info("Start serving", "serverID", a.serverID, "agentID", a.agentID)
 	go a.probe()
 	for {
 		select {
 		case <-a.stopCh:
-			klog.V(2).InfoS("stop agent client.")
+			a.logger.V(2).Info("stop agent client.")
 			return
 		default:
 		}
@@ -331,50 +683,102 @@ func (a *Client) Serve() {
 		pkt, err := a.Recv()
 		if err != nil {
 			if err == io.EOF {
-				klog.V(2).InfoS("received EOF, exit", "serverID", a.serverID, "agentID", a.agentID)
+				a.logger.V(2).Info("received EOF, exit", "serverID", a.serverID, "agentID", a.agentID)
 				return
 			}
 			if status.Code(err) == codes.Canceled {
-				klog.V(2).InfoS("stream canceled", "serverID", a.serverID, "agentID", a.agentID)
+				a.logger.V(2).Info("stream canceled", "serverID", a.serverID, "agentID", a.agentID)
 			} else {
-				klog.ErrorS(err, "could not read stream", "serverID", a.serverID, "agentID", a.agentID)
+				a.logger.Error(err, "could not read stream", "serverID", a.serverID, "agentID", a.agentID)
 			}
 			return
 		}
 
 		if pkt == nil {
-			klog.V(3).InfoS("empty packet received")
+			a.logger.V(3).Info("empty packet received")
 			continue
 		}
 
-		klog.V(5).InfoS("[tracing] recv packet", "type", pkt.Type)
+		a.logger.V(5).Info("[tracing] recv packet", "type", pkt.Type)
 		switch pkt.Type {
 		case client.PacketType_DIAL_REQ:
 			dialReq := pkt.GetDialRequest()
-			klog.V(3).InfoS("Received DIAL_REQ", "serverID", a.serverID, "agentID", a.agentID, "dialID", dialReq.Random, "dialAddress", dialReq.Address)
+			a.logger.V(3).Info("Received DIAL_REQ", "serverID", a.serverID, "agentID", a.agentID, "dialID", dialReq.Random, "dialAddress", dialReq.Address)
 			dialResp := &client.Packet{
 				Type:    client.PacketType_DIAL_RSP,
 				Payload: &client.Packet_DialResponse{DialResponse: &client.DialResponse{}},
 			}
 			dialResp.GetDialResponse().Random = dialReq.Random
+			span := a.startTunnelSpan(dialReq)
+
+			if a.cs.Draining() || a.draining.Load() {
+				a.logger.V(2).Info("Rejecting DIAL_REQ while draining", "serverID", a.serverID, "dialID", dialReq.Random, "dialAddress", dialReq.Address)
+				dialResp.GetDialResponse().Error = "agent is draining"
+				failTunnelSpan(span, nil, "agent is draining")
+				span.End()
+				if err := a.Send(dialResp); err != nil {
+					a.logger.Error(err, "could not send DIAL_RSP with error", "dialID", dialReq.Random, "dialAddress", dialReq.Address)
+				}
+				continue
+			}
+			if limit := a.cs.maxTunnelsPerClient; limit > 0 && a.ActiveTunnels() >= int64(limit) {
+				a.logger.V(2).Info("Rejecting DIAL_REQ, too many tunnels", "serverID", a.serverID, "dialID", dialReq.Random, "dialAddress", dialReq.Address, "maxTunnels", limit)
+				a.agentMetrics().IncTunnelRejectedOverload(a.serverID)
+				dialResp.GetDialResponse().Error = "agent is overloaded"
+				failTunnelSpan(span, nil, "agent is overloaded")
+				span.End()
+				if err := a.Send(dialResp); err != nil {
+					a.logger.Error(err, "could not send DIAL_RSP with error", "dialID", dialReq.Random, "dialAddress", dialReq.Address)
+				}
+				continue
+			}
+			delay, err := a.reserveTunnel()
+			if err != nil {
+				a.logger.V(2).Info("Rejecting DIAL_REQ, tunnel rate limit exceeded", "serverID", a.serverID, "dialID", dialReq.Random, "dialAddress", dialReq.Address, "maxTunnelsPerSecond", a.cs.maxTunnelsPerSecond)
+				dialResp.GetDialResponse().Error = err.Error()
+				failTunnelSpan(span, nil, "tunnel rate limit exceeded")
+				span.End()
+				if err := a.Send(dialResp); err != nil {
+					a.logger.Error(err, "could not send DIAL_RSP with error", "dialID", dialReq.Random, "dialAddress", dialReq.Address)
+				}
+				continue
+			}
+			if !a.beginTunnel() {
+				// Drain started since the check above.
+				a.logger.V(2).Info("Rejecting DIAL_REQ while draining", "serverID", a.serverID, "dialID", dialReq.Random, "dialAddress", dialReq.Address)
+				dialResp.GetDialResponse().Error = "agent is draining"
+				failTunnelSpan(span, nil, "agent is draining")
+				span.End()
+				if err := a.Send(dialResp); err != nil {
+					a.logger.Error(err, "could not send DIAL_RSP with error", "dialID", dialReq.Random, "dialAddress", dialReq.Address)
+				}
+				continue
+			}
 
 			connID := atomic.AddInt64(&a.nextConnID, 1)
-			dataCh := make(chan []byte, xfrChannelSize)
+			dataCh := make(chan []byte, a.dataChannelSize())
 			dialDone := make(chan struct{})
 			eConn := &endpointConn{
-				dataCh:    dataCh,
-				dialDone:  dialDone,
-				warnChLim: a.warnOnChannelLimit,
+				connID:        connID,
+				dataCh:        dataCh,
+				dialDone:      dialDone,
+				warnChLim:     a.warnOnChannelLimit,
+				onOverflow:    a.recordChannelOverflow,
+				onChannelFull: a.recordChannelFull,
+				limit:         a.cs.channelLimit,
+				logger:        a.logger,
 			}
 			eConn.cleanFunc = func() {
 				// block on purpose
 				<-dialDone
 				if eConn.conn == nil {
 					// TODO: move this guard lower
-					klog.ErrorS(fmt.Errorf("remote connection is nil"), "could not send CLOSE_RESP to nil connection")
+					a.logger.Error(fmt.Errorf("remote connection is nil"), "could not send CLOSE_RESP to nil connection")
 					return
 				}
-				klog.V(4).InfoS("close connection", "dialID", dialReq.Random, "connectionID", connID, "dialAddress", dialReq.Address)
+				defer span.End()
+				defer a.inFlight.Add(-1)
+				a.logger.V(4).Info("close connection", "dialID", dialReq.Random, "connectionID", connID, "dialAddress", dialReq.Address)
 				var closePkt *client.Packet
 				if connID == 0 {
 					closePkt = &client.Packet{
@@ -390,12 +794,15 @@ func (a *Client) Serve() {
 					closePkt.GetCloseResponse().ConnectID = connID
 				}
 				if err := a.Send(closePkt); err != nil {
-					klog.ErrorS(err, "close response failure", "")
+					a.logger.Error(err, "close response failure", "")
 				}
 				close(dataCh)
 				a.connManager.Delete(connID)
+				// cleanFunc is protected by cleanOnce, so the connection
+				// is only counted out once.
+				a.agentMetrics().EndpointConnectionDec()
 				if err := eConn.conn.Close(); err != nil {
-					klog.ErrorS(err, "failed to close connection to remote", "dialID", dialReq.Random, "connectionID", connID)
+					a.logger.Error(err, "failed to close connection to remote", "dialID", dialReq.Random, "connectionID", connID)
 				}
 			}
 			labels := runpprof.Labels(
@@ -408,27 +815,35 @@ func (a *Client) Serve() {
 			)
 			go runpprof.Do(context.Background(), labels, func(context.Context) {
 				defer close(dialDone)
+				var conn net.Conn
+				err := a.waitForTunnel(delay)
 				start := time.Now()
-				conn, err := net.DialTimeout(dialReq.Protocol, dialReq.Address, dialTimeout)
+				if err == nil {
+					conn, err = net.DialTimeout(dialReq.Protocol, dialReq.Address, dialTimeout)
+				}
 				if err != nil {
 					reason := metrics.DialFailureUnknown
 					if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
 						reason = metrics.DialFailureTimeout
 					}
-					metrics.Metrics.ObserveDialFailure(reason)
+					a.agentMetrics().ObserveDialFailure(reason)
 					// Do not log agent errors for remote unavailable.
-					klog.V(1).InfoS("error dialing backend", "error", err, "dialID", dialReq.Random, "connectionID", connID, "dialAddress", dialReq.Address)
+					a.logger.V(1).Info("error dialing backend", "error", err, "dialID", dialReq.Random, "connectionID", connID, "dialAddress", dialReq.Address)
 					dialResp.GetDialResponse().Error = err.Error()
+					failTunnelSpan(span, err, "dial failed")
+					span.End()
 					if err := a.Send(dialResp); err != nil {
-						klog.ErrorS(err, "could not send DIAL_RSP with error", "dialID", dialReq.Random, "connectionID", connID, "dialAddress", dialReq.Address)
+						a.logger.Error(err, "could not send DIAL_RSP with error", "dialID", dialReq.Random, "connectionID", connID, "dialAddress", dialReq.Address)
 					}
 					// Cannot invoke clean up as we have no conn yet.
+					a.inFlight.Add(-1)
 					return
 				}
-				metrics.Metrics.ObserveDialLatency(time.Since(start))
-				klog.V(3).InfoS("Endpoint connection established", "dialID", dialReq.Random, "connectionID", connID, "dialAddress", dialReq.Address)
+				a.agentMetrics().ObserveDialLatency(time.Since(start))
+				a.logger.V(3).Info("Endpoint connection established", "dialID", dialReq.Random, "connectionID", connID, "dialAddress", dialReq.Address)
 				eConn.conn = conn
 				a.connManager.Add(connID, eConn)
+				a.agentMetrics().EndpointConnectionInc()
 				dialResp.GetDialResponse().ConnectID = connID
 				labels := runpprof.Labels(
 					"agentID", a.agentID,
@@ -438,8 +853,10 @@ func (a *Client) Serve() {
 					"connectionID", strconv.FormatInt(connID, 10),
 					"dialAddress", dialReq.Address,
 				)
+				addDialResponseEvent(span, connID)
 				if err := a.Send(dialResp); err != nil {
-					klog.ErrorS(err, "could not send DIAL_RSP", "dialID", dialReq.Random, "connectionID", connID, "dialAddress", dialReq.Address)
+					a.logger.Error(err, "could not send DIAL_RSP", "dialID", dialReq.Random, "connectionID", connID, "dialAddress", dialReq.Address)
+					failTunnelSpan(span, err, "could not send DIAL_RSP")
 					// clean-up is normally called from remoteToProxy which we will never invoke.
 					// So we are invoking it here to force the clean-up to occur.
 					// However, cleanup will block until dialDone is closed.
@@ -452,10 +869,11 @@ func (a *Client) Serve() {
 			})
 
 		case client.PacketType_DATA:
+			a.recordActivity()
 			data := pkt.GetData()
-			klog.V(4).InfoS("received DATA", "connectionID", data.ConnectID)
+			a.logger.V(4).Info("received DATA", "connectionID", data.ConnectID)
 			if data.ConnectID == 0 {
-				klog.ErrorS(nil, "Received packet missing ConnectID from frontend", "packetType", "DATA")
+				a.logger.Error(nil, "Received packet missing ConnectID from frontend", "packetType", "DATA")
 				continue
 			}
 
@@ -463,7 +881,7 @@ func (a *Client) Serve() {
 			if ok {
 				eConn.send(data.Data)
 			} else {
-				klog.V(2).InfoS("received DATA for unrecognized connection", "connectionID", data.ConnectID)
+				a.logger.V(2).Info("received DATA for unrecognized connection", "connectionID", data.ConnectID)
 				a.Send(&client.Packet{
 					Type: client.PacketType_CLOSE_RSP,
 					Payload: &client.Packet_CloseResponse{
@@ -480,13 +898,13 @@ func (a *Client) Serve() {
 			closeReq := pkt.GetCloseRequest()
 			connID := closeReq.ConnectID
 
-			klog.V(4).InfoS("received CLOSE_REQ", "connectionID", connID)
+			a.logger.V(4).Info("received CLOSE_REQ", "connectionID", connID)
 
 			eConn, ok := a.connManager.Get(connID)
 			if ok {
 				eConn.cleanup()
 			} else {
-				klog.V(4).InfoS("Failed to find connection context for close", "connectionID", connID)
+				a.logger.V(4).Info("Failed to find connection context for close", "connectionID", connID)
 				resp := &client.Packet{
 					Type:    client.PacketType_CLOSE_RSP,
 					Payload: &client.Packet_CloseResponse{CloseResponse: &client.CloseResponse{}},
@@ -494,23 +912,140 @@ func (a *Client) Serve() {
 				resp.GetCloseResponse().ConnectID = connID
 				resp.GetCloseResponse().Error = "Unknown connectID"
 				if err := a.Send(resp); err != nil {
-					klog.ErrorS(err, "could not send CLOSE_RSP", err, "connectionID", connID)
+					a.logger.Error(err, "could not send CLOSE_RSP", err, "connectionID", connID)
 					continue
 				}
 			}
 
 		default:
-			klog.V(5).InfoS("unrecognized packet", "type", pkt)
+			a.logger.V(5).Info("unrecognized packet", "type", pkt)
 		}
 	}
 }
 
+// testTunnel serves a single tunnel to destination, as a would serve a
+// DIAL_REQ from its proxy server, over a loopback stream: a Client sharing
+// a's identity receives the packets of the test instead of those of the
+// server. See ClientSet.TestConnectivity.
+func (a *Client) testTunnel(ctx context.Context, destination string) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream := &loopbackStream{
+		ctx:        ctx,
+		toClient:   make(chan *client.Packet, 1),
+		fromClient: make(chan *client.Packet, 1),
+	}
+	t := &Client{
+		cs:                 a.cs,
+		logger:             a.logger,
+		stream:             stream,
+		agentID:            a.agentID,
+		agentIdentifiers:   a.agentIdentifiers,
+		serverID:           a.serverID,
+		address:            a.address,
+		stopCh:             make(chan struct{}),
+		probeInterval:      a.probeInterval,
+		connManager:        newConnectionManager(),
+		warnOnChannelLimit: a.warnOnChannelLimit,
+		xfrChannelSize:     a.xfrChannelSize,
+	}
+	go t.Serve()
+	defer func() {
+		cancel()
+		close(t.stopCh)
+		<-t.Done()
+	}()
+
+	if err := stream.send(&client.Packet{
+		Type: client.PacketType_DIAL_REQ,
+		Payload: &client.Packet_DialRequest{DialRequest: &client.DialRequest{
+			Protocol: "tcp",
+			Address:  destination,
+			Random:   rand.Int63(), /* #nosec G404 */
+		}},
+	}); err != nil {
+		return fmt.Errorf("failed to dial %q: %w", destination, err)
+	}
+	pkt, err := stream.recv()
+	if err != nil {
+		return fmt.Errorf("failed to dial %q: %w", destination, err)
+	}
+	dialResp := pkt.GetDialResponse()
+	if dialResp == nil {
+		return fmt.Errorf("failed to dial %q: unexpected %v packet", destination, pkt.Type)
+	}
+	if dialResp.Error != "" {
+		return fmt.Errorf("failed to dial %q: %s", destination, dialResp.Error)
+	}
+	// The tunnel is closed along with t once the test is done.
+	if err := stream.send(&client.Packet{
+		Type:    client.PacketType_DATA,
+		Payload: &client.Packet_Data{Data: &client.Data{ConnectID: dialResp.ConnectID, Data: []byte{0}}},
+	}); err != nil {
+		return fmt.Errorf("failed to write to %q: %w", destination, err)
+	}
+	pkt, err = stream.recv()
+	if err != nil {
+		return fmt.Errorf("no response from %q: %w", destination, err)
+	}
+	if pkt.Type != client.PacketType_DATA {
+		return fmt.Errorf("%q closed the connection without responding", destination)
+	}
+	return nil
+}
+
+// loopbackStream is the Connect stream of a Client serving a test tunnel:
+// the packets passed to send are received by the Client, and those the
+// Client sends are returned by recv. Only Send and Recv are implemented.
+type loopbackStream struct {
+	agent.AgentService_ConnectClient
+
+	ctx                  context.Context
+	toClient, fromClient chan *client.Packet
+}
+
+func (s *loopbackStream) Send(pkt *client.Packet) error {
+	select {
+	case s.fromClient <- pkt:
+		return nil
+	case <-s.ctx.Done():
+		return io.EOF
+	}
+}
+
+func (s *loopbackStream) Recv() (*client.Packet, error) {
+	select {
+	case pkt := <-s.toClient:
+		return pkt, nil
+	case <-s.ctx.Done():
+		return nil, io.EOF
+	}
+}
+
+func (s *loopbackStream) send(pkt *client.Packet) error {
+	select {
+	case s.toClient <- pkt:
+		return nil
+	case <-s.ctx.Done():
+		return s.ctx.Err()
+	}
+}
+
+func (s *loopbackStream) recv() (*client.Packet, error) {
+	select {
+	case pkt := <-s.fromClient:
+		return pkt, nil
+	case <-s.ctx.Done():
+		return nil, s.ctx.Err()
+	}
+}
+
 func (a *Client) remoteToProxy(connID int64, eConn *endpointConn) {
 	defer func() {
 		if panicInfo := recover(); panicInfo != nil {
-			klog.V(2).InfoS("Exiting remoteToProxy with recovery", "panicInfo", panicInfo, "connectionID", connID)
+			a.logger.V(2).Info("Exiting remoteToProxy with recovery", "panicInfo", panicInfo, "connectionID", connID)
 		} else {
-			klog.V(4).InfoS("Exiting remoteToProxy", "connectionID", connID)
+			a.logger.V(4).Info("Exiting remoteToProxy", "connectionID", connID)
 		}
 	}()
 	defer eConn.cleanup()
@@ -522,18 +1057,18 @@ func (a *Client) remoteToProxy(connID int64, eConn *endpointConn) {
 
 	for {
 		n, err := eConn.conn.Read(buf[:])
-		klog.V(5).InfoS("received data from remote", "bytes", n, "connectionID", connID)
+		a.logger.V(5).Info("received data from remote", "bytes", n, "connectionID", connID)
 
 		if err == io.EOF {
-			klog.V(2).InfoS("remote connection EOF", "connectionID", connID)
+			a.logger.V(2).Info("remote connection EOF", "connectionID", connID)
 			return
 		} else if err != nil {
 			// "use of closed network connection" errors are expected upon receiving CLOSE_REQ
 			// If connID doesn't exist in connManager, we assume the connection was meant to be closed.
 			if _, ok := a.connManager.Get(connID); !ok {
-				klog.V(5).InfoS("reading from a closed connection", "connectionID", connID, "err", err)
+				a.logger.V(5).Info("reading from a closed connection", "connectionID", connID, "err", err)
 			} else {
-				klog.ErrorS(err, "connection read failure", "connectionID", connID)
+				a.logger.Error(err, "connection read failure", "connectionID", connID)
 			}
 			return
 		} else {
@@ -542,7 +1077,10 @@ func (a *Client) remoteToProxy(connID int64, eConn *endpointConn) {
 				ConnectID: connID,
 			}}
 			if err := a.Send(resp); err != nil {
-				klog.ErrorS(err, "could not send DATA", "connectionID", connID)
+				a.logger.Error(err, "could not send DATA", "connectionID", connID)
+			} else {
+				a.cs.egressBytes.Add(int64(n))
+				a.recordActivity()
 			}
 		}
 	}
@@ -551,9 +1089,9 @@ func (a *Client) remoteToProxy(connID int64, eConn *endpointConn) {
 func (a *Client) proxyToRemote(connID int64, eConn *endpointConn) {
 	defer func() {
 		if panicInfo := recover(); panicInfo != nil {
-			klog.V(2).InfoS("Exiting proxyToRemote with recovery", "panicInfo", panicInfo, "connectionID", connID)
+			a.logger.V(2).Info("Exiting proxyToRemote with recovery", "panicInfo", panicInfo, "connectionID", connID)
 		} else {
-			klog.V(4).InfoS("Exiting proxyToRemote", "connectionID", connID)
+			a.logger.V(4).Info("Exiting proxyToRemote", "connectionID", connID)
 		}
 	}()
 	// Not safe to call cleanup here, as cleanup() closes the dataCh
@@ -570,7 +1108,7 @@ func (a *Client) proxyToRemote(connID int64, eConn *endpointConn) {
 			discardedPktCount++
 		}
 		if discardedPktCount > 0 {
-			klog.V(2).InfoS("Discard packets while exiting proxyToRemote", "pktCount", discardedPktCount, "connectionID", connID)
+			a.logger.V(2).Info("Discard packets while exiting proxyToRemote", "pktCount", discardedPktCount, "connectionID", connID)
 		}
 	}()
 
@@ -578,20 +1116,21 @@ func (a *Client) proxyToRemote(connID int64, eConn *endpointConn) {
 		pos := 0
 		for {
 			n, err := eConn.conn.Write(d[pos:])
+			a.cs.ingressBytes.Add(int64(n))
 			if err == nil {
-				klog.V(4).InfoS("write to remote", "connectionID", connID, "lastData", n, "dataSize", len(d))
+				a.logger.V(4).Info("write to remote", "connectionID", connID, "lastData", n, "dataSize", len(d))
 				break
 			} else if n > 0 {
 				// https://golang.org/pkg/io/#Writer specifies return non nil error if n < len(d)
-				klog.ErrorS(err, "write to remote with failure", "connectionID", connID, "lastData", n)
+				a.logger.Error(err, "write to remote with failure", "connectionID", connID, "lastData", n)
 				pos += n
 			} else {
 				// "use of closed network connection" errors are expected upon receiving CLOSE_REQ
 				// If connID doesn't exist in connManager, we assume the connection was meant to be closed.
 				if _, ok := a.connManager.Get(connID); !ok {
-					klog.V(5).InfoS("writing to a closed connection", "connectionID", connID, "err", err)
+					a.logger.V(5).Info("writing to a closed connection", "connectionID", connID, "err", err)
 				} else {
-					klog.ErrorS(err, "conn write failure", "connectionID", connID)
+					a.logger.Error(err, "conn write failure", "connectionID", connID)
 				}
 
 				return
@@ -614,8 +1153,22 @@ func (a *Client) probe() {
 				continue
 			}
 		}
-		klog.V(1).InfoS("Removing client used for server connection", "state", a.conn.GetState(), "serverID", a.serverID)
-		a.cs.RemoveClient(a.serverID)
+		a.logger.V(1).Info("Removing client used for server connection", "state", a.conn.GetState(), "serverID", a.serverID)
+		a.cs.recordServerFailure(a.serverID)
+		a.removeFromClientSet()
 		return
 	}
 }
+
+// removeFromClientSet removes this client from its ClientSet. The client may
+// already have been removed by another path (Send, probe or Serve), so an
+// UnknownServerError is expected and only logged at high verbosity.
+func (a *Client) removeFromClientSet() {
+	if err := a.cs.removeClientInstance(a); err != nil {
+		if _, ok := err.(*UnknownServerError); ok {
+			a.logger.V(4).Info("client already removed", "serverID", a.serverID)
+			return
+		}
+		a.logger.Error(err, "failed to remove client", "serverID", a.serverID)
+	}
+}
@@ -17,19 +17,32 @@ limitations under the License.
 package agent
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 	"go.uber.org/goleak"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/klog/v2"
 	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/agent/metrics"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/util"
 	"sigs.k8s.io/apiserver-network-proxy/proto/agent"
 )
 
@@ -221,6 +234,658 @@ func TestClose_Client(t *testing.T) {
 
 }
 
+func TestDrain_Client(t *testing.T) {
+	var stream agent.AgentService_ConnectClient
+	stopCh := make(chan struct{})
+	drainCh := make(chan struct{})
+	cs := &ClientSet{
+		clients:          make(map[string]*Client),
+		stopCh:           stopCh,
+		drainCh:          drainCh,
+		drainGracePeriod: wait.ForeverTestTimeout,
+	}
+	conn, err := grpc.Dial("localhost:0", grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testClient := &Client{
+		connManager: newConnectionManager(),
+		stopCh:      make(chan struct{}),
+		cs:          cs,
+		conn:        conn,
+		serverID:    "server1",
+		// The connection never becomes ready; keep probe from removing the client.
+		probeInterval: time.Hour,
+	}
+	testClient.stream, stream = pipe()
+	if err := cs.AddClient(testClient.serverID, testClient); err != nil {
+		t.Fatal(err)
+	}
+
+	// Start agent
+	go testClient.Serve()
+	go cs.drain()
+	defer close(stopCh)
+
+	// Start test http server as remote service
+	expectedBody := "Hello, client"
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, expectedBody)
+	}))
+	defer ts.Close()
+
+	// Open a tunnel before draining
+	if err := stream.Send(newDialPacket("tcp", ts.URL[len("http://"):], 111)); err != nil {
+		t.Fatal(err)
+	}
+	pkt, _ := stream.Recv()
+	if pkt == nil || pkt.Type != client.PacketType_DIAL_RSP {
+		t.Fatalf("expect PacketType_DIAL_RSP; got %v", pkt)
+	}
+	connID := pkt.GetDialResponse().ConnectID
+
+	close(drainCh)
+	if err := wait.PollImmediate(10*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		return cs.Draining(), nil
+	}); err != nil {
+		t.Fatal("client set never started draining")
+	}
+
+	// The server is told that the agent is draining
+	pkt, _ = stream.Recv()
+	if pkt == nil || pkt.Type != client.PacketType_DRAIN {
+		t.Fatalf("expect PacketType_DRAIN; got %v", pkt)
+	}
+
+	// New dial requests are rejected while draining
+	if err := stream.Send(newDialPacket("tcp", ts.URL[len("http://"):], 222)); err != nil {
+		t.Fatal(err)
+	}
+	pkt, _ = stream.Recv()
+	if pkt == nil || pkt.Type != client.PacketType_DIAL_RSP {
+		t.Fatalf("expect PacketType_DIAL_RSP; got %v", pkt)
+	}
+	if dialErr := pkt.GetDialResponse().Error; dialErr != "agent is draining" {
+		t.Errorf("expect dial to be rejected while draining; got error %q", dialErr)
+	}
+
+	// The tunnel opened before draining keeps working
+	if err := stream.Send(newDataPacket(connID, []byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))); err != nil {
+		t.Fatal(err)
+	}
+	pkt, _ = stream.Recv()
+	if pkt == nil || pkt.Type != client.PacketType_DATA {
+		t.Fatalf("expect PacketType_DATA; got %v", pkt)
+	}
+	headAndBody := strings.Split(string(pkt.GetData().Data), "\r\n")
+	if body := headAndBody[len(headAndBody)-1]; body != expectedBody {
+		t.Errorf("expect body %v; got %v", expectedBody, body)
+	}
+
+	select {
+	case <-cs.Drained():
+		t.Fatal("client set drained while a tunnel was still open")
+	default:
+	}
+
+	// Closing the last tunnel completes the drain
+	if err := stream.Send(newClosePacket(connID)); err != nil {
+		t.Fatal(err)
+	}
+	pkt, _ = stream.Recv()
+	if pkt == nil || pkt.Type != client.PacketType_CLOSE_RSP {
+		t.Fatalf("expect PacketType_CLOSE_RSP; got %v", pkt)
+	}
+	select {
+	case <-cs.Drained():
+	case <-time.After(wait.ForeverTestTimeout):
+		t.Fatal("client set never finished draining")
+	}
+	if cs.ClientsCount() != 0 {
+		t.Errorf("expect all clients closed after draining; got %d", cs.ClientsCount())
+	}
+}
+
+func TestClientDrain(t *testing.T) {
+	var stream agent.AgentService_ConnectClient
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	cs := &ClientSet{
+		clients: make(map[string]*Client),
+		stopCh:  stopCh,
+	}
+	conn, err := grpc.Dial("localhost:0", grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testClient := &Client{
+		connManager:   newConnectionManager(),
+		stopCh:        make(chan struct{}),
+		cs:            cs,
+		conn:          conn,
+		serverID:      "server1",
+		probeInterval: time.Hour,
+	}
+	testClient.stream, stream = pipe()
+	go testClient.Serve()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+
+	if err := stream.Send(newDialPacket("tcp", ts.URL[len("http://"):], 111)); err != nil {
+		t.Fatal(err)
+	}
+	pkt, _ := stream.Recv()
+	if pkt == nil || pkt.Type != client.PacketType_DIAL_RSP {
+		t.Fatalf("expect PacketType_DIAL_RSP; got %v", pkt)
+	}
+	if got := testClient.inFlight.Load(); got != 1 {
+		t.Fatalf("expect 1 tunnel in flight; got %d", got)
+	}
+
+	// The open tunnel keeps Drain from completing before the deadline.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := testClient.Drain(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expect Drain to return %v; got %v", context.DeadlineExceeded, err)
+	}
+	select {
+	case <-testClient.stopCh:
+	default:
+		t.Error("expect client to be closed after Drain")
+	}
+}
+
+func TestClientDrain_BeginTunnel(t *testing.T) {
+	conn, err := grpc.Dial("localhost:0", grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testClient := &Client{
+		connManager: newConnectionManager(),
+		stopCh:      make(chan struct{}),
+		cs:          &ClientSet{clients: make(map[string]*Client)},
+		conn:        conn,
+		serverID:    "server1",
+	}
+	if !testClient.beginTunnel() {
+		t.Fatal("expect a tunnel to begin before Drain")
+	}
+
+	// A tunnel which began before Drain is waited for, and none may begin
+	// once Drain has started.
+	drained := make(chan error, 1)
+	go func() { drained <- testClient.Drain(context.Background()) }()
+	if err := wait.PollImmediate(time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		return testClient.draining.Load(), nil
+	}); err != nil {
+		t.Fatal("client never started draining")
+	}
+	if testClient.beginTunnel() {
+		t.Error("expect no tunnel to begin while draining")
+	}
+	select {
+	case err := <-drained:
+		t.Fatalf("expect Drain to wait for the tunnel; returned %v", err)
+	case <-time.After(3 * drainCheckInterval):
+	}
+	testClient.inFlight.Add(-1)
+	select {
+	case err := <-drained:
+		if err != nil {
+			t.Errorf("expect Drain to succeed; got %v", err)
+		}
+	case <-time.After(wait.ForeverTestTimeout):
+		t.Fatal("Drain never returned")
+	}
+}
+
+func TestMaxTunnelsPerClient(t *testing.T) {
+	metrics.Metrics.Reset()
+	var stream agent.AgentService_ConnectClient
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	cs := &ClientSet{
+		clients:             make(map[string]*Client),
+		stopCh:              stopCh,
+		maxTunnelsPerClient: 1,
+	}
+	testClient := &Client{
+		connManager: newConnectionManager(),
+		stopCh:      make(chan struct{}),
+		cs:          cs,
+		serverID:    "server1",
+	}
+	testClient.stream, stream = pipe()
+	go testClient.Serve()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+
+	dial := func(random int64) string {
+		t.Helper()
+		if err := stream.Send(newDialPacket("tcp", ts.URL[len("http://"):], random)); err != nil {
+			t.Fatal(err)
+		}
+		pkt, _ := stream.Recv()
+		if pkt == nil || pkt.Type != client.PacketType_DIAL_RSP {
+			t.Fatalf("expect PacketType_DIAL_RSP; got %v", pkt)
+		}
+		return pkt.GetDialResponse().Error
+	}
+	if dialErr := dial(111); dialErr != "" {
+		t.Fatalf("expect first dial to succeed; got error %q", dialErr)
+	}
+	if dialErr := dial(222); dialErr != "agent is overloaded" {
+		t.Errorf("expect dial beyond the limit to be rejected; got error %q", dialErr)
+	}
+	if got := testClient.ActiveTunnels(); got != 1 {
+		t.Errorf("expect 1 active tunnel; got %d", got)
+	}
+	if got := serverCounterValue(t, "tunnel_rejected_overload_total", "server1"); got != 1 {
+		t.Errorf("expect 1 overload rejection; got %v", got)
+	}
+}
+
+func TestMaxTunnelsPerSecond(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+
+	// openTunnels sends count DIAL_REQs as fast as possible, and returns the
+	// errors of their DIAL_RSPs and how long it took to receive them all.
+	openTunnels := func(t *testing.T, cs *ClientSet, count int) ([]string, time.Duration) {
+		var stream agent.AgentService_ConnectClient
+		stopCh := make(chan struct{})
+		t.Cleanup(func() { close(stopCh) })
+		testClient := &Client{
+			connManager: newConnectionManager(),
+			stopCh:      stopCh,
+			cs:          cs,
+			serverID:    "server1",
+		}
+		testClient.stream, stream = pipe()
+		go testClient.Serve()
+
+		start := time.Now()
+		go func() {
+			for i := 0; i < count; i++ {
+				if err := stream.Send(newDialPacket("tcp", ts.URL[len("http://"):], int64(i+1))); err != nil {
+					return
+				}
+			}
+		}()
+		var dialErrs []string
+		for i := 0; i < count; i++ {
+			pkt, _ := stream.Recv()
+			if pkt == nil || pkt.Type != client.PacketType_DIAL_RSP {
+				t.Fatalf("expect PacketType_DIAL_RSP; got %v", pkt)
+			}
+			dialErrs = append(dialErrs, pkt.GetDialResponse().Error)
+		}
+		return dialErrs, time.Since(start)
+	}
+
+	t.Run("reject", func(t *testing.T) {
+		metrics.Metrics.Reset()
+		const limit, count = 5, 50
+		cs := &ClientSet{clients: make(map[string]*Client), maxTunnelsPerSecond: limit}
+		dialErrs, elapsed := openTunnels(t, cs, count)
+		var accepted, rejected int
+		expectedErr := (&TunnelRateLimitedError{Limit: limit}).Error()
+		for _, dialErr := range dialErrs {
+			switch dialErr {
+			case "":
+				accepted++
+			case expectedErr:
+				rejected++
+			default:
+				t.Errorf("unexpected dial error %q", dialErr)
+			}
+		}
+		if max := limit + int(elapsed.Seconds()*limit) + 1; accepted > max {
+			t.Errorf("expect at most %d tunnels in %v; got %d", max, elapsed, accepted)
+		}
+		if rejected == 0 {
+			t.Error("expect tunnels beyond the rate to be rejected")
+		}
+		if got := serverCounterValue(t, "tunnel_rate_limited_total", "server1"); got != float64(rejected) {
+			t.Errorf("expect %d rate limited tunnels; got %v", rejected, got)
+		}
+	})
+
+	t.Run("block", func(t *testing.T) {
+		metrics.Metrics.Reset()
+		const limit, count = 20, 30
+		cs := &ClientSet{clients: make(map[string]*Client), maxTunnelsPerSecond: limit, blockOnTunnelLimit: true}
+		dialErrs, elapsed := openTunnels(t, cs, count)
+		for _, dialErr := range dialErrs {
+			if dialErr != "" {
+				t.Errorf("expect delayed tunnels to be accepted; got error %q", dialErr)
+			}
+		}
+		// The first limit tunnels are the burst; the others come at the rate.
+		if min := time.Duration(count-limit) * time.Second / limit; elapsed < min*9/10 {
+			t.Errorf("expect %d tunnels to take at least %v; took %v", count, min, elapsed)
+		}
+		if got := serverCounterValue(t, "tunnel_rate_limited_total", "server1"); got == 0 {
+			t.Error("expect delayed tunnels to be counted as rate limited")
+		}
+	})
+}
+
+func TestTunnelTracing(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	defer tp.Shutdown(context.Background())
+
+	var stream agent.AgentService_ConnectClient
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	cs := &ClientSet{
+		clients:        make(map[string]*Client),
+		stopCh:         stopCh,
+		tracerProvider: tp,
+	}
+	testClient := &Client{
+		connManager: newConnectionManager(),
+		stopCh:      make(chan struct{}),
+		cs:          cs,
+		serverID:    "server1",
+		agentID:     "agent1",
+	}
+	testClient.stream, stream = pipe()
+	go testClient.Serve()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+
+	// Propagate the context of a server span the way the proxy server does.
+	ctx, parent := tp.Tracer("test").Start(context.Background(), "server tunnel")
+	dialPacket := newDialPacket("tcp", ts.URL[len("http://"):], 111)
+	propagation.TraceContext{}.Inject(ctx, util.DialRequestCarrier{Request: dialPacket.GetDialRequest()})
+	parent.End()
+	if err := stream.Send(dialPacket); err != nil {
+		t.Fatal(err)
+	}
+	pkt, _ := stream.Recv()
+	if pkt == nil || pkt.Type != client.PacketType_DIAL_RSP || pkt.GetDialResponse().Error != "" {
+		t.Fatalf("expect a successful DIAL_RSP; got %v", pkt)
+	}
+	connID := pkt.GetDialResponse().ConnectID
+	if err := stream.Send(newClosePacket(connID)); err != nil {
+		t.Fatal(err)
+	}
+	if pkt, _ := stream.Recv(); pkt == nil || pkt.Type != client.PacketType_CLOSE_RSP {
+		t.Fatalf("expect PacketType_CLOSE_RSP; got %v", pkt)
+	}
+	waitForConnectionDeletion(t, testClient, connID)
+
+	var span tracetest.SpanStub
+	if err := wait.PollImmediate(10*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		for _, s := range exporter.GetSpans() {
+			if s.Name == "konnectivity.agent.tunnel" {
+				span = s
+				return true, nil
+			}
+		}
+		return false, nil
+	}); err != nil {
+		t.Fatalf("expected an agent tunnel span, got %v", exporter.GetSpans())
+	}
+	if span.Parent.SpanID() != parent.SpanContext().SpanID() || span.Parent.TraceID() != parent.SpanContext().TraceID() {
+		t.Errorf("expected the agent span to be a child of the server span %v, got parent %v", parent.SpanContext(), span.Parent)
+	}
+	if len(span.Events) != 1 || span.Events[0].Name != traceEventDialResponse {
+		t.Errorf("expected a %s event, got %v", traceEventDialResponse, span.Events)
+	}
+	if span.Status.Code == codes.Error {
+		t.Errorf("expected the span not to fail, got %v", span.Status)
+	}
+
+	// A failed dial ends its span as failed.
+	exporter.Reset()
+	if err := stream.Send(newDialPacket("tcp", "127.0.0.1:0", 222)); err != nil {
+		t.Fatal(err)
+	}
+	pkt, _ = stream.Recv()
+	if pkt == nil || pkt.Type != client.PacketType_DIAL_RSP || pkt.GetDialResponse().Error == "" {
+		t.Fatalf("expect a failed DIAL_RSP; got %v", pkt)
+	}
+	spans := exporter.GetSpans()
+	if len(spans) != 1 || spans[0].Status.Code != codes.Error {
+		t.Errorf("expected a failed agent tunnel span, got %v", spans)
+	}
+	if len(spans) == 1 && spans[0].Parent.IsValid() {
+		t.Errorf("expected an untraced dial to start a root span, got parent %v", spans[0].Parent)
+	}
+}
+
+func TestPacketObserver(t *testing.T) {
+	var mu sync.Mutex
+	var observed []string
+	observer := func(serverID string, pkt *client.Packet, direction metrics.Direction) {
+		mu.Lock()
+		defer mu.Unlock()
+		observed = append(observed, fmt.Sprintf("%s %s %s", serverID, direction, pkt.Type))
+	}
+	cs := withTestDefaults(&ClientSetConfig{PacketObserver: observer}).NewAgentClientSet(nil, make(chan struct{}))
+
+	var stream agent.AgentService_ConnectClient
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	testClient := &Client{
+		connManager:    newConnectionManager(),
+		stopCh:         stopCh,
+		cs:             cs,
+		serverID:       "server1",
+		packetObserver: cs.packetObserver,
+	}
+	testClient.stream, stream = pipe()
+	go testClient.Serve()
+
+	// The remote service only reads, so that no DATA packet is sent back.
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(io.Discard, conn)
+	}()
+
+	// expect waits for the observer to have seen the given packets, since it
+	// is called after the packet is handed to the stream.
+	expect := func(expected ...string) {
+		t.Helper()
+		if err := wait.PollImmediate(time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			return len(observed) >= len(expected), nil
+		}); err != nil {
+			t.Fatalf("expected packets %v to be observed", expected)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if !reflect.DeepEqual(observed, expected) {
+			t.Fatalf("expected observed packets %v, got %v", expected, observed)
+		}
+	}
+
+	if err := stream.Send(newDialPacket("tcp", lis.Addr().String(), 111)); err != nil {
+		t.Fatal(err)
+	}
+	pkt, _ := stream.Recv()
+	if pkt == nil || pkt.Type != client.PacketType_DIAL_RSP || pkt.GetDialResponse().Error != "" {
+		t.Fatalf("expect a successful DIAL_RSP; got %v", pkt)
+	}
+	connID := pkt.GetDialResponse().ConnectID
+	expect("server1 from_server DIAL_REQ", "server1 to_server DIAL_RSP")
+
+	if err := stream.Send(newDataPacket(connID, []byte("hello"))); err != nil {
+		t.Fatal(err)
+	}
+	expect("server1 from_server DIAL_REQ", "server1 to_server DIAL_RSP", "server1 from_server DATA")
+
+	if err := stream.Send(newClosePacket(connID)); err != nil {
+		t.Fatal(err)
+	}
+	if pkt, _ := stream.Recv(); pkt == nil || pkt.Type != client.PacketType_CLOSE_RSP {
+		t.Fatalf("expect PacketType_CLOSE_RSP; got %v", pkt)
+	}
+	expect("server1 from_server DIAL_REQ", "server1 to_server DIAL_RSP", "server1 from_server DATA",
+		"server1 from_server CLOSE_REQ", "server1 to_server CLOSE_RSP")
+	waitForConnectionDeletion(t, testClient, connID)
+}
+
+func TestConnectedAt(t *testing.T) {
+	cs := withTestDefaults(&ClientSetConfig{
+		Address:     newTestProxyServer(t, "server1", 1),
+		DialOptions: []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())},
+	}).NewAgentClientSet(nil, make(chan struct{}))
+	before := time.Now()
+	c, _, err := cs.newAgentClient(cs.address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if got := c.ConnectedAt(); got.Before(before) || got.After(time.Now()) {
+		t.Errorf("expected ConnectedAt between %v and now, got %v", before, got)
+	}
+	if got := c.LastActivity(); !got.Equal(c.ConnectedAt()) {
+		t.Errorf("expected LastActivity to be ConnectedAt before any data, got %v", got)
+	}
+}
+
+func TestChannelOverflow(t *testing.T) {
+	metrics.Metrics.Reset()
+	testClient := &Client{serverID: "server1"}
+	cs := &ClientSet{clients: map[string]*Client{"server1": testClient}}
+	eConn := &endpointConn{
+		connID:     1,
+		dataCh:     make(chan []byte, 1),
+		onOverflow: testClient.recordChannelOverflow,
+	}
+
+	eConn.send([]byte("first"))
+	if got := cs.ChannelOverflows()["server1"]; got != 0 {
+		t.Errorf("expect no overflow before the channel is full; got %d", got)
+	}
+
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		eConn.send([]byte("second"))
+	}()
+	if err := wait.PollImmediate(10*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		return cs.ChannelOverflows()["server1"] == 1, nil
+	}); err != nil {
+		t.Fatalf("expect 1 overflow; got %v", cs.ChannelOverflows())
+	}
+	if got := serverCounterValue(t, "channel_overflow_total", "server1"); got != 1 {
+		t.Errorf("expect channel_overflow_total 1; got %v", got)
+	}
+
+	// Draining the channel unblocks the overflowing send.
+	<-eConn.dataCh
+	<-sent
+	if msg := <-eConn.dataCh; string(msg) != "second" {
+		t.Errorf("expect the overflowing packet to be delivered; got %q", msg)
+	}
+}
+
+func TestChannelFull(t *testing.T) {
+	metrics.Metrics.Reset()
+	testClient := &Client{serverID: "server1"}
+	var cleaned atomic.Bool
+	eConn := &endpointConn{
+		connID:        1,
+		dataCh:        make(chan []byte, 1),
+		warnChLim:     true,
+		onChannelFull: testClient.recordChannelFull,
+		limit:         channelLimit{budget: 1, window: time.Hour, closeTunnel: true},
+		cleanFunc:     func() { cleaned.Store(true) },
+	}
+
+	eConn.send([]byte("first"))
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		eConn.send([]byte("second"))
+	}()
+	if err := wait.PollImmediate(10*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		return serverCounterValue(t, "channel_full_total", "server1") == 1, nil
+	}); err != nil {
+		t.Fatalf("expect channel_full_total 1; got %v", serverCounterValue(t, "channel_full_total", "server1"))
+	}
+	// The first full channel is within the budget, so the send waits.
+	<-eConn.dataCh
+	<-sent
+	if cleaned.Load() {
+		t.Fatal("expect the tunnel to stay open within the budget")
+	}
+
+	// The second one exceeds it and closes the tunnel instead.
+	eConn.send([]byte("third"))
+	if got := serverCounterValue(t, "channel_full_total", "server1"); got != 2 {
+		t.Errorf("expect channel_full_total 2; got %v", got)
+	}
+	if !cleaned.Load() {
+		t.Error("expect the tunnel to be closed once the budget is exceeded")
+	}
+	if msg := <-eConn.dataCh; string(msg) != "second" {
+		t.Errorf("expect only the packet sent within the budget to be delivered; got %q", msg)
+	}
+}
+
+func TestExceedsChannelLimit(t *testing.T) {
+	start := time.Now()
+	testCases := []struct {
+		name     string
+		budget   int
+		offsets  []time.Duration // when dataCh is found full, relative to start.
+		expected []bool
+	}{
+		{
+			name:     "disabled",
+			offsets:  []time.Duration{0, time.Second, 2 * time.Second},
+			expected: []bool{false, false, false},
+		},
+		{
+			name:     "exceeded",
+			budget:   2,
+			offsets:  []time.Duration{0, 10 * time.Second, 20 * time.Second},
+			expected: []bool{false, false, true},
+		},
+		{
+			name:     "starts over once exceeded",
+			budget:   1,
+			offsets:  []time.Duration{0, time.Second, 2 * time.Second, 3 * time.Second},
+			expected: []bool{false, true, false, true},
+		},
+		{
+			name:     "rolling window",
+			budget:   2,
+			offsets:  []time.Duration{0, 50 * time.Second, 70 * time.Second, 80 * time.Second},
+			expected: []bool{false, false, false, true},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			eConn := &endpointConn{limit: channelLimit{budget: tc.budget, window: time.Minute}}
+			for i, offset := range tc.offsets {
+				if got := eConn.exceedsChannelLimit(start.Add(offset)); got != tc.expected[i] {
+					t.Errorf("at %v: expect %v; got %v", offset, tc.expected[i], got)
+				}
+			}
+		})
+	}
+}
+
 func TestConnectionMismatch(t *testing.T) {
 	var stream agent.AgentService_ConnectClient
 	stopCh := make(chan struct{})
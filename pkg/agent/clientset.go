@@ -18,15 +18,24 @@ package agent
 
 import (
 	"context"
-	"math"
+	"crypto/tls"
+	"fmt"
 	runpprof "runtime/pprof"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/klog/v2"
+	"k8s.io/utils/clock"
 	"sigs.k8s.io/apiserver-network-proxy/pkg/agent/metrics"
 )
 
@@ -36,9 +45,26 @@ type ClientSet struct {
 	clients map[string]*Client // map between serverID and the client
 	// connects to this server.
 
-	agentID     string // ID of this agent
-	address     string // proxy server address. Assuming HA proxy server
-	serverCount int    // number of proxy server instances, should be 1
+	agentID string // ID of this agent
+	address string // proxy server address. Assuming HA proxy server
+	// addresses are all the proxy server addresses; address is the first.
+	// Both are protected by mu, since Connect replaces them.
+	addresses []string
+	// fallbackAddress replaces address, under mu, once the sync loop has
+	// failed fallbackAfterFailures times in a row against primaryAddress,
+	// until a probe of primaryAddress succeeds. Empty disables the fallback.
+	fallbackAddress       string
+	fallbackAfterFailures int
+	primaryAddress        string
+	primaryFailures       int       // consecutive failures; sync loop only.
+	lastPrimaryProbe      time.Time // sync loop only.
+	// nextAddressIndex is where leastConnectedAddress starts looking in
+	// addresses, so that equally connected addresses take turns. Used by
+	// the sync loop only.
+	nextAddressIndex int
+	// leaseCounter, if set, counts the proxy servers from their Leases.
+	leaseCounter *ServerLeaseCounter
+	serverCount  int // number of proxy server instances, should be 1
 	// unless it is an HA server. Initialized when the ClientSet creates
 	// the first client. When syncForever is set, it will be the most recently seen.
 	syncInterval time.Duration // The interval by which the agent
@@ -46,40 +72,237 @@ type ClientSet struct {
 	// proxy server.
 	probeInterval time.Duration // The interval by which the agent
 	// periodically checks if its connections to the proxy server is ready.
+	connectTimeout time.Duration // bounds each connection attempt; zero
+	// means no limit.
+	initialSyncDelay time.Duration // base delay before the first sync
+	// attempt, jittered to spread out agents started together.
 	syncIntervalCap time.Duration // The maximum interval
 	// for the syncInterval to back off to when unable to connect to the proxy server
+	backoffFactor float64 // The multiplier applied to the sync interval
+	// after each failed attempt.
+	backoffJitter float64              // The jitter applied to each backoff step.
+	backoffFn     func() *wait.Backoff // If set, overrides the backoff
+	// built from the fields above.
+	retryStrategy RetryStrategy // If set, overrides the backoff after
+	// failed attempts.
+	serverPicker ServerPicker // If set, chooses the address to dial.
+	retryAttempt int          // consecutive failed attempts; used by the sync loop only.
+	// immediateRetryCodes are the gRPC codes of connection errors retried
+	// without backing off.
+	immediateRetryCodes []codes.Code
+	// immediateRetried is whether the last attempt was retried without
+	// backing off; used by the sync loop only.
+	immediateRetried bool
+	// the server hit by the last consecutive DuplicateServerErrors, and
+	// how many times; used by the sync loop only.
+	lastDuplicateServerID string
+	consecutiveDuplicates int
+	// atMaxClients is whether the last attempt found MaxClients clients;
+	// used by the sync loop only.
+	atMaxClients bool
+
+	tokenRefreshInterval time.Duration // how often the service account token
+	// is checked for rotation. Zero disables the check.
+	tokenCacheTTL time.Duration // how long a token read for a new connection
+	// is reused. Zero reads the token for every connection.
+	tokenMu         sync.RWMutex // protects token, dialToken and dialTokenReadAt.
+	token           string       // the service account token last loaded by watchToken.
+	dialToken       string       // the token last read for a new connection.
+	dialTokenReadAt time.Time    // when dialToken was read.
 
 	dialOptions []grpc.DialOption
+	// optional hook returning extra dial options for a given server.
+	dialOptionsForServer func(serverID, address string) []grpc.DialOption
+	// optional hook returning the transport credentials for a new connection.
+	credentialsReloader func() (credentials.TransportCredentials, error)
+	// tlsCertFile and tlsKeyFile are the client certificate for mutual TLS,
+	// loaded for each new connection by tlsCredentials. Empty if unset.
+	tlsCertFile string
+	tlsKeyFile  string
+	// tlsConfig is ClientSetConfig.TLSConfig, which tlsCredentials are
+	// built from.
+	tlsConfig *tls.Config
+	// tlsCredentials, if set, replace the credentials of DialOptions.
+	tlsCredentials       credentials.TransportCredentials
+	tlsCertWatchInterval time.Duration // how often the certificate files are
+	// checked for changes.
+	certMu   sync.Mutex       // protects lastCert.
+	lastCert *tls.Certificate // the client certificate last loaded.
+	// optional pool of connections shared with other ClientSets.
+	connPool *ConnPool
+
+	circuitBreakerConfig CircuitBreakerConfig
+	breakersMu           sync.Mutex                 // protects breakers.
+	breakers             map[string]*circuitBreaker // by address; created on first use.
 	// file path contains service account token
 	serviceAccountTokenPath string
 	// channel to signal shutting down the client set. Primarily for test.
+	// Deprecated in favor of Stop, which also waits for the shutdown.
 	stopCh <-chan struct{}
+	// channel to signal draining the client set. Once closed, clients stop
+	// accepting new dial requests and are closed after drainGracePeriod or
+	// once all of their endpoint connections have finished.
+	drainCh          <-chan struct{}
+	drainGracePeriod time.Duration
+	draining         int32         // set atomically once drainCh is closed.
+	drainTimeout     time.Duration // how long shutdown drains each client.
+	paused           atomic.Bool   // set by Pause to stop opening clients.
+	// stopping fires, under mu, once Stop, Shutdown or shutdown is called,
+	// after which no clients are added, no goroutines are added to wg and
+	// the goroutines started by Serve exit; see stoppingLocked.
+	stopping   signal
+	syncExited signal // fires when the sync loop exits.
+	drained    signal // fires once draining has completed.
+	// forceClose fires when the context of Stop expires, to cut short the
+	// draining of clients.
+	forceClose signal
+	// clientExitCh is signaled, without blocking, whenever a Serve
+	// goroutine started by serveClient returns.
+	clientExitCh chan struct{}
+	// tracks the goroutines started by Serve, and the Serve goroutine of
+	// each client; use goTracked.
+	wg sync.WaitGroup
 
 	agentIdentifiers string // The identifiers of the agent, which will be used
 	// by the server when choosing agent
 
 	warnOnChannelLimit bool
+	channelLimit       channelLimit // budget of full data channels per tunnel.
+	xfrChannelSize     int          // buffer size of each endpoint connection.
 
 	syncForever bool // Continue syncing (support dynamic server count).
+	// maxExcessConnections is the number of clients tolerated above the
+	// server count before the sync loop trims them. Zero means unlimited.
+	maxExcessConnections int
+
+	maxClients int // The maximum number of clients. Zero means unlimited.
+	// The maximum number of tunnels on each client. Zero means unlimited.
+	maxTunnelsPerClient int
+	// The rate of new tunnels on each client. Zero means unlimited.
+	maxTunnelsPerSecond int
+	blockOnTunnelLimit  bool // delay rather than reject tunnels beyond the rate.
+
+	// tracerProvider provides the tracer for tunnel spans; the global one
+	// if nil.
+	tracerProvider trace.TracerProvider
+
+	unhealthyTimeout time.Duration // how long a client may stay non-Ready
+	// before it is reaped. Zero disables the reaper.
+
+	idleThreshold time.Duration // how long a client may carry no data
+	// before it is counted as idle by the metric. Zero disables the metric.
+
+	heartbeatInterval time.Duration // how often Heartbeat is called. Zero
+	// disables the heartbeats.
+
+	maxConnectAttempts int // The number of consecutive connection failures
+	// after which a server is considered permanently failed. Zero disables
+	// the limit.
+	failuresMu     sync.Mutex     // protects the three maps below.
+	serverFailures map[string]int // consecutive connection failures by server ID.
+	dialFailures   map[string]int // consecutive dial failures by address.
+	// addressServerIDs maps each of several static addresses to the ID of
+	// the server last connected through it, so that failed dials of the
+	// address count against that server. A load balancer address is not
+	// mapped, as it reaches any of the servers.
+	addressServerIDs map[string]string
+
+	stats syncStats // sync loop statistics, accessed atomically.
+
+	clock clock.Clock // times the sync loop; replaced by a fake clock in tests.
+
+	metrics *metrics.AgentMetrics // nil means metrics.Metrics; use agentMetrics.
+
+	lastError atomic.Value // syncErrorValue holding the last connectOnce failure.
+
+	historyMu   sync.Mutex          // protects the fields below.
+	history     []ServerCountSample // ring buffer of server count samples.
+	historyNext int                 // index of the next sample to overwrite once full.
+	historyLast time.Time           // time of the most recent sample.
+
+	// bytes proxied by all clients, in each direction, since creation.
+	ingressBytes atomic.Int64
+	egressBytes  atomic.Int64
+	// bandwidthMu protects the fields below.
+	bandwidthMu      sync.Mutex
+	bandwidth        BandwidthStats
+	lastIngressBytes int64
+	lastEgressBytes  int64
+
+	logger klog.Logger     // logger used for the ClientSet and client log lines.
+	config ClientSetConfig // the config the ClientSet was created from; used by Clone.
+
+	serverCountMu            sync.Mutex // protects lastServerCount.
+	lastServerCount          int        // server count last reported to the handler.
+	serverCountChangeHandler func(old, new int)
+
+	packetObserver PacketObserver // called with each packet sent or received; may be nil.
+
+	eventRecorder record.EventRecorder // emits health transition events, if set.
+	podRef        *corev1.ObjectReference
+
+	minHealthyFraction float64 // fraction of serverCount which must be
+	// connected for the ClientSet to be Running.
+
+	eventsMu         sync.Mutex // serializes notify; held while calling the listeners.
+	unhealthy        bool       // an AgentUnhealthy event was emitted; protected by eventsMu.
+	eventsStateMu    sync.Mutex // protects the fields below.
+	listeners        []clientSetListener
+	lastHealthyCount int // healthy count last reported to the listeners.
+	status           ClientSetStatus
 }
 
-func (cs *ClientSet) ClientsCount() int {
-	cs.mu.Lock()
-	defer cs.mu.Unlock()
-	return len(cs.clients)
+// agentMetrics returns the metrics the ClientSet records to.
+func (cs *ClientSet) agentMetrics() *metrics.AgentMetrics {
+	if cs.metrics == nil {
+		return metrics.Metrics
+	}
+	return cs.metrics
 }
 
-func (cs *ClientSet) HealthyClientsCount() int {
+// ServerCount returns the number of proxy servers the agent should connect
+// to. It is the lease count when a ServerLeaseCounter is configured and
+// ready, and otherwise the server count last received from a proxy server,
+// so that an unsynced lease informer does not report a spurious zero.
+// If the count differs from the one last returned, the
+// ServerCountChangeHandler is called before returning.
+func (cs *ClientSet) ServerCount() int {
+	count := cs.currentServerCount()
+	cs.notifyServerCountChange(count)
+	return count
+}
+
+// currentServerCount is ServerCount without calling the
+// ServerCountChangeHandler, for callers holding a lock the handler may need.
+func (cs *ClientSet) currentServerCount() int {
+	if cs.leaseCounter != nil && cs.leaseCounter.Ready() {
+		return cs.leaseCounter.Count()
+	}
 	cs.mu.Lock()
 	defer cs.mu.Unlock()
-	var count int
-	for _, c := range cs.clients {
-		if c.conn.GetState() == connectivity.Ready {
-			count++
-		}
+	return cs.serverCount
+}
+
+// notifyServerCountChange calls the ServerCountChangeHandler if count differs
+// from the one last reported. The handler is called without holding any
+// ClientSet lock, so it may call back into the ClientSet.
+func (cs *ClientSet) notifyServerCountChange(count int) {
+	if cs.serverCountChangeHandler == nil {
+		return
 	}
-	return count
+	cs.serverCountMu.Lock()
+	old := cs.lastServerCount
+	cs.lastServerCount = count
+	cs.serverCountMu.Unlock()
+	if old != count {
+		cs.serverCountChangeHandler(old, count)
+	}
+}
 
+func (cs *ClientSet) ClientsCount() int {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return len(cs.clients)
 }
 
 func (cs *ClientSet) hasIDLocked(serverID string) bool {
@@ -93,6 +316,89 @@ func (cs *ClientSet) HasID(serverID string) bool {
 	return cs.hasIDLocked(serverID)
 }
 
+// GetClient returns the client connected to serverID, if any. The methods of
+// the returned Client are safe for concurrent use, but the pointer must not
+// be retained across a RemoveClient call for the same serverID, after which
+// the client is closed.
+func (cs *ClientSet) GetClient(serverID string) (*Client, bool) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	c, ok := cs.clients[serverID]
+	return c, ok
+}
+
+// AddressOf returns the address the client connected to serverID was dialed
+// at, or false if there is no such client.
+func (cs *ClientSet) AddressOf(serverID string) (string, bool) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	c, ok := cs.clients[serverID]
+	if !ok {
+		return "", false
+	}
+	return c.address, true
+}
+
+// ListServerIDs returns the sorted IDs of the servers this agent currently
+// has a client for.
+func (cs *ClientSet) ListServerIDs() []string {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	serverIDs := make([]string, 0, len(cs.clients))
+	for serverID := range cs.clients {
+		serverIDs = append(serverIDs, serverID)
+	}
+	sort.Strings(serverIDs)
+	return serverIDs
+}
+
+// ServerIDs returns a sorted snapshot of the IDs of the servers this agent
+// currently has a client for, like ListServerIDs.
+func (cs *ClientSet) ServerIDs() []string {
+	return cs.ListServerIDs()
+}
+
+// ForEachClient calls fn for each client, in no particular order, until fn
+// returns false. cs.mu is held throughout, so fn sees a consistent set of
+// clients, but it must not call any ClientSet method which acquires cs.mu,
+// or it deadlocks. For example, to find a client with a tunnel open:
+//
+//	var busy *Client
+//	cs.ForEachClient(func(serverID string, c *Client) bool {
+//		if c.ActiveTunnels() > 0 {
+//			busy = c
+//			return false
+//		}
+//		return true
+//	})
+func (cs *ClientSet) ForEachClient(fn func(serverID string, c *Client) bool) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	for serverID, c := range cs.clients {
+		if !fn(serverID, c) {
+			return
+		}
+	}
+}
+
+// ConnectedServerAddresses returns the sorted, deduplicated addresses of the
+// servers this agent currently has a client for.
+func (cs *ClientSet) ConnectedServerAddresses() []string {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	seen := make(map[string]bool, len(cs.clients))
+	addresses := make([]string, 0, len(cs.clients))
+	for _, c := range cs.clients {
+		if seen[c.address] {
+			continue
+		}
+		seen[c.address] = true
+		addresses = append(addresses, c.address)
+	}
+	sort.Strings(addresses)
+	return addresses
+}
+
 type DuplicateServerError struct {
 	ServerID string
 }
@@ -102,147 +408,453 @@ func (dse *DuplicateServerError) Error() string {
 }
 
 func (cs *ClientSet) addClientLocked(serverID string, c *Client) error {
+	if cs.stoppingLocked() {
+		return fmt.Errorf("client set for agent %s is shut down", cs.agentID)
+	}
 	if cs.hasIDLocked(serverID) {
 		return &DuplicateServerError{ServerID: serverID}
 	}
 	cs.clients[serverID] = c
-	metrics.Metrics.SetServerConnectionsCount(len(cs.clients))
+	cs.agentMetrics().SetServerConnectionsCount(cs.agentID, len(cs.clients))
 	return nil
 
 }
 
 func (cs *ClientSet) AddClient(serverID string, c *Client) error {
 	cs.mu.Lock()
-	defer cs.mu.Unlock()
-	return cs.addClientLocked(serverID, c)
+	err := cs.addClientLocked(serverID, c)
+	cs.mu.Unlock()
+	if err == nil {
+		cs.ClearFailedServer(serverID)
+		cs.notify([]string{serverID}, nil)
+	}
+	return err
+}
+
+type UnknownServerError struct {
+	ServerID string
+}
+
+func (use *UnknownServerError) Error() string {
+	return "unknown server: " + use.ServerID
+}
+
+// RemoveClient closes and removes the client connected to serverID. It
+// returns an UnknownServerError if there is no such client.
+func (cs *ClientSet) RemoveClient(serverID string) error {
+	if err := cs.removeClient(serverID); err != nil {
+		return err
+	}
+	cs.notify(nil, []string{serverID})
+	return nil
 }
 
-func (cs *ClientSet) RemoveClient(serverID string) {
+// removeClientInstance closes and removes c if it is still the client
+// connected to its server. A client which has since replaced it, e.g. after
+// c was drained, is left alone.
+func (cs *ClientSet) removeClientInstance(c *Client) error {
+	cs.mu.Lock()
+	if cs.clients[c.serverID] != c {
+		cs.mu.Unlock()
+		return &UnknownServerError{ServerID: c.serverID}
+	}
+	c.Close()
+	delete(cs.clients, c.serverID)
+	cs.agentMetrics().SetServerConnectionsCount(cs.agentID, len(cs.clients))
+	cs.mu.Unlock()
+	cs.notify(nil, []string{c.serverID})
+	return nil
+}
+
+func (cs *ClientSet) removeClient(serverID string) error {
 	cs.mu.Lock()
 	defer cs.mu.Unlock()
-	if cs.clients[serverID] == nil {
-		return
+	c, ok := cs.clients[serverID]
+	if !ok {
+		return &UnknownServerError{ServerID: serverID}
 	}
-	cs.clients[serverID].Close()
+	c.Close()
 	delete(cs.clients, serverID)
-	metrics.Metrics.SetServerConnectionsCount(len(cs.clients))
-}
-
-type ClientSetConfig struct {
-	Address                 string
-	AgentID                 string
-	AgentIdentifiers        string
-	SyncInterval            time.Duration
-	ProbeInterval           time.Duration
-	SyncIntervalCap         time.Duration
-	DialOptions             []grpc.DialOption
-	ServiceAccountTokenPath string
-	WarnOnChannelLimit      bool
-	SyncForever             bool
-}
-
-func (cc *ClientSetConfig) NewAgentClientSet(stopCh <-chan struct{}) *ClientSet {
-	return &ClientSet{
-		clients:                 make(map[string]*Client),
-		agentID:                 cc.AgentID,
-		agentIdentifiers:        cc.AgentIdentifiers,
-		address:                 cc.Address,
-		syncInterval:            cc.SyncInterval,
-		probeInterval:           cc.ProbeInterval,
-		syncIntervalCap:         cc.SyncIntervalCap,
-		dialOptions:             cc.DialOptions,
-		serviceAccountTokenPath: cc.ServiceAccountTokenPath,
-		warnOnChannelLimit:      cc.WarnOnChannelLimit,
-		syncForever:             cc.SyncForever,
-		stopCh:                  stopCh,
-	}
-}
-
-func (cs *ClientSet) newAgentClient() (*Client, int, error) {
-	return newAgentClient(cs.address, cs.agentID, cs.agentIdentifiers, cs, cs.dialOptions...)
-}
-
-func (cs *ClientSet) resetBackoff() *wait.Backoff {
-	return &wait.Backoff{
-		Steps:    math.MaxInt32,
-		Jitter:   0.1,
-		Factor:   1.5,
-		Duration: cs.syncInterval,
-		Cap:      cs.syncIntervalCap,
-	}
-}
-
-// sync makes sure that #clients >= #proxy servers
-func (cs *ClientSet) sync() {
-	defer cs.shutdown()
-	backoff := cs.resetBackoff()
-	var duration time.Duration
+	cs.agentMetrics().SetServerConnectionsCount(cs.agentID, len(cs.clients))
+	return nil
+}
+
+// RemoveWeakClients closes and removes clients whose connection is not Ready
+// and which connected more than maxAge ago. Younger unhealthy clients are
+// left alone to give them a chance to recover. It returns the number of
+// clients removed.
+func (cs *ClientSet) RemoveWeakClients(maxAge time.Duration) int {
+	return cs.removeClients(func(serverID string, c *Client) bool {
+		if c.conn == nil || c.conn.GetState() == connectivity.Ready || time.Since(c.connectedAt) <= maxAge {
+			return false
+		}
+		cs.logger.V(2).Info("Removing weak client", "serverID", serverID, "state", c.conn.GetState(), "connectedAt", c.connectedAt)
+		return true
+	})
+}
+
+// removeClients closes and removes the clients for which remove returns
+// true, then notifies the callbacks and updates the status as RemoveClient
+// does. remove is called with cs.mu held. It returns the number of clients
+// removed.
+func (cs *ClientSet) removeClients(remove func(serverID string, c *Client) bool) int {
+	cs.mu.Lock()
+	var removed []string
+	for serverID, c := range cs.clients {
+		if !remove(serverID, c) {
+			continue
+		}
+		c.Close()
+		delete(cs.clients, serverID)
+		removed = append(removed, serverID)
+	}
+	if len(removed) == 0 {
+		cs.mu.Unlock()
+		return 0
+	}
+	cs.agentMetrics().SetServerConnectionsCount(cs.agentID, len(cs.clients))
+	cs.mu.Unlock()
+	cs.notify(nil, removed)
+	return len(removed)
+}
+
+// Rebalance closes and removes the oldest-connected clients until the
+// number of clients no longer exceeds ServerCount, e.g. after a proxy server
+// has been removed. It does nothing while the server count is unknown. It
+// returns the number of clients removed. The sync loop does not call it; set
+// MaxExcessConnections for the sync loop to trim the clients instead.
+func (cs *ClientSet) Rebalance() int {
+	serverCount := cs.ServerCount()
+	if serverCount <= 0 {
+		return 0
+	}
+	return cs.closeOldestClients(serverCount, serverCount)
+}
+
+// trimExcessClients is how the sync loop keeps the number of clients within
+// MaxExcessConnections of ServerCount: weak clients are removed first, then
+// the oldest ones until the number of clients is within the limit. It does
+// nothing when MaxExcessConnections is zero, which allows any excess. It
+// returns the number of clients removed.
+func (cs *ClientSet) trimExcessClients() int {
+	if cs.maxExcessConnections <= 0 {
+		return 0
+	}
+	serverCount := cs.ServerCount()
+	if serverCount <= 0 {
+		return 0
+	}
+	limit := serverCount + cs.maxExcessConnections
+	if cs.ClientsCount() <= limit {
+		return 0
+	}
+	return cs.RemoveWeakClients(cs.probeInterval) + cs.closeOldestClients(limit, serverCount)
+}
+
+// closeOldestClients closes and removes the oldest-connected clients until
+// there are no more than limit. It returns the number of clients removed.
+func (cs *ClientSet) closeOldestClients(limit, serverCount int) int {
+	cs.mu.Lock()
+	excess := len(cs.clients) - limit
+	if excess <= 0 {
+		cs.mu.Unlock()
+		return 0
+	}
+	clients := make([]*Client, 0, len(cs.clients))
+	for _, c := range cs.clients {
+		clients = append(clients, c)
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].connectedAt.Before(clients[j].connectedAt)
+	})
+	removed := make([]string, 0, excess)
+	for _, c := range clients[:excess] {
+		cs.logger.V(2).Info("Closing excess client", "agentID", cs.agentID, "serverID", c.serverID, "connectedAt", c.connectedAt, "serverCount", serverCount)
+		c.Close()
+		delete(cs.clients, c.serverID)
+		removed = append(removed, c.serverID)
+	}
+	cs.agentMetrics().SetServerConnectionsCount(cs.agentID, len(cs.clients))
+	cs.mu.Unlock()
+	cs.notify(nil, removed)
+	return excess
+}
+
+// serveClient runs c.Serve in a goroutine tracked by Wait. A panic in Serve
+// is logged rather than crashing the agent, and the sync loop is notified
+// when Serve returns. Once the ClientSet is stopping, c is left to shutdown,
+// which closes it with the other clients.
+func (cs *ClientSet) serveClient(c *Client) {
+	labels := runpprof.Labels(
+		"agentIdentifiers", cs.agentIdentifiers,
+		"serverAddress", c.address,
+		"serverID", c.serverID,
+	)
+	served := cs.goTracked(labels, func() {
+		defer func() {
+			if panicInfo := recover(); panicInfo != nil {
+				cs.logger.Error(nil, "Client Serve panicked", "agentID", cs.agentID, "serverID", c.serverID, "panicInfo", panicInfo)
+			}
+			select {
+			case cs.clientExitCh <- struct{}{}:
+			default:
+			}
+		}()
+		c.Serve()
+	})
+	if served && c.conn != nil {
+		cs.goTracked(labels, func() { cs.watchConnState(c) })
+	}
+}
+
+type ServerIDMismatchError struct {
+	Expected string
+	Got      string
+}
+
+func (sme *ServerIDMismatchError) Error() string {
+	return fmt.Sprintf("server ID mismatch: expected %s, got %s", sme.Expected, sme.Got)
+}
+
+// ConnectToServer connects to the proxy server with the given ID, sending
+// the ID to the server as a hint. The client is added only if the server
+// reports the expected ID; otherwise a ServerIDMismatchError is returned.
+// It returns ctx.Err() if ctx is done before the server responds. Unlike
+// the sync loop, it does not update the server count.
+func (cs *ClientSet) ConnectToServer(ctx context.Context, serverID string) error {
+	if serverID == "" {
+		return fmt.Errorf("server ID must not be empty")
+	}
+	if cs.HasID(serverID) {
+		return &DuplicateServerError{ServerID: serverID}
+	}
+	c, err := cs.dialServer(ctx, serverID)
+	if err != nil {
+		return err
+	}
+	if c.serverID != serverID {
+		c.Close()
+		return &ServerIDMismatchError{Expected: serverID, Got: c.serverID}
+	}
+	if err := cs.AddClient(c.serverID, c); err != nil {
+		c.Close()
+		return err
+	}
+	cs.logger.V(2).Info("added client connecting to requested proxy server", "serverID", c.serverID)
+	cs.serveClient(c)
+	return nil
+}
+
+// dialServer connects a new client, sending serverID to the server as a
+// hint, without adding it to the ClientSet. The client may be connected to
+// another server. It returns ctx.Err() if ctx is done before the server
+// responds.
+func (cs *ClientSet) dialServer(ctx context.Context, serverID string) (*Client, error) {
+	address := cs.currentAddress()
+	opts, err := cs.dialOptionsFor(serverID, address)
+	if err != nil {
+		return nil, err
+	}
+	type dialResult struct {
+		c   *Client
+		err error
+	}
+	connected := make(chan dialResult, 1)
+	go func() {
+		c, _, err := newAgentClient(address, cs.agentID, cs.agentIdentifiers, serverID, cs, opts...)
+		connected <- dialResult{c: c, err: err}
+	}()
+	select {
+	case r := <-connected:
+		return r.c, r.err
+	case <-ctx.Done():
+		// Close the connection if it completes after we give up.
+		go func() {
+			if r := <-connected; r.err == nil {
+				r.c.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// Rehash replaces every client with a new connection to the same proxy
+// server, one at a time and without downtime: each new connection is open,
+// and so Ready, before the client it replaces is removed, and the replaced
+// client is drained in the background so that its tunnels can finish.
+// Each new connection is dialed with the ID of the server whose client it
+// should replace as a hint. If it reaches another server instead, it
+// replaces that server's client if it has not been replaced yet, or is
+// added if the server is new, and the dial is retried after SyncInterval
+// otherwise. Clients which are removed in the meantime, e.g. by the sync
+// loop, count as replaced. Rehash returns once all the clients present when
+// it was called have been replaced, or with an error if ctx is done or the
+// ClientSet is shut down first.
+func (cs *ClientSet) Rehash(ctx context.Context) error {
+	pending := make(map[string]*Client)
+	cs.ForEachClient(func(serverID string, c *Client) bool {
+		pending[serverID] = c
+		return true
+	})
+	cs.logger.V(1).Info("Rehashing clients", "agentID", cs.agentID, "clients", len(pending))
 	for {
-		if err := cs.connectOnce(); err != nil {
-			if dse, ok := err.(*DuplicateServerError); ok {
-				klog.V(4).InfoS("duplicate server", "serverID", dse.ServerID, "serverCount", cs.serverCount, "clientsCount", cs.ClientsCount())
-				if cs.serverCount != 0 && cs.ClientsCount() >= cs.serverCount {
-					duration = backoff.Step()
-				}
-			} else {
-				klog.ErrorS(err, "cannot connect once")
-				duration = backoff.Step()
+		cs.mu.Lock()
+		for serverID, old := range pending {
+			if cs.clients[serverID] != old {
+				delete(pending, serverID)
 			}
-		} else {
-			backoff = cs.resetBackoff()
-			duration = wait.Jitter(backoff.Duration, backoff.Jitter)
 		}
-		time.Sleep(duration)
+		cs.mu.Unlock()
+		if len(pending) == 0 {
+			return nil
+		}
+		if cs.isShutdown() {
+			return fmt.Errorf("client set for agent %s is shut down with %d clients left to rehash", cs.agentID, len(pending))
+		}
+		serverIDs := make([]string, 0, len(pending))
+		for serverID := range pending {
+			serverIDs = append(serverIDs, serverID)
+		}
+		sort.Strings(serverIDs)
+
+		c, err := cs.dialServer(ctx, serverIDs[0])
+		if err != nil {
+			cs.logger.V(2).Info("Failed to dial a replacement client", "agentID", cs.agentID, "serverID", serverIDs[0], "err", err)
+		} else if cs.replaceClient(c, pending[c.serverID]) {
+			delete(pending, c.serverID)
+			continue
+		}
 		select {
+		case <-ctx.Done():
+			return fmt.Errorf("rehashing with %d clients left: %w", len(pending), ctx.Err())
+		case <-cs.stopping.C():
+			return fmt.Errorf("client set for agent %s is shut down with %d clients left to rehash", cs.agentID, len(pending))
 		case <-cs.stopCh:
-			return
-		default:
+			return fmt.Errorf("client set for agent %s is stopped with %d clients left to rehash", cs.agentID, len(pending))
+		case <-cs.clock.After(cs.syncInterval):
 		}
 	}
 }
 
-func (cs *ClientSet) connectOnce() error {
-	if !cs.syncForever && cs.serverCount != 0 && cs.ClientsCount() >= cs.serverCount {
-		return nil
+// replaceClient adds c in place of old, which is drained in the background,
+// if old is still the client of c's server, or as the client of a server
+// which has none. It returns true if c replaced old; otherwise, if c's
+// server already has another client, c is closed.
+func (cs *ClientSet) replaceClient(c, old *Client) bool {
+	cs.mu.Lock()
+	if cs.stoppingLocked() {
+		cs.mu.Unlock()
+		c.Close()
+		return false
 	}
-	c, serverCount, err := cs.newAgentClient()
-	if err != nil {
-		return err
+	current := cs.clients[c.serverID]
+	if current != nil && (old == nil || current != old) {
+		cs.mu.Unlock()
+		cs.logger.V(2).Info("Replacement client reached a server which already has a client", "agentID", cs.agentID, "serverID", c.serverID)
+		c.Close()
+		return false
+	}
+	cs.clients[c.serverID] = c
+	cs.agentMetrics().SetServerConnectionsCount(cs.agentID, len(cs.clients))
+	cs.mu.Unlock()
+	cs.serveClient(c)
+	if current == nil {
+		cs.logger.V(2).Info("added client connecting to proxy server", "agentID", cs.agentID, "serverID", c.serverID, "address", c.address)
+		cs.notify([]string{c.serverID}, nil)
+		return old != nil
 	}
-	if cs.serverCount != 0 && cs.serverCount != serverCount {
-		klog.V(2).InfoS("Server count change suggestion by server",
-			"current", cs.serverCount, "serverID", c.serverID, "actual", serverCount)
+	cs.logger.V(2).Info("Replaced client", "agentID", cs.agentID, "serverID", c.serverID)
+	cs.notify(nil, nil)
+	if !cs.goTracked(runpprof.Labels(), func() { cs.drainClient(c.serverID, old) }) {
+		// The ClientSet started stopping since old was replaced, and
+		// shutdown only closes the clients still in the ClientSet.
+		old.Close()
+	}
+	return true
+}
 
+// Connect connects to the proxy server at serverAddress and serves the
+// client in the background, returning once the client has been added. It is
+// the entry point of manual mode, for callers which manage the connections
+// themselves rather than running the sync loop: serverAddress replaces the
+// addresses of the ClientSet, so Connect must not be called once Serve has
+// been. Like ConnectToServer, it does not update the server count.
+func (cs *ClientSet) Connect(serverAddress string) error {
+	if cs.isShutdown() {
+		return fmt.Errorf("client set for agent %s is shut down", cs.agentID)
+	}
+	if serverAddress == "" {
+		return fmt.Errorf("server address must not be empty")
+	}
+	cs.mu.Lock()
+	cs.address = serverAddress
+	cs.addresses = []string{serverAddress}
+	cs.mu.Unlock()
+	c, _, err := cs.newAgentClient(serverAddress)
+	if err != nil {
+		return err
 	}
-	cs.serverCount = serverCount
 	if err := cs.AddClient(c.serverID, c); err != nil {
 		c.Close()
 		return err
 	}
-	klog.V(2).InfoS("sync added client connecting to proxy server", "serverID", c.serverID)
-
-	labels := runpprof.Labels(
-		"agentIdentifiers", cs.agentIdentifiers,
-		"serverAddress", cs.address,
-		"serverID", c.serverID,
-	)
-	go runpprof.Do(context.Background(), labels, func(context.Context) { c.Serve() })
+	cs.logger.V(2).Info("added client connecting to proxy server", "agentID", cs.agentID, "serverID", c.serverID, "address", serverAddress)
+	cs.serveClient(c)
 	return nil
 }
 
 func (cs *ClientSet) Serve() {
 	labels := runpprof.Labels(
 		"agentIdentifiers", cs.agentIdentifiers,
-		"serverAddress", cs.address,
+		"serverAddress", cs.currentAddress(),
 	)
-	go runpprof.Do(context.Background(), labels, func(context.Context) { cs.sync() })
+	if !cs.goTracked(labels, cs.sync) {
+		// Stopped before serving, so there is no sync loop to shut down
+		// the clients added by Connect.
+		cs.shutdown()
+		cs.syncExited.fire()
+		return
+	}
+	cs.goTracked(labels, cs.drain)
+	cs.goTracked(labels, cs.trackBandwidth)
+	if cs.unhealthyTimeout > 0 {
+		cs.goTracked(labels, cs.reap)
+	}
+	if cs.serviceAccountTokenPath != "" && cs.tokenRefreshInterval > 0 {
+		cs.goTracked(labels, cs.watchToken)
+	}
+	if cs.tlsCertFile != "" {
+		cs.goTracked(labels, cs.watchCertificate)
+	}
+	if cs.heartbeatInterval > 0 {
+		cs.goTracked(labels, cs.heartbeat)
+	}
 }
 
-func (cs *ClientSet) shutdown() {
-	cs.mu.Lock()
-	defer cs.mu.Unlock()
-	for serverID, client := range cs.clients {
-		client.Close()
-		delete(cs.clients, serverID)
+// Clone creates a ClientSet with the same configuration as cs but
+// connecting as newAgentID, and starts it with Serve. It allows an agent to
+// change its ID without downtime: the caller drains cs once the clone has
+// connected. The clone shares cs's stop channel but not its drain channel,
+// and does not inherit the healthy count callbacks.
+func (cs *ClientSet) Clone(newAgentID string) (*ClientSet, error) {
+	if newAgentID == "" {
+		return nil, fmt.Errorf("agent ID must not be empty")
+	}
+	if newAgentID == cs.agentID {
+		return nil, fmt.Errorf("agent ID %q is already in use by this client set", newAgentID)
+	}
+	if cs.isShutdown() {
+		return nil, fmt.Errorf("cannot clone a client set which has been shut down")
 	}
+	cc := cs.config
+	cc.AgentID = newAgentID
+	clone := cc.newAgentClientSet(nil, cs.stopCh)
+	// Connect may have replaced the configured addresses, and tests replace
+	// the clock.
+	clone.address = cs.currentAddress()
+	clone.addresses = cs.currentAddresses()
+	clone.primaryAddress = cs.primaryAddress
+	clone.clock = cs.clock
+	clone.Serve()
+	return clone, nil
 }
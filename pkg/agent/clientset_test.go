@@ -0,0 +1,1125 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"k8s.io/apimachinery/pkg/util/wait"
+
+	"sigs.k8s.io/apiserver-network-proxy/pkg/agent/metrics"
+	"sigs.k8s.io/apiserver-network-proxy/proto/agent"
+	"sigs.k8s.io/apiserver-network-proxy/proto/header"
+)
+
+// connectAttemptsCount returns the connect attempts counter for serverID
+// and errorType.
+func connectAttemptsCount(t *testing.T, serverID, errorType string) float64 {
+	t.Helper()
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := prometheus.BuildFQName(metrics.Namespace, metrics.Subsystem, "connect_attempts_total")
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			labels := map[string]string{}
+			for _, label := range m.GetLabel() {
+				labels[label.GetName()] = label.GetValue()
+			}
+			if labels["server_id"] == serverID && labels["error_type"] == errorType {
+				return m.GetCounter().GetValue()
+			}
+		}
+	}
+	return 0
+}
+
+func TestMetricsRegistry(t *testing.T) {
+	name := prometheus.BuildFQName(metrics.Namespace, metrics.Subsystem, "open_server_connections")
+	serverConnections := func(g prometheus.Gatherer) float64 {
+		t.Helper()
+		families, err := g.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, family := range families {
+			if family.GetName() == name {
+				return family.GetMetric()[0].GetGauge().GetValue()
+			}
+		}
+		return 0
+	}
+	registry1, registry2 := prometheus.NewRegistry(), prometheus.NewRegistry()
+	cs1 := withTestDefaults(&ClientSetConfig{MetricsRegistry: registry1}).NewAgentClientSet(nil, make(chan struct{}))
+	cs2 := withTestDefaults(&ClientSetConfig{MetricsRegistry: registry2}).NewAgentClientSet(nil, make(chan struct{}))
+	if cs1.agentMetrics() == cs2.agentMetrics() || cs1.agentMetrics() == metrics.Metrics {
+		t.Fatal("expected separate metrics for each registry")
+	}
+
+	for _, serverID := range []string{"server1", "server2"} {
+		if err := cs1.AddClient(serverID, &Client{serverID: serverID}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := cs2.AddClient("server1", &Client{serverID: "server1"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := serverConnections(registry1); got != 2 {
+		t.Errorf("expected 2 server connections in the first registry, got %v", got)
+	}
+	if got := serverConnections(registry2); got != 1 {
+		t.Errorf("expected 1 server connection in the second registry, got %v", got)
+	}
+
+	// ClientSets sharing a registry share their metrics.
+	cs3 := withTestDefaults(&ClientSetConfig{MetricsRegistry: registry1}).NewAgentClientSet(nil, make(chan struct{}))
+	if cs3.agentMetrics() != cs1.agentMetrics() {
+		t.Error("expected ClientSets sharing a registry to share their metrics")
+	}
+}
+
+func TestMetricsPerAgentID(t *testing.T) {
+	metrics.Metrics.Reset()
+	cs1 := withTestDefaults(&ClientSetConfig{AgentID: "tenant1"}).NewAgentClientSet(nil, make(chan struct{}))
+	cs2 := withTestDefaults(&ClientSetConfig{AgentID: "tenant2"}).NewAgentClientSet(nil, make(chan struct{}))
+	for _, serverID := range []string{"server1", "server2"} {
+		c := &Client{cs: cs1, conn: newReadyConn(t), serverID: serverID, stopCh: make(chan struct{})}
+		if err := cs1.AddClient(serverID, c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := cs2.AddClient("server1", &Client{serverID: "server1"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := agentGaugeValue(t, "open_server_connections", "tenant1"); got != 2 {
+		t.Errorf("expected 2 server connections for tenant1, got %v", got)
+	}
+	if got := agentGaugeValue(t, "open_server_connections", "tenant2"); got != 1 {
+		t.Errorf("expected 1 server connection for tenant2, got %v", got)
+	}
+
+	if err := cs1.RemoveClient("server1"); err != nil {
+		t.Fatal(err)
+	}
+	if got := agentGaugeValue(t, "open_server_connections", "tenant1"); got != 1 {
+		t.Errorf("expected 1 server connection for tenant1, got %v", got)
+	}
+	if got := agentGaugeValue(t, "open_server_connections", "tenant2"); got != 1 {
+		t.Errorf("expected the server connections of tenant2 to be unchanged, got %v", got)
+	}
+}
+
+// connEstablishmentCount returns the number of connection establishment
+// observations recorded for address with the given result.
+func connEstablishmentCount(t *testing.T, address, result string) uint64 {
+	t.Helper()
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := prometheus.BuildFQName(metrics.Namespace, metrics.Subsystem, "connection_establishment_duration_seconds")
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			labels := map[string]string{}
+			for _, label := range m.GetLabel() {
+				labels[label.GetName()] = label.GetValue()
+			}
+			if labels["server_address"] == address && labels["result"] == result {
+				return m.GetHistogram().GetSampleCount()
+			}
+		}
+	}
+	return 0
+}
+
+// recordingRetryStrategy returns a delay of attempt seconds and records
+// its arguments.
+type recordingRetryStrategy struct {
+	attempts []int
+	errs     []error
+}
+
+func (s *recordingRetryStrategy) NextRetryDelay(attempt int, lastErr error) time.Duration {
+	s.attempts = append(s.attempts, attempt)
+	s.errs = append(s.errs, lastErr)
+	return time.Duration(attempt) * time.Second
+}
+
+// duplicateServerCount returns the duplicate server counter for serverID.
+func duplicateServerCount(t *testing.T, serverID string) float64 {
+	t.Helper()
+	return serverCounterValue(t, "duplicate_server_total", serverID)
+}
+
+// serverCounterValue returns the value of the agent counter metric for
+// serverID.
+func serverCounterValue(t *testing.T, metric, serverID string) float64 {
+	t.Helper()
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := prometheus.BuildFQName(metrics.Namespace, metrics.Subsystem, metric)
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			for _, label := range m.GetLabel() {
+				if label.GetName() == "server_id" && label.GetValue() == serverID {
+					return m.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	return 0
+}
+
+// syncBackoffCount returns the number of sync backoff observations recorded
+// with the given result.
+func syncBackoffCount(t *testing.T, result metrics.SyncResult) uint64 {
+	t.Helper()
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := prometheus.BuildFQName(metrics.Namespace, metrics.Subsystem, "sync_backoff_duration_seconds")
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			for _, label := range m.GetLabel() {
+				if label.GetName() == "result" && label.GetValue() == string(result) {
+					return m.GetHistogram().GetSampleCount()
+				}
+			}
+		}
+	}
+	return 0
+}
+
+func TestRemoveClient(t *testing.T) {
+	cs := withTestDefaults(&ClientSetConfig{}).NewAgentClientSet(nil, make(chan struct{}))
+	conn, err := grpc.Dial("localhost:0", grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Client{cs: cs, conn: conn, serverID: "server1", stopCh: make(chan struct{})}
+	if err := cs.AddClient("server1", c); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cs.RemoveClient("server1"); err != nil {
+		t.Errorf("expected no error removing known server, got %v", err)
+	}
+	if cs.HasID("server1") {
+		t.Error("expected server1 to be removed")
+	}
+
+	err = cs.RemoveClient("server1")
+	var use *UnknownServerError
+	if !errors.As(err, &use) || use.ServerID != "server1" {
+		t.Errorf("expected UnknownServerError for server1, got %v", err)
+	}
+}
+
+func TestListServerIDs(t *testing.T) {
+	testCases := []struct {
+		name      string
+		serverIDs []string
+		expected  []string
+	}{
+		{
+			name:     "empty",
+			expected: []string{},
+		},
+		{
+			name:      "single",
+			serverIDs: []string{"server1"},
+			expected:  []string{"server1"},
+		},
+		{
+			name:      "multiple",
+			serverIDs: []string{"server3", "server1", "server2"},
+			expected:  []string{"server1", "server2", "server3"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cs := withTestDefaults(&ClientSetConfig{}).NewAgentClientSet(nil, make(chan struct{}))
+			for _, serverID := range tc.serverIDs {
+				if err := cs.AddClient(serverID, &Client{serverID: serverID}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := cs.ListServerIDs(); !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("expected server IDs %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestServerIDs(t *testing.T) {
+	cs := withTestDefaults(&ClientSetConfig{}).NewAgentClientSet(nil, make(chan struct{}))
+	for _, serverID := range []string{"server2", "server3", "server1"} {
+		if err := cs.AddClient(serverID, &Client{serverID: serverID}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got := cs.ServerIDs()
+	if expected := []string{"server1", "server2", "server3"}; !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected server IDs %v, got %v", expected, got)
+	}
+	if cs.ClientsCount() != len(got) {
+		t.Errorf("expected %d clients, got %d", len(got), cs.ClientsCount())
+	}
+	for _, serverID := range got {
+		if !cs.HasID(serverID) {
+			t.Errorf("expected a client for %s", serverID)
+		}
+	}
+
+	// The result is a snapshot.
+	got[0] = "changed"
+	if err := cs.AddClient("server4", &Client{serverID: "server4"}); err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"server1", "server2", "server3", "server4"}; !reflect.DeepEqual(cs.ServerIDs(), expected) {
+		t.Errorf("expected server IDs %v, got %v", expected, cs.ServerIDs())
+	}
+}
+
+func TestAddressOf(t *testing.T) {
+	cs := withTestDefaults(&ClientSetConfig{
+		Addresses: []string{"proxy-0:8091", "proxy-1:8091"},
+	}).NewAgentClientSet(nil, make(chan struct{}))
+	if err := cs.AddClient("server1", &Client{serverID: "server1", address: "proxy-1:8091"}); err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := cs.AddressOf("server1"); !ok || got != "proxy-1:8091" {
+		t.Errorf("expected address proxy-1:8091, got %q, %v", got, ok)
+	}
+	if got, ok := cs.AddressOf("server2"); ok {
+		t.Errorf("expected no address for an unknown server, got %q", got)
+	}
+}
+
+func TestForEachClient(t *testing.T) {
+	testCases := []struct {
+		name      string
+		stopAfter int // the visit on which fn returns false; zero never stops.
+		panics    bool
+		expected  int
+	}{
+		{name: "all", expected: 3},
+		{name: "stop early", stopAfter: 2, expected: 2},
+		{name: "stop on first", stopAfter: 1, expected: 1},
+		{name: "panic", panics: true, expected: 1},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cs := withTestDefaults(&ClientSetConfig{}).NewAgentClientSet(nil, make(chan struct{}))
+			for _, serverID := range []string{"server1", "server2", "server3"} {
+				if err := cs.AddClient(serverID, &Client{serverID: serverID}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			visited := map[string]bool{}
+			func() {
+				defer func() {
+					if r := recover(); r != nil && !tc.panics {
+						t.Errorf("unexpected panic: %v", r)
+					}
+				}()
+				cs.ForEachClient(func(serverID string, c *Client) bool {
+					if c.serverID != serverID || visited[serverID] {
+						t.Errorf("unexpected visit of %s with client for %s", serverID, c.serverID)
+					}
+					visited[serverID] = true
+					if tc.panics {
+						panic("fn failed")
+					}
+					return len(visited) != tc.stopAfter
+				})
+			}()
+			if len(visited) != tc.expected {
+				t.Errorf("expected %d clients visited, got %v", tc.expected, visited)
+			}
+			if !cs.mu.TryLock() {
+				t.Fatal("expected the lock to be released")
+			}
+			cs.mu.Unlock()
+		})
+	}
+}
+
+func TestRemoveWeakClients(t *testing.T) {
+	cs := withTestDefaults(&ClientSetConfig{}).NewAgentClientSet(nil, make(chan struct{}))
+	now := time.Now()
+	for serverID, connectedAt := range map[string]time.Time{
+		"old":   now.Add(-time.Hour),
+		"young": now,
+	} {
+		// Nothing listens on the address, so the connection never becomes Ready.
+		conn, err := grpc.Dial("localhost:0", grpc.WithTransportCredentials(insecure.NewCredentials()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		c := &Client{cs: cs, conn: conn, serverID: serverID, stopCh: make(chan struct{}), connectedAt: connectedAt}
+		if err := cs.AddClient(serverID, c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A client without a connection, as in tests using pipe, is left alone.
+	clientStream, _ := pipe()
+	if err := cs.AddClient("stream", &Client{cs: cs, serverID: "stream", stream: clientStream, connectedAt: now.Add(-time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	var disconnected []string
+	cs.OnDisconnect(func(serverID string) { disconnected = append(disconnected, serverID) })
+
+	if removed := cs.RemoveWeakClients(time.Minute); removed != 1 {
+		t.Errorf("expected 1 client removed, got %d", removed)
+	}
+	if got := cs.ListServerIDs(); !reflect.DeepEqual(got, []string{"stream", "young"}) {
+		t.Errorf("expected the young and stream clients to remain, got %v", got)
+	}
+	if !reflect.DeepEqual(disconnected, []string{"old"}) {
+		t.Errorf("expected OnDisconnect to be called for old, got %v", disconnected)
+	}
+}
+
+// stubServerPicker always picks address, recording the connected server IDs
+// it was given.
+type stubServerPicker struct {
+	address   string
+	connected [][]string
+}
+
+func (p *stubServerPicker) PickAddress(_ string, connectedServerIDs []string) string {
+	p.connected = append(p.connected, connectedServerIDs)
+	return p.address
+}
+
+func TestRebalance(t *testing.T) {
+	cs := withTestDefaults(&ClientSetConfig{}).NewAgentClientSet(nil, make(chan struct{}))
+	now := time.Now()
+	for i, serverID := range []string{"server1", "server2", "server3"} {
+		c := &Client{
+			cs:          cs,
+			conn:        newReadyConn(t),
+			serverID:    serverID,
+			stopCh:      make(chan struct{}),
+			connectedAt: now.Add(time.Duration(i) * time.Minute),
+		}
+		if err := cs.AddClient(serverID, c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cs.serverCount = 3
+	if removed := cs.Rebalance(); removed != 0 {
+		t.Errorf("expected no clients removed at the server count, got %d", removed)
+	}
+
+	cs.serverCount = 1
+	if removed := cs.Rebalance(); removed != 2 {
+		t.Errorf("expected 2 clients removed, got %d", removed)
+	}
+	if got, expected := cs.ListServerIDs(), []string{"server3"}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected the newest client %v to remain, got %v", expected, got)
+	}
+}
+
+func TestTrimExcessClients(t *testing.T) {
+	cs := withTestDefaults(&ClientSetConfig{MaxExcessConnections: 2, ProbeInterval: time.Minute}).NewAgentClientSet(nil, make(chan struct{}))
+	now := time.Now()
+	for i, serverID := range []string{"server1", "server2", "server3"} {
+		c := &Client{
+			cs:          cs,
+			conn:        newReadyConn(t),
+			serverID:    serverID,
+			stopCh:      make(chan struct{}),
+			connectedAt: now.Add(time.Duration(i-3) * time.Hour),
+		}
+		if err := cs.AddClient(serverID, c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Nothing listens on the address, so the connection never becomes Ready.
+	conn, err := grpc.Dial("localhost:0", grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	weak := &Client{cs: cs, conn: conn, serverID: "weak", stopCh: make(chan struct{}), connectedAt: now.Add(-30 * time.Minute)}
+	if err := cs.AddClient("weak", weak); err != nil {
+		t.Fatal(err)
+	}
+
+	cs.serverCount = 2
+	if removed := cs.trimExcessClients(); removed != 0 {
+		t.Errorf("expected no clients removed within the allowed excess, got %d", removed)
+	}
+
+	// The weak client goes first, although it is not the oldest.
+	cs.serverCount = 1
+	if removed := cs.trimExcessClients(); removed != 1 {
+		t.Errorf("expected 1 client removed, got %d", removed)
+	}
+	if got, expected := cs.ListServerIDs(), []string{"server1", "server2", "server3"}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected the weak client to be removed, leaving %v, got %v", expected, got)
+	}
+
+	cs.maxExcessConnections = 1
+	if removed := cs.trimExcessClients(); removed != 1 {
+		t.Errorf("expected 1 client removed, got %d", removed)
+	}
+	if got, expected := cs.ListServerIDs(), []string{"server2", "server3"}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected the oldest client to be removed, leaving %v, got %v", expected, got)
+	}
+
+	// Zero allows any excess.
+	cs.maxExcessConnections = 0
+	if removed := cs.trimExcessClients(); removed != 0 {
+		t.Errorf("expected no clients removed without a limit, got %d", removed)
+	}
+	if got, expected := cs.ListServerIDs(), []string{"server2", "server3"}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected the clients %v to remain, got %v", expected, got)
+	}
+}
+
+func newReadyConn(t *testing.T) *grpc.ClientConn {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	go server.Serve(lis)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.Connect()
+	ctx, cancel := context.WithTimeout(context.Background(), wait.ForeverTestTimeout)
+	defer cancel()
+	for state := conn.GetState(); state != connectivity.Ready; state = conn.GetState() {
+		if !conn.WaitForStateChange(ctx, state) {
+			t.Fatalf("connection never became ready, last state %v", state)
+		}
+	}
+	return conn
+}
+
+// testProxyServer is a minimal AgentService which reports a fixed server ID
+// and count, then holds the stream open until the client goes away.
+type testProxyServer struct {
+	agent.UnimplementedAgentServiceServer
+	serverID    string
+	serverCount int
+	connections int64
+	// err, if set, is returned to every Connect call.
+	err error
+}
+
+func (s *testProxyServer) Connect(stream agent.AgentService_ConnectServer) error {
+	if s.err != nil {
+		return s.err
+	}
+	serverID := s.serverID
+	if serverID == "" {
+		// Behave like a load balanced HA server, with a distinct ID for
+		// each connection.
+		serverID = fmt.Sprintf("server%d", atomic.AddInt64(&s.connections, 1))
+	}
+	md := metadata.Pairs(header.ServerID, serverID, header.ServerCount, strconv.Itoa(s.serverCount))
+	if err := stream.SendHeader(md); err != nil {
+		return err
+	}
+	<-stream.Context().Done()
+	return nil
+}
+
+func TestClone(t *testing.T) {
+	addr := newTestProxyServer(t, "server1", 1)
+	cc := withTestDefaults(&ClientSetConfig{
+		Address:         addr,
+		AgentID:         "agent1",
+		SyncInterval:    10 * time.Millisecond,
+		SyncIntervalCap: 10 * time.Millisecond,
+		ProbeInterval:   time.Hour,
+		MaxClients:      3,
+		DialOptions:     []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())},
+	})
+	cs := cc.NewAgentClientSet(nil, make(chan struct{}))
+	defer cs.Wait()
+	defer cs.Shutdown()
+
+	for _, id := range []string{"", "agent1"} {
+		if _, err := cs.Clone(id); err == nil {
+			t.Errorf("expected Clone(%q) to fail", id)
+		}
+	}
+
+	clone, err := cs.Clone("agent2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clone.Wait()
+	defer clone.Shutdown()
+	if clone.agentID != "agent2" || clone.address != cs.address {
+		t.Errorf("expected clone of %s with agent ID agent2, got %s with agent ID %s", cs.address, clone.address, clone.agentID)
+	}
+	if clone.maxClients != 3 || clone.config.AgentID != "agent2" {
+		t.Errorf("expected the clone to be created from the config with agent ID agent2, got %+v", clone.config)
+	}
+	if err := wait.PollImmediate(10*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		return clone.ClientsCount() == 1, nil
+	}); err != nil {
+		t.Fatal("clone never connected")
+	}
+	if c, _ := clone.GetClient("server1"); c.agentID != "agent2" {
+		t.Errorf("expected clone client to connect as agent2, got %s", c.agentID)
+	}
+}
+
+func TestMaxClients(t *testing.T) {
+	addr := newTestProxyServer(t, "", 10)
+	cc := withTestDefaults(&ClientSetConfig{
+		Address:       addr,
+		ProbeInterval: time.Hour,
+		SyncForever:   true,
+		MaxClients:    2,
+		DialOptions:   []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())},
+	})
+	cs := cc.NewAgentClientSet(nil, make(chan struct{}))
+	defer cs.Wait()
+	defer cs.Shutdown()
+
+	for i := 0; i < 5; i++ {
+		result := cs.connectOnce()
+		if result.err != nil {
+			t.Fatalf("connectOnce %d: unexpected error %v", i, result.err)
+		}
+		if expected := i < 2; result.added != expected || result.atMaxClients == expected {
+			t.Errorf("connectOnce %d: expected added=%t, got %+v", i, expected, result)
+		}
+	}
+	if got := cs.ClientsCount(); got != 2 {
+		t.Errorf("expected 2 clients, got %d", got)
+	}
+
+	// At MaxClients, the sync loop waits at the capped interval rather than
+	// going back to the base one.
+	backoff := &wait.Backoff{Duration: time.Second, Cap: time.Minute, Factor: 2, Jitter: 0.1, Steps: math.MaxInt32}
+	if got := cs.nextSyncBackoff(connectResult{atMaxClients: true}, backoff, 0); got < time.Minute || backoff.Duration != time.Minute {
+		t.Errorf("expected the capped interval %v at MaxClients, got %v", time.Minute, got)
+	}
+}
+
+func TestConnectToServer(t *testing.T) {
+	addr := newTestProxyServer(t, "server1", 1)
+	cc := withTestDefaults(&ClientSetConfig{
+		Address:       addr,
+		ProbeInterval: time.Hour,
+		DialOptions:   []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())},
+	})
+	cs := cc.NewAgentClientSet(nil, make(chan struct{}))
+	defer cs.Wait()
+	defer cs.Shutdown()
+	ctx, cancel := context.WithTimeout(context.Background(), wait.ForeverTestTimeout)
+	defer cancel()
+
+	err := cs.ConnectToServer(ctx, "server2")
+	var sme *ServerIDMismatchError
+	if !errors.As(err, &sme) || sme.Expected != "server2" || sme.Got != "server1" {
+		t.Errorf("expected ServerIDMismatchError{server2, server1}, got %v", err)
+	}
+	if cs.ClientsCount() != 0 {
+		t.Errorf("expected mismatched client to be discarded, got %d clients", cs.ClientsCount())
+	}
+
+	if err := cs.ConnectToServer(ctx, "server1"); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if !cs.HasID("server1") {
+		t.Error("expected a client for server1")
+	}
+
+	var dse *DuplicateServerError
+	if err := cs.ConnectToServer(ctx, "server1"); !errors.As(err, &dse) {
+		t.Errorf("expected DuplicateServerError, got %v", err)
+	}
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := cs.ConnectToServer(cancelled, "server3"); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected %v, got %v", context.Canceled, err)
+	}
+}
+
+// hintProxyServer is an AgentService behind which several proxy servers
+// share an address. A connection reaches the server named by its server ID
+// hint if honorHint is set, and the next server in turn otherwise.
+type hintProxyServer struct {
+	agent.UnimplementedAgentServiceServer
+	serverIDs []string
+	honorHint bool
+	next      atomic.Int64
+}
+
+func (s *hintProxyServer) Connect(stream agent.AgentService_ConnectServer) error {
+	serverID := s.serverIDs[int(s.next.Add(1)-1)%len(s.serverIDs)]
+	if md, ok := metadata.FromIncomingContext(stream.Context()); ok && s.honorHint {
+		if hint := md.Get(header.ServerIDHint); len(hint) > 0 {
+			serverID = hint[0]
+		}
+	}
+	md := metadata.Pairs(header.ServerID, serverID, header.ServerCount, strconv.Itoa(len(s.serverIDs)))
+	if err := stream.SendHeader(md); err != nil {
+		return err
+	}
+	<-stream.Context().Done()
+	return nil
+}
+
+func TestRehash(t *testing.T) {
+	for _, honorHint := range []bool{true, false} {
+		t.Run(fmt.Sprintf("honorHint=%v", honorHint), func(t *testing.T) {
+			server := &hintProxyServer{serverIDs: []string{"server1", "server2", "server3"}, honorHint: honorHint}
+			cs := withTestDefaults(&ClientSetConfig{
+				Address:       serveTestProxyServer(t, server),
+				ProbeInterval: time.Hour,
+				SyncInterval:  10 * time.Millisecond,
+				DialOptions:   []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())},
+			}).NewAgentClientSet(nil, make(chan struct{}))
+			defer cs.Wait()
+			defer cs.Shutdown()
+			ctx, cancel := context.WithTimeout(context.Background(), wait.ForeverTestTimeout)
+			defer cancel()
+
+			old := make(map[string]*Client)
+			for _, serverID := range []string{"server1", "server2"} {
+				c, err := cs.dialServer(ctx, serverID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !cs.replaceClient(c, nil) {
+					// The server was reached without its hint.
+					continue
+				}
+				old[c.serverID] = c
+			}
+			before := cs.ListServerIDs()
+			if err := cs.Rehash(ctx); err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+
+			for _, serverID := range before {
+				c, ok := cs.GetClient(serverID)
+				if !ok {
+					t.Errorf("expected a client for %s after rehashing", serverID)
+					continue
+				}
+				if c == old[serverID] {
+					t.Errorf("expected the client for %s to be replaced", serverID)
+				}
+			}
+			for serverID, c := range old {
+				select {
+				case <-c.Done():
+				case <-time.After(wait.ForeverTestTimeout):
+					t.Errorf("expected the replaced client for %s to be closed", serverID)
+				}
+			}
+		})
+	}
+
+	t.Run("cancelled", func(t *testing.T) {
+		cs := withTestDefaults(&ClientSetConfig{
+			Address:     newTestProxyServer(t, "server1", 1),
+			DialOptions: []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())},
+		}).NewAgentClientSet(nil, make(chan struct{}))
+		defer cs.Wait()
+		defer cs.Shutdown()
+		ctx, cancel := context.WithCancel(context.Background())
+		if err := cs.ConnectToServer(ctx, "server1"); err != nil {
+			t.Fatal(err)
+		}
+		cancel()
+		if err := cs.Rehash(ctx); !errors.Is(err, context.Canceled) {
+			t.Errorf("expected %v, got %v", context.Canceled, err)
+		}
+		if !cs.HasID("server1") {
+			t.Error("expected the client to be kept")
+		}
+	})
+}
+
+func TestConnect(t *testing.T) {
+	cc := withTestDefaults(&ClientSetConfig{
+		Address:       "localhost:1,localhost:2",
+		ProbeInterval: time.Hour,
+		DialOptions:   []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())},
+	})
+	cs := cc.NewAgentClientSet(nil, make(chan struct{}))
+	defer cs.Wait()
+	defer cs.Shutdown()
+
+	if err := cs.Connect(""); err == nil {
+		t.Error("expected an error for an empty address")
+	}
+
+	addr := newTestProxyServer(t, "server1", 1)
+	if err := cs.Connect(addr); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	c, ok := cs.GetClient("server1")
+	if !ok {
+		t.Fatal("expected a client for server1")
+	}
+	if address, _ := cs.AddressOf("server1"); address != addr {
+		t.Errorf("expected the client to be connected to %s, got %s", addr, address)
+	}
+	if cs.currentAddress() != addr || !reflect.DeepEqual(cs.currentAddresses(), []string{addr}) {
+		t.Errorf("expected the addresses of the ClientSet to be replaced by %s, got %s and %v", addr, cs.currentAddress(), cs.currentAddresses())
+	}
+	if got, _ := cs.nextAddress(); got != addr {
+		t.Errorf("expected the next address to be %s, got %s", addr, got)
+	}
+	if cs.SyncStats().TotalSyncs != 0 {
+		t.Error("expected Connect not to run the sync loop")
+	}
+
+	var dse *DuplicateServerError
+	if err := cs.Connect(addr); !errors.As(err, &dse) {
+		t.Errorf("expected DuplicateServerError, got %v", err)
+	}
+	if got, _ := cs.GetClient("server1"); got != c {
+		t.Error("expected the duplicate client not to replace the first one")
+	}
+
+	cs.Shutdown()
+	if err := cs.Connect(addr); err == nil {
+		t.Error("expected an error after shutdown")
+	}
+}
+
+// serverConnectionsGauge returns the current value of the open server
+// connections metric.
+func serverConnectionsGauge(t *testing.T) float64 {
+	t.Helper()
+	return gaugeValue(t, "open_server_connections")
+}
+
+// gaugeValue returns the current value of the agent gauge metric for the
+// default test agent ID.
+func gaugeValue(t *testing.T, metric string) float64 {
+	t.Helper()
+	return agentGaugeValue(t, metric, "agent1")
+}
+
+// agentGaugeValue returns the current value of the agent gauge metric for
+// agentID.
+func agentGaugeValue(t *testing.T, metric, agentID string) float64 {
+	t.Helper()
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := prometheus.BuildFQName(metrics.Namespace, metrics.Subsystem, metric)
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			for _, label := range m.GetLabel() {
+				if label.GetName() == "agent_id" && label.GetValue() == agentID {
+					return m.GetGauge().GetValue()
+				}
+			}
+		}
+	}
+	return 0
+}
+
+func TestServerCount(t *testing.T) {
+	testCases := []struct {
+		name       string
+		noCounter  bool
+		leaseReady bool
+		leaseCount int
+		received   int
+		expected   int
+	}{
+		{name: "no lease counter", noCounter: true, received: 3, expected: 3},
+		{name: "lease not ready", leaseReady: false, leaseCount: 0, received: 3, expected: 3},
+		{name: "lease ready", leaseReady: true, leaseCount: 5, received: 3, expected: 5},
+		{name: "lease ready with no servers", leaseReady: true, leaseCount: 0, received: 3, expected: 0},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cc := withTestDefaults(&ClientSetConfig{})
+			if !tc.noCounter {
+				lc := &ServerLeaseCounter{hasSynced: func() bool { return tc.leaseReady }}
+				lc.count.Store(int64(tc.leaseCount))
+				cc.ServerLeaseCounter = lc
+			}
+			cs := cc.NewAgentClientSet(nil, make(chan struct{}))
+			cs.serverCount = tc.received
+			if got := cs.ServerCount(); got != tc.expected {
+				t.Errorf("expected server count %d, got %d", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestServerCountChangeHandler(t *testing.T) {
+	type change struct{ old, new int }
+	var changes []change
+	lc := &ServerLeaseCounter{hasSynced: func() bool { return true }}
+	var cs *ClientSet
+	cs = withTestDefaults(&ClientSetConfig{
+		ServerLeaseCounter: lc,
+		ServerCountChangeHandler: func(old, new int) {
+			// The handler may call back into the ClientSet.
+			if got := cs.ClientsCount(); got != 0 {
+				t.Errorf("expected no clients, got %d", got)
+			}
+			changes = append(changes, change{old, new})
+		},
+	}).NewAgentClientSet(nil, make(chan struct{}))
+
+	for _, count := range []int{2, 2, 3, 1, 1} {
+		lc.count.Store(int64(count))
+		if got := cs.ServerCount(); got != count {
+			t.Errorf("expected server count %d, got %d", count, got)
+		}
+	}
+	expected := []change{{0, 2}, {2, 3}, {3, 1}}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Errorf("expected changes %v, got %v", expected, changes)
+	}
+}
+
+// withTestDefaults fills in the fields required by Validate which cc leaves
+// unset, so that tests only need to set the fields they exercise.
+func withTestDefaults(cc *ClientSetConfig) *ClientSetConfig {
+	if cc.AgentID == "" {
+		cc.AgentID = "agent1"
+	}
+	if cc.Address == "" {
+		cc.Address = "localhost:0"
+	}
+	if cc.SyncInterval == 0 {
+		cc.SyncInterval = time.Second
+	}
+	if cc.SyncIntervalCap == 0 {
+		cc.SyncIntervalCap = cc.SyncInterval
+	}
+	return cc
+}
+
+// newTestProxyServer starts a testProxyServer and returns its address. An
+// empty serverID gives each connection a distinct server ID.
+func newTestProxyServer(t *testing.T, serverID string, serverCount int) string {
+	t.Helper()
+	return serveTestProxyServer(t, &testProxyServer{serverID: serverID, serverCount: serverCount})
+}
+
+// serveTestProxyServer serves s and returns its address.
+func serveTestProxyServer(t *testing.T, s agent.AgentServiceServer) string {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	agent.RegisterAgentServiceServer(server, s)
+	go server.Serve(lis)
+	t.Cleanup(server.Stop)
+	return lis.Addr().String()
+}
+
+// writeTestCert writes a self-signed certificate for commonName, valid for
+// 127.0.0.1, and its key to certFile and keyFile.
+func writeTestCert(t *testing.T, commonName, certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// peerRecordingProxyServer is a testProxyServer which records the common
+// name of each connecting agent's certificate.
+type peerRecordingProxyServer struct {
+	*testProxyServer
+	peers chan string
+}
+
+func (s *peerRecordingProxyServer) Connect(stream agent.AgentService_ConnectServer) error {
+	p, ok := peer.FromContext(stream.Context())
+	if !ok {
+		return fmt.Errorf("no peer in stream context")
+	}
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(tlsInfo.State.PeerCertificates) == 0 {
+		return fmt.Errorf("no client certificate")
+	}
+	s.peers <- tlsInfo.State.PeerCertificates[0].Subject.CommonName
+	return s.testProxyServer.Connect(stream)
+}
+
+func TestCredentialsReloader(t *testing.T) {
+	dir := t.TempDir()
+	serverCertFile, serverKeyFile := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	agentCertFile, agentKeyFile := filepath.Join(dir, "agent.crt"), filepath.Join(dir, "agent.key")
+	writeTestCert(t, "proxy-server", serverCertFile, serverKeyFile)
+
+	serverCert, err := tls.LoadX509KeyPair(serverCertFile, serverKeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer(grpc.Creds(credentials.NewTLS(&tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAnyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	})))
+	ps := &peerRecordingProxyServer{testProxyServer: &testProxyServer{serverCount: 1}, peers: make(chan string, 2)}
+	agent.RegisterAgentServiceServer(server, ps)
+	go server.Serve(lis)
+	defer server.Stop()
+
+	reloads := 0
+	cc := withTestDefaults(&ClientSetConfig{
+		Address: lis.Addr().String(),
+		// The insecure credentials are replaced by the reloaded ones.
+		DialOptions: []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())},
+		CredentialsReloader: func() (credentials.TransportCredentials, error) {
+			reloads++
+			caCert, err := os.ReadFile(serverCertFile)
+			if err != nil {
+				return nil, err
+			}
+			pool := x509.NewCertPool()
+			pool.AppendCertsFromPEM(caCert)
+			cert, err := tls.LoadX509KeyPair(agentCertFile, agentKeyFile)
+			if err != nil {
+				return nil, err
+			}
+			return credentials.NewTLS(&tls.Config{
+				RootCAs:      pool,
+				Certificates: []tls.Certificate{cert},
+				MinVersion:   tls.VersionTLS12,
+			}), nil
+		},
+	})
+	cs := cc.NewAgentClientSet(nil, make(chan struct{}))
+
+	// Each new client picks up the certificate on disk when it dials.
+	for _, commonName := range []string{"agent-before-rotation", "agent-after-rotation"} {
+		writeTestCert(t, commonName, agentCertFile, agentKeyFile)
+		c, _, err := cs.newAgentClient(cs.address)
+		if err != nil {
+			t.Fatalf("failed to connect with the certificate for %s: %v", commonName, err)
+		}
+		defer c.Close()
+		if got := <-ps.peers; got != commonName {
+			t.Errorf("expected the server to see certificate %q, got %q", commonName, got)
+		}
+	}
+	if reloads != 2 {
+		t.Errorf("expected credentials to be reloaded for each connection, got %d reloads", reloads)
+	}
+
+	// A failure to reload fails the connection attempt.
+	if err := os.Remove(agentKeyFile); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := cs.newAgentClient(cs.address); err == nil || !strings.Contains(err.Error(), "failed to reload transport credentials") {
+		t.Errorf("expected a reload error, got %v", err)
+	}
+}
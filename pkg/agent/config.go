@@ -0,0 +1,798 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/backoff"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/stats"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog/v2"
+	"k8s.io/utils/clock"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/agent/metrics"
+	"sigs.k8s.io/apiserver-network-proxy/proto/header"
+)
+
+type ClientSetConfig struct {
+	// Address is the proxy server address. It may list several addresses
+	// separated by commas, as a shorthand for Addresses.
+	Address string
+	// Addresses, if set, are the static addresses of the proxy servers in
+	// an HA setup without a load balancer, and Address is ignored. The sync
+	// loop spreads the connections over them, dialing an address with the
+	// fewest clients, so that it keeps one connection per address.
+	Addresses []string
+	// DNSSRVName, if set, is the name of DNS SRV records, such as
+	// _konnectivity._tcp.proxy.svc.cluster.local, listing the proxy
+	// servers. It overrides Address and Addresses: the servers are dialed
+	// in RFC 2782 order, and the records are looked up again every
+	// SyncInterval.
+	DNSSRVName       string
+	AgentID          string
+	AgentIdentifiers string
+	// AutoIdentifiers adds the pod topology from the POD_ZONE, POD_REGION
+	// and POD_NODE environment variables (typically set via the Downward
+	// API) to AgentIdentifiers. Explicit identifiers win on key conflicts.
+	AutoIdentifiers bool
+	SyncInterval    time.Duration
+	ProbeInterval   time.Duration
+	// FallbackAddress, if set, is a backup proxy server address, e.g. in
+	// another region, which the sync loop dials instead of Address after
+	// FallbackAfterFailures consecutive failed attempts. While it is in
+	// use, Address is probed every SyncIntervalCap, and used again as soon
+	// as a probe connects. The clients already connected are kept when
+	// switching either way. It cannot be combined with several addresses.
+	FallbackAddress string
+	// FallbackAfterFailures is the number of consecutive failed sync
+	// attempts after which FallbackAddress is used. Defaults to 3.
+	FallbackAfterFailures int
+	// ConnectTimeout, if set, bounds how long each connection attempt waits
+	// for the proxy server to accept the stream, so that a half-open
+	// network path fails the attempt, and the sync loop backs off, instead
+	// of blocking it. Zero means no limit.
+	ConnectTimeout  time.Duration
+	SyncIntervalCap time.Duration
+	// BackoffFactor is the multiplier applied to the sync interval after
+	// each failed attempt. Defaults to 1.5 when zero.
+	BackoffFactor float64
+	// BackoffJitter is the jitter applied to each backoff step. Defaults
+	// to 0.1 when zero.
+	BackoffJitter float64
+	// BackoffFn, if set, is called to build the sync loop backoff instead
+	// of SyncInterval, SyncIntervalCap, BackoffFactor and BackoffJitter.
+	BackoffFn func() *wait.Backoff
+	// RetryStrategy, if set, decides how long the sync loop waits after a
+	// failed attempt, instead of the exponential backoff. The wait after a
+	// successful attempt is unchanged.
+	RetryStrategy RetryStrategy
+	// ImmediateRetryOnCodes are the gRPC status codes of connection errors
+	// after which the sync loop retries at once instead of backing off,
+	// e.g. codes.Unavailable while a proxy server behind the address
+	// restarts. Only one attempt in a row is retried at once, so that an
+	// address which keeps failing with such a code is still backed off from.
+	ImmediateRetryOnCodes []codes.Code
+	// ServerPicker, if set, chooses the address the sync loop dials for
+	// each new connection. When nil, Address is always dialed.
+	ServerPicker ServerPicker
+	DialOptions  []grpc.DialOption
+	// KeepaliveTime, KeepaliveTimeout and KeepalivePermitWithoutStream
+	// configure the gRPC client keepalive. When all are unset no keepalive
+	// dial option is added; zero durations fall back to the gRPC defaults.
+	KeepaliveTime                time.Duration
+	KeepaliveTimeout             time.Duration
+	KeepalivePermitWithoutStream bool
+	ServiceAccountTokenPath      string
+	WarnOnChannelLimit           bool
+	// ChannelLimitBudget, if positive, is the number of times the data
+	// channel of a tunnel may be found full within ChannelLimitWindow
+	// while WarnOnChannelLimit is set. Exceeding it logs an error.
+	ChannelLimitBudget int
+	// ChannelLimitWindow is the rolling window of ChannelLimitBudget,
+	// defaulting to one minute.
+	ChannelLimitWindow time.Duration
+	// CloseOnChannelLimit closes a tunnel which exceeds ChannelLimitBudget,
+	// dropping the DATA packet which found its channel full.
+	CloseOnChannelLimit bool
+	// XfrChannelSize is the number of DATA packets buffered for each
+	// endpoint connection, defaulting to DefaultXfrChannelSize. Each packet
+	// may hold up to 32KiB, so the memory used by a busy tunnel grows with
+	// this value; it must be at most MaxXfrChannelSize.
+	XfrChannelSize int
+	SyncForever    bool
+	// MaxExcessConnections is the number of clients the sync loop tolerates
+	// above ServerCount, e.g. while connected to both old and new proxy
+	// servers during a rollout with SyncForever set. Beyond it, weak
+	// clients are removed first, then the oldest ones. Zero, the default,
+	// allows any excess and the clients are only removed once unhealthy.
+	MaxExcessConnections int
+	// DrainGracePeriod is how long a draining agent keeps existing endpoint
+	// connections open before closing its clients.
+	DrainGracePeriod time.Duration
+	// DrainTimeout is how long each client is given to finish its in-flight
+	// tunnels when the ClientSet shuts down. Zero closes clients immediately.
+	DrainTimeout time.Duration
+	// TransportProtocol is the transport used to reach the proxy server,
+	// either "tcp" (the default) or "unix". With "unix", Address is the
+	// absolute path of the proxy server's UNIX domain socket.
+	TransportProtocol string
+	// RandomizeDialOrder shuffles the addresses Address resolves to before
+	// each dial, so that agents started together do not all connect to the
+	// same proxy server first.
+	RandomizeDialOrder bool
+	// AddressFamilyPreference, if set to "ipv4" or "ipv6", dials the
+	// addresses of that family first when the host of Address resolves to
+	// both IPv4 and IPv6 addresses, falling back to the others. It only
+	// applies when TransportProtocol is "tcp". Empty keeps the gRPC default.
+	AddressFamilyPreference string
+	// InitialSyncDelay, if set, delays the first sync attempt by between
+	// one and two times its value, so that agents started together do not
+	// all connect at once.
+	InitialSyncDelay time.Duration
+	// GRPCConnectBackoff, if set, is the backoff gRPC uses between its own
+	// attempts to (re)connect the underlying transport of a client. It is
+	// independent of the sync loop backoff set by SyncInterval and
+	// SyncIntervalCap. The zero value keeps the gRPC default.
+	GRPCConnectBackoff backoff.Config
+	// StatsHandler, if set, is installed on each connection to the proxy
+	// server for RPC-level telemetry, e.g. a DefaultStatsHandler or an
+	// OpenTelemetry one. It is added to any stats handlers in DialOptions.
+	StatsHandler stats.Handler
+	// TracerProvider, if set, provides the tracer for the spans of the
+	// tunnels, instead of the global one. A tunnel span starts when the
+	// DIAL_REQ is received and ends when the tunnel closes. It is a child
+	// of the tunnel span of the proxy server, when the server propagates
+	// its trace context in the DIAL_REQ.
+	TracerProvider trace.TracerProvider
+	// DialOptionsForServer, if set, is called before dialing a server. The
+	// options it returns are appended to DialOptions, so they take
+	// precedence. serverID is the ID of the server expected at address:
+	// the one requested by ConnectToServer or Rehash or, of several static
+	// Addresses, the one last connected through address. It is empty when
+	// the server is not known, e.g. behind a load balancer address.
+	DialOptionsForServer func(serverID, address string) []grpc.DialOption
+	// CredentialsReloader, if set, is called before dialing each new
+	// connection, and the transport credentials it returns replace any set
+	// by DialOptions. It lets the agent pick up rotated certificates without
+	// a restart; established connections keep their credentials until they
+	// reconnect. An error fails the connection attempt.
+	CredentialsReloader func() (credentials.TransportCredentials, error)
+	// TLSCertFile and TLSKeyFile, if set, are the paths of the client
+	// certificate and key for mutual TLS with the proxy server. They are
+	// loaded again for each new connection, so that a certificate rotated on
+	// disk, e.g. by cert-manager, is used without restarting the agent;
+	// established connections keep their certificate until they reconnect.
+	// The TLS credentials they are used with replace any set by DialOptions.
+	TLSCertFile string
+	TLSKeyFile  string
+	// TLSConfig is the TLS configuration used with TLSCertFile and
+	// TLSKeyFile, e.g. with the RootCAs and ServerName to verify the proxy
+	// server. Its Certificates are ignored.
+	TLSConfig *tls.Config
+	// TLSCertWatchInterval is how often TLSCertFile and TLSKeyFile are
+	// checked for changes, which are logged. Defaults to a minute.
+	TLSCertWatchInterval time.Duration
+	// SharedConnPool, if set, is the pool clients borrow their connection
+	// to the proxy server from, instead of dialing their own. ClientSets
+	// sharing a pool, e.g. for different agent IDs, share connections to
+	// the same address; each connection is dialed with the options of the
+	// ClientSet which first borrows it.
+	SharedConnPool *ConnPool
+	// MetricsRegistry, if set, is the registry the agent metrics of the
+	// ClientSet are registered with, instead of the default one, e.g. to
+	// isolate the metrics of tests or tenants. ClientSets sharing a registry
+	// share their metrics.
+	MetricsRegistry prometheus.Registerer
+	// CircuitBreaker configures a circuit breaker for each address the sync
+	// loop connects to. While a breaker is open, the sync loop does not try
+	// to connect to its address and fails with a CircuitOpenError. The zero
+	// value disables the breakers.
+	CircuitBreaker CircuitBreakerConfig
+	// UnhealthyTimeout is how long a client's connection may stay in a
+	// non-Ready state before the client is closed and removed. Clients whose
+	// connection has shut down are removed at the next check. Checks run
+	// every ProbeInterval. Zero disables the check.
+	UnhealthyTimeout time.Duration
+	// ServerLeaseCounter, if set, is used to count the proxy servers
+	// instead of the server count they report, once it is ready.
+	ServerLeaseCounter *ServerLeaseCounter
+	// ServerCountChangeHandler, if set, is called with the old and new
+	// values whenever ServerCount returns a different value than it last
+	// did. It is called without holding the ClientSet lock, but calls may
+	// race when ServerCount is called concurrently.
+	ServerCountChangeHandler func(old, new int)
+	// PacketObserver, if set, is called by each client with every packet
+	// it sends to or receives from its proxy server, for debugging tunnels.
+	PacketObserver PacketObserver
+	// MaxClients caps the number of clients the ClientSet opens, regardless
+	// of the server count reported by the proxy servers. Zero means
+	// unlimited.
+	MaxClients int
+	// MaxTunnelsPerClient caps the number of tunnels open on each client.
+	// Dial requests beyond it are rejected so that the proxy server picks
+	// another agent. Zero means unlimited.
+	MaxTunnelsPerClient int
+	// MaxTunnelsPerSecond caps the rate at which each client accepts new
+	// tunnels, with bursts of up to MaxTunnelsPerSecond. Dial requests
+	// beyond it are rejected with a TunnelRateLimitedError, or delayed if
+	// BlockOnTunnelLimit is set. Zero means unlimited.
+	MaxTunnelsPerSecond int
+	// BlockOnTunnelLimit delays the dial requests beyond MaxTunnelsPerSecond
+	// until the rate allows them, instead of rejecting them.
+	BlockOnTunnelLimit bool
+	// MaxConnectAttempts is the number of consecutive connection failures
+	// after which a server is marked permanently failed and no longer
+	// reconnected to, until cleared with ClearFailedServer. Failures are
+	// counted by server ID, when the connection to a server is found broken,
+	// and reset when a client for the server is added. Failed dials, before
+	// a server is reached, are left to the backoff and circuit breakers.
+	// Zero retries forever.
+	MaxConnectAttempts int
+	// MinHealthyFraction is the fraction of the reported server count which
+	// must be connected for Status to report Running rather than Degraded.
+	// Must be in (0, 1]; defaults to 1.
+	MinHealthyFraction float64
+	// Logger is used for the log lines of the ClientSet and its clients.
+	// Defaults to klog.Background().
+	Logger klog.Logger
+	// TokenRefreshInterval, if set, is how often ServiceAccountTokenPath is
+	// checked for a rotated token. When the token changes, the existing
+	// connections are drained and re-established with the new token.
+	// Zero disables the check; new connections still read the current token,
+	// as set by TokenCacheTTL.
+	TokenRefreshInterval time.Duration
+	// TokenCacheTTL is how long a token read from ServiceAccountTokenPath
+	// for a new connection is reused for later connections, to avoid reading
+	// the file on every attempt while the sync loop retries quickly. Zero
+	// reads the token for every connection.
+	TokenCacheTTL time.Duration
+	// IdleConnectionThreshold, if set, is how long a client may go without
+	// sending or receiving data before it is counted in the
+	// idle_server_connections metric. Zero disables the metric.
+	IdleConnectionThreshold time.Duration
+	// HeartbeatInterval, if set, is how often Heartbeat is called once the
+	// ClientSet is serving. Zero disables the heartbeats.
+	HeartbeatInterval time.Duration
+	// KubeEventRecorder, if set, emits an AgentUnhealthy Warning event
+	// when the agent loses its last Ready connection, and an AgentHealthy
+	// Normal event when it recovers. Events are recorded against
+	// PodReference.
+	KubeEventRecorder record.EventRecorder
+	// PodReference is the agent's pod. Defaults to the pod described by
+	// the POD_NAME, POD_NAMESPACE and POD_UID environment variables.
+	PodReference *corev1.ObjectReference
+}
+
+// Reasons of the events emitted through ClientSetConfig.KubeEventRecorder.
+const (
+	EventReasonAgentUnhealthy = "AgentUnhealthy"
+	EventReasonAgentHealthy   = "AgentHealthy"
+)
+
+// WithTaggedLogger sets Logger to a klog.Background() logger which prepends
+// the given tags, in key order, to every log line. This distinguishes the
+// log output of multiple agents running in the same process.
+func (cc *ClientSetConfig) WithTaggedLogger(tags map[string]string) *ClientSetConfig {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	kvs := make([]interface{}, 0, 2*len(keys))
+	for _, k := range keys {
+		kvs = append(kvs, k, tags[k])
+	}
+	cc.Logger = klog.Background().WithValues(kvs...)
+	return cc
+}
+
+const (
+	defaultBackoffFactor = 1.5
+	defaultBackoffJitter = 0.1
+
+	defaultMinHealthyFraction = 1.0
+
+	// defaultGRPCMinConnectTimeout is the gRPC default, which
+	// grpc.WithConnectParams would otherwise reset to zero.
+	defaultGRPCMinConnectTimeout = 20 * time.Second
+
+	// xfrChannelSizeWarnThreshold is the XfrChannelSize above which a
+	// warning about memory usage is logged.
+	xfrChannelSizeWarnThreshold = 1024
+
+	defaultChannelLimitWindow = time.Minute
+
+	defaultTLSCertWatchInterval = time.Minute
+
+	defaultFallbackAfterFailures = 3
+
+	// defaultWaitForHealthyInterval is how often WaitForHealthy checks
+	// when ProbeInterval is not set.
+	defaultWaitForHealthyInterval = time.Second
+)
+
+// Bounds of ClientSetConfig.XfrChannelSize.
+const (
+	DefaultXfrChannelSize = 10
+	MaxXfrChannelSize     = 65535
+)
+
+// Transport protocols supported by ClientSetConfig.TransportProtocol.
+const (
+	TransportTCP  = "tcp"
+	TransportUnix = "unix"
+)
+
+// shuffleAddressListServiceConfig makes the pick_first balancer shuffle the
+// resolved addresses before connecting.
+const shuffleAddressListServiceConfig = `{"loadBalancingConfig": [{"pick_first": {"shuffleAddressList": true}}]}`
+
+// Validate checks that the required fields are set and that the fields are
+// consistent with each other. All violations are reported together. It only
+// checks the shape of the config; files such as ServiceAccountTokenPath are
+// checked by NewAgentClientSetChecked.
+func (cc *ClientSetConfig) Validate() error {
+	var errs []error
+	if cc.AgentID == "" {
+		errs = append(errs, fmt.Errorf("AgentID must not be empty"))
+	}
+	if err := ValidateAgentIdentifiers(cc.AgentIdentifiers); err != nil {
+		errs = append(errs, fmt.Errorf("AgentIdentifiers is invalid: %w", err))
+	}
+	switch cc.TransportProtocol {
+	case "", TransportTCP:
+		for _, address := range cc.addresses() {
+			if err := validateAddress(address); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	case TransportUnix:
+		for _, address := range cc.addresses() {
+			if !filepath.IsAbs(address) {
+				errs = append(errs, fmt.Errorf("Address %q must be an absolute socket path when TransportProtocol is %q", address, TransportUnix))
+			}
+		}
+	default:
+		errs = append(errs, fmt.Errorf("TransportProtocol must be %q or %q, got %q", TransportTCP, TransportUnix, cc.TransportProtocol))
+	}
+	if cc.DNSSRVName != "" && cc.TransportProtocol == TransportUnix {
+		errs = append(errs, fmt.Errorf("DNSSRVName must not be set when TransportProtocol is %q", TransportUnix))
+	}
+	if err := validateAddressFamily(cc.AddressFamilyPreference); err != nil {
+		errs = append(errs, err)
+	}
+	if cc.SyncInterval <= 0 {
+		errs = append(errs, fmt.Errorf("SyncInterval must be positive, got %v", cc.SyncInterval))
+	}
+	if cc.GRPCConnectBackoff != (backoff.Config{}) {
+		b := cc.GRPCConnectBackoff
+		if b.BaseDelay <= 0 {
+			errs = append(errs, fmt.Errorf("GRPCConnectBackoff.BaseDelay must be positive, got %v", b.BaseDelay))
+		}
+		if b.MaxDelay < b.BaseDelay {
+			errs = append(errs, fmt.Errorf("GRPCConnectBackoff.MaxDelay (%v) must not be less than BaseDelay (%v)", b.MaxDelay, b.BaseDelay))
+		}
+		if b.Multiplier < 1 {
+			errs = append(errs, fmt.Errorf("GRPCConnectBackoff.Multiplier must be at least 1, got %v", b.Multiplier))
+		}
+		if b.Jitter < 0 || b.Jitter > 1 {
+			errs = append(errs, fmt.Errorf("GRPCConnectBackoff.Jitter must be between 0 and 1, got %v", b.Jitter))
+		}
+	}
+	if cc.SyncIntervalCap < cc.SyncInterval {
+		errs = append(errs, fmt.Errorf("SyncIntervalCap (%v) must not be less than SyncInterval (%v)", cc.SyncIntervalCap, cc.SyncInterval))
+	}
+	if cc.ConnectTimeout < 0 {
+		errs = append(errs, fmt.Errorf("ConnectTimeout must not be negative, got %v", cc.ConnectTimeout))
+	}
+	if cc.ProbeInterval < 0 {
+		errs = append(errs, fmt.Errorf("ProbeInterval must not be negative, got %v", cc.ProbeInterval))
+	}
+	if cc.DrainGracePeriod < 0 {
+		errs = append(errs, fmt.Errorf("DrainGracePeriod must not be negative, got %v", cc.DrainGracePeriod))
+	}
+	if cc.DrainTimeout < 0 {
+		errs = append(errs, fmt.Errorf("DrainTimeout must not be negative, got %v", cc.DrainTimeout))
+	}
+	if cc.InitialSyncDelay < 0 {
+		errs = append(errs, fmt.Errorf("InitialSyncDelay must not be negative, got %v", cc.InitialSyncDelay))
+	}
+	if cb := cc.CircuitBreaker; cb.FailureThreshold < 0 || cb.SuccessThreshold < 0 || cb.OpenDuration < 0 {
+		errs = append(errs, fmt.Errorf("CircuitBreaker thresholds and OpenDuration must not be negative, got %+v", cb))
+	}
+	if cc.HeartbeatInterval < 0 {
+		errs = append(errs, fmt.Errorf("HeartbeatInterval must not be negative, got %v", cc.HeartbeatInterval))
+	}
+	if cc.UnhealthyTimeout < 0 {
+		errs = append(errs, fmt.Errorf("UnhealthyTimeout must not be negative, got %v", cc.UnhealthyTimeout))
+	}
+	if cc.TokenRefreshInterval < 0 {
+		errs = append(errs, fmt.Errorf("TokenRefreshInterval must not be negative, got %v", cc.TokenRefreshInterval))
+	}
+	if (cc.TLSCertFile == "") != (cc.TLSKeyFile == "") {
+		errs = append(errs, fmt.Errorf("TLSCertFile and TLSKeyFile must be set together"))
+	}
+	if cc.TLSCertFile != "" && cc.CredentialsReloader != nil {
+		errs = append(errs, fmt.Errorf("TLSCertFile must not be set together with CredentialsReloader"))
+	}
+	for _, code := range cc.ImmediateRetryOnCodes {
+		if code == codes.OK {
+			errs = append(errs, fmt.Errorf("ImmediateRetryOnCodes must not contain %v", code))
+		}
+	}
+	if cc.TLSCertWatchInterval < 0 {
+		errs = append(errs, fmt.Errorf("TLSCertWatchInterval must not be negative, got %v", cc.TLSCertWatchInterval))
+	}
+	if cc.TokenCacheTTL < 0 {
+		errs = append(errs, fmt.Errorf("TokenCacheTTL must not be negative, got %v", cc.TokenCacheTTL))
+	}
+	if cc.XfrChannelSize < 0 || cc.XfrChannelSize > MaxXfrChannelSize {
+		errs = append(errs, fmt.Errorf("XfrChannelSize must be between 1 and %d, or 0 for the default, got %d", MaxXfrChannelSize, cc.XfrChannelSize))
+	}
+	if cc.IdleConnectionThreshold < 0 {
+		errs = append(errs, fmt.Errorf("IdleConnectionThreshold must not be negative, got %v", cc.IdleConnectionThreshold))
+	}
+	if cc.UnhealthyTimeout > 0 && cc.ProbeInterval <= 0 {
+		errs = append(errs, fmt.Errorf("ProbeInterval must be positive when UnhealthyTimeout is set"))
+	}
+	if cc.MaxClients < 0 {
+		errs = append(errs, fmt.Errorf("MaxClients must not be negative, got %d", cc.MaxClients))
+	}
+	if cc.ChannelLimitBudget < 0 {
+		errs = append(errs, fmt.Errorf("ChannelLimitBudget must not be negative, got %d", cc.ChannelLimitBudget))
+	}
+	if cc.ChannelLimitWindow < 0 {
+		errs = append(errs, fmt.Errorf("ChannelLimitWindow must not be negative, got %v", cc.ChannelLimitWindow))
+	}
+	if cc.MaxExcessConnections < 0 {
+		errs = append(errs, fmt.Errorf("MaxExcessConnections must not be negative, got %d", cc.MaxExcessConnections))
+	}
+	if cc.MaxTunnelsPerClient < 0 {
+		errs = append(errs, fmt.Errorf("MaxTunnelsPerClient must not be negative, got %d", cc.MaxTunnelsPerClient))
+	}
+	if cc.FallbackAfterFailures < 0 {
+		errs = append(errs, fmt.Errorf("FallbackAfterFailures must not be negative, got %d", cc.FallbackAfterFailures))
+	}
+	if cc.FallbackAddress != "" {
+		if addresses := cc.addresses(); len(addresses) > 1 {
+			errs = append(errs, fmt.Errorf("FallbackAddress must not be set together with several addresses"))
+		} else if len(addresses) == 1 && cc.FallbackAddress == addresses[0] {
+			errs = append(errs, fmt.Errorf("FallbackAddress must differ from Address, got %q", cc.FallbackAddress))
+		}
+	}
+	if cc.MaxTunnelsPerSecond < 0 {
+		errs = append(errs, fmt.Errorf("MaxTunnelsPerSecond must not be negative, got %d", cc.MaxTunnelsPerSecond))
+	}
+	if cc.MaxConnectAttempts < 0 {
+		errs = append(errs, fmt.Errorf("MaxConnectAttempts must not be negative, got %d", cc.MaxConnectAttempts))
+	}
+	return errors.Join(errs...)
+}
+
+// dialUnix connects to the UNIX domain socket at path.
+func dialUnix(ctx context.Context, path string) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, TransportUnix, path)
+}
+
+// addresses returns Addresses or, if it is empty, the addresses listed in
+// Address.
+func (cc *ClientSetConfig) addresses() []string {
+	if cc.DNSSRVName != "" {
+		return []string{srvScheme + ":///" + cc.DNSSRVName}
+	}
+	if len(cc.Addresses) > 0 {
+		return cc.Addresses
+	}
+	addresses := strings.Split(cc.Address, ",")
+	for i := range addresses {
+		addresses[i] = strings.TrimSpace(addresses[i])
+	}
+	return addresses
+}
+
+// validateAddress checks that address is either a host:port or a gRPC
+// target URI such as dns:///host:port.
+func validateAddress(address string) error {
+	if strings.Contains(address, "://") {
+		if u, err := url.Parse(address); err != nil || u.Scheme == "" {
+			return fmt.Errorf("Address %q is not a valid target URI", address)
+		}
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		if strings.Count(address, ":") > 1 && !strings.HasPrefix(address, "[") {
+			return fmt.Errorf("Address %q is not a valid host:port, IPv6 literals must be bracketed as in [2001:db8::1]:8091: %v", address, err)
+		}
+		return fmt.Errorf("Address %q is not a valid host:port: %v", address, err)
+	}
+	return nil
+}
+
+// NewAgentClientSet creates a ClientSet from the config. It panics if the
+// config is invalid; use NewAgentClientSetChecked to handle the error instead.
+//
+// Deprecated: closing stopCh stops the ClientSet without a way to wait for
+// the shutdown to complete. Use NewAgentClientSetChecked with a nil stopCh,
+// and Stop the ClientSet instead.
+func (cc *ClientSetConfig) NewAgentClientSet(drainCh, stopCh <-chan struct{}) *ClientSet {
+	if err := cc.Validate(); err != nil {
+		panic(fmt.Sprintf("invalid ClientSetConfig: %v", err))
+	}
+	return cc.newAgentClientSet(drainCh, stopCh)
+}
+
+// NewAgentClientSetChecked creates a ClientSet from the config, or returns
+// the Validate error if the config is invalid. It also returns an error if
+// ServiceAccountTokenPath is set but cannot be read.
+func (cc *ClientSetConfig) NewAgentClientSetChecked(drainCh, stopCh <-chan struct{}) (*ClientSet, error) {
+	if err := cc.Validate(); err != nil {
+		return nil, err
+	}
+	if cc.ServiceAccountTokenPath != "" {
+		f, err := os.Open(cc.ServiceAccountTokenPath)
+		if err != nil {
+			return nil, fmt.Errorf("ServiceAccountTokenPath %q is not readable: %v", cc.ServiceAccountTokenPath, err)
+		}
+		f.Close()
+	}
+	return cc.newAgentClientSet(drainCh, stopCh), nil
+}
+
+func (cc *ClientSetConfig) newAgentClientSet(drainCh, stopCh <-chan struct{}) *ClientSet {
+	logger := cc.Logger
+	if logger.GetSink() == nil {
+		logger = klog.Background()
+	}
+	backoffFactor := cc.BackoffFactor
+	if backoffFactor == 0 {
+		backoffFactor = defaultBackoffFactor
+	} else if backoffFactor < 1 {
+		logger.Info("BackoffFactor must be at least 1, using default", "backoffFactor", backoffFactor, "default", defaultBackoffFactor)
+		backoffFactor = defaultBackoffFactor
+	}
+	backoffJitter := cc.BackoffJitter
+	if backoffJitter == 0 {
+		backoffJitter = defaultBackoffJitter
+	} else if backoffJitter < 0 {
+		logger.Info("BackoffJitter must not be negative, using default", "backoffJitter", backoffJitter, "default", defaultBackoffJitter)
+		backoffJitter = defaultBackoffJitter
+	}
+	minHealthyFraction := cc.MinHealthyFraction
+	if minHealthyFraction == 0 {
+		minHealthyFraction = defaultMinHealthyFraction
+	} else if minHealthyFraction < 0 || minHealthyFraction > 1 {
+		logger.Info("MinHealthyFraction must be in (0, 1], using default", "minHealthyFraction", minHealthyFraction, "default", defaultMinHealthyFraction)
+		minHealthyFraction = defaultMinHealthyFraction
+	}
+	xfrChannelSize := cc.XfrChannelSize
+	if xfrChannelSize == 0 {
+		xfrChannelSize = DefaultXfrChannelSize
+	} else if xfrChannelSize > xfrChannelSizeWarnThreshold {
+		logger.Info("XfrChannelSize is large, each tunnel may buffer a lot of memory", "xfrChannelSize", xfrChannelSize, "threshold", xfrChannelSizeWarnThreshold)
+	}
+	channelLimitWindow := cc.ChannelLimitWindow
+	if channelLimitWindow <= 0 {
+		channelLimitWindow = defaultChannelLimitWindow
+	}
+	tlsCertWatchInterval := cc.TLSCertWatchInterval
+	if tlsCertWatchInterval <= 0 {
+		tlsCertWatchInterval = defaultTLSCertWatchInterval
+	}
+	fallbackAfterFailures := cc.FallbackAfterFailures
+	if fallbackAfterFailures <= 0 {
+		fallbackAfterFailures = defaultFallbackAfterFailures
+	}
+	if cc.ChannelLimitBudget > 0 && !cc.WarnOnChannelLimit {
+		logger.Info("ChannelLimitBudget has no effect unless WarnOnChannelLimit is set", "channelLimitBudget", cc.ChannelLimitBudget)
+	}
+	agentIdentifiers := cc.AgentIdentifiers
+	if cc.AutoIdentifiers {
+		agentIdentifiers = withTopologyIdentifiers(logger, agentIdentifiers)
+	}
+	dialOptions := cc.DialOptions
+	if cc.KeepaliveTime != 0 || cc.KeepaliveTimeout != 0 || cc.KeepalivePermitWithoutStream {
+		// Prepend so that an explicit keepalive in DialOptions still wins.
+		dialOptions = append([]grpc.DialOption{grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:                cc.KeepaliveTime,
+			Timeout:             cc.KeepaliveTimeout,
+			PermitWithoutStream: cc.KeepalivePermitWithoutStream,
+		})}, cc.DialOptions...)
+	}
+	if cc.DNSSRVName != "" {
+		dialOptions = append([]grpc.DialOption{grpc.WithResolvers(&srvResolverBuilder{lookup: lookupSRV, refresh: cc.SyncInterval})}, dialOptions...)
+	}
+	if cc.TransportProtocol == TransportUnix {
+		// Prepend so that an explicit dialer in DialOptions still wins.
+		dialOptions = append([]grpc.DialOption{grpc.WithContextDialer(dialUnix)}, dialOptions...)
+	} else if cc.AddressFamilyPreference != AddressFamilyAny {
+		// Prepend so that an explicit dialer in DialOptions still wins.
+		fd := &familyDialer{preference: cc.AddressFamilyPreference}
+		dialOptions = append([]grpc.DialOption{grpc.WithContextDialer(fd.dial)}, dialOptions...)
+	}
+	if cc.StatsHandler != nil {
+		dialOptions = append([]grpc.DialOption{grpc.WithStatsHandler(cc.StatsHandler)}, dialOptions...)
+	}
+	if cc.GRPCConnectBackoff != (backoff.Config{}) {
+		// Prepend so that explicit connect params in DialOptions still win.
+		dialOptions = append([]grpc.DialOption{grpc.WithConnectParams(grpc.ConnectParams{
+			Backoff:           cc.GRPCConnectBackoff,
+			MinConnectTimeout: defaultGRPCMinConnectTimeout,
+		})}, dialOptions...)
+	}
+	if cc.RandomizeDialOrder {
+		// Prepend so that an explicit service config in DialOptions still wins.
+		dialOptions = append([]grpc.DialOption{grpc.WithDefaultServiceConfig(shuffleAddressListServiceConfig)}, dialOptions...)
+	}
+	agentMetrics, err := metrics.ForRegistry(cc.MetricsRegistry)
+	if err != nil {
+		logger.Error(err, "Failed to register the agent metrics with MetricsRegistry, using the default registry")
+		agentMetrics = metrics.Metrics
+	}
+	addresses := append([]string(nil), cc.addresses()...)
+	if cc.TransportProtocol != TransportUnix {
+		for i := range addresses {
+			addresses[i] = normalizeAddress(addresses[i])
+		}
+	}
+	cs := &ClientSet{
+		clients:                  make(map[string]*Client),
+		agentID:                  cc.AgentID,
+		agentIdentifiers:         agentIdentifiers,
+		address:                  addresses[0],
+		addresses:                addresses,
+		primaryAddress:           addresses[0],
+		fallbackAddress:          cc.FallbackAddress,
+		fallbackAfterFailures:    fallbackAfterFailures,
+		syncInterval:             cc.SyncInterval,
+		probeInterval:            cc.ProbeInterval,
+		connectTimeout:           cc.ConnectTimeout,
+		syncIntervalCap:          cc.SyncIntervalCap,
+		backoffFactor:            backoffFactor,
+		backoffJitter:            backoffJitter,
+		backoffFn:                cc.BackoffFn,
+		retryStrategy:            cc.RetryStrategy,
+		immediateRetryCodes:      append([]codes.Code(nil), cc.ImmediateRetryOnCodes...),
+		serverPicker:             cc.ServerPicker,
+		dialOptions:              dialOptions,
+		dialOptionsForServer:     cc.DialOptionsForServer,
+		credentialsReloader:      cc.CredentialsReloader,
+		tlsCertFile:              cc.TLSCertFile,
+		tlsKeyFile:               cc.TLSKeyFile,
+		tlsConfig:                cc.TLSConfig,
+		tlsCertWatchInterval:     tlsCertWatchInterval,
+		connPool:                 cc.SharedConnPool,
+		circuitBreakerConfig:     cc.CircuitBreaker,
+		serviceAccountTokenPath:  cc.ServiceAccountTokenPath,
+		warnOnChannelLimit:       cc.WarnOnChannelLimit,
+		channelLimit:             channelLimit{budget: cc.ChannelLimitBudget, window: channelLimitWindow, closeTunnel: cc.CloseOnChannelLimit},
+		xfrChannelSize:           xfrChannelSize,
+		syncForever:              cc.SyncForever,
+		maxExcessConnections:     cc.MaxExcessConnections,
+		stopCh:                   stopCh,
+		drainCh:                  drainCh,
+		drainGracePeriod:         cc.DrainGracePeriod,
+		drainTimeout:             cc.DrainTimeout,
+		initialSyncDelay:         cc.InitialSyncDelay,
+		clientExitCh:             make(chan struct{}, 1),
+		maxClients:               cc.MaxClients,
+		maxTunnelsPerClient:      cc.MaxTunnelsPerClient,
+		maxTunnelsPerSecond:      cc.MaxTunnelsPerSecond,
+		blockOnTunnelLimit:       cc.BlockOnTunnelLimit,
+		tracerProvider:           cc.TracerProvider,
+		leaseCounter:             cc.ServerLeaseCounter,
+		serverCountChangeHandler: cc.ServerCountChangeHandler,
+		packetObserver:           cc.PacketObserver,
+		unhealthyTimeout:         cc.UnhealthyTimeout,
+		idleThreshold:            cc.IdleConnectionThreshold,
+		heartbeatInterval:        cc.HeartbeatInterval,
+		tokenRefreshInterval:     cc.TokenRefreshInterval,
+		tokenCacheTTL:            cc.TokenCacheTTL,
+		maxConnectAttempts:       cc.MaxConnectAttempts,
+		serverFailures:           make(map[string]int),
+		minHealthyFraction:       minHealthyFraction,
+		logger:                   logger,
+		clock:                    clock.RealClock{},
+		metrics:                  agentMetrics,
+		config:                   *cc,
+	}
+	cs.initTLSCredentials()
+	if cc.KubeEventRecorder != nil {
+		podRef := cc.PodReference
+		if podRef == nil {
+			podRef = podReferenceFromEnv()
+		}
+		if podRef == nil {
+			logger.Info("KubeEventRecorder is set but the pod is unknown, not emitting events; set POD_NAME and POD_NAMESPACE")
+		} else {
+			cs.eventRecorder = cc.KubeEventRecorder
+			cs.podRef = podRef
+			cs.OnHealthyCountChange(cs.recordHealthEvent)
+		}
+	}
+	return cs
+}
+
+// podReferenceFromEnv returns a reference to the pod described by the
+// Downward API environment variables, or nil if they are not set.
+func podReferenceFromEnv() *corev1.ObjectReference {
+	name, namespace := os.Getenv("POD_NAME"), os.Getenv("POD_NAMESPACE")
+	if name == "" || namespace == "" {
+		return nil
+	}
+	return &corev1.ObjectReference{
+		Kind:       "Pod",
+		APIVersion: "v1",
+		Name:       name,
+		Namespace:  namespace,
+		UID:        types.UID(os.Getenv("POD_UID")),
+	}
+}
+
+// topologyEnvVars maps the Downward API environment variables read when
+// AutoIdentifiers is set to the identifier type they populate.
+var topologyEnvVars = []struct {
+	env    string
+	idType header.IdentifierType
+}{
+	{"POD_ZONE", header.Zone},
+	{"POD_REGION", header.Region},
+	{"POD_NODE", header.Node},
+}
+
+// withTopologyIdentifiers merges the pod topology found in the environment
+// into the URL encoded agentIdentifiers. Keys already present in
+// agentIdentifiers are left untouched.
+func withTopologyIdentifiers(logger klog.Logger, agentIdentifiers string) string {
+	idents, err := url.ParseQuery(agentIdentifiers)
+	if err != nil {
+		logger.Error(err, "failed to parse agent identifiers, skipping topology identifiers", "agentIdentifiers", agentIdentifiers)
+		return agentIdentifiers
+	}
+	added := false
+	for _, tv := range topologyEnvVars {
+		value := os.Getenv(tv.env)
+		if value == "" || idents.Has(string(tv.idType)) {
+			continue
+		}
+		idents.Set(string(tv.idType), value)
+		added = true
+	}
+	if !added {
+		return agentIdentifiers
+	}
+	return idents.Encode()
+}
@@ -0,0 +1,440 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"bytes"
+	"context"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/backoff"
+	"google.golang.org/grpc/credentials/insecure"
+	"k8s.io/klog/v2"
+)
+
+func TestNewAgentClientSet_Keepalive(t *testing.T) {
+	dialOptions := []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}
+	testCases := []struct {
+		name     string
+		cc       ClientSetConfig
+		expected int
+	}{
+		{
+			name:     "unset",
+			cc:       ClientSetConfig{DialOptions: dialOptions},
+			expected: 1,
+		},
+		{
+			name:     "time",
+			cc:       ClientSetConfig{DialOptions: dialOptions, KeepaliveTime: time.Minute},
+			expected: 2,
+		},
+		{
+			name:     "permit without stream",
+			cc:       ClientSetConfig{DialOptions: dialOptions, KeepalivePermitWithoutStream: true},
+			expected: 2,
+		},
+		{
+			name:     "grpc connect backoff",
+			cc:       ClientSetConfig{DialOptions: dialOptions, GRPCConnectBackoff: backoff.DefaultConfig},
+			expected: 2,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cs := withTestDefaults(&tc.cc).NewAgentClientSet(nil, make(chan struct{}))
+			if got := len(cs.dialOptions); got != tc.expected {
+				t.Errorf("expected %d dial options, got %d", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestWithTopologyIdentifiers(t *testing.T) {
+	t.Setenv("POD_ZONE", "us-east1-b")
+	t.Setenv("POD_REGION", "us-east1")
+	t.Setenv("POD_NODE", "")
+
+	testCases := []struct {
+		name     string
+		explicit string
+		expected string
+	}{
+		{
+			name:     "empty",
+			expected: "region=us-east1&zone=us-east1-b",
+		},
+		{
+			name:     "merged",
+			explicit: "host=node1",
+			expected: "host=node1&region=us-east1&zone=us-east1-b",
+		},
+		{
+			name:     "explicit wins",
+			explicit: "zone=override",
+			expected: "region=us-east1&zone=override",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cc := withTestDefaults(&ClientSetConfig{AgentIdentifiers: tc.explicit, AutoIdentifiers: true})
+			if got := cc.NewAgentClientSet(nil, make(chan struct{})).agentIdentifiers; got != tc.expected {
+				t.Errorf("expected agent identifiers %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestWithTaggedLogger(t *testing.T) {
+	var buf bytes.Buffer
+	klog.LogToStderr(false)
+	klog.SetOutput(&buf)
+	defer func() {
+		klog.SetOutput(os.Stderr)
+		klog.LogToStderr(true)
+	}()
+	// logLine returns the first line logged containing msg.
+	logLine := func(msg string) string {
+		t.Helper()
+		klog.Flush()
+		for _, line := range strings.Split(buf.String(), "\n") {
+			if strings.Contains(line, msg) {
+				return line
+			}
+		}
+		t.Fatalf("expected a log line containing %q, got %q", msg, buf.String())
+		return ""
+	}
+	const tags = `cluster="c1" tenant="customer-a"`
+
+	cs := withTestDefaults(&ClientSetConfig{
+		Address:       newTestProxyServer(t, "server1", 1),
+		DialOptions:   []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())},
+		BackoffFactor: 0.5,
+	}).WithTaggedLogger(map[string]string{"tenant": "customer-a", "cluster": "c1"}).NewAgentClientSet(nil, make(chan struct{}))
+
+	if line := logLine("BackoffFactor must be at least 1"); !strings.Contains(line, tags) {
+		t.Errorf("expected the ClientSet log line to have the tags %s, got %q", tags, line)
+	}
+
+	// The clients log through the ClientSet's logger.
+	c, err := cs.dialServer(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.conn.Close()
+	c.Close()
+	if line := logLine("failed to close gRPC connection"); !strings.Contains(line, tags) {
+		t.Errorf("expected the client log line to have the tags %s, got %q", tags, line)
+	}
+}
+
+func TestClientSetConfig_Addresses(t *testing.T) {
+	testCases := []struct {
+		name     string
+		cc       ClientSetConfig
+		expected []string
+	}{
+		{
+			name:     "address",
+			cc:       ClientSetConfig{Address: "proxy:8091"},
+			expected: []string{"proxy:8091"},
+		},
+		{
+			name:     "comma-separated address",
+			cc:       ClientSetConfig{Address: "proxy-0:8091, proxy-1:8091"},
+			expected: []string{"proxy-0:8091", "proxy-1:8091"},
+		},
+		{
+			name:     "addresses take precedence",
+			cc:       ClientSetConfig{Address: "proxy:8091", Addresses: []string{"proxy-0:8091", "proxy-1:8091"}},
+			expected: []string{"proxy-0:8091", "proxy-1:8091"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.cc.addresses(); !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("expected addresses %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestClientSetConfigValidate(t *testing.T) {
+	tokenPath := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenPath, []byte("token"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		name     string
+		cc       ClientSetConfig
+		expected []string
+	}{
+		{
+			name: "valid",
+			cc:   ClientSetConfig{AgentID: "agent1", Address: "localhost:8091", SyncInterval: time.Second, SyncIntervalCap: 10 * time.Second},
+		},
+		{
+			name:     "empty",
+			cc:       ClientSetConfig{},
+			expected: []string{"AgentID", "Address", "SyncInterval must be positive"},
+		},
+		{
+			name: "target URI",
+			cc:   ClientSetConfig{AgentID: "agent1", Address: "dns:///localhost:8091", SyncInterval: time.Second, SyncIntervalCap: time.Second},
+		},
+		{
+			name: "unix socket",
+			cc:   ClientSetConfig{AgentID: "agent1", Address: "/run/konnectivity.sock", TransportProtocol: TransportUnix, SyncInterval: time.Second, SyncIntervalCap: time.Second},
+		},
+		{
+			name: "addresses",
+			cc:   ClientSetConfig{AgentID: "agent1", Addresses: []string{"proxy-0:8091", "proxy-1:8091"}, SyncInterval: time.Second, SyncIntervalCap: time.Second},
+		},
+		{
+			name:     "comma-separated address",
+			cc:       ClientSetConfig{AgentID: "agent1", Address: "proxy-0:8091, proxy-1", SyncInterval: time.Second, SyncIntervalCap: time.Second},
+			expected: []string{"proxy-1"},
+		},
+		{
+			name: "dns srv name",
+			cc:   ClientSetConfig{AgentID: "agent1", DNSSRVName: "_konnectivity._tcp.proxy.example", SyncInterval: time.Second, SyncIntervalCap: time.Second},
+		},
+		{
+			name: "dns srv name over unix socket",
+			cc: ClientSetConfig{AgentID: "agent1", DNSSRVName: "_konnectivity._tcp.proxy.example", TransportProtocol: TransportUnix,
+				SyncInterval: time.Second, SyncIntervalCap: time.Second},
+			expected: []string{"DNSSRVName"},
+		},
+		{
+			name: "ipv6 literal",
+			cc:   ClientSetConfig{AgentID: "agent1", Address: "[2001:db8::1]:8091", SyncInterval: time.Second, SyncIntervalCap: time.Second},
+		},
+		{
+			name:     "unbracketed ipv6 literal",
+			cc:       ClientSetConfig{AgentID: "agent1", Address: "2001:db8::1:8091", SyncInterval: time.Second, SyncIntervalCap: time.Second},
+			expected: []string{"must be bracketed"},
+		},
+		{
+			name: "address family preference",
+			cc: ClientSetConfig{AgentID: "agent1", Address: "localhost:8091", SyncInterval: time.Second, SyncIntervalCap: time.Second,
+				AddressFamilyPreference: AddressFamilyIPv6},
+		},
+		{
+			name: "unknown address family preference",
+			cc: ClientSetConfig{AgentID: "agent1", Address: "localhost:8091", SyncInterval: time.Second, SyncIntervalCap: time.Second,
+				AddressFamilyPreference: "ipx"},
+			expected: []string{"AddressFamilyPreference"},
+		},
+		{
+			name:     "relative unix socket",
+			cc:       ClientSetConfig{AgentID: "agent1", Address: "konnectivity.sock", TransportProtocol: TransportUnix, SyncInterval: time.Second, SyncIntervalCap: time.Second},
+			expected: []string{"absolute socket path"},
+		},
+		{
+			name:     "unknown transport",
+			cc:       ClientSetConfig{AgentID: "agent1", Address: "localhost:8091", TransportProtocol: "udp", SyncInterval: time.Second, SyncIntervalCap: time.Second},
+			expected: []string{"TransportProtocol"},
+		},
+		{
+			name:     "cap below interval",
+			cc:       ClientSetConfig{AgentID: "agent1", Address: "localhost:8091", SyncInterval: time.Second, SyncIntervalCap: -time.Second},
+			expected: []string{"SyncIntervalCap"},
+		},
+		{
+			name: "negative limits",
+			cc: ClientSetConfig{AgentID: "agent1", Address: "localhost:8091", SyncInterval: time.Second, SyncIntervalCap: time.Second,
+				DrainTimeout: -time.Second, MaxClients: -1, MaxTunnelsPerClient: -1, ChannelLimitBudget: -1, ChannelLimitWindow: -time.Second,
+				ConnectTimeout: -time.Second, MaxExcessConnections: -1, MaxTunnelsPerSecond: -1},
+			expected: []string{"DrainTimeout", "MaxClients", "MaxTunnelsPerClient", "ChannelLimitBudget", "ChannelLimitWindow", "ConnectTimeout", "MaxExcessConnections", "MaxTunnelsPerSecond"},
+		},
+		{
+			name: "fallback address",
+			cc: ClientSetConfig{AgentID: "agent1", Address: "localhost:8091", SyncInterval: time.Second, SyncIntervalCap: time.Second,
+				FallbackAddress: "backup:8091"},
+		},
+		{
+			name: "fallback address with several addresses",
+			cc: ClientSetConfig{AgentID: "agent1", Address: "proxy1:8091,proxy2:8091", SyncInterval: time.Second, SyncIntervalCap: time.Second,
+				FallbackAddress: "backup:8091", FallbackAfterFailures: -1},
+			expected: []string{"FallbackAfterFailures", "FallbackAddress"},
+		},
+		{
+			name: "fallback address same as address",
+			cc: ClientSetConfig{AgentID: "agent1", Address: "localhost:8091", SyncInterval: time.Second, SyncIntervalCap: time.Second,
+				FallbackAddress: "localhost:8091"},
+			expected: []string{"FallbackAddress"},
+		},
+		{
+			name: "agent identifiers",
+			cc: ClientSetConfig{AgentID: "agent1", Address: "localhost:8091", SyncInterval: time.Second, SyncIntervalCap: time.Second,
+				AgentIdentifiers: "host=node1&host=node1.local&default-route=true"},
+		},
+		{
+			name: "invalid agent identifiers",
+			cc: ClientSetConfig{AgentID: "agent1", Address: "localhost:8091", SyncInterval: time.Second, SyncIntervalCap: time.Second,
+				AgentIdentifiers: "host=&zone=a&zone=b"},
+			expected: []string{"AgentIdentifiers", "empty value", `"zone" must not be set more than once`},
+		},
+		{
+			name: "token",
+			cc: ClientSetConfig{AgentID: "agent1", Address: "localhost:8091", SyncInterval: time.Second, SyncIntervalCap: time.Second,
+				ServiceAccountTokenPath: tokenPath},
+		},
+		{
+			name: "missing token",
+			cc: ClientSetConfig{AgentID: "agent1", Address: "localhost:8091", SyncInterval: time.Second, SyncIntervalCap: time.Second,
+				ServiceAccountTokenPath: tokenPath + ".missing"},
+		},
+		{
+			name: "grpc connect backoff",
+			cc: ClientSetConfig{AgentID: "agent1", Address: "localhost:8091", SyncInterval: time.Second, SyncIntervalCap: time.Second,
+				GRPCConnectBackoff: backoff.DefaultConfig},
+		},
+		{
+			name: "invalid grpc connect backoff",
+			cc: ClientSetConfig{AgentID: "agent1", Address: "localhost:8091", SyncInterval: time.Second, SyncIntervalCap: time.Second,
+				GRPCConnectBackoff: backoff.Config{BaseDelay: time.Second, Multiplier: 0.5}},
+			expected: []string{"GRPCConnectBackoff.MaxDelay", "GRPCConnectBackoff.Multiplier"},
+		},
+		{
+			name: "large xfr channel size",
+			cc: ClientSetConfig{AgentID: "agent1", Address: "localhost:8091", SyncInterval: time.Second, SyncIntervalCap: time.Second,
+				XfrChannelSize: MaxXfrChannelSize},
+		},
+		{
+			name: "xfr channel size too large",
+			cc: ClientSetConfig{AgentID: "agent1", Address: "localhost:8091", SyncInterval: time.Second, SyncIntervalCap: time.Second,
+				XfrChannelSize: math.MaxInt32},
+			expected: []string{"XfrChannelSize"},
+		},
+		{
+			name: "negative heartbeat interval",
+			cc: ClientSetConfig{AgentID: "agent1", Address: "localhost:8091", SyncInterval: time.Second, SyncIntervalCap: time.Second,
+				HeartbeatInterval: -time.Second},
+			expected: []string{"HeartbeatInterval"},
+		},
+		{
+			name: "negative token cache ttl",
+			cc: ClientSetConfig{AgentID: "agent1", Address: "localhost:8091", SyncInterval: time.Second, SyncIntervalCap: time.Second,
+				TokenCacheTTL: -time.Second},
+			expected: []string{"TokenCacheTTL"},
+		},
+		{
+			name: "negative circuit breaker threshold",
+			cc: ClientSetConfig{AgentID: "agent1", Address: "localhost:8091", SyncInterval: time.Second, SyncIntervalCap: time.Second,
+				CircuitBreaker: CircuitBreakerConfig{FailureThreshold: -1}},
+			expected: []string{"CircuitBreaker"},
+		},
+		{
+			name: "negative xfr channel size",
+			cc: ClientSetConfig{AgentID: "agent1", Address: "localhost:8091", SyncInterval: time.Second, SyncIntervalCap: time.Second,
+				XfrChannelSize: -1},
+			expected: []string{"XfrChannelSize"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.cc.Validate()
+			if len(tc.expected) == 0 {
+				if err != nil {
+					t.Fatalf("expected no error, got %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("expected errors mentioning %v, got nil", tc.expected)
+			}
+			for _, want := range tc.expected {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("expected error to mention %q, got %v", want, err)
+				}
+			}
+		})
+	}
+}
+
+func TestXfrChannelSize(t *testing.T) {
+	testCases := []struct {
+		name     string
+		size     int
+		expected int
+		warn     bool
+	}{
+		{name: "default", size: 0, expected: DefaultXfrChannelSize},
+		{name: "explicit", size: 10, expected: 10},
+		{name: "large", size: 4096, expected: 4096, warn: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			klog.LogToStderr(false)
+			klog.SetOutput(&buf)
+			defer func() {
+				klog.SetOutput(os.Stderr)
+				klog.LogToStderr(true)
+			}()
+
+			cs := withTestDefaults(&ClientSetConfig{XfrChannelSize: tc.size}).NewAgentClientSet(nil, make(chan struct{}))
+			klog.Flush()
+			if cs.xfrChannelSize != tc.expected {
+				t.Errorf("expected xfrChannelSize %d, got %d", tc.expected, cs.xfrChannelSize)
+			}
+			if got := (&Client{xfrChannelSize: cs.xfrChannelSize}).dataChannelSize(); got != tc.expected {
+				t.Errorf("expected data channel size %d, got %d", tc.expected, got)
+			}
+			if warned := strings.Contains(buf.String(), "XfrChannelSize is large"); warned != tc.warn {
+				t.Errorf("expected warning %v, got log %q", tc.warn, buf.String())
+			}
+		})
+	}
+}
+
+func TestNewAgentClientSetChecked(t *testing.T) {
+	cs, err := (&ClientSetConfig{Address: "localhost:8091"}).NewAgentClientSetChecked(nil, make(chan struct{}))
+	if err == nil || cs != nil {
+		t.Errorf("expected an invalid config to return an error, got %v, %v", cs, err)
+	}
+	cs, err = withTestDefaults(&ClientSetConfig{}).NewAgentClientSetChecked(nil, make(chan struct{}))
+	if err != nil || cs == nil {
+		t.Errorf("expected a valid config to create a ClientSet, got %v, %v", cs, err)
+	}
+	missing := filepath.Join(t.TempDir(), "token")
+	cs, err = withTestDefaults(&ClientSetConfig{ServiceAccountTokenPath: missing}).NewAgentClientSetChecked(nil, make(chan struct{}))
+	if err == nil || cs != nil || !strings.Contains(err.Error(), "ServiceAccountTokenPath") {
+		t.Errorf("expected a missing token file to return an error, got %v, %v", cs, err)
+	}
+	// NewAgentClientSet does not check the file, as the token may be
+	// mounted after the agent starts.
+	withTestDefaults(&ClientSetConfig{ServiceAccountTokenPath: missing}).NewAgentClientSet(nil, make(chan struct{}))
+}
+
+func TestNewAgentClientSet_InvalidConfigPanics(t *testing.T) {
+	defer func() {
+		if r := recover(); r == nil {
+			t.Error("expected NewAgentClientSet to panic on an invalid config")
+		}
+	}()
+	(&ClientSetConfig{}).NewAgentClientSet(nil, make(chan struct{}))
+}
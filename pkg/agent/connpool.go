@@ -0,0 +1,109 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"sync"
+
+	"google.golang.org/grpc"
+	"k8s.io/klog/v2"
+)
+
+// ConnPool shares gRPC connections to the proxy server between ClientSets,
+// e.g. ClientSets running with different agent IDs in one process. Each
+// ClientSet opens its own Connect stream over a borrowed connection.
+//
+// A connection is borrowed at most once per ClientSet, since a ClientSet
+// needs a distinct connection for each server it connects to. Connections
+// are closed when the last ClientSet borrowing them returns them. A
+// connection is dialed with the options of the ClientSet that first
+// borrowed it.
+type ConnPool struct {
+	mu sync.Mutex
+	// conns holds the pooled connections by address.
+	conns map[string][]*pooledConn
+}
+
+type pooledConn struct {
+	conn *grpc.ClientConn
+	// borrowers is the set of ClientSets using conn.
+	borrowers map[*ClientSet]struct{}
+}
+
+// NewConnPool returns an empty ConnPool.
+func NewConnPool() *ConnPool {
+	return &ConnPool{conns: make(map[string][]*pooledConn)}
+}
+
+// get returns a connection to address which cs is not borrowing yet,
+// dialing a new one if there is none.
+func (p *ConnPool) get(cs *ClientSet, address string, opts ...grpc.DialOption) (*grpc.ClientConn, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, pc := range p.conns[address] {
+		if _, ok := pc.borrowers[cs]; !ok {
+			pc.borrowers[cs] = struct{}{}
+			return pc.conn, nil
+		}
+	}
+	conn, err := grpc.Dial(address, opts...)
+	if err != nil {
+		return nil, err
+	}
+	p.conns[address] = append(p.conns[address], &pooledConn{
+		conn:      conn,
+		borrowers: map[*ClientSet]struct{}{cs: {}},
+	})
+	return conn, nil
+}
+
+// put returns conn, borrowed by cs, to the pool. conn is closed if no other
+// ClientSet is borrowing it.
+func (p *ConnPool) put(cs *ClientSet, address string, conn *grpc.ClientConn) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pooled := p.conns[address]
+	for i, pc := range pooled {
+		if pc.conn != conn {
+			continue
+		}
+		delete(pc.borrowers, cs)
+		if len(pc.borrowers) > 0 {
+			return nil
+		}
+		pooled = append(pooled[:i], pooled[i+1:]...)
+		if len(pooled) == 0 {
+			delete(p.conns, address)
+		} else {
+			p.conns[address] = pooled
+		}
+		return conn.Close()
+	}
+	klog.V(2).InfoS("Returned connection is not pooled, closing it", "address", address)
+	return conn.Close()
+}
+
+// Len returns the number of pooled connections.
+func (p *ConnPool) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := 0
+	for _, pooled := range p.conns {
+		n += len(pooled)
+	}
+	return n
+}
@@ -0,0 +1,93 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"slices"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+func TestSharedConnPool(t *testing.T) {
+	address := newTestProxyServer(t, "", 3)
+	pool := NewConnPool()
+	newClientSet := func(agentID string) *ClientSet {
+		return withTestDefaults(&ClientSetConfig{
+			AgentID:        agentID,
+			Address:        address,
+			DialOptions:    []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())},
+			SharedConnPool: pool,
+		}).NewAgentClientSet(nil, make(chan struct{}))
+	}
+	cs1, cs2 := newClientSet("agent1"), newClientSet("agent2")
+
+	// connect adds a client to cs and returns it.
+	connect := func(cs *ClientSet) *Client {
+		t.Helper()
+		before := cs.ListServerIDs()
+		if result := cs.connectOnce(); result.err != nil || !result.added {
+			t.Fatalf("expected a client to be added, got %+v", result)
+		}
+		cs.mu.Lock()
+		defer cs.mu.Unlock()
+		for serverID, c := range cs.clients {
+			if !slices.Contains(before, serverID) {
+				return c
+			}
+		}
+		t.Fatal("added client not found")
+		return nil
+	}
+
+	c1 := connect(cs1)
+	c2 := connect(cs2)
+	if c1.conn != c2.conn {
+		t.Errorf("expected ClientSets to share a connection")
+	}
+	c3 := connect(cs1)
+	if c3.conn == c1.conn {
+		t.Errorf("expected a second client of the same ClientSet to get its own connection")
+	}
+	if got := pool.Len(); got != 2 {
+		t.Errorf("expected 2 pooled connections, got %d", got)
+	}
+
+	if err := cs2.RemoveClient(c2.serverID); err != nil {
+		t.Fatal(err)
+	}
+	if c2.stream.Context().Err() == nil {
+		t.Errorf("expected the stream of the removed client to be cancelled")
+	}
+	if state := c1.conn.GetState(); state == connectivity.Shutdown {
+		t.Errorf("expected the connection to stay open while borrowed")
+	}
+
+	for _, c := range []*Client{c1, c3} {
+		if err := cs1.RemoveClient(c.serverID); err != nil {
+			t.Fatal(err)
+		}
+		if state := c.conn.GetState(); state != connectivity.Shutdown {
+			t.Errorf("expected the connection to be closed once returned by all ClientSets, got %v", state)
+		}
+	}
+	if got := pool.Len(); got != 0 {
+		t.Errorf("expected no pooled connections, got %d", got)
+	}
+}
@@ -0,0 +1,256 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"google.golang.org/grpc/connectivity"
+)
+
+// DebugPath is the path ServeDebugHTTP registers its handler at.
+const DebugPath = "/debug/agent/clientset"
+
+// ClientSetDebugInfo is a snapshot of the ClientSet state served at
+// DebugPath.
+type ClientSetDebugInfo struct {
+	AgentID         string            `json:"agent_id"`
+	Address         string            `json:"address"`
+	ServerCount     int               `json:"server_count"`
+	Clients         []ClientDebugInfo `json:"clients"`
+	LastServerCount int               `json:"last_server_count"`
+	// SyncIntervalCurrent is the sleep chosen after the most recent sync
+	// attempt, formatted as a time.Duration.
+	SyncIntervalCurrent string `json:"sync_interval_current"`
+}
+
+// ClientDebugInfo describes a client in ClientSetDebugInfo.
+type ClientDebugInfo struct {
+	ServerID    string    `json:"server_id"`
+	State       string    `json:"state"`
+	ConnectedAt time.Time `json:"connected_at"`
+}
+
+// DebugInfo returns a snapshot of the ClientSet state, with clients ordered
+// by server ID.
+func (cs *ClientSet) DebugInfo() ClientSetDebugInfo {
+	info := ClientSetDebugInfo{
+		AgentID:             cs.agentID,
+		Address:             cs.currentAddress(),
+		ServerCount:         cs.ServerCount(),
+		Clients:             []ClientDebugInfo{},
+		SyncIntervalCurrent: cs.SyncStats().CurrentBackoffDuration.String(),
+	}
+	cs.mu.Lock()
+	info.LastServerCount = cs.serverCount
+	for serverID, c := range cs.clients {
+		info.Clients = append(info.Clients, ClientDebugInfo{
+			ServerID:    serverID,
+			State:       c.conn.GetState().String(),
+			ConnectedAt: c.connectedAt,
+		})
+	}
+	cs.mu.Unlock()
+	sort.Slice(info.Clients, func(i, j int) bool {
+		return info.Clients[i].ServerID < info.Clients[j].ServerID
+	})
+	return info
+}
+
+// Sources of the transport credentials in ClientSetInfo.TransportSecurity.
+const (
+	TransportSecurityDialOptions         = "dial-options"
+	TransportSecurityCredentialsReloader = "credentials-reloader"
+	TransportSecurityTLSCertFiles        = "tls-cert-files"
+)
+
+// ClientSetInfo describes the configuration and state of a ClientSet, for
+// support and debugging.
+type ClientSetInfo struct {
+	AgentID          string `json:"agent_id"`
+	AgentIdentifiers string `json:"agent_identifiers"`
+	Address          string `json:"address"`
+
+	SyncInterval      time.Duration `json:"sync_interval"`
+	SyncIntervalCap   time.Duration `json:"sync_interval_cap"`
+	ProbeInterval     time.Duration `json:"probe_interval"`
+	HeartbeatInterval time.Duration `json:"heartbeat_interval"`
+
+	// DialOptionsCount is the number of dial options the ClientSet dials
+	// with, including those it adds to ClientSetConfig.DialOptions.
+	DialOptionsCount int `json:"dial_options_count"`
+	// TransportSecurity is where the transport credentials come from: one
+	// of the TransportSecurity constants.
+	TransportSecurity string `json:"transport_security"`
+	// HasLeaseCounter is whether the servers are counted from their Leases.
+	HasLeaseCounter bool `json:"has_lease_counter"`
+
+	ClientsCount        int `json:"clients_count"`
+	HealthyClientsCount int `json:"healthy_clients_count"`
+	// LastServerCount is the server count last reported by a server.
+	LastServerCount int `json:"last_server_count"`
+}
+
+// Describe returns a snapshot of the configuration and state of the
+// ClientSet, read at once under its lock.
+func (cs *ClientSet) Describe() ClientSetInfo {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	info := ClientSetInfo{
+		AgentID:           cs.agentID,
+		AgentIdentifiers:  cs.agentIdentifiers,
+		Address:           cs.address,
+		SyncInterval:      cs.syncInterval,
+		SyncIntervalCap:   cs.syncIntervalCap,
+		ProbeInterval:     cs.probeInterval,
+		HeartbeatInterval: cs.heartbeatInterval,
+		DialOptionsCount:  len(cs.dialOptions),
+		TransportSecurity: TransportSecurityDialOptions,
+		HasLeaseCounter:   cs.leaseCounter != nil,
+		ClientsCount:      len(cs.clients),
+		LastServerCount:   cs.serverCount,
+	}
+	switch {
+	case cs.tlsCredentials != nil:
+		info.TransportSecurity = TransportSecurityTLSCertFiles
+	case cs.credentialsReloader != nil:
+		info.TransportSecurity = TransportSecurityCredentialsReloader
+	}
+	for _, c := range cs.clients {
+		if c.conn != nil && c.conn.GetState() == connectivity.Ready {
+			info.HealthyClientsCount++
+		}
+	}
+	return info
+}
+
+// ServeDebugHTTP registers a handler at DebugPath on mux which serves
+// DebugInfo as JSON.
+func (cs *ClientSet) ServeDebugHTTP(mux *http.ServeMux) {
+	mux.HandleFunc(DebugPath, func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(cs.DebugInfo()); err != nil {
+			cs.logger.Error(err, "Failed to write debug info")
+		}
+	})
+}
+
+// SyncSummary describes the outcome of the last sync attempt in one line
+// for humans, e.g. "Last sync: 47s ago, connected 1/3 servers, 2 failures
+// (backoff: 30s)", where failures are consecutive.
+func (cs *ClientSet) SyncSummary() string {
+	stats := cs.SyncStats()
+	if stats.LastSyncTime.IsZero() {
+		return fmt.Sprintf("No sync yet, connected %d/%d servers", cs.ClientsCount(), cs.ServerCount())
+	}
+	summary := fmt.Sprintf("Last sync: %v ago, connected %d/%d servers, %d failures",
+		cs.clock.Since(stats.LastSyncTime).Round(time.Second), cs.ClientsCount(), cs.ServerCount(), stats.ConsecutiveFailures)
+	if stats.ConsecutiveFailures > 0 {
+		summary += fmt.Sprintf(" (backoff: %v)", stats.CurrentBackoffDuration.Round(time.Second))
+	}
+	return summary
+}
+
+// BandwidthStats is the smoothed rate at which the agent proxies data.
+type BandwidthStats struct {
+	// IngressBytesPerSecond is the rate of data received from the proxy
+	// servers and written to endpoints.
+	IngressBytesPerSecond float64
+	// EgressBytesPerSecond is the rate of data read from endpoints and sent
+	// to the proxy servers.
+	EgressBytesPerSecond float64
+}
+
+const (
+	// bandwidthSampleInterval is how often the bandwidth rates are updated.
+	bandwidthSampleInterval = time.Second
+	// bandwidthEMAAlpha is the weight given to the latest sample in the
+	// exponential moving average of the bandwidth rates.
+	bandwidthEMAAlpha = 0.3
+)
+
+// BandwidthStats returns the exponential moving average of the rate at
+// which data has been proxied across all clients. It is updated every
+// second while the ClientSet is serving.
+func (cs *ClientSet) BandwidthStats() BandwidthStats {
+	cs.bandwidthMu.Lock()
+	defer cs.bandwidthMu.Unlock()
+	return cs.bandwidth
+}
+
+func (cs *ClientSet) trackBandwidth() {
+	ticker := time.NewTicker(bandwidthSampleInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-cs.stopCh:
+			return
+		case <-cs.stopping.C():
+			return
+		case <-ticker.C:
+			cs.updateBandwidth(bandwidthSampleInterval)
+			if cs.idleThreshold > 0 {
+				cs.agentMetrics().SetIdleServerConnectionsCount(cs.agentID, cs.IdleClientsCount(cs.idleThreshold))
+			}
+		}
+	}
+}
+
+// ChannelOverflows returns, for each connected server, the number of DATA
+// packets from it which found the data channel of their endpoint connection
+// full. A high count suggests XfrChannelSize is too small for the traffic.
+func (cs *ClientSet) ChannelOverflows() map[string]int {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	overflows := make(map[string]int, len(cs.clients))
+	for serverID, c := range cs.clients {
+		overflows[serverID] = int(c.channelOverflows.Load())
+	}
+	return overflows
+}
+
+// IdleClientsCount returns the number of clients which have not sent or
+// received data for longer than threshold.
+func (cs *ClientSet) IdleClientsCount(threshold time.Duration) int {
+	now := time.Now()
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	idle := 0
+	for _, c := range cs.clients {
+		if now.Sub(c.LastActivity()) > threshold {
+			idle++
+		}
+	}
+	return idle
+}
+
+// updateBandwidth folds the bytes proxied since the previous update, over
+// the given interval, into the moving averages.
+func (cs *ClientSet) updateBandwidth(interval time.Duration) {
+	ingress, egress := cs.ingressBytes.Load(), cs.egressBytes.Load()
+	cs.bandwidthMu.Lock()
+	defer cs.bandwidthMu.Unlock()
+	ingressRate := float64(ingress-cs.lastIngressBytes) / interval.Seconds()
+	egressRate := float64(egress-cs.lastEgressBytes) / interval.Seconds()
+	cs.lastIngressBytes, cs.lastEgressBytes = ingress, egress
+	cs.bandwidth.IngressBytesPerSecond = bandwidthEMAAlpha*ingressRate + (1-bandwidthEMAAlpha)*cs.bandwidth.IngressBytesPerSecond
+	cs.bandwidth.EgressBytesPerSecond = bandwidthEMAAlpha*egressRate + (1-bandwidthEMAAlpha)*cs.bandwidth.EgressBytesPerSecond
+}
@@ -0,0 +1,212 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	clocktesting "k8s.io/utils/clock/testing"
+)
+
+func TestServeDebugHTTP(t *testing.T) {
+	cs := withTestDefaults(&ClientSetConfig{Address: "proxy:8091"}).NewAgentClientSet(nil, make(chan struct{}))
+	cs.serverCount = 2
+	connectedAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, serverID := range []string{"server2", "server1"} {
+		if err := cs.AddClient(serverID, &Client{serverID: serverID, conn: newReadyConn(t), connectedAt: connectedAt}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mux := http.NewServeMux()
+	cs.ServeDebugHTTP(mux)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, DebugPath, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, rec.Code)
+	}
+	if got := rec.Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("expected JSON content type, got %q", got)
+	}
+
+	var body map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"agent_id", "address", "server_count", "clients", "last_server_count", "sync_interval_current"} {
+		if _, ok := body[key]; !ok {
+			t.Errorf("expected key %q in %s", key, rec.Body.String())
+		}
+	}
+
+	var info ClientSetDebugInfo
+	if err := json.Unmarshal(rec.Body.Bytes(), &info); err != nil {
+		t.Fatal(err)
+	}
+	if info.AgentID != "agent1" || info.Address != "proxy:8091" || info.ServerCount != 2 || info.LastServerCount != 2 {
+		t.Errorf("unexpected ClientSet fields: %+v", info)
+	}
+	expected := []ClientDebugInfo{
+		{ServerID: "server1", State: "READY", ConnectedAt: connectedAt},
+		{ServerID: "server2", State: "READY", ConnectedAt: connectedAt},
+	}
+	if len(info.Clients) != len(expected) {
+		t.Fatalf("expected clients %+v, got %+v", expected, info.Clients)
+	}
+	for i := range expected {
+		if got := info.Clients[i]; got.ServerID != expected[i].ServerID || got.State != expected[i].State || !got.ConnectedAt.Equal(expected[i].ConnectedAt) {
+			t.Errorf("expected client %+v, got %+v", expected[i], got)
+		}
+	}
+}
+
+func TestDescribe(t *testing.T) {
+	cs := withTestDefaults(&ClientSetConfig{
+		Address:            "proxy:8091",
+		AgentIdentifiers:   "host=node1",
+		ProbeInterval:      time.Hour,
+		HeartbeatInterval:  time.Minute,
+		ServerLeaseCounter: &ServerLeaseCounter{hasSynced: func() bool { return true }},
+		DialOptions:        []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())},
+	}).NewAgentClientSet(nil, make(chan struct{}))
+	cs.serverCount = 2
+	if err := cs.AddClient("server1", &Client{serverID: "server1", conn: newReadyConn(t)}); err != nil {
+		t.Fatal(err)
+	}
+
+	info := cs.Describe()
+	v := reflect.ValueOf(info)
+	for i := 0; i < v.NumField(); i++ {
+		if v.Field(i).IsZero() {
+			t.Errorf("expected %s to be set in %+v", v.Type().Field(i).Name, info)
+		}
+	}
+	expected := ClientSetInfo{
+		AgentID:             "agent1",
+		AgentIdentifiers:    "host=node1",
+		Address:             "proxy:8091",
+		SyncInterval:        time.Second,
+		SyncIntervalCap:     time.Second,
+		ProbeInterval:       time.Hour,
+		HeartbeatInterval:   time.Minute,
+		DialOptionsCount:    len(cs.dialOptions),
+		TransportSecurity:   TransportSecurityDialOptions,
+		HasLeaseCounter:     true,
+		ClientsCount:        1,
+		HealthyClientsCount: 1,
+		LastServerCount:     2,
+	}
+	if info != expected {
+		t.Errorf("expected %+v, got %+v", expected, info)
+	}
+}
+
+func TestSyncSummary(t *testing.T) {
+	cs := withTestDefaults(&ClientSetConfig{SyncInterval: 30 * time.Second, SyncIntervalCap: time.Minute}).NewAgentClientSet(nil, make(chan struct{}))
+	fakeClock := clocktesting.NewFakeClock(time.Now())
+	cs.clock = fakeClock
+	if got, expected := cs.SyncSummary(), "No sync yet, connected 0/0 servers"; got != expected {
+		t.Errorf("expected summary %q, got %q", expected, got)
+	}
+
+	backoff := cs.resetBackoff()
+	var duration time.Duration
+	failure := &ConnectionFailedError{Address: "proxy:8091", AttemptCount: 1, Cause: errors.New("connection refused")}
+	for i := 0; i < 2; i++ {
+		duration = cs.nextSyncBackoff(connectResult{err: failure}, backoff, duration)
+	}
+	fakeClock.Step(47 * time.Second)
+	expected := fmt.Sprintf("Last sync: 47s ago, connected 0/0 servers, 2 failures (backoff: %v)", duration.Round(time.Second))
+	if got := cs.SyncSummary(); got != expected {
+		t.Errorf("expected summary %q, got %q", expected, got)
+	}
+
+	cs.nextSyncBackoff(connectResult{alreadyConnected: true}, backoff, duration)
+	fakeClock.Step(2 * time.Second)
+	if got, expected := cs.SyncSummary(), "Last sync: 2s ago, connected 0/0 servers, 0 failures"; got != expected {
+		t.Errorf("expected summary %q, got %q", expected, got)
+	}
+}
+
+func TestIdleClientsCount(t *testing.T) {
+	cs := withTestDefaults(&ClientSetConfig{}).NewAgentClientSet(nil, make(chan struct{}))
+	longAgo := time.Now().Add(-time.Hour)
+	testClients := []struct {
+		serverID     string
+		lastActivity time.Time // zero if the client has carried no data.
+		active       bool      // records activity now.
+	}{
+		{serverID: "never-used"},
+		{serverID: "idle", lastActivity: longAgo.Add(30 * time.Minute)},
+		{serverID: "active", active: true},
+		{serverID: "active-again", lastActivity: longAgo, active: true},
+	}
+	for _, tc := range testClients {
+		c := &Client{serverID: tc.serverID, connectedAt: longAgo}
+		if !tc.lastActivity.IsZero() {
+			c.lastActivity.Store(tc.lastActivity.UnixNano())
+		}
+		if tc.active {
+			c.recordActivity()
+		}
+		cs.clients[tc.serverID] = c
+	}
+
+	if got := cs.IdleClientsCount(time.Minute); got != 2 {
+		t.Errorf("expected 2 clients idle for over a minute, got %d", got)
+	}
+	if got := cs.IdleClientsCount(45 * time.Minute); got != 1 {
+		t.Errorf("expected 1 client idle for over 45 minutes, got %d", got)
+	}
+	if got := cs.IdleClientsCount(2 * time.Hour); got != 0 {
+		t.Errorf("expected no clients idle for over 2 hours, got %d", got)
+	}
+}
+
+func TestBandwidthStats(t *testing.T) {
+	cs := withTestDefaults(&ClientSetConfig{}).NewAgentClientSet(nil, make(chan struct{}))
+
+	cs.ingressBytes.Add(1000)
+	cs.egressBytes.Add(2000)
+	cs.updateBandwidth(time.Second)
+	expected := BandwidthStats{
+		IngressBytesPerSecond: bandwidthEMAAlpha * 1000,
+		EgressBytesPerSecond:  bandwidthEMAAlpha * 2000,
+	}
+	if got := cs.BandwidthStats(); got != expected {
+		t.Errorf("expected %+v, got %+v", expected, got)
+	}
+
+	// With no further traffic the rates decay towards zero.
+	cs.updateBandwidth(time.Second)
+	expected = BandwidthStats{
+		IngressBytesPerSecond: (1 - bandwidthEMAAlpha) * expected.IngressBytesPerSecond,
+		EgressBytesPerSecond:  (1 - bandwidthEMAAlpha) * expected.EgressBytesPerSecond,
+	}
+	if got := cs.BandwidthStats(); got != expected {
+		t.Errorf("expected %+v, got %+v", expected, got)
+	}
+}
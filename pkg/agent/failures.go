@@ -0,0 +1,217 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"fmt"
+	"time"
+
+	"sigs.k8s.io/apiserver-network-proxy/pkg/agent/metrics"
+)
+
+// syncErrorValue is the error of a failed connectOnce attempt and when it
+// failed. atomic.Value needs a single concrete type to hold a nil or
+// differently typed error.
+type syncErrorValue struct {
+	err error
+	at  time.Time
+}
+
+// LastError returns the error from the most recent connectOnce attempt if
+// it failed, or nil if it succeeded. Connecting to a server which already
+// has a client is neither a failure nor a success and leaves it unchanged.
+func (cs *ClientSet) LastError() error {
+	v, _ := cs.lastError.Load().(syncErrorValue)
+	return v.err
+}
+
+// LastSyncError is LastError. The sync loop is the only caller of
+// connectOnce, so both report the same attempts.
+func (cs *ClientSet) LastSyncError() error {
+	return cs.LastError()
+}
+
+// RecentSyncError returns LastError if the attempt failed within the last
+// window, e.g. a probe interval, and nil otherwise.
+func (cs *ClientSet) RecentSyncError(window time.Duration) error {
+	v, _ := cs.lastError.Load().(syncErrorValue)
+	if v.err == nil || cs.clock.Since(v.at) > window {
+		return nil
+	}
+	return v.err
+}
+
+// recordSyncResult stores the error of a failed connectOnce attempt, or
+// clears it after a successful one.
+func (cs *ClientSet) recordSyncResult(result connectResult) {
+	switch result.syncResult() {
+	case metrics.SyncResultFailure:
+		cs.lastError.Store(syncErrorValue{err: result.err, at: cs.clock.Now()})
+	case metrics.SyncResultSuccess:
+		cs.lastError.Store(syncErrorValue{})
+	}
+}
+
+type FailedServerError struct {
+	ServerID string
+}
+
+func (fse *FailedServerError) Error() string {
+	return "server permanently failed: " + fse.ServerID
+}
+
+// ConnectionFailedError is returned by the sync loop when connecting to the
+// proxy server at Address fails. AttemptCount is the number of consecutive
+// failed attempts to connect to Address, including this one.
+type ConnectionFailedError struct {
+	Address      string
+	AttemptCount int
+	Cause        error
+}
+
+func (cfe *ConnectionFailedError) Error() string {
+	return fmt.Sprintf("failed to connect to %s (attempt %d): %v", cfe.Address, cfe.AttemptCount, cfe.Cause)
+}
+
+func (cfe *ConnectionFailedError) Unwrap() error {
+	return cfe.Cause
+}
+
+// recordServerFailure counts a connection failure for the server with the
+// given ID. It returns the number of failures since the server was last
+// cleared, which a successful AddClient does.
+func (cs *ClientSet) recordServerFailure(serverID string) int {
+	cs.failuresMu.Lock()
+	defer cs.failuresMu.Unlock()
+	if cs.serverFailures == nil {
+		cs.serverFailures = make(map[string]int)
+	}
+	cs.serverFailures[serverID]++
+	failures := cs.serverFailures[serverID]
+	if cs.maxConnectAttempts > 0 && failures == cs.maxConnectAttempts {
+		cs.logger.Error(nil, "Marking server permanently failed", "serverID", serverID, "attempts", cs.maxConnectAttempts)
+		cs.agentMetrics().SetFailedServersCount(cs.agentID, cs.failedServersCountLocked())
+	}
+	return failures
+}
+
+func (cs *ClientSet) isFailedServer(serverID string) bool {
+	if cs.maxConnectAttempts <= 0 {
+		return false
+	}
+	cs.failuresMu.Lock()
+	defer cs.failuresMu.Unlock()
+	return cs.serverFailures[serverID] >= cs.maxConnectAttempts
+}
+
+func (cs *ClientSet) failedServersCountLocked() int {
+	if cs.maxConnectAttempts <= 0 {
+		return 0
+	}
+	var count int
+	for _, failures := range cs.serverFailures {
+		if failures >= cs.maxConnectAttempts {
+			count++
+		}
+	}
+	return count
+}
+
+// ClearFailedServer resets the failure count of serverID, allowing the agent
+// to reconnect to it if it had been marked permanently failed.
+func (cs *ClientSet) ClearFailedServer(serverID string) {
+	cs.failuresMu.Lock()
+	defer cs.failuresMu.Unlock()
+	if _, ok := cs.serverFailures[serverID]; !ok {
+		return
+	}
+	delete(cs.serverFailures, serverID)
+	cs.agentMetrics().SetFailedServersCount(cs.agentID, cs.failedServersCountLocked())
+}
+
+// recordDialFailure counts a failed dial of address, and returns the number
+// of consecutive failures, including this one. The failure also counts
+// against the server last connected through address, if it is known.
+func (cs *ClientSet) recordDialFailure(address string) int {
+	cs.failuresMu.Lock()
+	if cs.dialFailures == nil {
+		cs.dialFailures = make(map[string]int)
+	}
+	cs.dialFailures[address]++
+	failures := cs.dialFailures[address]
+	serverID := cs.addressServerIDs[address]
+	cs.failuresMu.Unlock()
+	if serverID != "" {
+		cs.recordServerFailure(serverID)
+	}
+	return failures
+}
+
+// setAddressServerID records that address, one of several static
+// addresses, reached the server serverID.
+func (cs *ClientSet) setAddressServerID(address, serverID string) {
+	cs.failuresMu.Lock()
+	defer cs.failuresMu.Unlock()
+	if cs.addressServerIDs == nil {
+		cs.addressServerIDs = make(map[string]string)
+	}
+	cs.addressServerIDs[address] = serverID
+}
+
+// addressServerID returns the ID of the server last connected through
+// address, one of several static addresses, or "" if it is not known.
+func (cs *ClientSet) addressServerID(address string) string {
+	cs.failuresMu.Lock()
+	defer cs.failuresMu.Unlock()
+	return cs.addressServerIDs[address]
+}
+
+// failedAddressServer returns the ID of the server last connected through
+// address if it is permanently failed, or "" otherwise.
+func (cs *ClientSet) failedAddressServer(address string) string {
+	serverID := cs.addressServerID(address)
+	if serverID != "" && cs.isFailedServer(serverID) {
+		return serverID
+	}
+	return ""
+}
+
+// resetDialFailures resets the count of consecutive failed dials of address.
+func (cs *ClientSet) resetDialFailures(address string) {
+	cs.failuresMu.Lock()
+	defer cs.failuresMu.Unlock()
+	delete(cs.dialFailures, address)
+}
+
+// circuitBreakerFor returns the circuit breaker for address, or nil if
+// circuit breakers are disabled.
+func (cs *ClientSet) circuitBreakerFor(address string) *circuitBreaker {
+	if cs.circuitBreakerConfig.FailureThreshold <= 0 {
+		return nil
+	}
+	cs.breakersMu.Lock()
+	defer cs.breakersMu.Unlock()
+	cb, ok := cs.breakers[address]
+	if !ok {
+		if cs.breakers == nil {
+			cs.breakers = make(map[string]*circuitBreaker)
+		}
+		cb = newCircuitBreaker(address, cs.circuitBreakerConfig, cs.clock, cs.agentMetrics())
+		cs.breakers[address] = cb
+	}
+	return cb
+}
@@ -0,0 +1,222 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	clocktesting "k8s.io/utils/clock/testing"
+
+	"sigs.k8s.io/apiserver-network-proxy/proto/agent"
+)
+
+func TestLastError(t *testing.T) {
+	cc := withTestDefaults(&ClientSetConfig{
+		ProbeInterval: time.Hour,
+		DialOptions:   []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())},
+	})
+	cs := cc.NewAgentClientSet(nil, make(chan struct{}))
+	defer cs.Wait()
+	defer cs.Shutdown()
+	if err := cs.LastError(); err != nil {
+		t.Fatalf("expected no error before the first attempt, got %v", err)
+	}
+
+	// Nothing listens on port 0, so the Connect stream fails.
+	result := cs.connectOnce()
+	if result.err == nil {
+		t.Fatalf("expected connectOnce to fail, got %+v", result)
+	}
+	if err := cs.LastError(); err != result.err {
+		t.Errorf("expected last error %v, got %v", result.err, err)
+	}
+	explanation := cs.HealthExplanation()
+	if !strings.Contains(explanation, "last error: "+result.err.Error()) {
+		t.Errorf("expected the explanation to include the last error, got %q", explanation)
+	}
+	if err := NewServerConnected(cs).Check(nil); err == nil || !strings.Contains(err.Error(), explanation) {
+		t.Errorf("expected the readiness check to include %q, got %v", explanation, err)
+	}
+
+	cs.address = newTestProxyServer(t, "server1", 2)
+	if result := cs.connectOnce(); !result.added {
+		t.Fatalf("expected connectOnce to add a client, got %+v", result)
+	}
+	if err := cs.LastError(); err != nil {
+		t.Errorf("expected a successful attempt to clear the last error, got %v", err)
+	}
+	if explanation := cs.HealthExplanation(); explanation != "Degraded, 1 of 2 proxy servers connected" {
+		t.Errorf("unexpected explanation %q", explanation)
+	}
+	// A duplicate server is not a failure.
+	if result := cs.connectOnce(); result.err == nil {
+		t.Fatalf("expected a duplicate server error, got %+v", result)
+	}
+	if err := cs.LastError(); err != nil {
+		t.Errorf("expected a duplicate server to leave the last error unset, got %v", err)
+	}
+}
+
+func TestLastSyncError(t *testing.T) {
+	cs := withTestDefaults(&ClientSetConfig{}).NewAgentClientSet(nil, make(chan struct{}))
+	fakeClock := clocktesting.NewFakeClock(time.Now())
+	cs.clock = fakeClock
+	if err := cs.LastSyncError(); err != nil {
+		t.Fatalf("expected no error before the first attempt, got %v", err)
+	}
+
+	failure := &ConnectionFailedError{Address: "proxy:8091", AttemptCount: 1, Cause: errors.New("connection refused")}
+	cs.recordSyncResult(connectResult{err: failure})
+	if err := cs.LastSyncError(); err != failure {
+		t.Errorf("expected last sync error %v, got %v", failure, err)
+	}
+	if err := cs.RecentSyncError(time.Second); err != failure {
+		t.Errorf("expected recent sync error %v, got %v", failure, err)
+	}
+	fakeClock.Step(2 * time.Second)
+	if err := cs.RecentSyncError(time.Second); err != nil {
+		t.Errorf("expected an older sync error not to be recent, got %v", err)
+	}
+
+	// A duplicate server is not a failure, nor a success.
+	cs.recordSyncResult(connectResult{err: &DuplicateServerError{ServerID: "server1"}})
+	if err := cs.LastSyncError(); err != failure {
+		t.Errorf("expected a duplicate server to leave the last sync error, got %v", err)
+	}
+
+	cs.recordSyncResult(connectResult{added: true, serverCount: 1})
+	if err := cs.LastSyncError(); err != nil {
+		t.Errorf("expected a successful attempt to clear the last sync error, got %v", err)
+	}
+	if err := cs.RecentSyncError(time.Hour); err != nil {
+		t.Errorf("expected no recent sync error, got %v", err)
+	}
+}
+
+func TestMaxConnectAttempts(t *testing.T) {
+	addr := newTestProxyServer(t, "server1", 1)
+	cc := withTestDefaults(&ClientSetConfig{
+		Address:            addr,
+		MaxConnectAttempts: 2,
+		ProbeInterval:      time.Hour,
+		DialOptions:        []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())},
+	})
+	cs := cc.NewAgentClientSet(nil, make(chan struct{}))
+	defer cs.Wait()
+	defer cs.Shutdown()
+	var fse *FailedServerError
+
+	// A successful connection resets the count.
+	cs.recordServerFailure("server1")
+	if result := cs.connectOnce(); !result.added {
+		t.Fatalf("expected a client to be added, got %+v", result)
+	}
+	cs.RemoveClient("server1")
+	cs.recordServerFailure("server1")
+	if result := cs.connectOnce(); !result.added {
+		t.Fatalf("expected a client to be added after one failure, got %+v", result)
+	}
+
+	cs.RemoveClient("server1")
+	for i := 0; i < cc.MaxConnectAttempts; i++ {
+		cs.recordServerFailure("server1")
+	}
+	if result := cs.connectOnce(); !errors.As(result.err, &fse) || fse.ServerID != "server1" {
+		t.Fatalf("expected FailedServerError for server1, got %+v", result)
+	}
+
+	cs.ClearFailedServer("server1")
+	if result := cs.connectOnce(); !result.added {
+		t.Errorf("expected a client to be added after clearing, got %+v", result)
+	}
+}
+
+func TestMaxConnectAttempts_DialFailures(t *testing.T) {
+	// No transport security is configured, so every dial fails, and the
+	// server behind the address is never known.
+	cc := withTestDefaults(&ClientSetConfig{Address: "localhost:0", MaxConnectAttempts: 1})
+	cs := cc.NewAgentClientSet(nil, make(chan struct{}))
+
+	for i := 0; i < 3; i++ {
+		var cfe *ConnectionFailedError
+		if result := cs.connectOnce(); !errors.As(result.err, &cfe) {
+			t.Fatalf("attempt %d: expected dial failure, got %v", i, result.err)
+		}
+	}
+}
+
+func TestMaxConnectAttempts_StaticAddresses(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server1 := grpc.NewServer()
+	agent.RegisterAgentServiceServer(server1, &testProxyServer{serverID: "server1", serverCount: 2})
+	go server1.Serve(lis)
+	defer server1.Stop()
+	addr1 := lis.Addr().String()
+	addr2 := serveTestProxyServer(t, &testProxyServer{serverID: "server2", serverCount: 2})
+
+	cc := withTestDefaults(&ClientSetConfig{
+		Addresses:          []string{addr1, addr2},
+		MaxConnectAttempts: 1,
+		ProbeInterval:      time.Hour,
+		DialOptions:        []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())},
+	})
+	cs := cc.NewAgentClientSet(nil, make(chan struct{}))
+	defer cs.Wait()
+	defer cs.Shutdown()
+	for i := 0; i < 2; i++ {
+		if result := cs.connectOnce(); !result.added {
+			t.Fatalf("expected a client to be added, got %+v", result)
+		}
+	}
+
+	// Failed dials of addr1 count against server1, which was reached
+	// through it, and addr1 is skipped once server1 has failed.
+	server1.Stop()
+	cs.RemoveClient("server1")
+	var cfe *ConnectionFailedError
+	if result := cs.connectOnce(); !errors.As(result.err, &cfe) || cfe.Address != addr1 {
+		t.Fatalf("expected a dial failure of %s, got %+v", addr1, result)
+	}
+	if !cs.isFailedServer("server1") {
+		t.Fatal("expected server1 to be marked failed by the dial failure")
+	}
+	for i := 0; i < 2; i++ {
+		if address, err := cs.nextAddress(); err != nil || address != addr2 {
+			t.Errorf("expected %s, got %q, %v", addr2, address, err)
+		}
+	}
+
+	cs.recordServerFailure("server2")
+	var fse *FailedServerError
+	if result := cs.connectOnce(); !errors.As(result.err, &fse) {
+		t.Errorf("expected FailedServerError once every address is skipped, got %+v", result)
+	}
+
+	cs.ClearFailedServer("server1")
+	if address, err := cs.nextAddress(); err != nil || address != addr1 {
+		t.Errorf("expected %s after clearing server1, got %q, %v", addr1, address, err)
+	}
+}
@@ -0,0 +1,495 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// HealthyClientsCount returns the number of clients whose connection is
+// Ready.
+func (cs *ClientSet) HealthyClientsCount() int {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	var count int
+	for _, c := range cs.clients {
+		if c.conn != nil && c.conn.GetState() == connectivity.Ready {
+			count++
+		}
+	}
+	return count
+}
+
+// WaitForHealthy blocks until at least min clients are healthy, as per
+// HealthyClientsCount, checking every ProbeInterval. It returns an error
+// wrapping the context error if ctx is done first, or an error if the
+// ClientSet is shut down.
+func (cs *ClientSet) WaitForHealthy(ctx context.Context, min int) error {
+	if cs.HealthyClientsCount() >= min {
+		return nil
+	}
+	interval := cs.probeInterval
+	if interval <= 0 {
+		interval = defaultWaitForHealthyInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("waiting for %d healthy clients, %d healthy: %w", min, cs.HealthyClientsCount(), ctx.Err())
+		case <-cs.stopping.C():
+			return fmt.Errorf("client set shut down while waiting for %d healthy clients", min)
+		case <-ticker.C:
+			if cs.HealthyClientsCount() >= min {
+				return nil
+			}
+		}
+	}
+}
+
+// TestConnectivity checks that a tunnel to destination, e.g.
+// "kubernetes.default.svc:443", can be served. It requires a healthy client,
+// then serves a DIAL_REQ for destination as that client would, sends a
+// single byte through the tunnel and waits for any response before closing
+// it. The returned error names the step which failed. Tunnels are opened by
+// the proxy server, so the packets of the test tunnel are exchanged with
+// the ClientSet rather than sent to the server.
+func (cs *ClientSet) TestConnectivity(ctx context.Context, destination string) error {
+	var via *Client
+	cs.mu.Lock()
+	for _, c := range cs.clients {
+		if c.conn != nil && c.conn.GetState() == connectivity.Ready {
+			via = c
+			break
+		}
+	}
+	cs.mu.Unlock()
+	if via == nil {
+		return fmt.Errorf("no healthy connection to a proxy server")
+	}
+	return via.testTunnel(ctx, destination)
+}
+
+// ClientSetStatus is the coarse-grained state of a ClientSet.
+type ClientSetStatus int
+
+const (
+	// StatusInitializing indicates the ClientSet has no connected clients.
+	StatusInitializing ClientSetStatus = iota
+	// StatusRunning indicates at least MinHealthyFraction of the reported
+	// servers are connected.
+	StatusRunning
+	// StatusDegraded indicates some, but fewer than MinHealthyFraction, of
+	// the reported servers are connected.
+	StatusDegraded
+	// StatusDraining indicates the drain channel has been closed.
+	StatusDraining
+	// StatusStopped indicates the ClientSet has been stopped, shut down or
+	// has finished draining.
+	StatusStopped
+)
+
+func (s ClientSetStatus) String() string {
+	switch s {
+	case StatusInitializing:
+		return "Initializing"
+	case StatusRunning:
+		return "Running"
+	case StatusDegraded:
+		return "Degraded"
+	case StatusDraining:
+		return "Draining"
+	case StatusStopped:
+		return "Stopped"
+	default:
+		return "Unknown"
+	}
+}
+
+// statusWatchBuffer is the number of transitions buffered for each watcher.
+const statusWatchBuffer = 16
+
+// clientSetListener is a set of callbacks registered for the events of a
+// ClientSet. Unset callbacks are skipped.
+type clientSetListener struct {
+	connect      func(serverID string)
+	disconnect   func(serverID string)
+	healthyCount func(old, new int)
+	status       func(ClientSetStatus)
+}
+
+// addListener registers l to be notified of subsequent events.
+func (cs *ClientSet) addListener(l clientSetListener) {
+	cs.eventsStateMu.Lock()
+	defer cs.eventsStateMu.Unlock()
+	cs.listeners = append(cs.listeners, l)
+}
+
+// notify calls the listeners for the clients connected and disconnected, then
+// for the healthy count and the status if they changed since the last call.
+// Calls are serialized, so listeners observe transitions in order; they may
+// call back into the ClientSet, but must not add or remove clients. It must
+// not be called with cs.mu held.
+func (cs *ClientSet) notify(connected, disconnected []string) {
+	cs.eventsMu.Lock()
+	defer cs.eventsMu.Unlock()
+	count := cs.HealthyClientsCount()
+	status := cs.computeStatus()
+	cs.eventsStateMu.Lock()
+	listeners := cs.listeners
+	oldCount, oldStatus := cs.lastHealthyCount, cs.status
+	cs.lastHealthyCount, cs.status = count, status
+	cs.eventsStateMu.Unlock()
+
+	for _, serverID := range connected {
+		for _, l := range listeners {
+			if l.connect != nil {
+				l.connect(serverID)
+			}
+		}
+	}
+	for _, serverID := range disconnected {
+		for _, l := range listeners {
+			if l.disconnect != nil {
+				l.disconnect(serverID)
+			}
+		}
+	}
+	if count != oldCount {
+		for _, l := range listeners {
+			if l.healthyCount != nil {
+				l.healthyCount(oldCount, count)
+			}
+		}
+	}
+	if status != oldStatus {
+		cs.logger.V(2).Info("ClientSet status changed", "from", oldStatus, "to", status)
+		for _, l := range listeners {
+			if l.status != nil {
+				l.status(status)
+			}
+		}
+	}
+}
+
+// OnConnect registers fn to be called with the server ID whenever a client
+// is added. Callbacks are called synchronously, one at a time, without
+// holding the ClientSet lock, so they may call back into the ClientSet.
+func (cs *ClientSet) OnConnect(fn func(serverID string)) {
+	cs.addListener(clientSetListener{connect: fn})
+}
+
+// OnDisconnect registers fn to be called with the server ID whenever a
+// client is removed. See OnConnect.
+func (cs *ClientSet) OnDisconnect(fn func(serverID string)) {
+	cs.addListener(clientSetListener{disconnect: fn})
+}
+
+// OnHealthyCountChange registers fn to be called whenever the number of
+// clients in the Ready state changes. See OnConnect.
+func (cs *ClientSet) OnHealthyCountChange(fn func(old, new int)) {
+	cs.addListener(clientSetListener{healthyCount: fn})
+}
+
+// Status returns the current status of the ClientSet.
+func (cs *ClientSet) Status() ClientSetStatus {
+	cs.eventsStateMu.Lock()
+	defer cs.eventsStateMu.Unlock()
+	return cs.status
+}
+
+// Watch returns a channel on which each subsequent status transition is
+// sent. Transitions are dropped for watchers which fall behind, so use
+// Status for the current value.
+func (cs *ClientSet) Watch() <-chan ClientSetStatus {
+	ch := make(chan ClientSetStatus, statusWatchBuffer)
+	cs.addListener(clientSetListener{status: func(status ClientSetStatus) {
+		select {
+		case ch <- status:
+		default:
+			cs.logger.V(2).Info("Dropping status transition for slow watcher", "status", status)
+		}
+	}})
+	return ch
+}
+
+// HealthExplanation describes the status of the ClientSet for humans, e.g.
+// in readiness probe output, including the last connection error if any.
+func (cs *ClientSet) HealthExplanation() string {
+	explanation := fmt.Sprintf("%s, %d of %d proxy servers connected", cs.Status(), cs.HealthyClientsCount(), cs.ServerCount())
+	if err := cs.LastError(); err != nil {
+		explanation += "; last error: " + err.Error()
+	}
+	return explanation
+}
+
+// computeStatus derives the status from the lifecycle channels and the
+// number of connected clients.
+func (cs *ClientSet) computeStatus() ClientSetStatus {
+	select {
+	case <-cs.stopCh:
+		return StatusStopped
+	case <-cs.stopping.C():
+		return StatusStopped
+	case <-cs.drained.C():
+		return StatusStopped
+	default:
+	}
+	if cs.Draining() {
+		return StatusDraining
+	}
+	serverCount := cs.currentServerCount()
+	cs.mu.Lock()
+	connected := len(cs.clients)
+	cs.mu.Unlock()
+	switch {
+	case connected == 0:
+		return StatusInitializing
+	case float64(connected) >= cs.minHealthyFraction*float64(serverCount):
+		return StatusRunning
+	default:
+		return StatusDegraded
+	}
+}
+
+// HealthCheck reports the health of the connection to each server, keyed by
+// server ID. Healthy connections map to nil. Connections which are not Ready
+// are given until the ctx deadline to become Ready before an error
+// describing their state is reported.
+func (cs *ClientSet) HealthCheck(ctx context.Context) map[string]error {
+	return cs.probe(ctx, false)
+}
+
+// FanOutPing is HealthCheck, except that idle connections are asked to
+// reconnect first.
+func (cs *ClientSet) FanOutPing(ctx context.Context) map[string]error {
+	return cs.probe(ctx, true)
+}
+
+// probe checks the connection to every server concurrently, using the same
+// connection check as the client probe. All checks share the ctx deadline.
+func (cs *ClientSet) probe(ctx context.Context, reconnectIdle bool) map[string]error {
+	return cs.fanOut(func(serverID string, c *Client) error {
+		if reconnectIdle && c.conn != nil && c.conn.GetState() == connectivity.Idle {
+			c.conn.Connect()
+		}
+		return checkConnReady(ctx, serverID, c.conn)
+	})
+}
+
+// fanOut calls fn concurrently for every client and returns the results,
+// keyed by server ID.
+func (cs *ClientSet) fanOut(fn func(serverID string, c *Client) error) map[string]error {
+	clients := make(map[string]*Client)
+	cs.ForEachClient(func(serverID string, c *Client) bool {
+		clients[serverID] = c
+		return true
+	})
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	results := make(map[string]error, len(clients))
+	for serverID, c := range clients {
+		wg.Add(1)
+		go func(serverID string, c *Client) {
+			defer wg.Done()
+			err := fn(serverID, c)
+			mu.Lock()
+			results[serverID] = err
+			mu.Unlock()
+		}(serverID, c)
+	}
+	wg.Wait()
+	return results
+}
+
+// HeartbeatError is returned by Heartbeat when the HEARTBEAT packet could not
+// be sent to some servers. Failures maps their IDs to the send errors.
+type HeartbeatError struct {
+	Failures map[string]error
+}
+
+func (he *HeartbeatError) Error() string {
+	serverIDs := make([]string, 0, len(he.Failures))
+	for serverID := range he.Failures {
+		serverIDs = append(serverIDs, serverID)
+	}
+	sort.Strings(serverIDs)
+	failures := make([]string, 0, len(serverIDs))
+	for _, serverID := range serverIDs {
+		failures = append(failures, fmt.Sprintf("%s: %v", serverID, he.Failures[serverID]))
+	}
+	return "heartbeat failed for servers " + strings.Join(failures, "; ")
+}
+
+// Heartbeat sends a HEARTBEAT packet on the stream to every connected server
+// concurrently, and records the time on each client it was sent on. Unlike
+// HealthCheck, which checks the gRPC connections, it exercises the stream the
+// proxied traffic uses, and is meant to be called periodically; see
+// HeartbeatInterval. Clients whose stream fails are removed, as for any
+// other send. It returns a *HeartbeatError listing the failed servers.
+func (cs *ClientSet) Heartbeat() error {
+	failures := cs.fanOut(func(_ string, c *Client) error {
+		return c.sendHeartbeat()
+	})
+	for serverID, err := range failures {
+		if err == nil {
+			delete(failures, serverID)
+		}
+	}
+	if len(failures) > 0 {
+		return &HeartbeatError{Failures: failures}
+	}
+	return nil
+}
+
+func checkConnReady(ctx context.Context, serverID string, conn *grpc.ClientConn) error {
+	if conn == nil {
+		return fmt.Errorf("no connection to server %s", serverID)
+	}
+	for {
+		state := conn.GetState()
+		if state == connectivity.Ready {
+			return nil
+		}
+		if state == connectivity.Shutdown || !conn.WaitForStateChange(ctx, state) {
+			return fmt.Errorf("connection to server %s is %s", serverID, state)
+		}
+	}
+}
+
+// recordHealthEvent emits an event when the last Ready client is lost, and
+// when a Ready client is regained after that. It is an OnHealthyCountChange
+// callback, so it is called with eventsMu held. Losing the clients while
+// draining or shutting down is expected and is not reported.
+func (cs *ClientSet) recordHealthEvent(old, count int) {
+	switch {
+	case old > 0 && count == 0 && !cs.unhealthy:
+		if cs.isShutdown() || cs.Draining() {
+			return
+		}
+		cs.unhealthy = true
+		cs.eventRecorder.Eventf(cs.podRef, corev1.EventTypeWarning, EventReasonAgentUnhealthy,
+			"Agent %s lost its connections to all proxy servers", cs.agentID)
+	case count > 0 && cs.unhealthy:
+		cs.unhealthy = false
+		cs.eventRecorder.Eventf(cs.podRef, corev1.EventTypeNormal, EventReasonAgentHealthy,
+			"Agent %s is connected to %d proxy server(s)", cs.agentID, count)
+	}
+}
+
+// watchConnState notifies the listeners whenever the
+// connection of c changes state, e.g. from Ready to TransientFailure while
+// the client is still in the ClientSet, until Serve of c returns.
+func (cs *ClientSet) watchConnState(c *Client) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-c.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	state := c.conn.GetState()
+	for c.conn.WaitForStateChange(ctx, state) {
+		state = c.conn.GetState()
+		cs.notify(nil, nil)
+	}
+}
+
+// heartbeat calls Heartbeat every heartbeatInterval until the ClientSet
+// stops.
+func (cs *ClientSet) heartbeat() {
+	ticker := time.NewTicker(cs.heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-cs.stopCh:
+			return
+		case <-cs.stopping.C():
+			return
+		case <-ticker.C:
+			if err := cs.Heartbeat(); err != nil {
+				cs.logger.Error(err, "Heartbeat failed", "agentID", cs.agentID)
+			}
+		}
+	}
+}
+
+// reap periodically removes unhealthy clients until the ClientSet stops.
+func (cs *ClientSet) reap() {
+	ticker := time.NewTicker(cs.probeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-cs.stopCh:
+			return
+		case <-cs.stopping.C():
+			return
+		case <-ticker.C:
+			cs.reapUnhealthyClients()
+		}
+	}
+}
+
+// reapUnhealthyClients closes and removes clients whose connection has shut
+// down, or has not been Ready for longer than unhealthyTimeout. It returns
+// the number of clients removed.
+func (cs *ClientSet) reapUnhealthyClients() int {
+	now := time.Now()
+	cs.mu.Lock()
+	var removed []string
+	for serverID, c := range cs.clients {
+		if c.conn == nil {
+			continue
+		}
+		state := c.conn.GetState()
+		if state == connectivity.Ready {
+			c.unhealthySince = time.Time{}
+			continue
+		}
+		if c.unhealthySince.IsZero() {
+			c.unhealthySince = now
+		}
+		if state != connectivity.Shutdown && now.Sub(c.unhealthySince) < cs.unhealthyTimeout {
+			continue
+		}
+		cs.logger.V(1).Info("Reaping unhealthy client", "serverID", serverID, "state", state, "unhealthySince", c.unhealthySince)
+		c.Close()
+		delete(cs.clients, serverID)
+		removed = append(removed, serverID)
+	}
+	if len(removed) > 0 {
+		cs.agentMetrics().SetServerConnectionsCount(cs.agentID, len(cs.clients))
+	}
+	cs.mu.Unlock()
+	if len(removed) > 0 {
+		cs.notify(nil, removed)
+	}
+	return len(removed)
+}
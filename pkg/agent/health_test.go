@@ -0,0 +1,582 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/record"
+
+	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/agent/metrics"
+	"sigs.k8s.io/apiserver-network-proxy/proto/agent"
+)
+
+func TestOnHealthyCountChange(t *testing.T) {
+	cs := withTestDefaults(&ClientSetConfig{}).NewAgentClientSet(nil, make(chan struct{}))
+	type transition struct{ old, new int }
+	var got []transition
+	cs.OnHealthyCountChange(func(old, new int) {
+		got = append(got, transition{old, new})
+		// Re-entrant calls must not deadlock.
+		cs.HealthyClientsCount()
+	})
+
+	for _, serverID := range []string{"server1", "server2"} {
+		c := &Client{cs: cs, conn: newReadyConn(t), serverID: serverID, stopCh: make(chan struct{})}
+		if err := cs.AddClient(serverID, c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := cs.RemoveClient("server1"); err != nil {
+		t.Fatal(err)
+	}
+	// Removing an unknown server does not change the healthy count.
+	cs.RemoveClient("server1")
+
+	expected := []transition{{0, 1}, {1, 2}, {2, 1}}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected transitions %v, got %v", expected, got)
+	}
+}
+
+func TestOnHealthyCountChange_ConnStateAndShutdown(t *testing.T) {
+	cs := withTestDefaults(&ClientSetConfig{}).NewAgentClientSet(nil, make(chan struct{}))
+	type transition struct{ old, new int }
+	transitions := make(chan transition, 10)
+	cs.OnHealthyCountChange(func(old, new int) {
+		transitions <- transition{old, new}
+	})
+	expectTransition := func(expected transition) {
+		t.Helper()
+		select {
+		case got := <-transitions:
+			if got != expected {
+				t.Errorf("expected transition %v, got %v", expected, got)
+			}
+		case <-time.After(wait.ForeverTestTimeout):
+			t.Fatalf("expected transition %v, got none", expected)
+		}
+	}
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	go server.Serve(lis)
+	defer server.Stop()
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), wait.ForeverTestTimeout)
+	defer cancel()
+	if err := checkConnReady(ctx, "server1", conn); err != nil {
+		t.Fatal(err)
+	}
+	c := &Client{cs: cs, conn: conn, serverID: "server1", stopCh: make(chan struct{})}
+	if err := cs.AddClient("server1", c); err != nil {
+		t.Fatal(err)
+	}
+	expectTransition(transition{0, 1})
+
+	// The connection leaves Ready while the client is still in the
+	// ClientSet.
+	watched := make(chan struct{})
+	go func() {
+		defer close(watched)
+		cs.watchConnState(c)
+	}()
+	server.Stop()
+	expectTransition(transition{1, 0})
+	if !cs.HasID("server1") {
+		t.Error("expected the client to still be in the ClientSet")
+	}
+	close(c.doneCh())
+	<-watched
+
+	// Clients dropped by shutdown are reported too.
+	c2 := &Client{cs: cs, conn: newReadyConn(t), serverID: "server2", stopCh: make(chan struct{})}
+	if err := cs.AddClient("server2", c2); err != nil {
+		t.Fatal(err)
+	}
+	expectTransition(transition{0, 1})
+	cs.shutdown()
+	expectTransition(transition{1, 0})
+}
+
+func TestOnConnectAndDisconnect(t *testing.T) {
+	cs := withTestDefaults(&ClientSetConfig{}).NewAgentClientSet(nil, make(chan struct{}))
+	var got []string
+	for _, prefix := range []string{"a", "b"} {
+		prefix := prefix
+		cs.OnConnect(func(serverID string) {
+			got = append(got, prefix+" connect "+serverID)
+			// Re-entrant calls must not deadlock.
+			cs.ClientsCount()
+		})
+		cs.OnDisconnect(func(serverID string) {
+			got = append(got, prefix+" disconnect "+serverID)
+		})
+	}
+
+	c := &Client{cs: cs, conn: newReadyConn(t), serverID: "server1", stopCh: make(chan struct{})}
+	if err := cs.AddClient("server1", c); err != nil {
+		t.Fatal(err)
+	}
+	// Adding a duplicate server does not connect.
+	cs.AddClient("server1", c)
+	if err := cs.RemoveClient("server1"); err != nil {
+		t.Fatal(err)
+	}
+	// Removing an unknown server does not disconnect.
+	cs.RemoveClient("server1")
+
+	expected := []string{"a connect server1", "b connect server1", "a disconnect server1", "b disconnect server1"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected callbacks %v, got %v", expected, got)
+	}
+}
+
+func TestKubeEventRecorder(t *testing.T) {
+	recorder := record.NewFakeRecorder(10)
+	cs := withTestDefaults(&ClientSetConfig{
+		KubeEventRecorder: recorder,
+		PodReference:      &corev1.ObjectReference{Kind: "Pod", Namespace: "kube-system", Name: "konnectivity-agent-1"},
+	}).NewAgentClientSet(nil, make(chan struct{}))
+	addClient := func(serverID string) {
+		t.Helper()
+		c := &Client{cs: cs, conn: newReadyConn(t), serverID: serverID, stopCh: make(chan struct{})}
+		if err := cs.AddClient(serverID, c); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Connecting for the first time is not a recovery.
+	addClient("server1")
+	addClient("server2")
+	cs.RemoveClient("server1")
+	cs.RemoveClient("server2")
+	addClient("server3")
+
+	close(recorder.Events)
+	var got []string
+	for event := range recorder.Events {
+		got = append(got, event)
+	}
+	expected := []string{
+		"Warning AgentUnhealthy Agent agent1 lost its connections to all proxy servers",
+		"Normal AgentHealthy Agent agent1 is connected to 1 proxy server(s)",
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected events %q, got %q", expected, got)
+	}
+}
+
+// newReadyConn returns a client connection to a local gRPC server which has
+// reached the Ready state.
+func TestWaitForHealthy(t *testing.T) {
+	newClientSet := func() *ClientSet {
+		return withTestDefaults(&ClientSetConfig{ProbeInterval: 10 * time.Millisecond}).NewAgentClientSet(nil, make(chan struct{}))
+	}
+	addHealthyClient := func(cs *ClientSet, serverID string) {
+		c := &Client{cs: cs, conn: newReadyConn(t), serverID: serverID, stopCh: make(chan struct{})}
+		if err := cs.AddClient(serverID, c); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("already satisfied", func(t *testing.T) {
+		cs := newClientSet()
+		addHealthyClient(cs, "server1")
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if err := cs.WaitForHealthy(ctx, 1); err != nil {
+			t.Errorf("expected no error, got %v", err)
+		}
+		if err := cs.WaitForHealthy(ctx, 0); err != nil {
+			t.Errorf("expected no error for zero clients, got %v", err)
+		}
+	})
+
+	t.Run("success", func(t *testing.T) {
+		cs := newClientSet()
+		addHealthyClient(cs, "server1")
+		done := make(chan error, 1)
+		go func() {
+			done <- cs.WaitForHealthy(context.Background(), 2)
+		}()
+		select {
+		case err := <-done:
+			t.Fatalf("expected WaitForHealthy to block with 1 healthy client, got %v", err)
+		case <-time.After(50 * time.Millisecond):
+		}
+		addHealthyClient(cs, "server2")
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Errorf("expected no error, got %v", err)
+			}
+		case <-time.After(wait.ForeverTestTimeout):
+			t.Fatal("WaitForHealthy did not return once 2 clients were healthy")
+		}
+	})
+
+	t.Run("context cancelled", func(t *testing.T) {
+		cs := newClientSet()
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		if err := cs.WaitForHealthy(ctx, 1); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("expected a deadline exceeded error, got %v", err)
+		}
+	})
+}
+
+func TestTestConnectivity(t *testing.T) {
+	// listen serves each connection to a local listener with handle.
+	listen := func(handle func(net.Conn)) string {
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { lis.Close() })
+		go func() {
+			for {
+				conn, err := lis.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					defer conn.Close()
+					handle(conn)
+				}()
+			}
+		}()
+		return lis.Addr().String()
+	}
+	echo := listen(func(conn net.Conn) { io.Copy(conn, conn) })
+	// Reading the byte first makes closing send a FIN rather than a RST.
+	hangUp := listen(func(conn net.Conn) { conn.Read(make([]byte, 1)) })
+	silent := listen(func(conn net.Conn) { io.Copy(io.Discard, conn) })
+	// Nothing listens on the address of a closed listener.
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := lis.Addr().String()
+	lis.Close()
+
+	cs := withTestDefaults(&ClientSetConfig{}).NewAgentClientSet(nil, make(chan struct{}))
+	if err := cs.TestConnectivity(context.Background(), echo); err == nil || !strings.Contains(err.Error(), "no healthy connection") {
+		t.Errorf("expected an error without a proxy server, got %v", err)
+	}
+	c := &Client{cs: cs, conn: newReadyConn(t), serverID: "server1", stopCh: make(chan struct{})}
+	if err := cs.AddClient("server1", c); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name        string
+		destination string
+		timeout     time.Duration
+		errMsg      string
+	}{
+		{name: "echo", destination: echo},
+		{name: "refused", destination: closed, errMsg: "failed to dial"},
+		{name: "hang up", destination: hangUp, errMsg: "closed the connection without responding"},
+		{name: "no response", destination: silent, timeout: 500 * time.Millisecond, errMsg: "no response"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tc.timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tc.timeout)
+				defer cancel()
+			}
+			err := cs.TestConnectivity(ctx, tc.destination)
+			if tc.errMsg == "" {
+				if err != nil {
+					t.Errorf("expected no error, got %v", err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tc.errMsg) {
+				t.Errorf("expected error containing %q, got %v", tc.errMsg, err)
+			}
+		})
+	}
+	// The test tunnels are served beside the client, which stays connected.
+	if !cs.HasID("server1") {
+		t.Error("expected the client to remain in the ClientSet")
+	}
+	if n := c.ActiveTunnels(); n != 0 {
+		t.Errorf("expected no tunnels on the client, got %d", n)
+	}
+}
+
+func TestFanOutPing(t *testing.T) {
+	cs := withTestDefaults(&ClientSetConfig{}).NewAgentClientSet(nil, make(chan struct{}))
+	for _, serverID := range []string{"healthy1", "healthy2"} {
+		cs.clients[serverID] = &Client{serverID: serverID, conn: newReadyConn(t)}
+	}
+	// Nothing listens on these addresses, so the connections never become
+	// Ready.
+	for _, serverID := range []string{"unhealthy1", "unhealthy2"} {
+		conn, err := grpc.Dial("localhost:0", grpc.WithTransportCredentials(insecure.NewCredentials()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		cs.clients[serverID] = &Client{serverID: serverID, conn: conn}
+	}
+
+	const timeout = 200 * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	start := time.Now()
+	results := cs.FanOutPing(ctx)
+	// All pings share the deadline, rather than each unhealthy server
+	// waiting out its own.
+	if elapsed := time.Since(start); elapsed > 2*timeout {
+		t.Errorf("expected pings to share the %v deadline, took %v", timeout, elapsed)
+	}
+	if len(results) != 4 {
+		t.Fatalf("expected 4 results, got %v", results)
+	}
+	for _, serverID := range []string{"healthy1", "healthy2"} {
+		if err := results[serverID]; err != nil {
+			t.Errorf("expected %s to report nil, got %v", serverID, err)
+		}
+	}
+	for _, serverID := range []string{"unhealthy1", "unhealthy2"} {
+		if err := results[serverID]; err == nil {
+			t.Errorf("expected %s to report an error", serverID)
+		}
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	cs := withTestDefaults(&ClientSetConfig{}).NewAgentClientSet(nil, make(chan struct{}))
+	servers := map[string]agent.AgentService_ConnectClient{}
+	for _, serverID := range []string{"server1", "server2"} {
+		clientStream, serverStream := pipe()
+		servers[serverID] = serverStream
+		if err := cs.AddClient(serverID, &Client{cs: cs, serverID: serverID, stream: clientStream}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	broken := &Client{
+		cs:       cs,
+		serverID: "broken",
+		conn:     newReadyConn(t),
+		stopCh:   make(chan struct{}),
+		stream:   &brokenStream{sendErr: errors.New("stream reset")},
+	}
+	if err := cs.AddClient("broken", broken); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	err := cs.Heartbeat()
+	var he *HeartbeatError
+	if !errors.As(err, &he) || len(he.Failures) != 1 || he.Failures["broken"] == nil {
+		t.Fatalf("expected a HeartbeatError for the broken server only, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "broken: stream reset") {
+		t.Errorf("expected the error to name the failed server, got %q", err)
+	}
+	for serverID, stream := range servers {
+		if pkt, err := stream.Recv(); err != nil || pkt.Type != client.PacketType_HEARTBEAT {
+			t.Errorf("%s: expected a HEARTBEAT packet, got %v (err: %v)", serverID, pkt, err)
+		}
+		cs.mu.Lock()
+		c := cs.clients[serverID]
+		cs.mu.Unlock()
+		if last := c.LastHeartbeatTime(); last.Before(start) {
+			t.Errorf("%s: expected the heartbeat time to be recorded, got %v", serverID, last)
+		}
+	}
+	if !broken.LastHeartbeatTime().IsZero() {
+		t.Errorf("expected no heartbeat time for the broken server, got %v", broken.LastHeartbeatTime())
+	}
+	// A client whose stream fails is removed, as on any failed send.
+	if cs.HasID("broken") {
+		t.Error("expected the broken client to be removed")
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	cs := withTestDefaults(&ClientSetConfig{}).NewAgentClientSet(nil, make(chan struct{}))
+	// Nothing listens on the address, so the connection never becomes Ready.
+	unhealthy, err := grpc.Dial("localhost:0", grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unhealthy.Close()
+	cs.clients["healthy"] = &Client{serverID: "healthy", conn: newReadyConn(t)}
+	cs.clients["unhealthy"] = &Client{serverID: "unhealthy", conn: unhealthy}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	results := cs.HealthCheck(ctx)
+	if len(results) != 2 {
+		t.Fatalf("expected 2 results, got %v", results)
+	}
+	if err := results["healthy"]; err != nil {
+		t.Errorf("expected healthy server to report nil, got %v", err)
+	}
+	if err := results["unhealthy"]; err == nil {
+		t.Error("expected unhealthy server to report an error")
+	}
+}
+
+func TestStatus(t *testing.T) {
+	testCases := []struct {
+		name               string
+		serverCount        int
+		minHealthyFraction float64
+		expected           ClientSetStatus
+	}{
+		{name: "all connected", serverCount: 1, expected: StatusRunning},
+		{name: "below default fraction", serverCount: 2, expected: StatusDegraded},
+		{name: "at custom fraction", serverCount: 2, minHealthyFraction: 0.5, expected: StatusRunning},
+		{name: "below custom fraction", serverCount: 4, minHealthyFraction: 0.5, expected: StatusDegraded},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			addr := newTestProxyServer(t, "server1", tc.serverCount)
+			cc := withTestDefaults(&ClientSetConfig{
+				Address:            addr,
+				ProbeInterval:      time.Hour,
+				MinHealthyFraction: tc.minHealthyFraction,
+				DialOptions:        []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())},
+			})
+			cs := cc.NewAgentClientSet(nil, make(chan struct{}))
+			defer cs.Wait()
+			defer cs.Shutdown()
+
+			if got := cs.Status(); got != StatusInitializing {
+				t.Errorf("expected %v before connecting, got %v", StatusInitializing, got)
+			}
+			if result := cs.connectOnce(); result.err != nil || !result.added {
+				t.Fatalf("expected connectOnce to add a client, got %+v", result)
+			}
+			if got := cs.Status(); got != tc.expected {
+				t.Errorf("expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestStatus_Watch(t *testing.T) {
+	addr := newTestProxyServer(t, "server1", 1)
+	cc := withTestDefaults(&ClientSetConfig{
+		Address:       addr,
+		ProbeInterval: time.Hour,
+		DialOptions:   []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())},
+	})
+	drainCh := make(chan struct{})
+	cs := cc.NewAgentClientSet(drainCh, make(chan struct{}))
+	watch := cs.Watch()
+
+	if result := cs.connectOnce(); result.err != nil || !result.added {
+		t.Fatalf("expected connectOnce to add a client, got %+v", result)
+	}
+	cs.Serve()
+	close(drainCh)
+	<-cs.Drained()
+	cs.Shutdown()
+	cs.Wait()
+
+	expected := []ClientSetStatus{StatusRunning, StatusDraining, StatusStopped}
+	for _, want := range expected {
+		select {
+		case got := <-watch:
+			if got != want {
+				t.Errorf("expected transition to %v, got %v", want, got)
+			}
+		case <-time.After(wait.ForeverTestTimeout):
+			t.Fatalf("timed out waiting for transition to %v", want)
+		}
+	}
+	select {
+	case got := <-watch:
+		t.Errorf("unexpected transition to %v", got)
+	default:
+	}
+	if got := cs.Status(); got != StatusStopped {
+		t.Errorf("expected %v, got %v", StatusStopped, got)
+	}
+}
+
+func TestReapUnhealthyClients(t *testing.T) {
+	metrics.Metrics.Reset()
+	cs := withTestDefaults(&ClientSetConfig{
+		ProbeInterval:    time.Hour,
+		UnhealthyTimeout: time.Minute,
+	}).NewAgentClientSet(nil, make(chan struct{}))
+
+	newClient := func(serverID string, conn *grpc.ClientConn) *Client {
+		c := &Client{cs: cs, conn: conn, serverID: serverID, stopCh: make(chan struct{})}
+		if err := cs.AddClient(serverID, c); err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	newClient("ready", newReadyConn(t))
+	shutdownConn := newReadyConn(t)
+	shutdownConn.Close()
+	newClient("shutdown", shutdownConn)
+	// Nothing listens on port 0, so this connection never becomes Ready.
+	failing, err := grpc.Dial("localhost:0", grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	failingClient := newClient("failing", failing)
+
+	if removed := cs.reapUnhealthyClients(); removed != 1 {
+		t.Errorf("expected 1 client reaped, got %d", removed)
+	}
+	if got, expected := cs.ListServerIDs(), []string{"failing", "ready"}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected clients %v, got %v", expected, got)
+	}
+	if got := serverConnectionsGauge(t); got != 2 {
+		t.Errorf("expected open server connections metric 2, got %v", got)
+	}
+
+	// Once the unhealthy timeout has passed, the failing client is reaped too.
+	cs.mu.Lock()
+	failingClient.unhealthySince = time.Now().Add(-2 * time.Minute)
+	cs.mu.Unlock()
+	if removed := cs.reapUnhealthyClients(); removed != 1 {
+		t.Errorf("expected 1 client reaped, got %d", removed)
+	}
+	if got, expected := cs.ListServerIDs(), []string{"ready"}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected clients %v, got %v", expected, got)
+	}
+}
@@ -0,0 +1,93 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"unicode"
+
+	"sigs.k8s.io/apiserver-network-proxy/proto/header"
+)
+
+// repeatableIdentifiers are the identifier types an agent may have several
+// of. The proxy server only uses the first value of the other types.
+var repeatableIdentifiers = map[header.IdentifierType]bool{
+	header.IPv4: true,
+	header.IPv6: true,
+	header.Host: true,
+	header.CIDR: true,
+}
+
+// ValidateAgentIdentifiers checks that identifiers, URL query encoded as in
+// "host=node1&host=node1.local&ipv4=10.0.0.1", would be understood by the
+// proxy server, which otherwise silently drops what it cannot parse. It
+// reports every malformed pair, empty key or value, disallowed character,
+// and repeated identifier type which only takes one value. Unknown types are
+// not rejected, so that agents may send types newer than the server's.
+func ValidateAgentIdentifiers(identifiers string) error {
+	var errs []error
+	counts := make(map[string]int)
+	for _, pair := range strings.Split(identifiers, "&") {
+		if pair == "" {
+			continue
+		}
+		// The identifiers are sent as is in a gRPC header, which only
+		// carries printable ASCII, and the server's query parsing
+		// rejects semicolons.
+		if i := strings.IndexFunc(pair, func(r rune) bool {
+			return r < ' ' || r > '~' || r == ';'
+		}); i >= 0 {
+			errs = append(errs, fmt.Errorf("agent identifier %q has disallowed character %q; it must be URL encoded", pair, pair[i]))
+			continue
+		}
+		rawKey, rawValue, ok := strings.Cut(pair, "=")
+		if !ok {
+			errs = append(errs, fmt.Errorf("agent identifier %q must be of the form key=value", pair))
+			continue
+		}
+		key, err := url.QueryUnescape(rawKey)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("agent identifier %q has a malformed key: %v", pair, err))
+			continue
+		}
+		value, err := url.QueryUnescape(rawValue)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("agent identifier %q has a malformed value: %v", pair, err))
+			continue
+		}
+		if key == "" {
+			errs = append(errs, fmt.Errorf("agent identifier %q has an empty key", pair))
+		}
+		if value == "" {
+			errs = append(errs, fmt.Errorf("agent identifier %q has an empty value", pair))
+		}
+		if strings.IndexFunc(key+value, unicode.IsControl) >= 0 {
+			errs = append(errs, fmt.Errorf("agent identifier %q has a control character", pair))
+		}
+		if key == "" {
+			continue
+		}
+		counts[key]++
+		if counts[key] == 2 && !repeatableIdentifiers[header.IdentifierType(key)] {
+			errs = append(errs, fmt.Errorf("agent identifier %q must not be set more than once", key))
+		}
+	}
+	return errors.Join(errs...)
+}
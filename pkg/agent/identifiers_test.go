@@ -0,0 +1,145 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+
+	"sigs.k8s.io/apiserver-network-proxy/proto/header"
+)
+
+func TestValidateAgentIdentifiers(t *testing.T) {
+	testCases := []struct {
+		name        string
+		identifiers string
+		expected    []string
+	}{
+		{name: "empty"},
+		{name: "single", identifiers: "host=node1"},
+		{name: "repeated host", identifiers: "host=node1&host=node1.local&ipv4=10.0.0.1&ipv4=10.0.0.2"},
+		{name: "encoded", identifiers: "cidr=10.0.0.0%2F8&zone=us%20east"},
+		{name: "unknown type", identifiers: "rack=r1"},
+		{name: "trailing separator", identifiers: "host=node1&"},
+		{
+			name:        "empty key",
+			identifiers: "=node1",
+			expected:    []string{"empty key"},
+		},
+		{
+			name:        "empty value",
+			identifiers: "host=",
+			expected:    []string{"empty value"},
+		},
+		{
+			name:        "missing separator",
+			identifiers: "host",
+			expected:    []string{"key=value"},
+		},
+		{
+			name:        "duplicate key",
+			identifiers: "default-route=true&default-route=false&default-route=true",
+			expected:    []string{`"default-route" must not be set more than once`},
+		},
+		{
+			name:        "malformed escape",
+			identifiers: "host=node%zz",
+			expected:    []string{"malformed value"},
+		},
+		{
+			name:        "non-ASCII",
+			identifiers: "zone=zürich",
+			expected:    []string{"disallowed character"},
+		},
+		{
+			name:        "semicolon",
+			identifiers: "host=node1;host=node2",
+			expected:    []string{"disallowed character"},
+		},
+		{
+			name:        "encoded control character",
+			identifiers: "host=node1%0A",
+			expected:    []string{"control character"},
+		},
+		{
+			name:        "every violation",
+			identifiers: "=a&host=&qos=1&qos=2",
+			expected:    []string{"empty key", "empty value", `"qos"`},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := ValidateAgentIdentifiers(tc.identifiers)
+			if len(tc.expected) == 0 {
+				if err != nil {
+					t.Errorf("expected no error, got %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("expected an error containing %q", tc.expected)
+			}
+			for _, expected := range tc.expected {
+				if !strings.Contains(err.Error(), expected) {
+					t.Errorf("expected error to contain %q, got %v", expected, err)
+				}
+			}
+		})
+	}
+}
+
+func FuzzValidateAgentIdentifiers(f *testing.F) {
+	for _, seed := range []string{
+		"",
+		"host=node1",
+		"host=node1&host=node1.local&ipv4=10.0.0.1&default-route=true",
+		"cidr=10.0.0.0%2F8&zone=us-east-1a&region=us-east-1&node=node1&qos=high",
+		"=node1",
+		"host=",
+		"host",
+		"qos=1&qos=2",
+		"host=%zz",
+		"host=a;host=b",
+		"&&=&",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, identifiers string) {
+		if err := ValidateAgentIdentifiers(identifiers); err != nil {
+			return
+		}
+		// Whatever is accepted must be understood by the proxy server.
+		decoded, err := url.ParseQuery(identifiers)
+		if err != nil {
+			t.Fatalf("accepted %q, which the server fails to parse: %v", identifiers, err)
+		}
+		for key, values := range decoded {
+			if key == "" {
+				t.Errorf("accepted %q with an empty key", identifiers)
+			}
+			for _, value := range values {
+				if value == "" {
+					t.Errorf("accepted %q with an empty value for %q", identifiers, key)
+				}
+			}
+			if len(values) > 1 && !repeatableIdentifiers[header.IdentifierType(key)] {
+				t.Errorf("accepted %q with %q set %d times", identifiers, key, len(values))
+			}
+		}
+	})
+}
@@ -0,0 +1,169 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+	"k8s.io/utils/clock"
+)
+
+// ServerLeaseCounter counts the proxy servers in the cluster from the
+// unexpired Leases they hold. The count is maintained by informer event
+// handlers, and by a timer when a Lease expires without being renewed, so
+// Count does not make any API server calls.
+type ServerLeaseCounter struct {
+	namespace string
+	selector  labels.Selector
+	hasSynced cache.InformerSynced
+
+	clock clock.WithDelayedExecution // times Lease expiry; replaced by a fake clock in tests.
+
+	mu     sync.Mutex           // protects leases and timer.
+	leases map[string]time.Time // expiry times of the matching Leases, by key.
+	timer  clock.Timer          // recounts at the next expiry; nil if none.
+	count  atomic.Int64
+}
+
+// NewInformerServerLeaseCounter creates a ServerLeaseCounter counting the
+// Leases in namespace matching labelSelector, as seen by informer. The
+// informer must watch coordination.k8s.io/v1 Leases; it is not started by
+// the counter. An invalid labelSelector is logged and matches no Leases.
+func NewInformerServerLeaseCounter(informer cache.SharedIndexInformer, namespace, labelSelector string) *ServerLeaseCounter {
+	selector, err := labels.Parse(labelSelector)
+	if err != nil {
+		klog.ErrorS(err, "Invalid server lease label selector, no leases will be counted", "labelSelector", labelSelector)
+		selector = labels.Nothing()
+	}
+	lc := &ServerLeaseCounter{
+		namespace: namespace,
+		selector:  selector,
+		clock:     clock.RealClock{},
+		leases:    make(map[string]time.Time),
+	}
+	registration, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    lc.update,
+		UpdateFunc: func(_, obj interface{}) { lc.update(obj) },
+		DeleteFunc: lc.delete,
+	})
+	if err != nil {
+		klog.ErrorS(err, "Failed to add server lease event handler, the lease count will never be ready")
+		return lc
+	}
+	// Unlike informer.HasSynced, this waits for the initial Leases to have
+	// been delivered to the handlers.
+	lc.hasSynced = registration.HasSynced
+	return lc
+}
+
+// Count returns the number of matching unexpired Leases. It may undercount
+// until Ready returns true.
+func (lc *ServerLeaseCounter) Count() int {
+	return int(lc.count.Load())
+}
+
+// Ready returns true once the informer has synced, so that Count reflects
+// all the matching Leases.
+func (lc *ServerLeaseCounter) Ready() bool {
+	return lc.hasSynced != nil && lc.hasSynced()
+}
+
+func (lc *ServerLeaseCounter) matches(lease *coordinationv1.Lease) bool {
+	return lease.Namespace == lc.namespace && lc.selector.Matches(labels.Set(lease.Labels))
+}
+
+// leaseExpiry returns when lease expires if it is not renewed, or the zero
+// time if it has never been renewed.
+func leaseExpiry(lease *coordinationv1.Lease) time.Time {
+	if lease.Spec.RenewTime == nil || lease.Spec.LeaseDurationSeconds == nil {
+		return time.Time{}
+	}
+	return lease.Spec.RenewTime.Add(time.Duration(*lease.Spec.LeaseDurationSeconds) * time.Second)
+}
+
+// update adds or removes the Lease depending on whether it currently
+// matches, since an update may change its labels.
+func (lc *ServerLeaseCounter) update(obj interface{}) {
+	lease, ok := obj.(*coordinationv1.Lease)
+	if !ok {
+		klog.V(2).InfoS("Ignoring unexpected object in lease informer", "object", obj)
+		return
+	}
+	key, err := cache.MetaNamespaceKeyFunc(lease)
+	if err != nil {
+		klog.ErrorS(err, "Failed to get lease key")
+		return
+	}
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	if lc.matches(lease) {
+		lc.leases[key] = leaseExpiry(lease)
+	} else {
+		delete(lc.leases, key)
+	}
+	lc.recountLocked()
+}
+
+func (lc *ServerLeaseCounter) delete(obj interface{}) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		klog.ErrorS(err, "Failed to get lease key")
+		return
+	}
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	delete(lc.leases, key)
+	lc.recountLocked()
+}
+
+func (lc *ServerLeaseCounter) recount() {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	lc.recountLocked()
+}
+
+// recountLocked counts the unexpired Leases, and sets the timer to count
+// them again when the next one expires. Expired Leases are kept, since they
+// count again if they are renewed.
+func (lc *ServerLeaseCounter) recountLocked() {
+	now := lc.clock.Now()
+	var count int
+	var next time.Time
+	for _, expiry := range lc.leases {
+		if !expiry.After(now) {
+			continue
+		}
+		count++
+		if next.IsZero() || expiry.Before(next) {
+			next = expiry
+		}
+	}
+	lc.count.Store(int64(count))
+	if lc.timer != nil {
+		lc.timer.Stop()
+		lc.timer = nil
+	}
+	if !next.IsZero() {
+		lc.timer = lc.clock.AfterFunc(next.Sub(now), lc.recount)
+	}
+}
@@ -0,0 +1,167 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"testing"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/utils/clock"
+	clocktesting "k8s.io/utils/clock/testing"
+)
+
+// newLease returns a Lease renewed now, for an hour.
+func newLease(namespace, name string, lbls map[string]string) *coordinationv1.Lease {
+	return renewLease(&coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, Labels: lbls},
+	}, time.Now(), time.Hour)
+}
+
+// renewLease sets the renew time and duration of lease, and returns it.
+func renewLease(lease *coordinationv1.Lease, renewTime time.Time, duration time.Duration) *coordinationv1.Lease {
+	seconds := int32(duration / time.Second)
+	lease.Spec.RenewTime = &metav1.MicroTime{Time: renewTime}
+	lease.Spec.LeaseDurationSeconds = &seconds
+	return lease
+}
+
+// newFakeLeaseInformer returns an informer listing initial and then
+// receiving events from the returned watcher.
+func newFakeLeaseInformer(initial ...coordinationv1.Lease) (cache.SharedIndexInformer, *watch.FakeWatcher) {
+	watcher := watch.NewFake()
+	lw := &cache.ListWatch{
+		ListFunc: func(metav1.ListOptions) (runtime.Object, error) {
+			return &coordinationv1.LeaseList{Items: initial}, nil
+		},
+		WatchFunc: func(metav1.ListOptions) (watch.Interface, error) {
+			return watcher, nil
+		},
+	}
+	return cache.NewSharedIndexInformer(lw, &coordinationv1.Lease{}, 0, cache.Indexers{}), watcher
+}
+
+func TestInformerServerLeaseCounter(t *testing.T) {
+	server := map[string]string{"k8s-app": "konnectivity-server"}
+	other := map[string]string{"k8s-app": "other"}
+	informer, watcher := newFakeLeaseInformer(
+		*newLease("kube-system", "server1", server),
+		*newLease("kube-system", "other", other),
+		*newLease("default", "server2", server),
+	)
+	lc := NewInformerServerLeaseCounter(informer, "kube-system", "k8s-app=konnectivity-server")
+	if lc.Ready() {
+		t.Error("expected counter not to be ready before the informer has synced")
+	}
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go informer.Run(stopCh)
+	if !cache.WaitForCacheSync(stopCh, informer.HasSynced) {
+		t.Fatal("informer never synced")
+	}
+	if !cache.WaitForCacheSync(stopCh, lc.Ready) {
+		t.Fatal("counter never became ready")
+	}
+
+	expectCount := func(expected int) {
+		t.Helper()
+		if err := wait.PollImmediate(10*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+			return lc.Count() == expected, nil
+		}); err != nil {
+			t.Fatalf("expected count %d, got %d", expected, lc.Count())
+		}
+	}
+	expectCount(1)
+
+	watcher.Add(newLease("kube-system", "server3", server))
+	expectCount(2)
+	// Relabeling a lease so it matches, or no longer matches, is counted.
+	watcher.Modify(newLease("kube-system", "other", server))
+	expectCount(3)
+	watcher.Modify(newLease("kube-system", "server1", other))
+	expectCount(2)
+	watcher.Delete(newLease("kube-system", "server3", server))
+	expectCount(1)
+}
+
+func TestInformerServerLeaseCounter_InvalidSelector(t *testing.T) {
+	informer, _ := newFakeLeaseInformer(*newLease("kube-system", "server1", nil))
+	lc := NewInformerServerLeaseCounter(informer, "kube-system", "k8s-app in (")
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go informer.Run(stopCh)
+	if !cache.WaitForCacheSync(stopCh, lc.Ready) {
+		t.Fatal("counter never became ready")
+	}
+	if got := lc.Count(); got != 0 {
+		t.Errorf("expected an invalid selector to match no leases, got %d", got)
+	}
+}
+
+func TestInformerServerLeaseCounter_Expiry(t *testing.T) {
+	server := map[string]string{"k8s-app": "konnectivity-server"}
+	fakeClock := clocktesting.NewFakeClock(time.Now())
+	now := fakeClock.Now()
+	informer, watcher := newFakeLeaseInformer(
+		*renewLease(newLease("kube-system", "server1", server), now, 10*time.Second),
+		*renewLease(newLease("kube-system", "server2", server), now, 20*time.Second),
+		*renewLease(newLease("kube-system", "expired", server), now.Add(-time.Minute), 10*time.Second),
+		coordinationv1.Lease{ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "unrenewed", Labels: server}},
+	)
+	lc := NewInformerServerLeaseCounter(informer, "kube-system", "k8s-app=konnectivity-server")
+	lc.clock = goAfterFuncClock{fakeClock}
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go informer.Run(stopCh)
+	if !cache.WaitForCacheSync(stopCh, lc.Ready) {
+		t.Fatal("counter never became ready")
+	}
+
+	expectCount := func(expected int) {
+		t.Helper()
+		if err := wait.PollImmediate(10*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+			return lc.Count() == expected, nil
+		}); err != nil {
+			t.Fatalf("expected count %d, got %d", expected, lc.Count())
+		}
+	}
+	expectCount(2)
+
+	// Leases expiring without any informer event are no longer counted.
+	fakeClock.Step(15 * time.Second)
+	expectCount(1)
+	// A renewed Lease counts again.
+	watcher.Modify(renewLease(newLease("kube-system", "expired", server), fakeClock.Now(), 10*time.Second))
+	expectCount(2)
+	fakeClock.Step(10 * time.Second)
+	expectCount(0)
+}
+
+// goAfterFuncClock runs AfterFunc functions in their own goroutine, as the
+// real clock does, rather than with the fake clock locked.
+type goAfterFuncClock struct {
+	*clocktesting.FakeClock
+}
+
+func (c goAfterFuncClock) AfterFunc(d time.Duration, f func()) clock.Timer {
+	return c.FakeClock.AfterFunc(d, func() { go f() })
+}
@@ -0,0 +1,314 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"context"
+	runpprof "runtime/pprof"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// signal is a one-shot event whose channel is closed when it fires. The
+// zero value is ready to use.
+type signal struct {
+	mu    sync.Mutex
+	ch    chan struct{}
+	fired bool
+}
+
+// C returns a channel which is closed once the signal has fired.
+func (s *signal) C() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ch == nil {
+		s.ch = make(chan struct{})
+	}
+	return s.ch
+}
+
+// fire closes the channel returned by C, if it is not already closed.
+func (s *signal) fire() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fired {
+		return
+	}
+	if s.ch == nil {
+		s.ch = make(chan struct{})
+	}
+	close(s.ch)
+	s.fired = true
+}
+
+// Fired returns true once the signal has fired.
+func (s *signal) Fired() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.fired
+}
+
+// goTracked runs fn in a goroutine labeled with labels and tracked by wg,
+// and returns true, unless the ClientSet is stopping: Stop and Wait may
+// already be waiting on wg, so fn is not run and false is returned.
+func (cs *ClientSet) goTracked(labels runpprof.LabelSet, fn func()) bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.stoppingLocked() {
+		return false
+	}
+	cs.wg.Add(1)
+	go runpprof.Do(context.Background(), labels, func(context.Context) {
+		defer cs.wg.Done()
+		fn()
+	})
+	return true
+}
+
+// stoppingLocked returns true once the ClientSet is stopping: Stop,
+// Shutdown or shutdown has been called, or stopCh is closed. cs.mu must be
+// held.
+func (cs *ClientSet) stoppingLocked() bool {
+	if cs.stopping.Fired() {
+		return true
+	}
+	select {
+	case <-cs.stopCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// beginStop fires stopping, which stops the ClientSet from adding clients
+// and starting goroutines, so that wg may be waited on, and the goroutines
+// started by Serve from running. It is fired under cs.mu; see goTracked.
+func (cs *ClientSet) beginStop() {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.stopping.fire()
+}
+
+// Shutdown stops the sync loop and closes all clients. Use Wait to block
+// until the goroutines started by Serve have exited.
+func (cs *ClientSet) Shutdown() {
+	cs.beginStop()
+	cs.shutdown()
+}
+
+// Stop stops the sync loop, waits for the goroutines started by Serve to
+// exit and closes all clients. If ctx expires first, the clients are closed
+// without waiting for their in-flight tunnels and ctx.Err() is returned.
+func (cs *ClientSet) Stop(ctx context.Context) error {
+	cs.beginStop()
+	if err := cs.wait(ctx); err == nil {
+		cs.shutdown()
+		return nil
+	}
+
+	cs.forceClose.fire()
+	cs.mu.Lock()
+	clients := cs.clients
+	cs.clients = make(map[string]*Client)
+	cs.mu.Unlock()
+	for _, c := range clients {
+		c.Close()
+	}
+	cs.notify(nil, nil)
+	return ctx.Err()
+}
+
+// Done returns a channel which is closed when the sync loop started by
+// Serve exits, following Stop, Shutdown, draining or the closing of stopCh.
+// Unlike Wait, it does not wait for the other goroutines started by Serve.
+func (cs *ClientSet) Done() <-chan struct{} {
+	return cs.syncExited.C()
+}
+
+// Wait blocks until the sync loop and the Serve goroutine of every client it
+// started have exited, following Shutdown or the closing of stopCh.
+func (cs *ClientSet) Wait() {
+	_ = cs.wait(context.Background())
+}
+
+// wait blocks until the goroutines tracked by wg have exited, or returns
+// ctx.Err() if ctx is done first.
+func (cs *ClientSet) wait(ctx context.Context) error {
+	// Once stopping, goroutines are only added to wg under cs.mu, so they
+	// have all been added when it is released.
+	cs.mu.Lock()
+	cs.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		cs.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// isShutdown returns true once the ClientSet is stopping.
+func (cs *ClientSet) isShutdown() bool {
+	return cs.stopping.Fired()
+}
+
+// drainCheckInterval is how often a draining ClientSet checks whether all
+// endpoint connections have finished.
+const drainCheckInterval = 100 * time.Millisecond
+
+// Draining returns true once the ClientSet has been signaled to drain.
+func (cs *ClientSet) Draining() bool {
+	return atomic.LoadInt32(&cs.draining) == 1
+}
+
+// Drained returns a channel which is closed once draining has completed and
+// all clients have been closed.
+func (cs *ClientSet) Drained() <-chan struct{} {
+	return cs.drained.C()
+}
+
+// Pause stops the sync loop from opening new clients, e.g. during
+// maintenance, until Resume is called. The loop keeps running, and the
+// existing clients are kept.
+func (cs *ClientSet) Pause() {
+	if !cs.paused.Swap(true) {
+		cs.logger.V(1).Info("Pausing the sync loop", "agentID", cs.agentID)
+	}
+}
+
+// Resume lets the sync loop open new clients again after Pause. They are
+// opened from the next sync attempt, within SyncInterval.
+func (cs *ClientSet) Resume() {
+	if cs.paused.Swap(false) {
+		cs.logger.V(1).Info("Resuming the sync loop", "agentID", cs.agentID)
+	}
+}
+
+// Paused returns true while the sync loop is paused by Pause.
+func (cs *ClientSet) Paused() bool {
+	return cs.paused.Load()
+}
+
+// drain waits for drainCh and then closes all clients once the endpoint
+// connections have finished or the grace period has elapsed.
+func (cs *ClientSet) drain() {
+	select {
+	case <-cs.drainCh:
+	case <-cs.stopCh:
+		return
+	case <-cs.stopping.C():
+		return
+	}
+	atomic.StoreInt32(&cs.draining, 1)
+	cs.notify(nil, nil)
+	cs.logger.V(1).Info("Draining agent", "gracePeriod", cs.drainGracePeriod)
+	cs.notifyDraining()
+	deadline := time.Now().Add(cs.drainGracePeriod)
+	for {
+		inFlight := cs.endpointConnectionsCount()
+		if inFlight == 0 {
+			break
+		}
+		if !time.Now().Before(deadline) {
+			cs.logger.V(1).Info("Drain grace period elapsed, closing remaining endpoint connections", "endpointConnections", inFlight)
+			break
+		}
+		select {
+		case <-cs.stopCh:
+			return
+		case <-cs.stopping.C():
+			return
+		case <-time.After(drainCheckInterval):
+		}
+	}
+	cs.shutdown()
+	cs.drained.fire()
+	cs.notify(nil, nil)
+}
+
+// notifyDraining tells every proxy server the agent is connected to that it
+// is draining, so that they stop picking it for new dials.
+func (cs *ClientSet) notifyDraining() {
+	cs.mu.Lock()
+	clients := make([]*Client, 0, len(cs.clients))
+	for _, c := range cs.clients {
+		clients = append(clients, c)
+	}
+	cs.mu.Unlock()
+	for _, c := range clients {
+		if err := c.sendDrain(); err != nil {
+			cs.logger.V(2).Info("Failed to notify proxy server of drain", "serverID", c.serverID, "err", err)
+		}
+	}
+}
+
+// endpointConnectionsCount returns the number of tunnels in flight across
+// all clients.
+func (cs *ClientSet) endpointConnectionsCount() int {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	var count int
+	for _, c := range cs.clients {
+		count += int(c.inFlight.Load())
+	}
+	return count
+}
+
+// shutdown removes all clients and drains them concurrently, giving each
+// up to drainTimeout to finish its in-flight tunnels.
+func (cs *ClientSet) shutdown() {
+	cs.mu.Lock()
+	cs.stopping.fire()
+	clients := cs.clients
+	cs.clients = make(map[string]*Client)
+	cs.mu.Unlock()
+	cs.notify(nil, nil)
+
+	var wg sync.WaitGroup
+	for serverID, c := range clients {
+		wg.Add(1)
+		go func(serverID string, c *Client) {
+			defer wg.Done()
+			cs.drainClient(serverID, c)
+		}(serverID, c)
+	}
+	wg.Wait()
+	cs.agentMetrics().DeleteAgent(cs.agentID)
+	cs.notify(nil, nil)
+}
+
+// drainClient drains c, which must already have been removed from the
+// ClientSet, for up to drainTimeout before closing it.
+func (cs *ClientSet) drainClient(serverID string, c *Client) {
+	ctx, cancel := context.WithTimeout(context.Background(), cs.drainTimeout)
+	defer cancel()
+	go func() {
+		select {
+		case <-cs.forceClose.C():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	if err := c.Drain(ctx); err != nil {
+		cs.logger.V(2).Info("Closing client with tunnels in flight", "serverID", serverID, "tunnels", c.inFlight.Load(), "err", err)
+	}
+}
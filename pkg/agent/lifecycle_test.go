@@ -0,0 +1,260 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/goleak"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+func TestPauseResume(t *testing.T) {
+	cs := withTestDefaults(&ClientSetConfig{
+		Address:         newTestProxyServer(t, "", 3),
+		SyncInterval:    10 * time.Millisecond,
+		SyncIntervalCap: 10 * time.Millisecond,
+		ProbeInterval:   time.Hour,
+		DialOptions:     []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())},
+	}).NewAgentClientSet(nil, make(chan struct{}))
+	// Pretend a server reported more servers than there are clients.
+	cs.serverCount = 3
+	cs.Pause()
+	if !cs.Paused() {
+		t.Fatal("expected the ClientSet to be paused")
+	}
+	defer cs.Wait()
+	defer cs.Shutdown()
+	cs.Serve()
+
+	if err := wait.PollImmediate(10*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		return cs.SyncStats().TotalSyncs >= 5, nil
+	}); err != nil {
+		t.Fatalf("expected the sync loop to keep running while paused, got %+v", cs.SyncStats())
+	}
+	if got := cs.ClientsCount(); got != 0 {
+		t.Fatalf("expected no clients while paused, got %d", got)
+	}
+
+	cs.Resume()
+	if cs.Paused() {
+		t.Fatal("expected the ClientSet to be resumed")
+	}
+	if err := wait.PollImmediate(10*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		return cs.ClientsCount() == 3, nil
+	}); err != nil {
+		t.Fatalf("expected a client for each server after resuming, got %v", cs.ListServerIDs())
+	}
+
+	// Pausing keeps the existing clients.
+	cs.Pause()
+	syncs := cs.SyncStats().TotalSyncs
+	if err := wait.PollImmediate(10*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		return cs.SyncStats().TotalSyncs >= syncs+3, nil
+	}); err != nil {
+		t.Fatal("expected the sync loop to keep running while paused")
+	}
+	if got := cs.ClientsCount(); got != 3 {
+		t.Errorf("expected the clients to be kept while paused, got %d", got)
+	}
+}
+
+func TestShutdown_Wait(t *testing.T) {
+	// Registered first so that it runs after the test server is stopped.
+	ignoreCurrent := goleak.IgnoreCurrent()
+	t.Cleanup(func() { goleakVerifyNone(t, ignoreCurrent) })
+
+	addr := newTestProxyServer(t, "server1", 1)
+	cc := withTestDefaults(&ClientSetConfig{
+		Address:         addr,
+		SyncInterval:    10 * time.Millisecond,
+		SyncIntervalCap: 10 * time.Millisecond,
+		ProbeInterval:   time.Hour,
+		DialOptions:     []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())},
+	})
+	cs := cc.NewAgentClientSet(nil, make(chan struct{}))
+	cs.Serve()
+	if err := wait.PollImmediate(10*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		return cs.ClientsCount() == 1, nil
+	}); err != nil {
+		t.Fatal("client never connected")
+	}
+
+	cs.Shutdown()
+	done := make(chan struct{})
+	go func() {
+		cs.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(wait.ForeverTestTimeout):
+		t.Fatal("Wait did not return after Shutdown")
+	}
+	if cs.ClientsCount() != 0 {
+		t.Errorf("expected no clients after Shutdown, got %d", cs.ClientsCount())
+	}
+}
+
+func TestStop(t *testing.T) {
+	testCases := []struct {
+		name     string
+		inFlight bool // whether the client has a tunnel which never finishes
+		timeout  time.Duration
+		wantErr  error
+	}{
+		{
+			name:    "clean",
+			timeout: wait.ForeverTestTimeout,
+		},
+		{
+			name:     "deadline exceeded",
+			inFlight: true,
+			timeout:  100 * time.Millisecond,
+			wantErr:  context.DeadlineExceeded,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			addr := newTestProxyServer(t, "server1", 1)
+			cc := withTestDefaults(&ClientSetConfig{
+				Address:         addr,
+				SyncInterval:    10 * time.Millisecond,
+				SyncIntervalCap: 10 * time.Millisecond,
+				ProbeInterval:   time.Hour,
+				DrainTimeout:    time.Hour,
+				DialOptions:     []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())},
+			})
+			cs := cc.NewAgentClientSet(nil, make(chan struct{}))
+			cs.Serve()
+			if err := wait.PollImmediate(10*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+				return cs.ClientsCount() == 1, nil
+			}); err != nil {
+				t.Fatal("client never connected")
+			}
+			if tc.inFlight {
+				cs.mu.Lock()
+				cs.clients["server1"].inFlight.Add(1)
+				cs.mu.Unlock()
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), tc.timeout)
+			defer cancel()
+			start := time.Now()
+			if err := cs.Stop(ctx); err != tc.wantErr {
+				t.Errorf("expected error %v, got %v", tc.wantErr, err)
+			}
+			if elapsed := time.Since(start); elapsed > tc.timeout+time.Second {
+				t.Errorf("expected Stop to return within %v, took %v", tc.timeout, elapsed)
+			}
+			if cs.ClientsCount() != 0 {
+				t.Errorf("expected no clients after Stop, got %d", cs.ClientsCount())
+			}
+
+			// A forced stop still lets the goroutines started by Serve exit.
+			done := make(chan struct{})
+			go func() {
+				cs.Wait()
+				close(done)
+			}()
+			select {
+			case <-done:
+			case <-time.After(wait.ForeverTestTimeout):
+				t.Fatal("Wait did not return after Stop")
+			}
+		})
+	}
+}
+
+func TestStop_ConcurrentConnect(t *testing.T) {
+	addr := newTestProxyServer(t, "", 1)
+	cc := withTestDefaults(&ClientSetConfig{
+		Address:         addr,
+		MaxClients:      100,
+		SyncInterval:    10 * time.Millisecond,
+		SyncIntervalCap: 10 * time.Millisecond,
+		ProbeInterval:   time.Hour,
+		DialOptions:     []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())},
+	})
+	cs, err := cc.NewAgentClientSetChecked(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs.Serve()
+
+	// Clients connected while Stop runs must not be added to the WaitGroup
+	// once Stop waits on it, and none may outlive Stop.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for !cs.isShutdown() {
+				_ = cs.Connect(addr)
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	if err := cs.Stop(context.Background()); err != nil {
+		t.Errorf("expected no error from Stop, got %v", err)
+	}
+	wg.Wait()
+	cs.Wait()
+
+	if err := cs.Connect(addr); err == nil {
+		t.Error("expected Connect to fail after Stop")
+	}
+	c := &Client{cs: cs, conn: newReadyConn(t), serverID: "late", stopCh: make(chan struct{})}
+	if err := cs.AddClient("late", c); err == nil {
+		t.Error("expected AddClient to fail after Stop")
+	}
+	if cs.ClientsCount() != 0 {
+		t.Errorf("expected no clients after Stop, got %d", cs.ClientsCount())
+	}
+}
+
+func TestDone(t *testing.T) {
+	cs := withTestDefaults(&ClientSetConfig{
+		Address:     newTestProxyServer(t, "server1", 1),
+		DialOptions: []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())},
+	}).NewAgentClientSet(nil, make(chan struct{}))
+	cs.Serve()
+	if err := wait.PollImmediate(10*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		return cs.ClientsCount() == 1, nil
+	}); err != nil {
+		t.Fatal("client never connected")
+	}
+	select {
+	case <-cs.Done():
+		t.Fatal("expected Done not to be closed while the sync loop runs")
+	default:
+	}
+
+	if err := cs.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-cs.Done():
+	case <-time.After(wait.ForeverTestTimeout):
+		t.Fatal("Done was not closed after Stop")
+	}
+}
@@ -17,6 +17,9 @@ limitations under the License.
 package metrics
 
 import (
+	"errors"
+	"fmt"
+	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -42,11 +45,50 @@ const (
 var (
 	// Use buckets ranging from 5 ms to 30 seconds.
 	latencyBuckets = []float64{0.005, 0.025, 0.1, 0.5, 2.5, 10, 30}
+	// RPCs include the Connect stream, which lasts as long as the
+	// connection, so use buckets ranging from 5 ms to 6 hours.
+	rpcDurationBuckets = []float64{0.005, 0.025, 0.1, 0.5, 2.5, 10, 30, 300, 1800, 21600}
+	// A sync attempt is dominated by the DNS resolution and dial of the
+	// proxy server, so use buckets ranging from 10 ms to 30 seconds.
+	syncDurationBuckets = []float64{0.01, 0.05, 0.1, 0.5, 1, 5, 30}
 
-	// Metrics provides access to all dial metrics.
-	Metrics = newAgentMetrics()
+	// Metrics provides access to all dial metrics. They are registered with
+	// the default registry.
+	Metrics = mustRegister(newAgentMetrics(prometheus.DefaultRegisterer))
+
+	registryMu sync.Mutex // protects registryMetrics.
+	// registryMetrics holds the metrics registered by ForRegistry, by the
+	// registry they were registered with.
+	registryMetrics = make(map[prometheus.Registerer]*AgentMetrics)
 )
 
+// ForRegistry returns the agent metrics registered with r, creating and
+// registering them on first use, so that ClientSets sharing a registry
+// share their metrics. It returns Metrics if r is nil or the default
+// registerer.
+func ForRegistry(r prometheus.Registerer) (*AgentMetrics, error) {
+	if r == nil || r == prometheus.DefaultRegisterer {
+		return Metrics, nil
+	}
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if m, ok := registryMetrics[r]; ok {
+		return m, nil
+	}
+	m := newAgentMetrics(r)
+	if err := m.Register(); err != nil {
+		m.Unregister()
+		return nil, err
+	}
+	registryMetrics[r] = m
+	return m, nil
+}
+
+func mustRegister(m *AgentMetrics) *AgentMetrics {
+	m.registerer.MustRegister(m.collectors...)
+	return m
+}
+
 // AgentMetrics includes all the metrics of the proxy agent.
 type AgentMetrics struct {
 	dialLatencies       *prometheus.HistogramVec
@@ -56,10 +98,31 @@ type AgentMetrics struct {
 	endpointConnections *prometheus.GaugeVec
 	streamPackets       *prometheus.CounterVec
 	streamErrors        *prometheus.CounterVec
+	syncBackoff         *prometheus.HistogramVec
+	syncDurations       *prometheus.HistogramVec
+	failedServers       *prometheus.GaugeVec
+	connEstablishment   *prometheus.HistogramVec
+	connectAttempts     *prometheus.CounterVec
+	idleConnections     *prometheus.GaugeVec
+	duplicateServers    *prometheus.CounterVec
+	overloadRejections  *prometheus.CounterVec
+	rateLimitedTunnels  *prometheus.CounterVec
+	channelOverflows    *prometheus.CounterVec
+	channelFull         *prometheus.CounterVec
+	rpcDurations        *prometheus.HistogramVec
+	rpcBytes            *prometheus.CounterVec
+	circuitBreakers     *prometheus.GaugeVec
+	sinceLastConnect    *prometheus.GaugeVec
+
+	// collectors holds all the metrics above, for registration.
+	collectors []prometheus.Collector
+	// registerer is the registry the metrics are registered with.
+	registerer prometheus.Registerer
 }
 
-// newAgentMetrics create a new AgentMetrics, configured with default metric names.
-func newAgentMetrics() *AgentMetrics {
+// newAgentMetrics create a new AgentMetrics, configured with default metric
+// names, for registration with r. It does not register them.
+func newAgentMetrics(r prometheus.Registerer) *AgentMetrics {
 	dialLatencies := prometheus.NewHistogramVec(
 		prometheus.HistogramOpts{
 			Namespace: Namespace,
@@ -93,9 +156,9 @@ func newAgentMetrics() *AgentMetrics {
 			Namespace: Namespace,
 			Subsystem: Subsystem,
 			Name:      "open_server_connections",
-			Help:      "Current number of open server connections.",
+			Help:      "Current number of open server connections, labeled by agent ID.",
 		},
-		[]string{},
+		[]string{"agent_id"},
 	)
 	endpointConnections := prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
@@ -106,16 +169,148 @@ func newAgentMetrics() *AgentMetrics {
 		},
 		[]string{},
 	)
+	syncBackoff := prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: Namespace,
+			Subsystem: Subsystem,
+			Name:      "sync_backoff_duration_seconds",
+			Help:      "Time the agent waits between attempts to connect to the proxy server, labeled by the result of the last attempt (success, duplicate or failure).",
+			Buckets:   latencyBuckets,
+		},
+		[]string{"result"},
+	)
+	syncDurations := prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: Namespace,
+			Subsystem: Subsystem,
+			Name:      "sync_duration_seconds",
+			Help:      "Duration of the attempts of the agent to connect to the proxy server, labeled by their result (success, duplicate or failure).",
+			Buckets:   syncDurationBuckets,
+		},
+		[]string{"result"},
+	)
+	failedServers := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: Namespace,
+			Subsystem: Subsystem,
+			Name:      "permanently_failed_servers",
+			Help:      "Current number of proxy servers the agent has stopped reconnecting to after too many connection failures, labeled by agent ID.",
+		},
+		[]string{"agent_id"},
+	)
+	connEstablishment := prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: Namespace,
+			Subsystem: Subsystem,
+			Name:      "connection_establishment_duration_seconds",
+			Help:      "Time taken to establish a connection to the proxy server, labeled by server address and result (success or error).",
+			Buckets:   latencyBuckets,
+		},
+		[]string{"server_address", "result"},
+	)
+	connectAttempts := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: Namespace,
+			Subsystem: Subsystem,
+			Name:      "connect_attempts_total",
+			Help:      "Number of attempts to connect to a proxy server, labeled by server ID (or address, if the server was not reached) and error type (none, duplicate, transport or auth).",
+		},
+		[]string{"server_id", "error_type"},
+	)
+	idleConnections := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: Namespace,
+			Subsystem: Subsystem,
+			Name:      "idle_server_connections",
+			Help:      "Current number of open server connections which have not carried data for longer than the idle threshold, labeled by agent ID.",
+		},
+		[]string{"agent_id"},
+	)
+	duplicateServers := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: Namespace,
+			Subsystem: Subsystem,
+			Name:      "duplicate_server_total",
+			Help:      "Number of sync attempts which connected to a proxy server the agent already had a client for, labeled by server ID.",
+		},
+		[]string{"server_id"},
+	)
+	overloadRejections := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: Namespace,
+			Subsystem: Subsystem,
+			Name:      "tunnel_rejected_overload_total",
+			Help:      "Number of dial requests rejected because the connection to the proxy server already carried the maximum number of tunnels, labeled by server ID.",
+		},
+		[]string{"server_id"},
+	)
+	rateLimitedTunnels := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: Namespace,
+			Subsystem: Subsystem,
+			Name:      "tunnel_rate_limited_total",
+			Help:      "Number of dial requests which exceeded the tunnel rate limit of their connection to the proxy server, and were delayed or rejected, labeled by server ID.",
+		},
+		[]string{"server_id"},
+	)
+	channelOverflows := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: Namespace,
+			Subsystem: Subsystem,
+			Name:      "channel_overflow_total",
+			Help:      "Number of packets which found the data channel of an endpoint connection full and had to wait, labeled by server ID and direction.",
+		},
+		[]string{"server_id", "direction"},
+	)
+	channelFull := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: Namespace,
+			Subsystem: Subsystem,
+			Name:      "channel_full_total",
+			Help:      "Number of DATA packets from the proxy server which found the data channel of an endpoint connection full while WarnOnChannelLimit was set, labeled by server ID.",
+		},
+		[]string{"server_id"},
+	)
+	rpcDurations := prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: Namespace,
+			Subsystem: Subsystem,
+			Name:      "rpc_duration_seconds",
+			Help:      "Duration of RPCs to the proxy server recorded by DefaultStatsHandler, labeled by method and status code.",
+			Buckets:   rpcDurationBuckets,
+		},
+		[]string{"method", "code"},
+	)
+	rpcBytes := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: Namespace,
+			Subsystem: Subsystem,
+			Name:      "rpc_bytes_total",
+			Help:      "Bytes on the wire of RPC messages to and from the proxy server recorded by DefaultStatsHandler, labeled by method and direction.",
+		},
+		[]string{"method", "direction"},
+	)
+	circuitBreakers := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: Namespace,
+			Subsystem: Subsystem,
+			Name:      "circuit_breaker_state",
+			Help:      "State of the circuit breaker for connections to a proxy server address: 0 closed, 1 open, 2 half-open.",
+		},
+		[]string{"address"},
+	)
+	sinceLastConnect := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: Namespace,
+			Subsystem: Subsystem,
+			Name:      "time_since_last_connect_seconds",
+			Help:      "Seconds since a sync attempt last succeeded, as of the latest attempt, labeled by agent ID. Zero while the agent has a connection to every server.",
+		},
+		[]string{"agent_id"},
+	)
 	streamPackets := commonmetrics.MakeStreamPacketsTotalMetric(Namespace, Subsystem)
 	streamErrors := commonmetrics.MakeStreamErrorsTotalMetric(Namespace, Subsystem)
-	prometheus.MustRegister(dialLatencies)
-	prometheus.MustRegister(serverFailures)
-	prometheus.MustRegister(dialFailures)
-	prometheus.MustRegister(serverConnections)
-	prometheus.MustRegister(endpointConnections)
-	prometheus.MustRegister(streamPackets)
-	prometheus.MustRegister(streamErrors)
-	return &AgentMetrics{
+	m := &AgentMetrics{
 		dialLatencies:       dialLatencies,
 		serverFailures:      serverFailures,
 		dialFailures:        dialFailures,
@@ -123,8 +318,78 @@ func newAgentMetrics() *AgentMetrics {
 		endpointConnections: endpointConnections,
 		streamPackets:       streamPackets,
 		streamErrors:        streamErrors,
+		syncBackoff:         syncBackoff,
+		syncDurations:       syncDurations,
+		failedServers:       failedServers,
+		connEstablishment:   connEstablishment,
+		connectAttempts:     connectAttempts,
+		idleConnections:     idleConnections,
+		duplicateServers:    duplicateServers,
+		overloadRejections:  overloadRejections,
+		rateLimitedTunnels:  rateLimitedTunnels,
+		channelOverflows:    channelOverflows,
+		channelFull:         channelFull,
+		rpcDurations:        rpcDurations,
+		rpcBytes:            rpcBytes,
+		circuitBreakers:     circuitBreakers,
+		sinceLastConnect:    sinceLastConnect,
+		registerer:          r,
+	}
+	m.collectors = []prometheus.Collector{
+		dialLatencies,
+		serverFailures,
+		dialFailures,
+		serverConnections,
+		endpointConnections,
+		streamPackets,
+		streamErrors,
+		syncBackoff,
+		syncDurations,
+		failedServers,
+		connEstablishment,
+		connectAttempts,
+		idleConnections,
+		duplicateServers,
+		overloadRejections,
+		rateLimitedTunnels,
+		channelOverflows,
+		channelFull,
+		rpcDurations,
+		rpcBytes,
+		circuitBreakers,
+		sinceLastConnect,
 	}
+	return m
+}
 
+// Register adds all agent metrics to their registry, after they were
+// removed by Unregister. The metrics are registered when they are created,
+// by package initialization for Metrics or by ForRegistry.
+func (a *AgentMetrics) Register() error {
+	var errs []error
+	for _, c := range a.collectors {
+		if err := a.registerer.Register(c); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Unregister removes all agent metrics from their registry, e.g. so a
+// test can register collectors of the same names; the registry still
+// requires those to have the same help and labels. It returns an error if
+// some of the metrics were not registered.
+func (a *AgentMetrics) Unregister() error {
+	var missing int
+	for _, c := range a.collectors {
+		if !a.registerer.Unregister(c) {
+			missing++
+		}
+	}
+	if missing > 0 {
+		return fmt.Errorf("%d of %d agent metrics were not registered", missing, len(a.collectors))
+	}
+	return nil
 }
 
 // Reset resets the metrics.
@@ -136,6 +401,21 @@ func (a *AgentMetrics) Reset() {
 	a.endpointConnections.Reset()
 	a.streamPackets.Reset()
 	a.streamErrors.Reset()
+	a.syncBackoff.Reset()
+	a.syncDurations.Reset()
+	a.failedServers.Reset()
+	a.connEstablishment.Reset()
+	a.connectAttempts.Reset()
+	a.idleConnections.Reset()
+	a.duplicateServers.Reset()
+	a.overloadRejections.Reset()
+	a.rateLimitedTunnels.Reset()
+	a.channelOverflows.Reset()
+	a.channelFull.Reset()
+	a.rpcDurations.Reset()
+	a.rpcBytes.Reset()
+	a.circuitBreakers.Reset()
+	a.sinceLastConnect.Reset()
 }
 
 // ObserveServerFailure records a failure to send to or receive from the proxy
@@ -161,8 +441,143 @@ func (a *AgentMetrics) ObserveDialFailure(reason DialFailureReason) {
 	a.dialFailures.WithLabelValues(string(reason)).Inc()
 }
 
-func (a *AgentMetrics) SetServerConnectionsCount(count int) {
-	a.serverConnections.WithLabelValues().Set(float64(count))
+type SyncResult string
+
+const (
+	// SyncResultSuccess indicates the last sync attempt succeeded.
+	SyncResultSuccess SyncResult = "success"
+	// SyncResultDuplicate indicates the last sync attempt connected to a
+	// server which already had a client.
+	SyncResultDuplicate SyncResult = "duplicate"
+	// SyncResultFailure indicates the last sync attempt failed.
+	SyncResultFailure SyncResult = "failure"
+)
+
+// ObserveSyncBackoff records the time the sync loop waits before the next
+// attempt, labeled by the result of the last attempt.
+func (a *AgentMetrics) ObserveSyncBackoff(result SyncResult, backoff time.Duration) {
+	a.syncBackoff.WithLabelValues(string(result)).Observe(backoff.Seconds())
+}
+
+// RecordSyncDuration records how long a sync attempt took, labeled by its
+// result.
+func (a *AgentMetrics) RecordSyncDuration(duration time.Duration, result SyncResult) {
+	a.syncDurations.WithLabelValues(string(result)).Observe(duration.Seconds())
+}
+
+const (
+	// ConnectionResultSuccess indicates a connection to the proxy server
+	// was established.
+	ConnectionResultSuccess = "success"
+	// ConnectionResultError indicates a connection to the proxy server
+	// could not be established.
+	ConnectionResultError = "error"
+)
+
+// RecordConnectionEstablishment records the time taken to establish a
+// connection to the proxy server at address, labeled by the result.
+func (a *AgentMetrics) RecordConnectionEstablishment(address, result string, duration time.Duration) {
+	a.connEstablishment.WithLabelValues(address, result).Observe(duration.Seconds())
+}
+
+const (
+	// ConnectErrorNone indicates a connect attempt added a client.
+	ConnectErrorNone = "none"
+	// ConnectErrorDuplicate indicates a connect attempt reached a server
+	// which already had a client.
+	ConnectErrorDuplicate = "duplicate"
+	// ConnectErrorTransport indicates a connect attempt failed to reach
+	// the server.
+	ConnectErrorTransport = "transport"
+	// ConnectErrorAuth indicates a connect attempt was rejected by the
+	// server as unauthenticated or unauthorized.
+	ConnectErrorAuth = "auth"
+)
+
+// RecordConnectAttempt records an attempt to connect to the proxy server,
+// labeled by the server ID and the error type.
+func (a *AgentMetrics) RecordConnectAttempt(serverID, errorType string) {
+	a.connectAttempts.WithLabelValues(serverID, errorType).Inc()
+}
+
+// SetServerConnectionsCount sets the number of open server connections of
+// the agent agentID.
+func (a *AgentMetrics) SetServerConnectionsCount(agentID string, count int) {
+	a.serverConnections.WithLabelValues(agentID).Set(float64(count))
+}
+
+// IncDuplicateServer records a sync attempt which connected to serverID
+// while the agent already had a client for it.
+func (a *AgentMetrics) IncDuplicateServer(serverID string) {
+	a.duplicateServers.WithLabelValues(serverID).Inc()
+}
+
+// IncTunnelRejectedOverload records a dial request from serverID rejected
+// because its connection already carried the maximum number of tunnels.
+func (a *AgentMetrics) IncTunnelRejectedOverload(serverID string) {
+	a.overloadRejections.WithLabelValues(serverID).Inc()
+}
+
+// IncTunnelRateLimited records a dial request from serverID which exceeded
+// the tunnel rate limit of its connection.
+func (a *AgentMetrics) IncTunnelRateLimited(serverID string) {
+	a.rateLimitedTunnels.WithLabelValues(serverID).Inc()
+}
+
+// IncChannelOverflow records a packet from or to serverID which found the
+// data channel of an endpoint connection full.
+func (a *AgentMetrics) IncChannelOverflow(serverID string, direction Direction) {
+	a.channelOverflows.WithLabelValues(serverID, string(direction)).Inc()
+}
+
+// IncChannelFull records a DATA packet from serverID which found the data
+// channel of an endpoint connection full while WarnOnChannelLimit was set.
+func (a *AgentMetrics) IncChannelFull(serverID string) {
+	a.channelFull.WithLabelValues(serverID).Inc()
+}
+
+// ObserveRPCDuration records the duration of an RPC to the proxy server
+// which ended with code.
+func (a *AgentMetrics) ObserveRPCDuration(method, code string, d time.Duration) {
+	a.rpcDurations.WithLabelValues(method, code).Observe(d.Seconds())
+}
+
+// AddRPCBytes records n bytes on the wire of RPC messages in direction.
+func (a *AgentMetrics) AddRPCBytes(method string, direction Direction, n int) {
+	a.rpcBytes.WithLabelValues(method, string(direction)).Add(float64(n))
+}
+
+// SetCircuitBreakerState sets the state of the circuit breaker for address:
+// 0 closed, 1 open, 2 half-open.
+func (a *AgentMetrics) SetCircuitBreakerState(address string, state int) {
+	a.circuitBreakers.WithLabelValues(address).Set(float64(state))
+}
+
+// SetIdleServerConnectionsCount sets the number of idle server connections
+// of the agent agentID.
+func (a *AgentMetrics) SetIdleServerConnectionsCount(agentID string, count int) {
+	a.idleConnections.WithLabelValues(agentID).Set(float64(count))
+}
+
+// SetFailedServersCount sets the number of permanently failed servers of
+// the agent agentID.
+func (a *AgentMetrics) SetFailedServersCount(agentID string, count int) {
+	a.failedServers.WithLabelValues(agentID).Set(float64(count))
+}
+
+// SetTimeSinceLastConnect sets the number of seconds since a sync attempt
+// of the agent agentID last succeeded.
+func (a *AgentMetrics) SetTimeSinceLastConnect(agentID string, seconds float64) {
+	a.sinceLastConnect.WithLabelValues(agentID).Set(seconds)
+}
+
+// DeleteAgent removes the metrics labeled with agentID, once the agent has
+// shut down.
+func (a *AgentMetrics) DeleteAgent(agentID string) {
+	a.serverConnections.DeleteLabelValues(agentID)
+	a.idleConnections.DeleteLabelValues(agentID)
+	a.failedServers.DeleteLabelValues(agentID)
+	a.sinceLastConnect.DeleteLabelValues(agentID)
 }
 
 // EndpointConnectionInc increments a new endpoint connection.
@@ -0,0 +1,177 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestUnregister(t *testing.T) {
+	name := prometheus.BuildFQName(Namespace, Subsystem, "open_server_connections")
+	registered := func() bool {
+		t.Helper()
+		families, err := prometheus.DefaultGatherer.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, family := range families {
+			if family.GetName() == name {
+				return true
+			}
+		}
+		return false
+	}
+	Metrics.SetServerConnectionsCount("agent1", 1)
+	defer Metrics.Reset()
+	if !registered() {
+		t.Fatalf("expected %s to be registered", name)
+	}
+
+	if err := Metrics.Unregister(); err != nil {
+		t.Fatalf("Unregister: %v", err)
+	}
+	if registered() {
+		t.Errorf("expected %s to be unregistered", name)
+	}
+	// A collector of the same name can be registered now. The registry
+	// still requires it to have the same help and labels.
+	gauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: name, Help: "Current number of open server connections, labeled by agent ID."}, []string{"agent_id"})
+	if err := prometheus.Register(gauge); err != nil {
+		t.Errorf("expected to register a replacement metric, got %v", err)
+	}
+	prometheus.Unregister(gauge)
+	if err := Metrics.Unregister(); err == nil {
+		t.Errorf("expected an error unregistering twice")
+	}
+
+	if err := Metrics.Register(); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	if !registered() {
+		t.Errorf("expected %s to be registered again", name)
+	}
+	if err := Metrics.Register(); err == nil {
+		t.Errorf("expected an error registering twice")
+	}
+}
+
+func TestForRegistry(t *testing.T) {
+	if m, err := ForRegistry(nil); err != nil || m != Metrics {
+		t.Errorf("expected the default metrics for a nil registry, got %p, %v", m, err)
+	}
+	if m, err := ForRegistry(prometheus.DefaultRegisterer); err != nil || m != Metrics {
+		t.Errorf("expected the default metrics for the default registry, got %p, %v", m, err)
+	}
+
+	registry := prometheus.NewRegistry()
+	m, err := ForRegistry(registry)
+	if err != nil {
+		t.Fatalf("ForRegistry: %v", err)
+	}
+	if m == Metrics {
+		t.Fatal("expected separate metrics for a custom registry")
+	}
+	if again, err := ForRegistry(registry); err != nil || again != m {
+		t.Errorf("expected the same metrics for the same registry, got %p, %v", again, err)
+	}
+	m.SetServerConnectionsCount("agent1", 1)
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(families) == 0 {
+		t.Error("expected the metrics to be registered with the custom registry")
+	}
+
+	// A registry which already has a conflicting collector is rejected.
+	conflicting := prometheus.NewRegistry()
+	conflicting.MustRegister(prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: prometheus.BuildFQName(Namespace, Subsystem, "open_server_connections"),
+		Help: "Conflicting help.",
+	}))
+	if _, err := ForRegistry(conflicting); err == nil {
+		t.Error("expected an error for a registry with a conflicting collector")
+	}
+}
+
+func TestDeleteAgent(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	m, err := ForRegistry(registry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.SetServerConnectionsCount("agent1", 2)
+	m.SetServerConnectionsCount("agent2", 1)
+	m.SetFailedServersCount("agent1", 1)
+	m.DeleteAgent("agent1")
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "agent_id" && label.GetValue() != "agent2" {
+					t.Errorf("expected only agent2 metrics to remain, got %s for %s", family.GetName(), label.GetValue())
+				}
+			}
+		}
+	}
+}
+
+func TestRecordSyncDuration(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	m, err := ForRegistry(registry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.RecordSyncDuration(30*time.Millisecond, SyncResultSuccess)
+	m.RecordSyncDuration(2*time.Second, SyncResultFailure)
+	m.RecordSyncDuration(3*time.Second, SyncResultFailure)
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := prometheus.BuildFQName(Namespace, Subsystem, "sync_duration_seconds")
+	counts := map[string]uint64{}
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			h := metric.GetHistogram()
+			var bounds []float64
+			for _, b := range h.GetBucket() {
+				bounds = append(bounds, b.GetUpperBound())
+			}
+			if !reflect.DeepEqual(bounds, syncDurationBuckets) {
+				t.Errorf("expected buckets %v, got %v", syncDurationBuckets, bounds)
+			}
+			counts[metric.GetLabel()[0].GetValue()] = h.GetSampleCount()
+		}
+	}
+	expected := map[string]uint64{string(SyncResultSuccess): 1, string(SyncResultFailure): 2}
+	if !reflect.DeepEqual(counts, expected) {
+		t.Errorf("expected sync duration counts %v, got %v", expected, counts)
+	}
+}
@@ -73,6 +73,8 @@ func (s *serverConnected) Check(_ *http.Request) error {
 	if s.rm.Ready() {
 		return nil
 	}
-
+	if e, ok := s.rm.(interface{ HealthExplanation() string }); ok {
+		return fmt.Errorf("no servers connected: %s", e.HealthExplanation())
+	}
 	return fmt.Errorf("no servers connected")
 }
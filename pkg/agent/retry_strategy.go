@@ -0,0 +1,83 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"math"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// RetryStrategy decides how long the sync loop waits before retrying after
+// a failed attempt to connect to the proxy server.
+type RetryStrategy interface {
+	// NextRetryDelay returns the delay before the next attempt. attempt is
+	// the number of consecutive failed attempts, starting at 1, and lastErr
+	// is the error from the most recent one.
+	NextRetryDelay(attempt int, lastErr error) time.Duration
+}
+
+// ConstantRetryStrategy always waits Delay.
+type ConstantRetryStrategy struct {
+	Delay time.Duration
+}
+
+func (s ConstantRetryStrategy) NextRetryDelay(int, error) time.Duration {
+	return s.Delay
+}
+
+// LinearRetryStrategy waits Initial after the first failure, and Increment
+// longer after each subsequent one, up to Cap. A zero Cap means no cap.
+type LinearRetryStrategy struct {
+	Initial   time.Duration
+	Increment time.Duration
+	Cap       time.Duration
+}
+
+func (s LinearRetryStrategy) NextRetryDelay(attempt int, _ error) time.Duration {
+	delay := s.Initial + time.Duration(max(attempt-1, 0))*s.Increment
+	if s.Cap > 0 && delay > s.Cap {
+		return s.Cap
+	}
+	return delay
+}
+
+// ExponentialRetryStrategy waits Initial after the first failure, and
+// Factor times longer after each subsequent one, up to Cap, with Jitter
+// applied as by wait.Jitter. A zero Cap means no cap. This matches the
+// backoff used when no RetryStrategy is set.
+type ExponentialRetryStrategy struct {
+	Initial time.Duration
+	Cap     time.Duration
+	Factor  float64
+	Jitter  float64
+}
+
+func (s ExponentialRetryStrategy) NextRetryDelay(attempt int, _ error) time.Duration {
+	delay := float64(s.Initial) * math.Pow(s.Factor, float64(max(attempt-1, 0)))
+	if s.Cap > 0 && delay > float64(s.Cap) {
+		delay = float64(s.Cap)
+	}
+	if delay >= math.MaxInt64 {
+		return math.MaxInt64
+	}
+	if s.Jitter > 0 {
+		return wait.Jitter(time.Duration(delay), s.Jitter)
+	}
+	return time.Duration(delay)
+}
@@ -0,0 +1,79 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRetryStrategies(t *testing.T) {
+	testCases := []struct {
+		name     string
+		strategy RetryStrategy
+		expected []time.Duration // for attempts 1, 2, ...
+	}{
+		{
+			name:     "constant",
+			strategy: ConstantRetryStrategy{Delay: time.Second},
+			expected: []time.Duration{time.Second, time.Second, time.Second},
+		},
+		{
+			name:     "linear",
+			strategy: LinearRetryStrategy{Initial: time.Second, Increment: 2 * time.Second, Cap: 4 * time.Second},
+			expected: []time.Duration{time.Second, 3 * time.Second, 4 * time.Second, 4 * time.Second},
+		},
+		{
+			name:     "linear uncapped",
+			strategy: LinearRetryStrategy{Initial: time.Second, Increment: time.Second},
+			expected: []time.Duration{time.Second, 2 * time.Second, 3 * time.Second},
+		},
+		{
+			name:     "exponential",
+			strategy: ExponentialRetryStrategy{Initial: time.Second, Cap: 5 * time.Second, Factor: 2},
+			expected: []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second},
+		},
+		{
+			name:     "exponential overflow",
+			strategy: ExponentialRetryStrategy{Initial: time.Hour, Factor: 1e10},
+			expected: []time.Duration{time.Hour, math.MaxInt64, math.MaxInt64},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var got []time.Duration
+			for attempt := 1; attempt <= len(tc.expected); attempt++ {
+				got = append(got, tc.strategy.NextRetryDelay(attempt, nil))
+			}
+			if !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("expected delays %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestExponentialRetryStrategy_Jitter(t *testing.T) {
+	strategy := ExponentialRetryStrategy{Initial: time.Second, Factor: 2, Jitter: 0.5}
+	for attempt := 1; attempt <= 5; attempt++ {
+		base := time.Second << (attempt - 1)
+		if got := strategy.NextRetryDelay(attempt, nil); got < base || got > base+base/2 {
+			t.Errorf("attempt %d: expected a delay in [%v, %v], got %v", attempt, base, base+base/2, got)
+		}
+	}
+}
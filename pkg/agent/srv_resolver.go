@@ -0,0 +1,187 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/resolver"
+	"k8s.io/klog/v2"
+)
+
+// srvScheme is the scheme of the gRPC targets resolved from DNS SRV records,
+// as in srv:///_konnectivity._tcp.proxy.svc.cluster.local.
+const srvScheme = "srv"
+
+// lookupSRV looks up SRV records; a variable so that tests can fake DNS.
+var lookupSRV = net.DefaultResolver.LookupSRV
+
+// srvResolverBuilder builds resolvers for srv:/// targets, which resolve to
+// the targets of the SRV records of their name, ordered as per RFC 2782.
+type srvResolverBuilder struct {
+	lookup func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+	// refresh is how often the records are looked up again. Zero only
+	// looks them up when gRPC asks to.
+	refresh time.Duration
+	// intn returns a random number in [0, n); rand.Intn if nil.
+	intn func(n int) int
+}
+
+func (b *srvResolverBuilder) Scheme() string {
+	return srvScheme
+}
+
+func (b *srvResolverBuilder) Build(target resolver.Target, cc resolver.ClientConn, _ resolver.BuildOptions) (resolver.Resolver, error) {
+	name := target.Endpoint()
+	if name == "" {
+		return nil, fmt.Errorf("SRV target %q has no name", target.URL.String())
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &srvResolver{
+		builder:    b,
+		name:       name,
+		cc:         cc,
+		ctx:        ctx,
+		cancel:     cancel,
+		resolveNow: make(chan struct{}, 1),
+	}
+	r.wg.Add(1)
+	go r.watch()
+	return r, nil
+}
+
+type srvResolver struct {
+	builder    *srvResolverBuilder
+	name       string
+	cc         resolver.ClientConn
+	ctx        context.Context
+	cancel     context.CancelFunc
+	resolveNow chan struct{}
+	wg         sync.WaitGroup
+}
+
+// watch looks up the records until the resolver is closed, every refresh
+// and whenever gRPC asks to.
+func (r *srvResolver) watch() {
+	defer r.wg.Done()
+	var tick <-chan time.Time
+	if r.builder.refresh > 0 {
+		ticker := time.NewTicker(r.builder.refresh)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		r.resolve()
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-r.resolveNow:
+		case <-tick:
+		}
+	}
+}
+
+func (r *srvResolver) resolve() {
+	_, srvs, err := r.builder.lookup(r.ctx, "", "", r.name)
+	if err == nil && len(srvs) == 0 {
+		err = fmt.Errorf("no SRV records found for %q", r.name)
+	}
+	if err != nil {
+		if r.ctx.Err() == nil {
+			klog.V(2).InfoS("Failed to look up SRV records", "name", r.name, "err", err)
+			r.cc.ReportError(err)
+		}
+		return
+	}
+	intn := r.builder.intn
+	if intn == nil {
+		intn = rand.Intn
+	}
+	sortSRV(srvs, intn)
+	addresses := make([]resolver.Address, 0, len(srvs))
+	for _, srv := range srvs {
+		host := strings.TrimSuffix(srv.Target, ".")
+		addresses = append(addresses, resolver.Address{Addr: net.JoinHostPort(host, strconv.Itoa(int(srv.Port)))})
+	}
+	if err := r.cc.UpdateState(resolver.State{Addresses: addresses}); err != nil {
+		klog.V(4).InfoS("Failed to update the SRV addresses", "name", r.name, "err", err)
+	}
+}
+
+func (r *srvResolver) ResolveNow(resolver.ResolveNowOptions) {
+	select {
+	case r.resolveNow <- struct{}{}:
+	default:
+	}
+}
+
+func (r *srvResolver) Close() {
+	r.cancel()
+	r.wg.Wait()
+}
+
+// sortSRV orders srvs as per RFC 2782: by ascending priority and, within a
+// priority, randomly in proportion to their weight, with records of zero
+// weight having a small chance to come first.
+func sortSRV(srvs []*net.SRV, intn func(n int) int) {
+	sort.SliceStable(srvs, func(i, j int) bool {
+		if srvs[i].Priority != srvs[j].Priority {
+			return srvs[i].Priority < srvs[j].Priority
+		}
+		// Zero weights first, so that they can be picked when the
+		// random number is zero.
+		return srvs[i].Weight == 0 && srvs[j].Weight != 0
+	})
+	for start := 0; start < len(srvs); {
+		end := start + 1
+		for end < len(srvs) && srvs[end].Priority == srvs[start].Priority {
+			end++
+		}
+		shuffleByWeight(srvs[start:end], intn)
+		start = end
+	}
+}
+
+// shuffleByWeight repeatedly moves to the front of srvs a record picked
+// with a probability proportional to its weight.
+func shuffleByWeight(srvs []*net.SRV, intn func(n int) int) {
+	sum := 0
+	for _, srv := range srvs {
+		sum += int(srv.Weight)
+	}
+	for sum > 0 && len(srvs) > 1 {
+		n := intn(sum + 1)
+		running := 0
+		for i, srv := range srvs {
+			running += int(srv.Weight)
+			if running >= n {
+				srvs[0], srvs[i] = srvs[i], srvs[0]
+				break
+			}
+		}
+		sum -= int(srvs[0].Weight)
+		srvs = srvs[1:]
+	}
+}
@@ -0,0 +1,201 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/resolver"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+func TestSortSRV(t *testing.T) {
+	records := func() []*net.SRV {
+		return []*net.SRV{
+			{Target: "a.", Priority: 10, Weight: 0},
+			{Target: "b.", Priority: 10, Weight: 60},
+			{Target: "c.", Priority: 10, Weight: 40},
+			{Target: "d.", Priority: 20, Weight: 0},
+			{Target: "e.", Priority: 5, Weight: 0},
+		}
+	}
+	testCases := []struct {
+		name     string
+		intn     func(n int) int
+		expected []string
+	}{
+		{
+			name:     "lowest random number",
+			intn:     func(int) int { return 0 },
+			expected: []string{"e.", "a.", "b.", "c.", "d."},
+		},
+		{
+			name:     "highest random number",
+			intn:     func(n int) int { return n - 1 },
+			expected: []string{"e.", "c.", "b.", "a.", "d."},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			srvs := records()
+			sortSRV(srvs, tc.intn)
+			var got []string
+			for _, srv := range srvs {
+				got = append(got, srv.Target)
+			}
+			if !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+// fakeResolverClientConn records the states and errors reported by a
+// resolver.
+type fakeResolverClientConn struct {
+	resolver.ClientConn
+	mu     sync.Mutex
+	states []resolver.State
+	errs   []error
+}
+
+func (cc *fakeResolverClientConn) UpdateState(state resolver.State) error {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cc.states = append(cc.states, state)
+	return nil
+}
+
+func (cc *fakeResolverClientConn) ReportError(err error) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cc.errs = append(cc.errs, err)
+}
+
+func (cc *fakeResolverClientConn) counts() (states, errs int) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	return len(cc.states), len(cc.errs)
+}
+
+func TestSRVResolver(t *testing.T) {
+	var mu sync.Mutex
+	var lookups []string
+	records := []*net.SRV{{Target: "proxy-0.example.", Port: 8091, Priority: 10, Weight: 1}}
+	var lookupErr error
+	b := &srvResolverBuilder{
+		lookup: func(_ context.Context, service, proto, name string) (string, []*net.SRV, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			lookups = append(lookups, service+proto+name)
+			return name, append([]*net.SRV(nil), records...), lookupErr
+		},
+		refresh: 10 * time.Millisecond,
+	}
+	cc := &fakeResolverClientConn{}
+	r, err := b.Build(resolver.Target{URL: url.URL{Scheme: srvScheme, Path: "/_konnectivity._tcp.proxy.example"}}, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	if err := wait.PollImmediate(10*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		states, _ := cc.counts()
+		return states > 0, nil
+	}); err != nil {
+		t.Fatal("expected the SRV records to be resolved")
+	}
+	cc.mu.Lock()
+	if got, expected := cc.states[0].Addresses, []resolver.Address{{Addr: "proxy-0.example:8091"}}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected addresses %v, got %v", expected, got)
+	}
+	cc.mu.Unlock()
+	mu.Lock()
+	if lookups[0] != "_konnectivity._tcp.proxy.example" {
+		t.Errorf("expected a lookup of the target name, got %q", lookups[0])
+	}
+	// The records are refreshed periodically.
+	records = append(records, &net.SRV{Target: "proxy-1.example.", Port: 8091, Priority: 20})
+	mu.Unlock()
+	if err := wait.PollImmediate(10*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		cc.mu.Lock()
+		defer cc.mu.Unlock()
+		return len(cc.states[len(cc.states)-1].Addresses) == 2, nil
+	}); err != nil {
+		t.Fatal("expected the refreshed SRV records to be resolved")
+	}
+
+	// Lookup failures are reported to gRPC.
+	mu.Lock()
+	lookupErr = errors.New("no such host")
+	mu.Unlock()
+	r.ResolveNow(resolver.ResolveNowOptions{})
+	if err := wait.PollImmediate(10*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		_, errs := cc.counts()
+		return errs > 0, nil
+	}); err != nil {
+		t.Fatal("expected the lookup error to be reported")
+	}
+}
+
+func TestSync_DNSSRVName(t *testing.T) {
+	var records []*net.SRV
+	for _, serverID := range []string{"server1", "server2"} {
+		_, port, _ := net.SplitHostPort(newTestProxyServer(t, serverID, 2))
+		p, err := strconv.Atoi(port)
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, &net.SRV{Target: "127.0.0.1.", Port: uint16(p), Priority: 10, Weight: 50})
+	}
+	defer func(lookup func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)) {
+		lookupSRV = lookup
+	}(lookupSRV)
+	lookupSRV = func(_ context.Context, _, _, name string) (string, []*net.SRV, error) {
+		if name != "_konnectivity._tcp.proxy.example" {
+			return "", nil, errors.New("no such host")
+		}
+		return name, append([]*net.SRV(nil), records...), nil
+	}
+
+	cs := withTestDefaults(&ClientSetConfig{
+		DNSSRVName:      "_konnectivity._tcp.proxy.example",
+		SyncInterval:    10 * time.Millisecond,
+		SyncIntervalCap: 10 * time.Millisecond,
+		ProbeInterval:   time.Hour,
+		DialOptions:     []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())},
+	}).NewAgentClientSet(nil, make(chan struct{}))
+	defer cs.Wait()
+	defer cs.Shutdown()
+	cs.Serve()
+
+	if err := wait.PollImmediate(10*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		return cs.ClientsCount() == 2, nil
+	}); err != nil {
+		t.Fatalf("expected a client for each SRV target, got %v", cs.ListServerIDs())
+	}
+}
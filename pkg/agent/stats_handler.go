@@ -0,0 +1,71 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"context"
+
+	"google.golang.org/grpc/stats"
+	"google.golang.org/grpc/status"
+
+	"sigs.k8s.io/apiserver-network-proxy/pkg/agent/metrics"
+)
+
+// DefaultStatsHandler is a gRPC stats handler which records the duration of
+// each RPC to the proxy server, and the bytes of its messages, in the agent
+// metrics. It is meant for ClientSetConfig.StatsHandler when per-RPC
+// telemetry is wanted without OpenTelemetry.
+type DefaultStatsHandler struct {
+	// Metrics are the metrics to record to, metrics.Metrics if nil.
+	Metrics *metrics.AgentMetrics
+}
+
+var _ stats.Handler = &DefaultStatsHandler{}
+
+// rpcMethodKey is the context key of the full method name of an RPC.
+type rpcMethodKey struct{}
+
+func (h *DefaultStatsHandler) agentMetrics() *metrics.AgentMetrics {
+	if h.Metrics == nil {
+		return metrics.Metrics
+	}
+	return h.Metrics
+}
+
+// TagRPC records the method of the RPC, since the stats passed to HandleRPC
+// do not carry it.
+func (h *DefaultStatsHandler) TagRPC(ctx context.Context, info *stats.RPCTagInfo) context.Context {
+	return context.WithValue(ctx, rpcMethodKey{}, info.FullMethodName)
+}
+
+func (h *DefaultStatsHandler) HandleRPC(ctx context.Context, s stats.RPCStats) {
+	method, _ := ctx.Value(rpcMethodKey{}).(string)
+	switch s := s.(type) {
+	case *stats.OutPayload:
+		h.agentMetrics().AddRPCBytes(method, metrics.DirectionToServer, s.WireLength)
+	case *stats.InPayload:
+		h.agentMetrics().AddRPCBytes(method, metrics.DirectionFromServer, s.WireLength)
+	case *stats.End:
+		h.agentMetrics().ObserveRPCDuration(method, status.Code(s.Error).String(), s.EndTime.Sub(s.BeginTime))
+	}
+}
+
+func (h *DefaultStatsHandler) TagConn(ctx context.Context, _ *stats.ConnTagInfo) context.Context {
+	return ctx
+}
+
+func (h *DefaultStatsHandler) HandleConn(context.Context, stats.ConnStats) {}
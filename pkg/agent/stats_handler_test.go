@@ -0,0 +1,94 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"k8s.io/apimachinery/pkg/util/wait"
+
+	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/agent/metrics"
+)
+
+const connectMethod = "/AgentService/Connect"
+
+// findMetric returns the metric named name in registry with the given
+// labels, or nil if there is none.
+func findMetric(t *testing.T, registry *prometheus.Registry, name string, labels map[string]string) *dto.Metric {
+	t.Helper()
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() != prometheus.BuildFQName(metrics.Namespace, metrics.Subsystem, name) {
+			continue
+		}
+	metricLoop:
+		for _, m := range family.GetMetric() {
+			for _, label := range m.GetLabel() {
+				if value, ok := labels[label.GetName()]; ok && value != label.GetValue() {
+					continue metricLoop
+				}
+			}
+			return m
+		}
+	}
+	return nil
+}
+
+func TestDefaultStatsHandler(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	m, err := metrics.ForRegistry(registry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs := withTestDefaults(&ClientSetConfig{
+		Address:      newTestProxyServer(t, "server1", 1),
+		StatsHandler: &DefaultStatsHandler{Metrics: m},
+		DialOptions:  []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())},
+	}).NewAgentClientSet(nil, make(chan struct{}))
+
+	c, _, err := cs.newAgentClient(cs.address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Send(&client.Packet{Type: client.PacketType_DIAL_CLS, Payload: &client.Packet_CloseDial{CloseDial: &client.CloseDial{Random: 1}}}); err != nil {
+		t.Fatal(err)
+	}
+	sent := findMetric(t, registry, "rpc_bytes_total", map[string]string{"method": connectMethod, "direction": string(metrics.DirectionToServer)})
+	if sent == nil || sent.GetCounter().GetValue() <= 0 {
+		t.Errorf("expected bytes sent on %s to be recorded, got %v", connectMethod, sent)
+	}
+
+	c.Close()
+	labels := map[string]string{"method": connectMethod, "code": "Canceled"}
+	if err := wait.PollImmediate(10*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		return findMetric(t, registry, "rpc_duration_seconds", labels) != nil, nil
+	}); err != nil {
+		t.Fatalf("expected the duration of %s to be recorded", connectMethod)
+	}
+	if got := findMetric(t, registry, "rpc_duration_seconds", labels).GetHistogram().GetSampleCount(); got != 1 {
+		t.Errorf("expected 1 RPC duration sample, got %d", got)
+	}
+}
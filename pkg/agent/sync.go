@@ -0,0 +1,518 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/agent/metrics"
+)
+
+// syncStats holds the counters backing SyncStats. All fields are accessed
+// atomically; durations and timestamps are stored in nanoseconds.
+type syncStats struct {
+	totalSyncs             int64
+	successfulSyncs        int64
+	failedSyncs            int64
+	duplicateErrors        int64
+	lastSyncDuration       int64
+	currentBackoffDuration int64
+	nextSyncTime           int64
+	lastSyncTime           int64
+	consecutiveFailures    int64
+}
+
+// SyncStats is a point-in-time snapshot of the sync loop statistics.
+type SyncStats struct {
+	// TotalSyncs is the number of connectOnce attempts made by the sync loop.
+	TotalSyncs int64
+	// SuccessfulSyncs is the number of attempts that returned no error.
+	SuccessfulSyncs int64
+	// FailedSyncs is the number of attempts that failed with an error other
+	// than a DuplicateServerError.
+	FailedSyncs int64
+	// DuplicateErrors is the number of attempts that connected to a server
+	// which already had a client.
+	DuplicateErrors int64
+	// LastSyncDuration is how long the most recent attempt took.
+	LastSyncDuration time.Duration
+	// CurrentBackoffDuration is the sleep chosen after the most recent attempt.
+	CurrentBackoffDuration time.Duration
+	// TimeUntilNextSync is the remaining time before the next attempt, or
+	// zero if it is due.
+	TimeUntilNextSync time.Duration
+	// LastSyncTime is when the most recent attempt finished, or zero if
+	// there was none.
+	LastSyncTime time.Time
+	// ConsecutiveFailures is the number of failed attempts since the last
+	// successful one. Duplicate servers do not reset it.
+	ConsecutiveFailures int64
+}
+
+// SyncStats returns a snapshot of the sync loop statistics. It is safe to
+// call concurrently with the sync loop and does not take the ClientSet lock.
+func (cs *ClientSet) SyncStats() SyncStats {
+	stats := SyncStats{
+		TotalSyncs:             atomic.LoadInt64(&cs.stats.totalSyncs),
+		SuccessfulSyncs:        atomic.LoadInt64(&cs.stats.successfulSyncs),
+		FailedSyncs:            atomic.LoadInt64(&cs.stats.failedSyncs),
+		DuplicateErrors:        atomic.LoadInt64(&cs.stats.duplicateErrors),
+		LastSyncDuration:       time.Duration(atomic.LoadInt64(&cs.stats.lastSyncDuration)),
+		CurrentBackoffDuration: time.Duration(atomic.LoadInt64(&cs.stats.currentBackoffDuration)),
+		ConsecutiveFailures:    atomic.LoadInt64(&cs.stats.consecutiveFailures),
+	}
+	if last := atomic.LoadInt64(&cs.stats.lastSyncTime); last != 0 {
+		stats.LastSyncTime = time.Unix(0, last)
+	}
+	if next := atomic.LoadInt64(&cs.stats.nextSyncTime); next != 0 {
+		if until := time.Unix(0, next).Sub(cs.clock.Now()); until > 0 {
+			stats.TimeUntilNextSync = until
+		}
+	}
+	return stats
+}
+
+// ServerCountSample is the server count observed by the sync loop at a
+// point in time.
+type ServerCountSample struct {
+	Timestamp time.Time
+	Count     int
+}
+
+const (
+	// serverCountHistorySize is the number of samples kept by
+	// ServerCountHistory, an hour at one sample per minute.
+	serverCountHistorySize    = 60
+	serverCountSampleInterval = time.Minute
+)
+
+// ServerCountHistory returns the server count sampled by the sync loop about
+// once a minute over the last hour, oldest first.
+func (cs *ClientSet) ServerCountHistory() []ServerCountSample {
+	cs.historyMu.Lock()
+	history := append([]ServerCountSample(nil), cs.history...)
+	cs.historyMu.Unlock()
+	sort.Slice(history, func(i, j int) bool {
+		return history[i].Timestamp.Before(history[j].Timestamp)
+	})
+	return history
+}
+
+// recordServerCount adds a sample of the current server count, unless the
+// last one was taken less than serverCountSampleInterval before now.
+func (cs *ClientSet) recordServerCount(now time.Time) {
+	cs.historyMu.Lock()
+	defer cs.historyMu.Unlock()
+	if !cs.historyLast.IsZero() && now.Sub(cs.historyLast) < serverCountSampleInterval {
+		return
+	}
+	cs.historyLast = now
+	sample := ServerCountSample{Timestamp: now, Count: cs.currentServerCount()}
+	if len(cs.history) < serverCountHistorySize {
+		cs.history = append(cs.history, sample)
+		return
+	}
+	cs.history[cs.historyNext] = sample
+	cs.historyNext = (cs.historyNext + 1) % serverCountHistorySize
+}
+
+// newAgentClient connects a new client to the proxy server at address,
+// without adding it to the ClientSet. The dial options are those of the
+// server last connected through address, if it is known.
+func (cs *ClientSet) newAgentClient(address string) (*Client, int, error) {
+	opts, err := cs.dialOptionsFor(cs.addressServerID(address), address)
+	if err != nil {
+		return nil, 0, err
+	}
+	return newAgentClient(address, cs.agentID, cs.agentIdentifiers, "", cs, opts...)
+}
+
+// dialOptionsFor returns the dial options to use when connecting to the
+// given server.
+func (cs *ClientSet) dialOptionsFor(serverID, address string) ([]grpc.DialOption, error) {
+	var extra []grpc.DialOption
+	if cs.dialOptionsForServer != nil {
+		extra = cs.dialOptionsForServer(serverID, address)
+	}
+	if cs.credentialsReloader != nil {
+		creds, err := cs.credentialsReloader()
+		if err != nil {
+			return nil, fmt.Errorf("failed to reload transport credentials: %w", err)
+		}
+		extra = append(extra, grpc.WithTransportCredentials(creds))
+	}
+	if cs.tlsCredentials != nil {
+		extra = append(extra, grpc.WithTransportCredentials(cs.tlsCredentials))
+	}
+	if extra == nil {
+		return cs.dialOptions, nil
+	}
+	opts := make([]grpc.DialOption, 0, len(cs.dialOptions)+len(extra))
+	opts = append(opts, cs.dialOptions...)
+	return append(opts, extra...), nil
+}
+
+func (cs *ClientSet) resetBackoff() *wait.Backoff {
+	if cs.backoffFn != nil {
+		return cs.backoffFn()
+	}
+	return &wait.Backoff{
+		Steps:    math.MaxInt32,
+		Jitter:   cs.backoffJitter,
+		Factor:   cs.backoffFactor,
+		Duration: cs.syncInterval,
+		Cap:      cs.syncIntervalCap,
+	}
+}
+
+// sync makes sure that #clients >= #proxy servers
+func (cs *ClientSet) sync() {
+	defer cs.syncExited.fire()
+	defer cs.shutdown()
+	if cs.initialSyncDelay > 0 {
+		delay := wait.Jitter(cs.initialSyncDelay, 1.0)
+		cs.logger.V(2).Info("Delaying first sync", "agentID", cs.agentID, "delay", delay)
+		select {
+		case <-cs.stopCh:
+			return
+		case <-cs.stopping.C():
+			return
+		case <-cs.clock.After(delay):
+		}
+	}
+	backoff := cs.resetBackoff()
+	var duration time.Duration
+	// lastConnect is when a sync attempt last succeeded, i.e. added a client
+	// or found one for every server.
+	lastConnect := cs.clock.Now()
+	for {
+		start := cs.clock.Now()
+		result := cs.connectOnce()
+		elapsed := cs.clock.Since(start)
+		atomic.StoreInt64(&cs.stats.lastSyncDuration, int64(elapsed))
+		cs.agentMetrics().RecordSyncDuration(elapsed, result.syncResult())
+		cs.updateFallback(result)
+		cs.probePrimary()
+		if result.err == nil {
+			lastConnect = cs.clock.Now()
+			cs.agentMetrics().SetTimeSinceLastConnect(cs.agentID, 0)
+			if cs.maxExcessConnections > 0 {
+				// Trimming is opt-in: by default the clients of servers
+				// beyond ServerCount are kept until they are unhealthy.
+				cs.trimExcessClients()
+			}
+		} else {
+			cs.agentMetrics().SetTimeSinceLastConnect(cs.agentID, cs.clock.Since(lastConnect).Seconds())
+		}
+		cs.recordServerCount(cs.clock.Now())
+		duration = cs.nextSyncBackoff(result, backoff, duration)
+		if !cs.waitForNextSync(duration) {
+			return
+		}
+	}
+}
+
+// waitForNextSync waits for duration, removing the clients whose Serve
+// goroutine exits in the meantime so that the next sync can replace them.
+// It returns false if the ClientSet was stopped or shut down.
+func (cs *ClientSet) waitForNextSync(duration time.Duration) bool {
+	next := cs.clock.After(duration)
+	for {
+		select {
+		case <-cs.stopCh:
+			return false
+		case <-cs.stopping.C():
+			return false
+		case <-cs.clientExitCh:
+			cs.removeExitedClients()
+		case <-next:
+			return true
+		}
+	}
+}
+
+// removeExitedClients closes and removes the clients whose Serve has
+// returned but which are still in the ClientSet. Serve normally removes its
+// own client as it returns, so this is a safety net against zombie clients
+// which would otherwise count towards ClientsCount and block their
+// replacement. It returns the number of clients removed.
+func (cs *ClientSet) removeExitedClients() int {
+	return cs.removeClients(func(serverID string, c *Client) bool {
+		select {
+		case <-c.Done():
+		default:
+			return false
+		}
+		cs.logger.V(1).Info("Removing client whose Serve has exited", "agentID", cs.agentID, "serverID", serverID)
+		return true
+	})
+}
+
+// nextSyncBackoff records the outcome of a connectOnce attempt and returns
+// how long the sync loop should sleep before the next one. last is the
+// previous sleep, which is kept when a duplicate server is hit while there
+// are still servers left to connect to.
+func (cs *ClientSet) nextSyncBackoff(result connectResult, backoff *wait.Backoff, last time.Duration) time.Duration {
+	atomic.AddInt64(&cs.stats.totalSyncs, 1)
+	duration := last
+	syncResult := result.syncResult()
+	var dse *DuplicateServerError
+	switch {
+	case errors.As(result.err, &dse):
+		atomic.AddInt64(&cs.stats.duplicateErrors, 1)
+		cs.recordDuplicateServer(dse.ServerID)
+		serverCount := cs.ServerCount()
+		cs.logger.V(4).Info("duplicate server", "agentID", cs.agentID, "serverID", dse.ServerID, "serverCount", serverCount, "clientsCount", cs.ClientsCount())
+		if serverCount != 0 && cs.ClientsCount() >= serverCount {
+			duration = cs.retryDelay(backoff, result.err)
+		}
+	case result.atMaxClients:
+		// Nothing to connect to until a client goes away, so the sync
+		// interval is kept at its cap rather than reset.
+		atomic.AddInt64(&cs.stats.successfulSyncs, 1)
+		atomic.StoreInt64(&cs.stats.consecutiveFailures, 0)
+		if backoff.Cap > 0 {
+			backoff.Duration = backoff.Cap
+		}
+		duration = wait.Jitter(backoff.Duration, backoff.Jitter)
+	case result.err != nil:
+		atomic.AddInt64(&cs.stats.failedSyncs, 1)
+		atomic.AddInt64(&cs.stats.consecutiveFailures, 1)
+		cs.logger.Error(result.err, "cannot connect once", "agentID", cs.agentID)
+		if cs.retryImmediately(result.err) {
+			duration = 0
+		} else {
+			duration = cs.retryDelay(backoff, result.err)
+		}
+	default:
+		// Either a client was added, or there is a client for every server.
+		atomic.AddInt64(&cs.stats.successfulSyncs, 1)
+		atomic.StoreInt64(&cs.stats.consecutiveFailures, 0)
+		if serverCount := cs.ServerCount(); serverCount == 0 || cs.ClientsCount() >= serverCount {
+			*backoff = *cs.resetBackoff()
+			cs.retryAttempt = 0
+		} else {
+			// Some servers are still unreachable: back off one step only,
+			// so that they are not retried at the base interval.
+			cs.stepBackoffDown(backoff)
+		}
+		duration = wait.Jitter(backoff.Duration, backoff.Jitter)
+	}
+	if syncResult != metrics.SyncResultDuplicate {
+		cs.lastDuplicateServerID, cs.consecutiveDuplicates = "", 0
+	}
+	if syncResult != metrics.SyncResultFailure {
+		cs.immediateRetried = false
+	}
+	now := cs.clock.Now()
+	atomic.StoreInt64(&cs.stats.currentBackoffDuration, int64(duration))
+	atomic.StoreInt64(&cs.stats.nextSyncTime, now.Add(duration).UnixNano())
+	atomic.StoreInt64(&cs.stats.lastSyncTime, now.UnixNano())
+	cs.agentMetrics().ObserveSyncBackoff(syncResult, duration)
+	return duration
+}
+
+// stepBackoffDown undoes one step of backoff, and of the retry strategy
+// attempts, without going below the sync interval.
+func (cs *ClientSet) stepBackoffDown(backoff *wait.Backoff) {
+	if cs.retryAttempt > 0 {
+		cs.retryAttempt--
+	}
+	base := cs.resetBackoff().Duration
+	if backoff.Factor > 1 {
+		backoff.Duration = time.Duration(float64(backoff.Duration) / backoff.Factor)
+	}
+	if backoff.Duration < base {
+		backoff.Duration = base
+	}
+}
+
+// duplicateServerWarnThreshold is the number of consecutive
+// DuplicateServerErrors for the same server after which, and every such
+// number after, a warning is logged.
+const duplicateServerWarnThreshold = 5
+
+// recordDuplicateServer counts a DuplicateServerError for serverID, and logs
+// a warning if it keeps being hit. That usually means the server count is
+// wrong, or the address keeps resolving to the same server.
+func (cs *ClientSet) recordDuplicateServer(serverID string) {
+	cs.agentMetrics().IncDuplicateServer(serverID)
+	if serverID != cs.lastDuplicateServerID {
+		cs.lastDuplicateServerID = serverID
+		cs.consecutiveDuplicates = 0
+	}
+	cs.consecutiveDuplicates++
+	if cs.consecutiveDuplicates%duplicateServerWarnThreshold == 0 {
+		cs.logger.Info("Repeatedly connected to a server which already has a client; the server count may be wrong or the address may keep resolving to the same server",
+			"agentID", cs.agentID, "serverID", serverID, "consecutiveDuplicates", cs.consecutiveDuplicates,
+			"serverCount", cs.ServerCount(), "clientsCount", cs.ClientsCount())
+	}
+}
+
+// retryDelay returns how long to wait after the failed attempt which
+// returned err, stepping backoff unless a RetryStrategy is set.
+func (cs *ClientSet) retryDelay(backoff *wait.Backoff, err error) time.Duration {
+	if cs.retryStrategy == nil {
+		return backoff.Step()
+	}
+	cs.retryAttempt++
+	return cs.retryStrategy.NextRetryDelay(cs.retryAttempt, err)
+}
+
+// retryImmediately returns true if the sync loop should retry at once after
+// err, i.e. if err has one of immediateRetryCodes and the previous attempt
+// was not retried at once already.
+func (cs *ClientSet) retryImmediately(err error) bool {
+	retried := cs.immediateRetried
+	cs.immediateRetried = false
+	if retried {
+		return false
+	}
+	code := status.Code(err)
+	for _, c := range cs.immediateRetryCodes {
+		if c == code {
+			cs.immediateRetried = true
+			return true
+		}
+	}
+	return false
+}
+
+// connectResult is the outcome of a single connectOnce attempt.
+type connectResult struct {
+	// serverCount is the server count reported by the dialed server, or
+	// zero if no server was dialed.
+	serverCount int
+	// added is true if a client for a new server was added to the ClientSet.
+	added bool
+	// alreadyConnected is true if no server was dialed because the
+	// ClientSet already has a client for every server, or is draining or
+	// paused.
+	alreadyConnected bool
+	// atMaxClients is true if no server was dialed because the ClientSet
+	// has MaxClients clients.
+	atMaxClients bool
+	// err is a *DuplicateServerError if the dialed server already had a
+	// client, or the error from dialing the server.
+	err error
+}
+
+// syncResult classifies the attempt for the sync metrics.
+func (r connectResult) syncResult() metrics.SyncResult {
+	var dse *DuplicateServerError
+	switch {
+	case errors.As(r.err, &dse):
+		return metrics.SyncResultDuplicate
+	case r.err != nil:
+		return metrics.SyncResultFailure
+	default:
+		return metrics.SyncResultSuccess
+	}
+}
+
+func (cs *ClientSet) connectOnce() (result connectResult) {
+	defer func() { cs.recordSyncResult(result) }()
+	if cs.isShutdown() || cs.Draining() || cs.Paused() {
+		return connectResult{alreadyConnected: true}
+	}
+	if serverCount := cs.ServerCount(); !cs.syncForever && serverCount != 0 && cs.ClientsCount() >= serverCount {
+		return connectResult{alreadyConnected: true}
+	}
+	if cs.maxClients > 0 && cs.ClientsCount() >= cs.maxClients {
+		if !cs.atMaxClients {
+			cs.logger.Info("Reached the maximum number of clients, not opening more connections",
+				"agentID", cs.agentID, "maxClients", cs.maxClients, "serverCount", cs.ServerCount())
+		}
+		cs.atMaxClients = true
+		return connectResult{atMaxClients: true}
+	}
+	cs.atMaxClients = false
+	address, err := cs.nextAddress()
+	if err != nil {
+		return connectResult{err: err}
+	}
+	cb := cs.circuitBreakerFor(address)
+	if cb != nil {
+		if err := cb.allow(); err != nil {
+			return connectResult{err: err}
+		}
+	}
+	start := time.Now()
+	c, serverCount, err := cs.newAgentClient(address)
+	if cb != nil {
+		if err != nil {
+			cb.recordFailure()
+		} else {
+			cb.recordSuccess()
+		}
+	}
+	if err != nil {
+		cs.agentMetrics().RecordConnectionEstablishment(address, metrics.ConnectionResultError, time.Since(start))
+		cs.agentMetrics().RecordConnectAttempt(address, connectErrorType(err))
+		attempts := cs.recordDialFailure(address)
+		return connectResult{err: &ConnectionFailedError{Address: address, AttemptCount: attempts, Cause: err}}
+	}
+	// The Connect stream has been opened and the server headers received,
+	// so the connection has reached Ready.
+	cs.agentMetrics().RecordConnectionEstablishment(address, metrics.ConnectionResultSuccess, time.Since(start))
+	cs.resetDialFailures(address)
+	if len(cs.currentAddresses()) > 1 {
+		cs.setAddressServerID(address, c.serverID)
+	}
+	if cs.isFailedServer(c.serverID) {
+		cs.logger.V(2).Info("Skipping permanently failed server", "agentID", cs.agentID, "serverID", c.serverID)
+		c.Close()
+		return connectResult{serverCount: serverCount, err: &FailedServerError{ServerID: c.serverID}}
+	}
+	if cs.serverCount != 0 && cs.serverCount != serverCount {
+		cs.logger.V(2).Info("Server count change suggestion by server",
+			"agentID", cs.agentID, "current", cs.serverCount, "serverID", c.serverID, "actual", serverCount)
+
+	}
+	cs.mu.Lock()
+	cs.serverCount = serverCount
+	cs.mu.Unlock()
+	if err := cs.AddClient(c.serverID, c); err != nil {
+		cs.agentMetrics().RecordConnectAttempt(c.serverID, metrics.ConnectErrorDuplicate)
+		c.Close()
+		return connectResult{serverCount: serverCount, err: err}
+	}
+	cs.agentMetrics().RecordConnectAttempt(c.serverID, metrics.ConnectErrorNone)
+	cs.logger.V(2).Info("sync added client connecting to proxy server", "agentID", cs.agentID, "serverID", c.serverID)
+	cs.serveClient(c)
+	return connectResult{serverCount: serverCount, added: true}
+}
+
+// connectErrorType classifies an error from dialing the proxy server for
+// the connect attempts metric.
+func connectErrorType(err error) string {
+	switch status.Code(err) {
+	case codes.Unauthenticated, codes.PermissionDenied:
+		return metrics.ConnectErrorAuth
+	default:
+		return metrics.ConnectErrorTransport
+	}
+}
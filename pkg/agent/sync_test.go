@@ -0,0 +1,1069 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/resolver/manual"
+	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+	clocktesting "k8s.io/utils/clock/testing"
+
+	"sigs.k8s.io/apiserver-network-proxy/pkg/agent/metrics"
+	"sigs.k8s.io/apiserver-network-proxy/proto/agent"
+)
+
+func TestResetBackoff_CustomFactor(t *testing.T) {
+	cc := withTestDefaults(&ClientSetConfig{
+		Address:         "localhost:0",
+		SyncInterval:    100 * time.Millisecond,
+		SyncIntervalCap: time.Minute,
+		BackoffFactor:   3,
+		BackoffJitter:   0.05,
+	})
+	cs := cc.NewAgentClientSet(nil, make(chan struct{}))
+
+	backoff := cs.resetBackoff()
+	var duration time.Duration
+	expected := cc.SyncInterval
+	for i := 0; i < 5; i++ {
+		// No transport security is configured, so every attempt fails.
+		result := cs.connectOnce()
+		if result.err == nil {
+			t.Fatalf("attempt %d: expected connectOnce to fail", i)
+		}
+		duration = cs.nextSyncBackoff(result, backoff, duration)
+		max := time.Duration(float64(expected) * (1 + cc.BackoffJitter))
+		if duration < expected || duration > max {
+			t.Errorf("attempt %d: expected backoff in [%v, %v], got %v", i, expected, max, duration)
+		}
+		expected = time.Duration(float64(expected) * cc.BackoffFactor)
+	}
+}
+
+func TestResetBackoff_Defaults(t *testing.T) {
+	testCases := []struct {
+		name           string
+		factor, jitter float64
+	}{
+		{name: "zero"},
+		{name: "invalid", factor: 0.5, jitter: -1},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cc := withTestDefaults(&ClientSetConfig{BackoffFactor: tc.factor, BackoffJitter: tc.jitter})
+			backoff := cc.NewAgentClientSet(nil, make(chan struct{})).resetBackoff()
+			if backoff.Factor != defaultBackoffFactor {
+				t.Errorf("expected factor %v, got %v", defaultBackoffFactor, backoff.Factor)
+			}
+			if backoff.Jitter != defaultBackoffJitter {
+				t.Errorf("expected jitter %v, got %v", defaultBackoffJitter, backoff.Jitter)
+			}
+		})
+	}
+}
+
+func TestResetBackoff_BackoffFn(t *testing.T) {
+	custom := &wait.Backoff{Duration: time.Second, Factor: 2, Steps: 3}
+	cc := withTestDefaults(&ClientSetConfig{BackoffFn: func() *wait.Backoff { return custom }})
+	if got := cc.NewAgentClientSet(nil, make(chan struct{})).resetBackoff(); got != custom {
+		t.Errorf("expected backoff from BackoffFn, got %+v", got)
+	}
+}
+
+func TestConnectOnce(t *testing.T) {
+	testCases := []struct {
+		name        string
+		serverCount int
+		clients     []string
+		syncForever bool
+		draining    bool
+		expected    connectResult
+		expectErr   bool
+	}{
+		{
+			name:        "already connected",
+			serverCount: 1,
+			clients:     []string{"server1"},
+			expected:    connectResult{alreadyConnected: true},
+		},
+		{
+			name:     "draining",
+			draining: true,
+			expected: connectResult{alreadyConnected: true},
+		},
+		{
+			name:      "dial failure",
+			expectErr: true,
+		},
+		{
+			name:        "sync forever dials when connected",
+			serverCount: 1,
+			clients:     []string{"server1"},
+			syncForever: true,
+			expectErr:   true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// No transport security is configured, so any dial fails.
+			cc := withTestDefaults(&ClientSetConfig{Address: "localhost:0", SyncForever: tc.syncForever})
+			cs := cc.NewAgentClientSet(nil, make(chan struct{}))
+			cs.serverCount = tc.serverCount
+			for _, serverID := range tc.clients {
+				cs.clients[serverID] = &Client{serverID: serverID}
+			}
+			if tc.draining {
+				cs.draining = 1
+			}
+
+			result := cs.connectOnce()
+			if tc.expectErr {
+				var cfe *ConnectionFailedError
+				if !errors.As(result.err, &cfe) || result.added || result.alreadyConnected {
+					t.Errorf("expected dial failure, got %+v", result)
+				} else if cfe.Address != "localhost:0" || cfe.AttemptCount != 1 {
+					t.Errorf("expected the first failure to connect to localhost:0, got %v", cfe)
+				}
+				return
+			}
+			if result != tc.expected {
+				t.Errorf("expected %+v, got %+v", tc.expected, result)
+			}
+		})
+	}
+}
+
+func TestConnectOnce_ConnectionFailedError(t *testing.T) {
+	cs := withTestDefaults(&ClientSetConfig{}).NewAgentClientSet(nil, make(chan struct{}))
+	for attempt := 1; attempt <= 3; attempt++ {
+		result := cs.connectOnce()
+		var cfe *ConnectionFailedError
+		if !errors.As(result.err, &cfe) {
+			t.Fatalf("expected a ConnectionFailedError, got %v", result.err)
+		}
+		if cfe.AttemptCount != attempt {
+			t.Errorf("expected attempt %d, got %d", attempt, cfe.AttemptCount)
+		}
+		if cfe.Cause == nil || errors.Unwrap(result.err) != cfe.Cause {
+			t.Errorf("expected the error to unwrap to its cause, got %v", errors.Unwrap(result.err))
+		}
+	}
+	// A successful dial resets the count.
+	cs.resetDialFailures(cs.address)
+	var cfe *ConnectionFailedError
+	if result := cs.connectOnce(); !errors.As(result.err, &cfe) || cfe.AttemptCount != 1 {
+		t.Errorf("expected attempt 1 after clearing, got %v", result.err)
+	}
+}
+
+// TestConnectOnce_ServerCount verifies the last received server count (the
+// serverCount field) survives a DuplicateServerError.
+func TestConnectOnce_ServerCount(t *testing.T) {
+	addr := newTestProxyServer(t, "server1", 3)
+	cc := withTestDefaults(&ClientSetConfig{
+		Address:       addr,
+		ProbeInterval: time.Hour,
+		DialOptions:   []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())},
+	})
+	cs := cc.NewAgentClientSet(nil, make(chan struct{}))
+	defer cs.Wait()
+	defer cs.Shutdown()
+
+	result := cs.connectOnce()
+	if result.err != nil || !result.added {
+		t.Fatalf("expected first connectOnce to add a client, got %+v", result)
+	}
+	if result.serverCount != 3 || cs.serverCount != 3 {
+		t.Errorf("expected server count 3, got result %d and last received %d", result.serverCount, cs.serverCount)
+	}
+
+	// The test server always reports the same ID, so the next connection
+	// is a duplicate.
+	result = cs.connectOnce()
+	var dse *DuplicateServerError
+	if !errors.As(result.err, &dse) {
+		t.Fatalf("expected DuplicateServerError, got %+v", result)
+	}
+	if cs.serverCount != 3 {
+		t.Errorf("expected last received server count to remain 3, got %d", cs.serverCount)
+	}
+	if cs.ClientsCount() != 1 {
+		t.Errorf("expected the duplicate client to be discarded, got %d clients", cs.ClientsCount())
+	}
+}
+
+func TestConnectOnce_EstablishmentMetric(t *testing.T) {
+	metrics.Metrics.Reset()
+	addr := newTestProxyServer(t, "server1", 1)
+	cc := withTestDefaults(&ClientSetConfig{
+		Address:       addr,
+		ProbeInterval: time.Hour,
+		DialOptions:   []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())},
+	})
+	cs := cc.NewAgentClientSet(nil, make(chan struct{}))
+	defer cs.Wait()
+	defer cs.Shutdown()
+
+	if result := cs.connectOnce(); result.err != nil || !result.added {
+		t.Fatalf("expected connectOnce to add a client, got %+v", result)
+	}
+	if got := connEstablishmentCount(t, addr, metrics.ConnectionResultSuccess); got != 1 {
+		t.Errorf("expected 1 successful connection observation, got %d", got)
+	}
+
+	// Nothing listens on port 0, so the Connect stream fails.
+	cc.Address = "localhost:0"
+	failing := cc.NewAgentClientSet(nil, make(chan struct{}))
+	if result := failing.connectOnce(); result.err == nil {
+		t.Fatalf("expected connectOnce to fail, got %+v", result)
+	}
+	if got := connEstablishmentCount(t, "localhost:0", metrics.ConnectionResultError); got != 1 {
+		t.Errorf("expected 1 failed connection observation, got %d", got)
+	}
+}
+
+func TestConnectOnce_ConnectAttemptsMetric(t *testing.T) {
+	metrics.Metrics.Reset()
+	insecureDial := []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}
+	testCases := []struct {
+		name             string
+		server           *testProxyServer
+		connectTwice     bool
+		expectedServerID string
+		expectedType     string
+	}{
+		{
+			name:             "none",
+			server:           &testProxyServer{serverID: "server-none", serverCount: 1},
+			expectedServerID: "server-none",
+			expectedType:     metrics.ConnectErrorNone,
+		},
+		{
+			name:             "duplicate",
+			server:           &testProxyServer{serverID: "server-dup", serverCount: 2},
+			connectTwice:     true,
+			expectedServerID: "server-dup",
+			expectedType:     metrics.ConnectErrorDuplicate,
+		},
+		{
+			name:         "transport",
+			server:       &testProxyServer{err: status.Error(codes.Unavailable, "unavailable")},
+			expectedType: metrics.ConnectErrorTransport,
+		},
+		{
+			name:         "auth",
+			server:       &testProxyServer{err: status.Error(codes.Unauthenticated, "bad token")},
+			expectedType: metrics.ConnectErrorAuth,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			addr := serveTestProxyServer(t, tc.server)
+			serverID := tc.expectedServerID
+			if serverID == "" {
+				// The server was not reached, so the attempt is recorded
+				// against its address.
+				serverID = addr
+			}
+			cs := withTestDefaults(&ClientSetConfig{Address: addr, ProbeInterval: time.Hour, DialOptions: insecureDial}).NewAgentClientSet(nil, make(chan struct{}))
+			defer cs.Wait()
+			defer cs.Shutdown()
+
+			cs.connectOnce()
+			if tc.connectTwice {
+				cs.connectOnce()
+			}
+			if got := connectAttemptsCount(t, serverID, tc.expectedType); got != 1 {
+				t.Errorf("expected 1 %s attempt for %s, got %v", tc.expectedType, serverID, got)
+			}
+		})
+	}
+}
+
+func TestSyncDurationMetric(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	cs := withTestDefaults(&ClientSetConfig{
+		Address:         newTestProxyServer(t, "server1", 1),
+		SyncInterval:    10 * time.Millisecond,
+		SyncIntervalCap: 10 * time.Millisecond,
+		ProbeInterval:   time.Hour,
+		DialOptions:     []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())},
+		MetricsRegistry: registry,
+	}).NewAgentClientSet(nil, make(chan struct{}))
+	defer cs.Wait()
+	defer cs.Shutdown()
+	cs.Serve()
+
+	name := prometheus.BuildFQName(metrics.Namespace, metrics.Subsystem, "sync_duration_seconds")
+	if err := wait.PollImmediate(10*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		families, err := registry.Gather()
+		if err != nil {
+			return false, err
+		}
+		for _, family := range families {
+			if family.GetName() != name {
+				continue
+			}
+			for _, m := range family.GetMetric() {
+				if m.GetLabel()[0].GetValue() == string(metrics.SyncResultSuccess) && m.GetHistogram().GetSampleCount() > 0 {
+					return true, nil
+				}
+			}
+		}
+		return false, nil
+	}); err != nil {
+		t.Errorf("expected the sync attempts to be recorded in %s: %v", name, err)
+	}
+}
+
+func TestNextSyncBackoff_RetryStrategy(t *testing.T) {
+	strategy := &recordingRetryStrategy{}
+	cs := withTestDefaults(&ClientSetConfig{SyncInterval: time.Hour, RetryStrategy: strategy}).NewAgentClientSet(nil, make(chan struct{}))
+	backoff := cs.resetBackoff()
+	dialErr := errors.New("dial failed")
+
+	var got []time.Duration
+	for _, err := range []error{dialErr, dialErr, nil, dialErr} {
+		got = append(got, cs.nextSyncBackoff(connectResult{err: err}, backoff, 0))
+	}
+	// The wait after a success is the jittered sync interval, which is at
+	// least an hour.
+	if got[0] != time.Second || got[1] != 2*time.Second || got[2] < time.Hour || got[3] != time.Second {
+		t.Errorf("expected delays [1s 2s >=1h 1s], got %v", got)
+	}
+	if expected := []int{1, 2, 1}; !reflect.DeepEqual(strategy.attempts, expected) {
+		t.Errorf("expected attempts %v, got %v", expected, strategy.attempts)
+	}
+	for _, err := range strategy.errs {
+		if err != dialErr {
+			t.Errorf("expected the last error to be passed to the strategy, got %v", err)
+		}
+	}
+}
+
+func TestNextSyncBackoff_PartialConnectivity(t *testing.T) {
+	testCases := []struct {
+		name    string
+		clients int
+		err     error
+		// expected is the unjittered wait, and next the backoff duration
+		// after it.
+		expected, next time.Duration
+	}{
+		{name: "connected to all", clients: 3, expected: time.Second, next: time.Second},
+		{name: "connected to some", clients: 1, expected: 4 * time.Second, next: 4 * time.Second},
+		{name: "connected to none", err: errors.New("dial failed"), expected: 8 * time.Second, next: 16 * time.Second},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cs := withTestDefaults(&ClientSetConfig{
+				SyncInterval:    time.Second,
+				SyncIntervalCap: time.Minute,
+				BackoffFactor:   2,
+			}).NewAgentClientSet(nil, make(chan struct{}))
+			cs.serverCount = 3
+			for i := 0; i < tc.clients; i++ {
+				serverID := fmt.Sprintf("server%d", i)
+				if err := cs.AddClient(serverID, &Client{serverID: serverID}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// Back off to 8s after three failures.
+			backoff := cs.resetBackoff()
+			for i := 0; i < 3; i++ {
+				cs.nextSyncBackoff(connectResult{err: errors.New("dial failed")}, backoff, 0)
+			}
+
+			got := cs.nextSyncBackoff(connectResult{err: tc.err, added: tc.err == nil}, backoff, 0)
+			if max := time.Duration(float64(tc.expected) * (1 + backoff.Jitter)); got < tc.expected || got > max {
+				t.Errorf("expected a wait between %v and %v, got %v", tc.expected, max, got)
+			}
+			if backoff.Duration != tc.next {
+				t.Errorf("expected the backoff to be at %v, got %v", tc.next, backoff.Duration)
+			}
+		})
+	}
+}
+
+func TestNextSyncBackoff_PartialConnectivityFloor(t *testing.T) {
+	cs := withTestDefaults(&ClientSetConfig{
+		SyncInterval:    time.Second,
+		SyncIntervalCap: time.Minute,
+		BackoffFactor:   2,
+	}).NewAgentClientSet(nil, make(chan struct{}))
+	cs.serverCount = 3
+	if err := cs.AddClient("server1", &Client{serverID: "server1"}); err != nil {
+		t.Fatal(err)
+	}
+	backoff := cs.resetBackoff()
+	cs.nextSyncBackoff(connectResult{err: errors.New("dial failed")}, backoff, 0)
+	for i := 0; i < 3; i++ {
+		cs.nextSyncBackoff(connectResult{added: true}, backoff, 0)
+	}
+	if backoff.Duration != time.Second {
+		t.Errorf("expected the backoff not to go below the sync interval, got %v", backoff.Duration)
+	}
+}
+
+func TestNextSyncBackoff_ImmediateRetry(t *testing.T) {
+	cs := withTestDefaults(&ClientSetConfig{
+		SyncInterval:          time.Second,
+		SyncIntervalCap:       time.Minute,
+		ImmediateRetryOnCodes: []codes.Code{codes.Unavailable},
+	}).NewAgentClientSet(nil, make(chan struct{}))
+	backoff := cs.resetBackoff()
+	fail := func(code codes.Code) time.Duration {
+		err := &ConnectionFailedError{Address: "proxy:8091", AttemptCount: 1, Cause: status.Error(code, "connect failed")}
+		return cs.nextSyncBackoff(connectResult{err: err}, backoff, 0)
+	}
+
+	if got := fail(codes.Unavailable); got != 0 {
+		t.Errorf("expected an immediate retry after Unavailable, got %v", got)
+	}
+	// The next attempt backs off, even if it fails the same way.
+	if got := fail(codes.Unavailable); got < time.Second {
+		t.Errorf("expected a backoff after two Unavailable in a row, got %v", got)
+	}
+	if got := fail(codes.Unavailable); got != 0 {
+		t.Errorf("expected an immediate retry after a backoff, got %v", got)
+	}
+	if got := fail(codes.Unauthenticated); got < time.Second {
+		t.Errorf("expected a backoff after Unauthenticated, got %v", got)
+	}
+	cs.nextSyncBackoff(connectResult{alreadyConnected: true}, backoff, 0)
+	if got := fail(codes.Unavailable); got != 0 {
+		t.Errorf("expected an immediate retry after a success, got %v", got)
+	}
+
+	if err := withTestDefaults(&ClientSetConfig{ImmediateRetryOnCodes: []codes.Code{codes.OK}}).Validate(); err == nil {
+		t.Error("expected codes.OK to be rejected")
+	}
+}
+
+func TestNextSyncBackoff_RepeatedDuplicates(t *testing.T) {
+	metrics.Metrics.Reset()
+	var buf bytes.Buffer
+	klog.LogToStderr(false)
+	klog.SetOutput(&buf)
+	defer func() {
+		klog.SetOutput(os.Stderr)
+		klog.LogToStderr(true)
+	}()
+
+	cs := withTestDefaults(&ClientSetConfig{}).NewAgentClientSet(nil, make(chan struct{}))
+	backoff := cs.resetBackoff()
+	duplicate := func(serverID string) {
+		cs.nextSyncBackoff(connectResult{err: &DuplicateServerError{ServerID: serverID}}, backoff, 0)
+	}
+	// Interleaved and interrupted duplicates do not count as consecutive.
+	for i := 0; i < duplicateServerWarnThreshold-1; i++ {
+		duplicate("server1")
+	}
+	duplicate("server2")
+	for i := 0; i < duplicateServerWarnThreshold-1; i++ {
+		duplicate("server1")
+	}
+	cs.nextSyncBackoff(connectResult{err: errors.New("dial failed")}, backoff, 0)
+	for i := 0; i < duplicateServerWarnThreshold-1; i++ {
+		duplicate("server1")
+	}
+	klog.Flush()
+	if strings.Contains(buf.String(), "Repeatedly connected") {
+		t.Fatalf("expected no warning before %d consecutive duplicates, got %q", duplicateServerWarnThreshold, buf.String())
+	}
+
+	duplicate("server1")
+	klog.Flush()
+	if got := strings.Count(buf.String(), "Repeatedly connected"); got != 1 {
+		t.Errorf("expected 1 warning, got %d in %q", got, buf.String())
+	}
+	if got, expected := duplicateServerCount(t, "server1"), float64(3*duplicateServerWarnThreshold-2); got != expected {
+		t.Errorf("expected %v duplicates of server1, got %v", expected, got)
+	}
+	if got := duplicateServerCount(t, "server2"); got != 1 {
+		t.Errorf("expected 1 duplicate of server2, got %v", got)
+	}
+}
+
+func TestNextSyncBackoff_Metric(t *testing.T) {
+	testCases := []struct {
+		name     string
+		err      error
+		expected metrics.SyncResult
+	}{
+		{name: "success", expected: metrics.SyncResultSuccess},
+		{name: "duplicate", err: &DuplicateServerError{ServerID: "server1"}, expected: metrics.SyncResultDuplicate},
+		{name: "failure", err: errors.New("connection refused"), expected: metrics.SyncResultFailure},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			metrics.Metrics.Reset()
+			cc := withTestDefaults(&ClientSetConfig{SyncInterval: time.Second, SyncIntervalCap: 10 * time.Second})
+			cs := cc.NewAgentClientSet(nil, make(chan struct{}))
+			cs.nextSyncBackoff(connectResult{err: tc.err}, cs.resetBackoff(), 0)
+			for _, result := range []metrics.SyncResult{metrics.SyncResultSuccess, metrics.SyncResultDuplicate, metrics.SyncResultFailure} {
+				var expected uint64
+				if result == tc.expected {
+					expected = 1
+				}
+				if got := syncBackoffCount(t, result); got != expected {
+					t.Errorf("expected %d sync backoff observations for %q, got %d", expected, result, got)
+				}
+			}
+		})
+	}
+}
+
+func TestSyncLogsAgentID(t *testing.T) {
+	var buf bytes.Buffer
+	klog.LogToStderr(false)
+	klog.SetOutput(&buf)
+	defer func() {
+		klog.SetOutput(os.Stderr)
+		klog.LogToStderr(true)
+	}()
+
+	cs := withTestDefaults(&ClientSetConfig{AgentID: "agent-42"}).NewAgentClientSet(nil, make(chan struct{}))
+	cs.nextSyncBackoff(connectResult{err: errors.New("dial failed")}, cs.resetBackoff(), 0)
+	klog.Flush()
+
+	if got := buf.String(); !strings.Contains(got, `agentID="agent-42"`) {
+		t.Errorf("expected the sync log line to include the agentID, got %q", got)
+	}
+}
+
+func TestSyncStats(t *testing.T) {
+	server := &failingProxyServer{testProxyServer: &testProxyServer{serverID: "server1", serverCount: 2}}
+	server.failing.Store(true)
+	cs := withTestDefaults(&ClientSetConfig{
+		Address:         serveTestProxyServer(t, server),
+		DialOptions:     []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())},
+		SyncInterval:    time.Second,
+		SyncIntervalCap: time.Minute,
+	}).NewAgentClientSet(nil, make(chan struct{}))
+	defer cs.Wait()
+	defer cs.Shutdown()
+	fakeClock := clocktesting.NewFakeClock(time.Now())
+	cs.clock = fakeClock
+	if got := cs.SyncStats(); got != (SyncStats{}) {
+		t.Errorf("expected empty stats before the first sync, got %+v", got)
+	}
+
+	backoff := cs.resetBackoff()
+	var duration time.Duration
+	sync := func(expected SyncStats) {
+		t.Helper()
+		fakeClock.Step(time.Second)
+		duration = cs.nextSyncBackoff(cs.connectOnce(), backoff, duration)
+		expected.CurrentBackoffDuration = duration
+		expected.TimeUntilNextSync = duration
+		got := cs.SyncStats()
+		if !got.LastSyncTime.Equal(fakeClock.Now()) {
+			t.Errorf("expected the last sync at %v, got %v", fakeClock.Now(), got.LastSyncTime)
+		}
+		got.LastSyncTime, got.LastSyncDuration = time.Time{}, 0
+		if got != expected {
+			t.Errorf("expected stats %+v, got %+v", expected, got)
+		}
+	}
+	sync(SyncStats{TotalSyncs: 1, FailedSyncs: 1, ConsecutiveFailures: 1})
+	sync(SyncStats{TotalSyncs: 2, FailedSyncs: 2, ConsecutiveFailures: 2})
+	server.failing.Store(false)
+	sync(SyncStats{TotalSyncs: 3, SuccessfulSyncs: 1, FailedSyncs: 2})
+	// The server has a single ID, so the next attempt finds a duplicate.
+	sync(SyncStats{TotalSyncs: 4, SuccessfulSyncs: 1, FailedSyncs: 2, DuplicateErrors: 1})
+
+	fakeClock.Step(duration / 2)
+	if got, expected := cs.SyncStats().TimeUntilNextSync, duration-duration/2; got != expected {
+		t.Errorf("expected %v until the next sync, got %v", expected, got)
+	}
+	fakeClock.Step(duration)
+	if got := cs.SyncStats().TimeUntilNextSync; got != 0 {
+		t.Errorf("expected the next sync to be due, got %v until it", got)
+	}
+}
+
+func TestSync_FakeClock(t *testing.T) {
+	stopCh := make(chan struct{})
+	// No transport security is configured, so every dial fails and the
+	// sync loop backs off.
+	cs := withTestDefaults(&ClientSetConfig{SyncInterval: time.Hour, SyncIntervalCap: 10 * time.Hour}).NewAgentClientSet(nil, stopCh)
+	fakeClock := clocktesting.NewFakeClock(time.Now())
+	cs.clock = fakeClock
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		cs.sync()
+	}()
+
+	const cycles = 5
+	for i := 1; i <= cycles; i++ {
+		if err := wait.PollImmediate(time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+			return fakeClock.HasWaiters(), nil
+		}); err != nil {
+			t.Fatalf("sync loop never waited on the clock in cycle %d", i)
+		}
+		stats := cs.SyncStats()
+		if stats.FailedSyncs != int64(i) {
+			t.Fatalf("expected %d failed syncs, got %d", i, stats.FailedSyncs)
+		}
+		if stats.TimeUntilNextSync != stats.CurrentBackoffDuration {
+			t.Errorf("expected %v until the next sync, got %v", stats.CurrentBackoffDuration, stats.TimeUntilNextSync)
+		}
+		fakeClock.Step(stats.CurrentBackoffDuration)
+	}
+
+	close(stopCh)
+	<-done
+}
+
+func TestSync_TimeSinceLastConnect(t *testing.T) {
+	metrics.Metrics.Reset()
+	stopCh := make(chan struct{})
+	server := &failingProxyServer{testProxyServer: &testProxyServer{serverID: "server1", serverCount: 1}}
+	server.failing.Store(true)
+	cs := withTestDefaults(&ClientSetConfig{
+		Address:         serveTestProxyServer(t, server),
+		DialOptions:     []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())},
+		SyncInterval:    time.Minute,
+		SyncIntervalCap: time.Minute,
+	}).NewAgentClientSet(nil, stopCh)
+	fakeClock := clocktesting.NewFakeClock(time.Now())
+	cs.clock = fakeClock
+	start := fakeClock.Now()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		cs.sync()
+	}()
+	defer func() {
+		close(stopCh)
+		<-done
+	}()
+
+	// waitForSync waits for the sync loop to finish an attempt, and steps
+	// the clock to the next one.
+	waitForSync := func(cycle int) {
+		t.Helper()
+		if err := wait.PollImmediate(time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+			return fakeClock.HasWaiters(), nil
+		}); err != nil {
+			t.Fatalf("sync loop never waited on the clock in cycle %d", cycle)
+		}
+	}
+	const failures = 3
+	for i := 0; i < failures; i++ {
+		waitForSync(i)
+		expected := fakeClock.Since(start).Seconds()
+		if got := gaugeValue(t, "time_since_last_connect_seconds"); got != expected {
+			t.Errorf("cycle %d: expected %v seconds since the last connect, got %v", i, expected, got)
+		}
+		if i > 0 && expected == 0 {
+			t.Errorf("cycle %d: expected the clock to have advanced", i)
+		}
+		fakeClock.Step(cs.SyncStats().CurrentBackoffDuration)
+	}
+
+	server.failing.Store(false)
+	waitForSync(failures)
+	if !cs.HasID("server1") {
+		t.Fatal("expected the sync loop to connect once the server recovered")
+	}
+	if got := gaugeValue(t, "time_since_last_connect_seconds"); got != 0 {
+		t.Errorf("expected the gauge to reset on success, got %v", got)
+	}
+}
+
+func TestSync_RemovesExitedClients(t *testing.T) {
+	stopCh := make(chan struct{})
+	cs := withTestDefaults(&ClientSetConfig{SyncInterval: time.Hour}).NewAgentClientSet(nil, stopCh)
+	fakeClock := clocktesting.NewFakeClock(time.Now())
+	cs.clock = fakeClock
+	// A zombie: Serve has returned, but the client was left in the set.
+	zombie := &Client{cs: cs, conn: newReadyConn(t), serverID: "server1", stopCh: make(chan struct{})}
+	close(zombie.doneCh())
+	cs.clients["server1"] = zombie
+	cs.serverCount = 1
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		cs.sync()
+	}()
+	defer func() {
+		close(stopCh)
+		<-done
+	}()
+
+	if err := wait.PollImmediate(time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		return fakeClock.HasWaiters(), nil
+	}); err != nil {
+		t.Fatal("sync loop never waited on the clock")
+	}
+	// The zombie counts as connected, so the loop waits without dialing.
+	if got := cs.ClientsCount(); got != 1 {
+		t.Fatalf("expected the zombie client to be counted, got %d clients", got)
+	}
+
+	cs.clientExitCh <- struct{}{}
+	if err := wait.PollImmediate(time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		return cs.ClientsCount() == 0, nil
+	}); err != nil {
+		t.Errorf("expected the exited client to be removed, got %v", cs.ListServerIDs())
+	}
+	select {
+	case <-zombie.stopCh:
+	default:
+		t.Error("expected the exited client to be closed")
+	}
+}
+
+func TestSync_MultipleAddresses(t *testing.T) {
+	var servers []*failingProxyServer
+	var addresses []string
+	for _, serverID := range []string{"server1", "server2"} {
+		server := &failingProxyServer{testProxyServer: &testProxyServer{serverID: serverID, serverCount: 2}}
+		servers = append(servers, server)
+		addresses = append(addresses, serveTestProxyServer(t, server))
+	}
+	cs := withTestDefaults(&ClientSetConfig{
+		Addresses:       addresses,
+		SyncInterval:    10 * time.Millisecond,
+		SyncIntervalCap: 10 * time.Millisecond,
+		ProbeInterval:   time.Hour,
+		DialOptions:     []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())},
+	}).NewAgentClientSet(nil, make(chan struct{}))
+	defer cs.Wait()
+	defer cs.Shutdown()
+	cs.Serve()
+
+	if err := wait.PollImmediate(10*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		return cs.ClientsCount() == 2, nil
+	}); err != nil {
+		t.Fatalf("expected a client for each server, got %v", cs.ListServerIDs())
+	}
+	for i, server := range servers {
+		if got := server.attempts.Load(); got != 1 {
+			t.Errorf("expected 1 connection to %s, got %d", server.serverID, got)
+		}
+		if got := cs.ClientsPerAddress()[addresses[i]]; got != 1 {
+			t.Errorf("expected 1 client for %s, got %d", addresses[i], got)
+		}
+	}
+}
+
+func TestServerCountHistory(t *testing.T) {
+	cs := withTestDefaults(&ClientSetConfig{}).NewAgentClientSet(nil, make(chan struct{}))
+	if got := cs.ServerCountHistory(); len(got) != 0 {
+		t.Fatalf("expected no history, got %v", got)
+	}
+
+	start := time.Now()
+	for i := 0; i < 65; i++ {
+		cs.serverCount = i
+		now := start.Add(time.Duration(i) * time.Minute)
+		cs.recordServerCount(now)
+		// Samples taken less than a minute apart are dropped.
+		cs.serverCount = -1
+		cs.recordServerCount(now.Add(30 * time.Second))
+	}
+
+	history := cs.ServerCountHistory()
+	if len(history) != serverCountHistorySize {
+		t.Fatalf("expected %d samples, got %d", serverCountHistorySize, len(history))
+	}
+	// The oldest 5 samples were overwritten.
+	for i, sample := range history {
+		expected := ServerCountSample{Timestamp: start.Add(time.Duration(i+5) * time.Minute), Count: i + 5}
+		if !sample.Timestamp.Equal(expected.Timestamp) || sample.Count != expected.Count {
+			t.Errorf("sample %d: expected %+v, got %+v", i, expected, sample)
+		}
+	}
+}
+
+func TestSync_KeepsExcessClientsByDefault(t *testing.T) {
+	// Each connection reaches a new server, which reports a single server.
+	addr := newTestProxyServer(t, "", 1)
+	cc := withTestDefaults(&ClientSetConfig{
+		Address:       addr,
+		SyncInterval:  10 * time.Millisecond,
+		ProbeInterval: time.Hour,
+		SyncForever:   true,
+		MaxClients:    3,
+		DialOptions:   []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())},
+	})
+	cs := cc.NewAgentClientSet(nil, make(chan struct{}))
+	cs.Serve()
+	defer cs.Wait()
+	defer cs.Shutdown()
+
+	if err := wait.PollImmediate(10*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		return cs.ClientsCount() == 3, nil
+	}); err != nil {
+		t.Fatalf("expected the excess clients to be kept, got %d clients", cs.ClientsCount())
+	}
+	// The sync loop keeps running at MaxClients without closing any.
+	time.Sleep(10 * cc.SyncInterval)
+	if got := cs.ClientsCount(); got != 3 {
+		t.Errorf("expected 3 clients, got %d", got)
+	}
+}
+
+func TestDialOptionsForServer(t *testing.T) {
+	var gotAddress string
+	intercepted := false
+	marker := grpc.WithStreamInterceptor(func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		intercepted = true
+		return streamer(ctx, desc, cc, method, opts...)
+	})
+	cc := withTestDefaults(&ClientSetConfig{
+		Address: "localhost:0",
+		DialOptionsForServer: func(serverID, address string) []grpc.DialOption {
+			gotAddress = address
+			// The base options have no transport security, so the dial only
+			// gets as far as opening a stream if these options are used.
+			return []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials()), marker}
+		},
+	})
+	cs := cc.NewAgentClientSet(nil, make(chan struct{}))
+
+	if result := cs.connectOnce(); result.err == nil {
+		t.Fatal("expected connectOnce to fail with no server listening")
+	}
+	if gotAddress != cc.Address {
+		t.Errorf("expected hook to be called with address %q, got %q", cc.Address, gotAddress)
+	}
+	if !intercepted {
+		t.Error("expected dial option from hook to reach the client dial")
+	}
+}
+
+func TestDialOptionsForServer_KnownServer(t *testing.T) {
+	addr1 := newTestProxyServer(t, "server1", 2)
+	addr2 := newTestProxyServer(t, "server2", 2)
+	var dialed []string // serverID@address of each dial.
+	cs := withTestDefaults(&ClientSetConfig{
+		Addresses:     []string{addr1, addr2},
+		ProbeInterval: time.Hour,
+		DialOptionsForServer: func(serverID, address string) []grpc.DialOption {
+			dialed = append(dialed, serverID+"@"+address)
+			return []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}
+		},
+	}).NewAgentClientSet(nil, make(chan struct{}))
+	defer cs.Wait()
+	defer cs.Shutdown()
+
+	// The servers behind the addresses are unknown until connected.
+	for i := 0; i < 2; i++ {
+		if result := cs.connectOnce(); !result.added {
+			t.Fatalf("expected a client to be added, got %+v", result)
+		}
+	}
+	// Redialing an address passes the server last connected through it.
+	cs.RemoveClient("server1")
+	if result := cs.connectOnce(); !result.added {
+		t.Fatalf("expected a client to be added, got %+v", result)
+	}
+	// Replacing a client passes the ID of the server it should reach.
+	ctx, cancel := context.WithTimeout(context.Background(), wait.ForeverTestTimeout)
+	defer cancel()
+	c, err := cs.dialServer(ctx, "server2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	expected := []string{"@" + addr1, "@" + addr2, "server1@" + addr1, "server2@" + addr1}
+	if !reflect.DeepEqual(dialed, expected) {
+		t.Errorf("expected dials %v, got %v", expected, dialed)
+	}
+}
+
+func TestInitialSyncDelay(t *testing.T) {
+	const delay = 200 * time.Millisecond
+	addr := newTestProxyServer(t, "server1", 1)
+	cc := withTestDefaults(&ClientSetConfig{
+		Address:          addr,
+		ProbeInterval:    time.Hour,
+		InitialSyncDelay: delay,
+		DialOptions:      []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())},
+	})
+	cs := cc.NewAgentClientSet(nil, make(chan struct{}))
+	defer cs.Wait()
+	defer cs.Shutdown()
+
+	start := time.Now()
+	cs.Serve()
+	if err := wait.PollImmediate(10*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		return cs.SyncStats().TotalSyncs > 0, nil
+	}); err != nil {
+		t.Fatal("sync loop never attempted to connect")
+	}
+	// The delay is jittered between one and two times its configured value.
+	if elapsed := time.Since(start); elapsed < delay {
+		t.Errorf("expected first sync after at least %v, got %v", delay, elapsed)
+	}
+}
+
+func TestInitialSyncDelay_Shutdown(t *testing.T) {
+	cc := withTestDefaults(&ClientSetConfig{InitialSyncDelay: time.Hour})
+	cs := cc.NewAgentClientSet(nil, make(chan struct{}))
+	cs.Serve()
+	cs.Shutdown()
+	done := make(chan struct{})
+	go func() {
+		cs.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(wait.ForeverTestTimeout):
+		t.Fatal("Wait did not return after Shutdown during the initial sync delay")
+	}
+	if got := cs.SyncStats().TotalSyncs; got != 0 {
+		t.Errorf("expected no sync attempts, got %d", got)
+	}
+}
+
+func TestRandomizeDialOrder(t *testing.T) {
+	testCases := []struct {
+		name      string
+		randomize bool
+		expected  []string
+	}{
+		{name: "resolved order", expected: []string{"server1"}},
+		{name: "randomized", randomize: true, expected: []string{"server1", "server2"}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := manual.NewBuilderWithScheme("test")
+			r.InitialState(resolver.State{Addresses: []resolver.Address{
+				{Addr: newTestProxyServer(t, "server1", 2)},
+				{Addr: newTestProxyServer(t, "server2", 2)},
+			}})
+			cc := withTestDefaults(&ClientSetConfig{
+				Address:            "test:///proxy:8091",
+				ProbeInterval:      time.Hour,
+				RandomizeDialOrder: tc.randomize,
+				DialOptions: []grpc.DialOption{
+					grpc.WithTransportCredentials(insecure.NewCredentials()),
+					grpc.WithResolvers(r),
+				},
+			})
+			cs := cc.NewAgentClientSet(nil, make(chan struct{}))
+			defer cs.Wait()
+			defer cs.Shutdown()
+
+			// Each dial picks a server afresh; with two servers, 20 dials
+			// all picking the same one when shuffled is vanishingly rare.
+			seen := map[string]bool{}
+			for i := 0; i < 20; i++ {
+				if result := cs.connectOnce(); result.err != nil || !result.added {
+					t.Fatalf("connectOnce %d: expected a client to be added, got %+v", i, result)
+				}
+				for _, serverID := range cs.ListServerIDs() {
+					seen[serverID] = true
+					if err := cs.RemoveClient(serverID); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			var got []string
+			for serverID := range seen {
+				got = append(got, serverID)
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("expected to connect to %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestConnectOnce_UnixSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "proxy.sock")
+	lis, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	agent.RegisterAgentServiceServer(server, &testProxyServer{serverID: "server1", serverCount: 1})
+	go server.Serve(lis)
+	defer server.Stop()
+
+	cc := withTestDefaults(&ClientSetConfig{
+		Address:           socket,
+		TransportProtocol: TransportUnix,
+		ProbeInterval:     time.Hour,
+		DialOptions:       []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())},
+	})
+	cs := cc.NewAgentClientSet(nil, make(chan struct{}))
+	defer cs.Wait()
+	defer cs.Shutdown()
+
+	if result := cs.connectOnce(); result.err != nil || !result.added {
+		t.Fatalf("expected connectOnce to add a client over the UNIX socket, got %+v", result)
+	}
+	if !cs.HasID("server1") {
+		t.Error("expected a client for server1")
+	}
+}
+
+func TestConnectTimeout(t *testing.T) {
+	// The listener never accepts, so the TCP handshake completes but the
+	// server never answers, as on a half-open network path.
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+
+	timeout := 200 * time.Millisecond
+	cs := withTestDefaults(&ClientSetConfig{
+		Address:        lis.Addr().String(),
+		ConnectTimeout: timeout,
+		DialOptions:    []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())},
+	}).NewAgentClientSet(nil, make(chan struct{}))
+
+	start := time.Now()
+	_, _, err = cs.newAgentClient(cs.address)
+	elapsed := time.Since(start)
+	if err == nil || !strings.Contains(err.Error(), "within "+timeout.String()) {
+		t.Errorf("expected a connect timeout error, got %v", err)
+	}
+	if elapsed < timeout || elapsed > wait.ForeverTestTimeout {
+		t.Errorf("expected the connect to abort after %v, took %v", timeout, elapsed)
+	}
+}
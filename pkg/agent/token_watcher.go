@@ -0,0 +1,136 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"context"
+	"os"
+	"time"
+)
+
+// tokenFileStat identifies a version of the service account token file.
+type tokenFileStat struct {
+	modTime time.Time
+	size    int64
+}
+
+// watchToken polls the service account token file every
+// tokenRefreshInterval until the ClientSet stops. When the token is rotated,
+// the existing connections, which were authenticated with the old token, are
+// re-established; the token file is not checked again until they have been.
+func (cs *ClientSet) watchToken() {
+	var last tokenFileStat
+	cs.refreshToken(&last)
+	ticker := time.NewTicker(cs.tokenRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-cs.stopCh:
+			return
+		case <-cs.stopping.C():
+			return
+		case <-ticker.C:
+			if cs.refreshToken(&last) {
+				cs.logger.Info("Service account token rotated, re-establishing connections", "agentID", cs.agentID, "path", cs.serviceAccountTokenPath)
+				if err := cs.reauthenticate(context.Background()); err != nil {
+					cs.logger.Error(err, "Failed to re-establish connections with the rotated token", "agentID", cs.agentID)
+				}
+			}
+		}
+	}
+}
+
+// refreshToken reloads the token if the file has changed since last, which
+// is updated. It returns true if a previously loaded token was replaced by a
+// different one.
+func (cs *ClientSet) refreshToken(last *tokenFileStat) bool {
+	fi, err := os.Stat(cs.serviceAccountTokenPath)
+	if err != nil {
+		cs.logger.Error(err, "Failed to stat token", "path", cs.serviceAccountTokenPath)
+		return false
+	}
+	stat := tokenFileStat{modTime: fi.ModTime(), size: fi.Size()}
+	if stat == *last {
+		return false
+	}
+	b, err := os.ReadFile(cs.serviceAccountTokenPath)
+	if err != nil {
+		cs.logger.Error(err, "Failed to read token", "path", cs.serviceAccountTokenPath)
+		return false
+	}
+	*last = stat
+	token := string(b)
+	cs.tokenMu.Lock()
+	defer cs.tokenMu.Unlock()
+	old := cs.token
+	cs.token = token
+	return old != "" && old != token
+}
+
+// cachedToken returns the token last loaded by watchToken, or "" if the
+// token is not being watched.
+func (cs *ClientSet) cachedToken() string {
+	cs.tokenMu.RLock()
+	defer cs.tokenMu.RUnlock()
+	return cs.token
+}
+
+// tokenForDial returns the token at path to authenticate a new connection
+// with. The file is read at most once per tokenCacheTTL, so a rotated token
+// is used by the first connection after the TTL expires. If the file cannot
+// be read, the token last loaded is used, if there is one.
+func (cs *ClientSet) tokenForDial(path string) (string, error) {
+	cs.tokenMu.Lock()
+	defer cs.tokenMu.Unlock()
+	if cs.dialToken != "" && cs.tokenCacheTTL > 0 && cs.clock.Since(cs.dialTokenReadAt) < cs.tokenCacheTTL {
+		return cs.dialToken, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if last := cs.lastTokenLocked(); last != "" {
+			cs.logger.Error(err, "Failed to read token, using the last loaded one", "path", path)
+			return last, nil
+		}
+		return "", err
+	}
+	cs.dialToken = string(b)
+	if cs.tokenCacheTTL > 0 {
+		cs.dialTokenReadAt = cs.clock.Now()
+	}
+	return cs.dialToken, nil
+}
+
+// lastTokenLocked returns the token last read for a connection or, failing
+// that, by watchToken.
+func (cs *ClientSet) lastTokenLocked() string {
+	if cs.dialToken != "" {
+		return cs.dialToken
+	}
+	return cs.token
+}
+
+// reauthenticate replaces the clients, one at a time, with connections
+// using the current token. As with Rehash, each new connection is open
+// before the client it replaces is removed, and the replaced clients are
+// drained in the background, so that the agent stays connected throughout.
+func (cs *ClientSet) reauthenticate(ctx context.Context) error {
+	// The replacements must not reuse the token cached for dialing.
+	cs.tokenMu.Lock()
+	cs.dialToken = ""
+	cs.tokenMu.Unlock()
+	return cs.Rehash(ctx)
+}
@@ -0,0 +1,197 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	clocktesting "k8s.io/utils/clock/testing"
+
+	"sigs.k8s.io/apiserver-network-proxy/proto/agent"
+	"sigs.k8s.io/apiserver-network-proxy/proto/header"
+)
+
+func writeToken(t *testing.T, path, token string, modTime time.Time) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(token), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRefreshToken(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	now := time.Now()
+	writeToken(t, path, "token1", now)
+	cs := withTestDefaults(&ClientSetConfig{ServiceAccountTokenPath: path}).NewAgentClientSet(nil, make(chan struct{}))
+
+	var last tokenFileStat
+	if cs.refreshToken(&last) {
+		t.Error("expected loading the first token not to be a rotation")
+	}
+	if got := cs.cachedToken(); got != "token1" {
+		t.Errorf("expected cached token %q, got %q", "token1", got)
+	}
+	if cs.refreshToken(&last) {
+		t.Error("expected an unchanged file not to be a rotation")
+	}
+	// Rewriting the same token is not a rotation.
+	writeToken(t, path, "token1", now.Add(time.Minute))
+	if cs.refreshToken(&last) {
+		t.Error("expected an unchanged token not to be a rotation")
+	}
+	writeToken(t, path, "token2", now.Add(2*time.Minute))
+	if !cs.refreshToken(&last) {
+		t.Error("expected a new token to be a rotation")
+	}
+	if got := cs.cachedToken(); got != "token2" {
+		t.Errorf("expected cached token %q, got %q", "token2", got)
+	}
+
+	// A token which cannot be read is kept until it can.
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if cs.refreshToken(&last) || cs.cachedToken() != "token2" {
+		t.Errorf("expected a missing file to keep token %q, got %q", "token2", cs.cachedToken())
+	}
+}
+
+func TestInitializeAuthContext_CachedToken(t *testing.T) {
+	cs := withTestDefaults(&ClientSetConfig{}).NewAgentClientSet(nil, make(chan struct{}))
+	cs.token = "cached"
+	c := &Client{cs: cs, serviceAccountTokenPath: filepath.Join(t.TempDir(), "missing")}
+	ctx, err := c.initializeAuthContext(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	md, _ := metadata.FromOutgoingContext(ctx)
+	expected := header.AuthenticationTokenContextSchemePrefix + "cached"
+	if got := md.Get(header.AuthenticationTokenContextKey); len(got) != 1 || got[0] != expected {
+		t.Errorf("expected token %q, got %v", expected, got)
+	}
+}
+
+func TestReauthenticate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	writeToken(t, path, "token1", time.Now())
+	server := &tokenRecordingProxyServer{testProxyServer: &testProxyServer{serverID: "server1", serverCount: 1}, tokens: make(chan string, 2)}
+	cs := withTestDefaults(&ClientSetConfig{
+		Address:                 serveTestProxyServer(t, server),
+		DialOptions:             []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())},
+		ProbeInterval:           time.Hour,
+		ServiceAccountTokenPath: path,
+		TokenCacheTTL:           time.Hour,
+	}).NewAgentClientSet(nil, make(chan struct{}))
+	defer cs.Wait()
+	defer cs.Shutdown()
+	if result := cs.connectOnce(); !result.added {
+		t.Fatalf("expected a client to be added, got %+v", result)
+	}
+	old, _ := cs.GetClient("server1")
+	<-server.tokens
+
+	writeToken(t, path, "token2", time.Now())
+	if err := cs.reauthenticate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	replacement, _ := cs.GetClient("server1")
+	if replacement == nil || replacement == old {
+		t.Fatalf("expected the client to be replaced, got %v", cs.ListServerIDs())
+	}
+	if got := <-server.tokens; got != "token2" {
+		t.Errorf("expected the replacement to authenticate with token2, got %q", got)
+	}
+
+	// The old client exiting must not remove its replacement.
+	old.removeFromClientSet()
+	if got, _ := cs.GetClient("server1"); got != replacement {
+		t.Errorf("expected the replacement client to remain, got %v", cs.ListServerIDs())
+	}
+}
+
+// tokenRecordingProxyServer is a testProxyServer which records the token
+// each agent authenticates with.
+type tokenRecordingProxyServer struct {
+	*testProxyServer
+	tokens chan string
+}
+
+func (s *tokenRecordingProxyServer) Connect(stream agent.AgentService_ConnectServer) error {
+	md, _ := metadata.FromIncomingContext(stream.Context())
+	var token string
+	if values := md.Get(header.AuthenticationTokenContextKey); len(values) == 1 {
+		token = strings.TrimPrefix(values[0], header.AuthenticationTokenContextSchemePrefix)
+	}
+	s.tokens <- token
+	return s.testProxyServer.Connect(stream)
+}
+
+func TestConnect_ReloadsToken(t *testing.T) {
+	testCases := []struct {
+		name string
+		ttl  time.Duration
+		// expected is the token sent by each connection, the last one after
+		// the TTL has expired.
+		expected []string
+	}{
+		{name: "no cache", expected: []string{"token1", "token2", "token2"}},
+		{name: "cached", ttl: time.Minute, expected: []string{"token1", "token1", "token2"}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "token")
+			writeToken(t, path, "token1", time.Now())
+			server := &tokenRecordingProxyServer{testProxyServer: &testProxyServer{serverCount: 3}, tokens: make(chan string, 3)}
+			cs := withTestDefaults(&ClientSetConfig{
+				Address:                 serveTestProxyServer(t, server),
+				DialOptions:             []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())},
+				ServiceAccountTokenPath: path,
+				TokenCacheTTL:           tc.ttl,
+			}).NewAgentClientSet(nil, make(chan struct{}))
+			fakeClock := clocktesting.NewFakeClock(time.Now())
+			cs.clock = fakeClock
+
+			for i, expected := range tc.expected {
+				switch i {
+				case 1:
+					writeToken(t, path, "token2", time.Now())
+				case 2:
+					fakeClock.Step(tc.ttl)
+				}
+				c, _, err := cs.newAgentClient(cs.address)
+				if err != nil {
+					t.Fatal(err)
+				}
+				c.Close()
+				if got := <-server.tokens; got != expected {
+					t.Errorf("connection %d: expected token %q, got %q", i, expected, got)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+
+	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/util"
+)
+
+// tracerName is the instrumentation scope of the agent tunnel spans.
+const tracerName = "sigs.k8s.io/apiserver-network-proxy/pkg/agent"
+
+// tracePropagator reads the trace context the proxy server propagates in
+// a DIAL_REQ, in the W3C Trace Context format.
+var tracePropagator propagation.TextMapPropagator = propagation.TraceContext{}
+
+// Names of the events added to an agent tunnel span.
+const (
+	traceEventDialResponse = "DIAL_RSP"
+)
+
+// tracer returns the tracer for tunnel spans, from tracerProvider or, if
+// it is nil, the global one.
+func (cs *ClientSet) tracer() trace.Tracer {
+	tp := cs.tracerProvider
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	return tp.Tracer(tracerName)
+}
+
+// startTunnelSpan starts the span of the tunnel requested by dialReq, as a
+// child of the trace context the server propagated in it, if any.
+func (a *Client) startTunnelSpan(dialReq *client.DialRequest) trace.Span {
+	ctx := tracePropagator.Extract(context.Background(), util.DialRequestCarrier{Request: dialReq})
+	_, span := a.cs.tracer().Start(ctx, "konnectivity.agent.tunnel",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("konnectivity.dial_address", dialReq.GetAddress()),
+			attribute.Int64("konnectivity.dial_id", dialReq.GetRandom()),
+			attribute.String("konnectivity.server_id", a.serverID),
+			attribute.String("konnectivity.agent_id", a.agentID),
+		))
+	return span
+}
+
+// failTunnelSpan marks span as failed with description, recording err if
+// it is not nil.
+func failTunnelSpan(span trace.Span, err error, description string) {
+	if err != nil {
+		span.RecordError(err)
+	}
+	span.SetStatus(codes.Error, description)
+}
+
+// addDialResponseEvent adds to span the event of the DIAL_RSP for the
+// established connection connID.
+func addDialResponseEvent(span trace.Span, connID int64) {
+	span.AddEvent(traceEventDialResponse, trace.WithAttributes(attribute.Int64("konnectivity.connection_id", connID)))
+}
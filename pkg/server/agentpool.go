@@ -0,0 +1,176 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+
+	"sigs.k8s.io/apiserver-network-proxy/pkg/server/metrics"
+	"sigs.k8s.io/apiserver-network-proxy/proto/admin"
+)
+
+var (
+	// evictionGracePeriod bounds how long an agent evicted by ResizePool
+	// keeps its connection while it still has established tunnels.
+	evictionGracePeriod = 30 * time.Second
+	// evictionCheckInterval is how often an evicted agent's tunnels are
+	// checked.
+	evictionCheckInterval = time.Second
+)
+
+// agentPool tracks the agent connections of the proxy server in the order
+// they were made, and limits their number.
+type agentPool struct {
+	mu       sync.Mutex // protects the fields below.
+	max      int        // maximum number of connections; zero means no limit.
+	backends []*Backend // oldest first.
+	// emptyNotify holds the channels registered by notifyOnEmpty, which
+	// are closed once the last connection is removed.
+	emptyNotify []chan<- struct{}
+}
+
+// add adds backend to the pool, unless the pool is full. The pool is full
+// while it holds max connections or more, including connections evicted
+// by resize which have not disconnected yet.
+func (p *agentPool) add(backend *Backend) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.max > 0 && len(p.backends) >= p.max {
+		return false
+	}
+	p.backends = append(p.backends, backend)
+	return true
+}
+
+// remove removes backend from the pool.
+func (p *agentPool) remove(backend *Backend) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, b := range p.backends {
+		if b == backend {
+			p.backends = append(p.backends[:i], p.backends[i+1:]...)
+			break
+		}
+	}
+	if len(p.backends) == 0 {
+		for _, ch := range p.emptyNotify {
+			close(ch)
+		}
+		p.emptyNotify = nil
+	}
+}
+
+// notifyOnEmpty closes ch once the pool holds no connections, immediately
+// if it is empty already.
+func (p *agentPool) notifyOnEmpty(ch chan<- struct{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.backends) == 0 {
+		close(ch)
+		return
+	}
+	p.emptyNotify = append(p.emptyNotify, ch)
+}
+
+// resize sets the maximum number of connections to newMax, and returns the
+// oldest connections beyond it.
+func (p *agentPool) resize(newMax int) []*Backend {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.max = newMax
+	if newMax <= 0 || len(p.backends) <= newMax {
+		return nil
+	}
+	return append([]*Backend{}, p.backends[:len(p.backends)-newMax]...)
+}
+
+// size returns the number of connections and their maximum.
+func (p *agentPool) size() (count, max int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.backends), p.max
+}
+
+// ResizePool sets the maximum number of agent connections to newMax, zero
+// meaning no limit, without restarting the server. Agents connecting while
+// the pool is full are rejected. If more than newMax agents are connected,
+// the pool is over capacity and the oldest connections are evicted: they
+// are no longer picked for new tunnels while other agents are available,
+// and are closed once their agent has no established tunnels left, or
+// after evictionGracePeriod.
+func (s *ProxyServer) ResizePool(newMax int) {
+	evicted := s.agentPool.resize(newMax)
+	metrics.Metrics.IncPoolResize()
+	klog.V(1).InfoS("Resized the agent pool", "maxAgents", newMax, "evicting", len(evicted))
+	for _, backend := range evicted {
+		backend.setDraining()
+		go s.evictBackend(backend)
+	}
+}
+
+// AdminServer serves the AdminService of a proxy server.
+type AdminServer struct {
+	server *ProxyServer
+}
+
+var _ admin.AdminServiceServer = &AdminServer{}
+
+// NewAdminServer returns an AdminServer for s.
+func NewAdminServer(s *ProxyServer) *AdminServer {
+	return &AdminServer{server: s}
+}
+
+// ResizePool resizes the agent pool of the proxy server; see
+// ProxyServer.ResizePool.
+func (a *AdminServer) ResizePool(_ context.Context, req *admin.ResizePoolRequest) (*admin.ResizePoolResponse, error) {
+	if req.GetMaxAgents() < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "maxAgents must not be negative, got %d", req.GetMaxAgents())
+	}
+	a.server.ResizePool(int(req.GetMaxAgents()))
+	count, _ := a.server.agentPool.size()
+	return &admin.ResizePoolResponse{AgentCount: int32(count)}, nil
+}
+
+// NotifyOnEmpty closes ch once no agent is connected to the server, e.g. so
+// that a graceful shutdown can wait for all agents to disconnect. If no
+// agent is connected, ch is closed immediately. ch is closed at most once,
+// and must not be closed by the caller.
+func (s *ProxyServer) NotifyOnEmpty(ch chan<- struct{}) {
+	s.agentPool.notifyOnEmpty(ch)
+}
+
+// evictBackend closes the connection of the draining backend once its
+// agent has no established tunnels left, or after evictionGracePeriod.
+func (s *ProxyServer) evictBackend(backend *Backend) {
+	agentID := backend.GetAgentID()
+	deadline := time.Now().Add(evictionGracePeriod)
+	for s.numEstablished(agentID) > 0 && time.Now().Before(deadline) {
+		select {
+		case <-backend.Evicted():
+			return
+		case <-time.After(evictionCheckInterval):
+		}
+	}
+	klog.V(2).InfoS("Evicting agent from the agent pool", "agentID", agentID, "tunnels", s.numEstablished(agentID))
+	backend.evict()
+}
@@ -0,0 +1,201 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/mock/gomock"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/util/wait"
+
+	"sigs.k8s.io/apiserver-network-proxy/pkg/server/metrics"
+	"sigs.k8s.io/apiserver-network-proxy/proto/admin"
+)
+
+func TestAgentPool(t *testing.T) {
+	var p agentPool
+	backends := []*Backend{{}, {}, {}}
+	for _, b := range backends {
+		if !p.add(b) {
+			t.Fatal("expected a pool without limit to accept every agent")
+		}
+	}
+	if evicted := p.resize(5); evicted != nil {
+		t.Errorf("expected no eviction below the limit, got %v", evicted)
+	}
+	if evicted := p.resize(1); !reflect.DeepEqual(evicted, backends[:2]) {
+		t.Errorf("expected the two oldest agents to be evicted, got %v", evicted)
+	}
+	// The evicted agents count until they disconnect.
+	p.remove(backends[0])
+	if p.add(&Backend{}) {
+		t.Error("expected an over capacity pool to reject agents")
+	}
+	p.remove(backends[1])
+	if p.add(&Backend{}) {
+		t.Error("expected a full pool to reject agents")
+	}
+	p.remove(backends[2])
+	if !p.add(&Backend{}) {
+		t.Error("expected a pool below its limit to accept agents")
+	}
+	if count, max := p.size(); count != 1 || max != 1 {
+		t.Errorf("expected 1/1 agents, got %d/%d", count, max)
+	}
+}
+
+func TestNotifyOnEmpty(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	s := NewProxyServer(uuid.New().String(), []ProxyStrategy{ProxyStrategyDefault}, 1, &AgentTokenAuthenticationOptions{})
+
+	isClosed := func(ch chan struct{}) bool {
+		select {
+		case <-ch:
+			return true
+		default:
+			return false
+		}
+	}
+
+	empty := make(chan struct{})
+	s.NotifyOnEmpty(empty)
+	if !isClosed(empty) {
+		t.Error("expected the channel to be closed immediately without agents")
+	}
+
+	_, backend1 := prepareAgentConnMD(t, ctrl, s)
+	_, backend2 := prepareAgentConnMD(t, ctrl, s)
+	s.agentPool.add(backend1)
+	s.agentPool.add(backend2)
+	ch1, ch2 := make(chan struct{}), make(chan struct{})
+	s.NotifyOnEmpty(ch1)
+	s.NotifyOnEmpty(ch2)
+
+	s.agentPool.remove(backend1)
+	if isClosed(ch1) || isClosed(ch2) {
+		t.Fatal("expected no notification while an agent is still connected")
+	}
+	s.agentPool.remove(backend2)
+	if !isClosed(ch1) || !isClosed(ch2) {
+		t.Error("expected all channels to be closed once the last agent disconnected")
+	}
+
+	// Each channel is only closed once, even if the pool empties again.
+	s.agentPool.add(backend1)
+	s.agentPool.remove(backend1)
+}
+
+func TestResizePool(t *testing.T) {
+	defer func(interval time.Duration) { evictionCheckInterval = interval }(evictionCheckInterval)
+	evictionCheckInterval = 10 * time.Millisecond
+	resizes := promtest.ToFloat64(metrics.Metrics.PoolResizes())
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	s := NewProxyServer(uuid.New().String(), []ProxyStrategy{ProxyStrategyDefault}, 1, &AgentTokenAuthenticationOptions{})
+
+	var backends []*Backend
+	for i := 0; i < 3; i++ {
+		_, backend := prepareAgentConnMD(t, ctrl, s)
+		s.agentPool.add(backend)
+		backends = append(backends, backend)
+	}
+	// The oldest agent has a tunnel, which it keeps until it closes.
+	oldest := backends[0].GetAgentID()
+	s.addEstablished(oldest, 1, &ProxyClientConnection{})
+
+	s.ResizePool(1)
+	waitEvicted := func(b *Backend) {
+		t.Helper()
+		select {
+		case <-b.Evicted():
+		case <-time.After(wait.ForeverTestTimeout):
+			t.Fatalf("expected agent %s to be evicted", b.GetAgentID())
+		}
+	}
+	waitEvicted(backends[1])
+	if !backends[0].IsDraining() || !backends[1].IsDraining() {
+		t.Error("expected the evicted agents to be draining")
+	}
+	select {
+	case <-backends[0].Evicted():
+		t.Error("expected the agent with a tunnel not to be evicted yet")
+	case <-time.After(10 * evictionCheckInterval):
+	}
+	s.removeEstablished(oldest, 1)
+	waitEvicted(backends[0])
+
+	select {
+	case <-backends[2].Evicted():
+		t.Error("expected the newest agent to be kept")
+	default:
+	}
+	if backends[2].IsDraining() {
+		t.Error("expected the newest agent not to be draining")
+	}
+	if got := promtest.ToFloat64(metrics.Metrics.PoolResizes()) - resizes; got != 1 {
+		t.Errorf("expected 1 pool resize to be counted, got %v", got)
+	}
+}
+
+func TestAdminServer_ResizePool(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	s := NewProxyServer(uuid.New().String(), []ProxyStrategy{ProxyStrategyDefault}, 1, &AgentTokenAuthenticationOptions{})
+	for i := 0; i < 2; i++ {
+		_, backend := prepareAgentConnMD(t, ctrl, s)
+		s.agentPool.add(backend)
+	}
+	a := NewAdminServer(s)
+
+	if _, err := a.ResizePool(context.Background(), &admin.ResizePoolRequest{MaxAgents: -1}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected an InvalidArgument error, got %v", err)
+	}
+	resp, err := a.ResizePool(context.Background(), &admin.ResizePoolRequest{MaxAgents: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.GetAgentCount() != 2 {
+		t.Errorf("expected 2 agents, got %d", resp.GetAgentCount())
+	}
+	if _, max := s.agentPool.size(); max != 5 {
+		t.Errorf("expected the pool limit to be 5, got %d", max)
+	}
+}
+
+func TestConnect_AgentPoolFull(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	s := NewProxyServer(uuid.New().String(), []ProxyStrategy{ProxyStrategyDefault}, 1, &AgentTokenAuthenticationOptions{})
+	s.ResizePool(1)
+	_, backend := prepareAgentConnMD(t, ctrl, s)
+	s.agentPool.add(backend)
+
+	// The rejected agent gets no headers.
+	agentConn, _ := prepareAgentConnMD(t, ctrl, s)
+	err := s.Connect(agentConn)
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("expected a ResourceExhausted error, got %v", err)
+	}
+}
@@ -24,6 +24,7 @@ import (
 	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"google.golang.org/grpc/metadata"
@@ -111,6 +112,20 @@ type Backend struct {
 	// cached from conn.Context()
 	id     string
 	idents header.Identifiers
+
+	// qosClass is the agent's QoS class, or the server's default if the
+	// agent did not set one.
+	qosClass string
+
+	// draining is set once the agent reports that it is draining, after
+	// which it is only picked for new dials if no other agent is available.
+	draining atomic.Bool
+
+	// evicted is closed when the agent is evicted from the agent pool, to
+	// end its connection; use evictedCh.
+	evictedInit sync.Once
+	evictOnce   sync.Once
+	evicted     chan struct{}
 }
 
 func (b *Backend) Send(p *client.Packet) error {
@@ -155,6 +170,56 @@ func (b *Backend) GetAgentIdentifiers() header.Identifiers {
 	return b.idents
 }
 
+// GetQoSClass returns the QoS class used to prioritize the backend.
+func (b *Backend) GetQoSClass() string {
+	return b.qosClass
+}
+
+// IsDraining returns whether the agent has reported that it is draining.
+func (b *Backend) IsDraining() bool {
+	return b.draining.Load()
+}
+
+// setDraining marks the agent as draining.
+func (b *Backend) setDraining() {
+	b.draining.Store(true)
+}
+
+// Evicted returns a channel which is closed when the agent is evicted from
+// the agent pool.
+func (b *Backend) Evicted() <-chan struct{} {
+	return b.evictedCh()
+}
+
+func (b *Backend) evictedCh() chan struct{} {
+	b.evictedInit.Do(func() { b.evicted = make(chan struct{}) })
+	return b.evicted
+}
+
+// evict ends the connection of the agent.
+func (b *Backend) evict() {
+	ch := b.evictedCh()
+	b.evictOnce.Do(func() { close(ch) })
+}
+
+const (
+	// QoSClassSystem agents are preferred when several agents match a
+	// request, e.g. agents serving system components.
+	QoSClassSystem = "system"
+	// QoSClassDefault agents are used when no system agent matches.
+	QoSClassDefault = "default"
+)
+
+// ValidateQoSClass returns an error if qosClass is not a known QoS class.
+func ValidateQoSClass(qosClass string) error {
+	switch qosClass {
+	case QoSClassSystem, QoSClassDefault:
+		return nil
+	default:
+		return fmt.Errorf("unknown QoS class %q, available classes are: %s, %s", qosClass, QoSClassSystem, QoSClassDefault)
+	}
+}
+
 func getAgentID(stream agent.AgentService_ConnectServer) (string, error) {
 	md, ok := metadata.FromIncomingContext(stream.Context())
 	if !ok {
@@ -193,7 +258,7 @@ func NewBackend(conn agent.AgentService_ConnectServer) (*Backend, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &Backend{conn: conn, id: agentID, idents: agentIdentifiers}, nil
+	return &Backend{conn: conn, id: agentID, idents: agentIdentifiers, qosClass: agentIdentifiers.QoSClass}, nil
 }
 
 // BackendStorage is an interface to manage the storage of the backend
@@ -205,6 +270,9 @@ type BackendStorage interface {
 	removeBackend(identifier string, idType header.IdentifierType, backend *Backend)
 	// NumBackends returns the number of backends.
 	NumBackends() int
+	// NumDrainingBackends returns the number of backends whose preferred
+	// connection is to a draining agent.
+	NumDrainingBackends() int
 }
 
 // BackendManager is an interface to manage backend connections, i.e.,
@@ -368,6 +436,34 @@ func (s *DefaultBackendStorage) NumBackends() int {
 	return len(s.backends)
 }
 
+// NumDrainingBackends returns the number of backends whose preferred
+// connection is to a draining agent.
+func (s *DefaultBackendStorage) NumDrainingBackends() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var count int
+	for _, backends := range s.backends {
+		if backends[0].IsDraining() {
+			count++
+		}
+	}
+	return count
+}
+
+// preferenceRank ranks a backend for picking: agents which are not
+// draining rank above draining ones and, within each, agents of the system
+// QoS class rank above the rest.
+func preferenceRank(b *Backend) int {
+	var rank int
+	if !b.IsDraining() {
+		rank += 2
+	}
+	if b.GetQoSClass() == QoSClassSystem {
+		rank++
+	}
+	return rank
+}
+
 // ErrNotFound indicates that no backend can be found.
 type ErrNotFound struct{}
 
@@ -392,14 +488,31 @@ func ignoreNotFound(err error) error {
 	return err
 }
 
-// GetRandomBackend returns a random backend connection from all connected agents.
+// GetRandomBackend returns a random backend connection from all connected
+// agents, preferring agents which are not draining and, among those, agents
+// of the system QoS class.
 func (s *DefaultBackendStorage) GetRandomBackend() (*Backend, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	if len(s.backends) == 0 {
 		return nil, &ErrNotFound{}
 	}
-	agentID := s.agentIDs[s.random.Intn(len(s.agentIDs))]
+	// Pick uniformly among the agents of the best rank in a single pass,
+	// by reservoir sampling over the agents seen so far at that rank.
+	var agentID string
+	bestRank, seen := -1, 0
+	for _, id := range s.agentIDs {
+		rank := preferenceRank(s.backends[id][0])
+		switch {
+		case rank > bestRank:
+			agentID, bestRank, seen = id, rank, 1
+		case rank == bestRank:
+			seen++
+			if s.random.Intn(seen) == 0 {
+				agentID = id
+			}
+		}
+	}
 	klog.V(5).InfoS("Pick agent as backend", "agentID", agentID)
 	// always return the first connection to an agent, because the agent
 	// will close later connections if there are multiple.
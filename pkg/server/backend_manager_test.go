@@ -154,6 +154,113 @@ func TestDefaultBackendManager_AddRemoveBackends(t *testing.T) {
 	}
 }
 
+func TestDefaultBackendManager_QoSClass(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	system, _ := NewBackend(mockAgentConn(ctrl, "system", []string{"qos=system"}))
+	default1, _ := NewBackend(mockAgentConn(ctrl, "default1", []string{"qos=default"}))
+	default2, _ := NewBackend(mockAgentConn(ctrl, "default2", []string{}))
+
+	p := NewDefaultBackendManager()
+	p.AddBackend(default1)
+	p.AddBackend(default2)
+	p.AddBackend(system)
+
+	// The system agent is always preferred while it is connected.
+	for i := 0; i < 10; i++ {
+		be, err := p.Backend(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if be != system {
+			t.Fatalf("expected the system backend, got agent %s", be.GetAgentID())
+		}
+	}
+
+	p.RemoveBackend(system)
+	be, err := p.Backend(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if be != default1 && be != default2 {
+		t.Errorf("expected a default backend, got agent %s", be.GetAgentID())
+	}
+}
+
+func TestDefaultBackendManager_Draining(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	system, _ := NewBackend(mockAgentConn(ctrl, "system", []string{"qos=system"}))
+	default1, _ := NewBackend(mockAgentConn(ctrl, "default1", []string{}))
+
+	p := NewDefaultBackendManager()
+	p.AddBackend(system)
+	p.AddBackend(default1)
+
+	// A draining agent is not picked while another agent is available,
+	// even if it is of the system QoS class.
+	system.setDraining()
+	if got := p.NumDrainingBackends(); got != 1 {
+		t.Errorf("expected 1 draining backend, got %d", got)
+	}
+	for i := 0; i < 10; i++ {
+		be, err := p.Backend(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if be != default1 {
+			t.Fatalf("expected the non-draining backend, got agent %s", be.GetAgentID())
+		}
+	}
+
+	// Once every agent is draining, one is still picked.
+	default1.setDraining()
+	if _, err := p.Backend(context.Background()); err != nil {
+		t.Errorf("expected a draining backend to be picked, got %v", err)
+	}
+}
+
+func TestDestHostBackendManager_Preference(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	default1, _ := NewBackend(mockAgentConn(ctrl, "default1", []string{"host=node1"}))
+	system, _ := NewBackend(mockAgentConn(ctrl, "system", []string{"host=node1&qos=system"}))
+	default2, _ := NewBackend(mockAgentConn(ctrl, "default2", []string{"host=node1"}))
+
+	p := NewDestHostBackendManager()
+	p.AddBackend(default1)
+	p.AddBackend(system)
+	p.AddBackend(default2)
+
+	ctx := context.WithValue(context.Background(), destHostKey, "node1")
+	expectBackend := func(want *Backend) {
+		t.Helper()
+		be, err := p.Backend(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if be != want {
+			t.Errorf("expected agent %s, got agent %s", want.GetAgentID(), be.GetAgentID())
+		}
+	}
+
+	// The system agent is preferred over earlier default agents.
+	expectBackend(system)
+
+	// A draining agent is not picked while another agent is available,
+	// and the earliest connection wins among equals.
+	system.setDraining()
+	expectBackend(default1)
+
+	// Once every agent is draining, the system agent is preferred again.
+	default1.setDraining()
+	default2.setDraining()
+	expectBackend(system)
+}
+
 func TestDefaultRouteBackendManager_AddRemoveBackends(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
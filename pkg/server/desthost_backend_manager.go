@@ -79,7 +79,15 @@ func (dibm *DestHostBackendManager) Backend(ctx context.Context) (*Backend, erro
 		bes, exist := dibm.backends[destHost]
 		if exist && len(bes) > 0 {
 			klog.V(5).InfoS("Get the backend through the DestHostBackendManager", "destHost", destHost)
-			return dibm.backends[destHost][0], nil
+			// Prefer the earliest connection among those of the best
+			// rank, as GetRandomBackend does across agents.
+			best := bes[0]
+			for _, be := range bes[1:] {
+				if preferenceRank(be) > preferenceRank(best) {
+					best = be
+				}
+			}
+			return best, nil
 		}
 	}
 	return nil, &ErrNotFound{}
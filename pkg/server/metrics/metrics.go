@@ -56,6 +56,7 @@ type ServerMetrics struct {
 	dialFailures      *prometheus.CounterVec
 	streamPackets     *prometheus.CounterVec
 	streamErrors      *prometheus.CounterVec
+	poolResizes       prometheus.Counter
 }
 
 // newServerMetrics create a new ServerMetrics, configured with default metric names.
@@ -148,6 +149,14 @@ func newServerMetrics() *ServerMetrics {
 			"reason",
 		},
 	)
+	poolResizes := prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: Namespace,
+			Subsystem: Subsystem,
+			Name:      "pool_resize_total",
+			Help:      "Number of times the maximum number of agent connections was changed.",
+		},
+	)
 	streamPackets := commonmetrics.MakeStreamPacketsTotalMetric(Namespace, Subsystem)
 	streamErrors := commonmetrics.MakeStreamErrorsTotalMetric(Namespace, Subsystem)
 	prometheus.MustRegister(endpointLatencies)
@@ -159,6 +168,7 @@ func newServerMetrics() *ServerMetrics {
 	prometheus.MustRegister(establishedConns)
 	prometheus.MustRegister(fullRecvChannels)
 	prometheus.MustRegister(dialFailures)
+	prometheus.MustRegister(poolResizes)
 	prometheus.MustRegister(streamPackets)
 	prometheus.MustRegister(streamErrors)
 	return &ServerMetrics{
@@ -173,6 +183,7 @@ func newServerMetrics() *ServerMetrics {
 		dialFailures:      dialFailures,
 		streamPackets:     streamPackets,
 		streamErrors:      streamErrors,
+		poolResizes:       poolResizes,
 	}
 }
 
@@ -231,6 +242,13 @@ func (s *ServerMetrics) SetEstablishedConnCount(count int) {
 	s.establishedConns.WithLabelValues().Set(float64(count))
 }
 
+// IncPoolResize counts a change of the maximum number of agent connections.
+func (s *ServerMetrics) IncPoolResize() { s.poolResizes.Inc() }
+
+// PoolResizes retrieves the metric for counting agent pool resizes. It is a
+// plain counter, which Reset does not reset.
+func (s *ServerMetrics) PoolResizes() prometheus.Counter { return s.poolResizes }
+
 // FullRecvChannel retrieves the metric for counting full receive channels.
 func (s *ServerMetrics) FullRecvChannel(serviceMethod string) prometheus.Gauge {
 	return s.fullRecvChannels.With(prometheus.Labels{"service_method": serviceMethod})
@@ -30,6 +30,9 @@ import (
 	"time"
 
 	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
@@ -56,6 +59,8 @@ type GrpcFrontend struct {
 	streamUID string
 	sendLock  sync.Mutex
 	recvLock  sync.Mutex
+	// traceCtx carries the trace context propagated by the frontend, if any.
+	traceCtx context.Context
 }
 
 func (g *GrpcFrontend) Send(pkt *client.Packet) error {
@@ -103,7 +108,8 @@ type ProxyClientConnection struct {
 	agentID     string
 	start       time.Time
 	backend     *Backend
-	dialAddress string // cached for logging
+	dialAddress string     // cached for logging
+	span        trace.Span // the tunnel span, or nil if it is not traced.
 }
 
 const (
@@ -218,6 +224,18 @@ type ProxyServer struct {
 
 	// TODO: move strategies into BackendStorage
 	proxyStrategies []ProxyStrategy
+
+	// DefaultQoSClass is the QoS class of agents which do not set one.
+	DefaultQoSClass string
+
+	// agentPool limits the number of agent connections; see ResizePool.
+	agentPool agentPool
+
+	// TracerProvider, if set, provides the tracer for the spans of the
+	// tunnels, instead of the global one. A tunnel span starts when the
+	// DIAL_REQ is received and ends when the frontend stream or HTTP
+	// connection closes.
+	TracerProvider trace.TracerProvider
 }
 
 // AgentTokenAuthenticationOptions contains list of parameters required for agent token based authentication
@@ -340,6 +358,13 @@ func (s *ProxyServer) removeEstablishedForBackendConn(agentID string, backend *B
 	return ret, nil
 }
 
+// numEstablished returns the number of established tunnels of agentID.
+func (s *ProxyServer) numEstablished(agentID string) int {
+	s.fmu.RLock()
+	defer s.fmu.RUnlock()
+	return len(s.established[agentID])
+}
+
 func (s *ProxyServer) getCount(established map[string](map[int64]*ProxyClientConnection)) int {
 	count := 0
 	for _, frontend := range established {
@@ -401,6 +426,7 @@ func NewProxyServer(serverID string, proxyStrategies []ProxyStrategy, serverCoun
 		// use the first backend-manager as the Readiness Manager
 		Readiness:       bms[0],
 		proxyStrategies: proxyStrategies,
+		DefaultQoSClass: QoSClassDefault,
 	}
 }
 
@@ -423,6 +449,7 @@ func (s *ProxyServer) Proxy(stream client.ProxyService_ProxyServer) error {
 	frontend := GrpcFrontend{
 		stream:    stream,
 		streamUID: streamUID,
+		traceCtx:  incomingTraceContext(stream.Context()),
 	}
 
 	defer func() {
@@ -494,6 +521,21 @@ func (s *ProxyServer) serveRecvFrontend(frontend *GrpcFrontend, recvCh <-chan *c
 	// connectionID} with a simpler key (#462).
 	var backend *Backend
 	var err error
+	// span is the span of the tunnel last dialed on the stream.
+	var span trace.Span
+	traceCtx := frontend.traceCtx
+	if traceCtx == nil {
+		traceCtx = context.Background()
+	}
+
+	defer func() {
+		if span != nil {
+			if firstConnID != 0 {
+				span.AddEvent(traceEventTransferEnd)
+			}
+			span.End()
+		}
+	}()
 
 	defer func() {
 		klog.V(5).InfoS("Close frontend streaming", "connectionID", firstConnID, "streamUID", frontend.streamUID)
@@ -521,6 +563,10 @@ func (s *ProxyServer) serveRecvFrontend(frontend *GrpcFrontend, recvCh <-chan *c
 			random := pkt.GetDialRequest().Random
 			address := pkt.GetDialRequest().Address
 			klog.V(3).InfoS("Received DIAL_REQ", "dialID", random, "dialAddress", address)
+			if span != nil {
+				span.End()
+			}
+			span = s.startTunnelSpan(traceCtx, ModeGRPC, address, random)
 			// TODO: if we track what agent has historically served
 			// the address, then we can send the Dial_REQ to the
 			// same agent. That way we save the agent from creating
@@ -529,6 +575,8 @@ func (s *ProxyServer) serveRecvFrontend(frontend *GrpcFrontend, recvCh <-chan *c
 			if err != nil {
 				klog.ErrorS(err, "Failed to get a backend", "dialID", random)
 				metrics.Metrics.ObserveDialFailure(metrics.DialFailureNoAgent)
+				span.RecordError(err)
+				span.SetStatus(otelcodes.Error, "no backend")
 
 				resp := &client.Packet{
 					Type: client.PacketType_DIAL_RSP,
@@ -545,6 +593,7 @@ func (s *ProxyServer) serveRecvFrontend(frontend *GrpcFrontend, recvCh <-chan *c
 				// The Dial is failing; no reason to keep this goroutine.
 				return
 			}
+			span.SetAttributes(attribute.String("konnectivity.agent_id", backend.GetAgentID()))
 			s.PendingDial.Add(
 				random,
 				&ProxyClientConnection{
@@ -555,7 +604,9 @@ func (s *ProxyServer) serveRecvFrontend(frontend *GrpcFrontend, recvCh <-chan *c
 					start:       time.Now(),
 					backend:     backend,
 					dialAddress: address,
+					span:        span,
 				})
+			injectTraceContext(span, pkt.GetDialRequest())
 			if err := backend.Send(pkt); err != nil {
 				klog.ErrorS(err, "DIAL_REQ to Backend failed", "dialID", random)
 			} else {
@@ -565,6 +616,9 @@ func (s *ProxyServer) serveRecvFrontend(frontend *GrpcFrontend, recvCh <-chan *c
 		case client.PacketType_CLOSE_REQ:
 			connID := pkt.GetCloseRequest().ConnectID
 			klog.V(5).InfoS("Received CLOSE_REQ", "connectionID", connID)
+			if span != nil {
+				span.AddEvent(traceEventCloseRequest, trace.WithAttributes(attribute.Int64("konnectivity.connection_id", connID)))
+			}
 			if backend == nil {
 				klog.V(2).InfoS("Backend has not been initialized for this connection", "connectionID", connID)
 				s.sendFrontendClose(frontend, connID, "backend uninitialized")
@@ -591,6 +645,8 @@ func (s *ProxyServer) serveRecvFrontend(frontend *GrpcFrontend, recvCh <-chan *c
 					"dialDuration", time.Since(pd.start),
 				)
 				metrics.Metrics.ObserveDialFailure(metrics.DialFailureFrontendClose)
+				pd.addTraceEvent(traceEventDialClose)
+				pd.failTrace("dial cancelled by frontend")
 			} else {
 				// TODO: Fix the leaked connection due to race (client cancels a pending dial but
 				// server has completed the dial).
@@ -613,6 +669,9 @@ func (s *ProxyServer) serveRecvFrontend(frontend *GrpcFrontend, recvCh <-chan *c
 			}
 			if firstConnID == 0 {
 				firstConnID = connID
+				if span != nil {
+					span.AddEvent(traceEventTransferStart, trace.WithAttributes(attribute.Int64("konnectivity.connection_id", connID)))
+				}
 			} else if firstConnID != connID {
 				klog.ErrorS(nil, "Data does not match first connection id", "firstConnectionID", firstConnID, "connectionID", connID)
 				// Something went very wrong if we get here. Close both connections to avoid leaks.
@@ -719,6 +778,12 @@ func (s *ProxyServer) Connect(stream agent.AgentService_ConnectServer) error {
 		return err
 	}
 	agentID := backend.GetAgentID()
+	if backend.qosClass == "" {
+		backend.qosClass = s.DefaultQoSClass
+	} else if err := ValidateQoSClass(backend.qosClass); err != nil {
+		klog.V(2).InfoS("Ignoring invalid agent QoS class", "agentID", agentID, "err", err)
+		backend.qosClass = s.DefaultQoSClass
+	}
 
 	klog.V(5).InfoS("Connect request from agent", "agentID", agentID, "serverID", s.serverID)
 	labels := runpprof.Labels(
@@ -735,6 +800,13 @@ func (s *ProxyServer) Connect(stream agent.AgentService_ConnectServer) error {
 		}
 	}
 
+	if !s.agentPool.add(backend) {
+		count, max := s.agentPool.size()
+		klog.V(2).InfoS("Rejecting agent, the agent pool is full", "agentID", agentID, "agents", count, "maxAgents", max)
+		return status.Errorf(codes.ResourceExhausted, "the proxy server is at its maximum of %d agents", max)
+	}
+	defer s.agentPool.remove(backend)
+
 	h := metadata.Pairs(header.ServerID, s.serverID, header.ServerCount, strconv.Itoa(s.serverCount))
 	if err := stream.SendHeader(h); err != nil {
 		klog.ErrorS(err, "Failed to send server count back to agent", "agentID", agentID)
@@ -749,14 +821,21 @@ func (s *ProxyServer) Connect(stream agent.AgentService_ConnectServer) error {
 
 	go runpprof.Do(context.Background(), labels, func(context.Context) { s.serveRecvBackend(backend, agentID, recvCh) })
 
-	defer func() {
-		close(recvCh)
-	}()
-
-	stopCh := make(chan error)
-	go runpprof.Do(context.Background(), labels, func(context.Context) { s.readBackendToChannel(backend, recvCh, stopCh) })
+	// The reader may outlive an evicted stream until the stream context is
+	// cancelled, so it closes recvCh itself, and stopCh is buffered.
+	stopCh := make(chan error, 1)
+	go runpprof.Do(context.Background(), labels, func(context.Context) {
+		defer close(recvCh)
+		s.readBackendToChannel(backend, recvCh, stopCh)
+	})
 
-	return <-stopCh
+	select {
+	case err := <-stopCh:
+		return err
+	case <-backend.Evicted():
+		klog.V(2).InfoS("Disconnecting agent evicted from the agent pool", "agentID", agentID)
+		return status.Error(codes.ResourceExhausted, "the agent was evicted, the proxy server agent pool was resized")
+	}
 }
 
 func (s *ProxyServer) readBackendToChannel(backend *Backend, recvCh chan *client.Packet, stopCh chan error) {
@@ -845,11 +924,15 @@ func (s *ProxyServer) serveRecvBackend(backend *Backend, agentID string, recvCh
 					s.sendBackendClose(backend, resp.ConnectID, resp.Random, "unknown dial id")
 				}
 			} else {
+				frontend.addTraceEvent(traceEventDialResponse,
+					attribute.String("konnectivity.agent_id", agentID),
+					attribute.Int64("konnectivity.connection_id", resp.ConnectID))
 				dialErr := false
 				if resp.Error != "" {
 					// Dial response with error should not contain a valid ConnID.
 					klog.ErrorS(errors.New(resp.Error), "DIAL_RSP contains failure", "dialID", resp.Random, "agentID", agentID)
 					metrics.Metrics.ObserveDialFailure(metrics.DialFailureErrorResponse)
+					frontend.failTrace(resp.Error)
 					dialErr = true
 				}
 				err := frontend.send(pkt)
@@ -858,6 +941,7 @@ func (s *ProxyServer) serveRecvBackend(backend *Backend, agentID string, recvCh
 						"dialID", resp.Random, "agentID", agentID, "connectionID", resp.ConnectID)
 					if !dialErr { // Avoid double-counting.
 						metrics.Metrics.ObserveDialFailure(metrics.DialFailureSendResponse)
+						frontend.failTrace("DIAL_RSP send to frontend failed")
 					}
 					// If we never finish setting up the tunnel for ConnectID, then the connection is dead.
 					// Currently, the agent will no resend DIAL_RSP, so connection is dead.
@@ -903,6 +987,8 @@ func (s *ProxyServer) serveRecvBackend(backend *Backend, agentID string, recvCh
 					"dialDuration", time.Since(frontend.start),
 				)
 				metrics.Metrics.ObserveDialFailure(metrics.DialFailureBackendClose)
+				frontend.addTraceEvent(traceEventDialClose)
+				frontend.failTrace("dial closed by agent")
 			}
 
 		case client.PacketType_DATA:
@@ -941,6 +1027,13 @@ func (s *ProxyServer) serveRecvBackend(backend *Backend, agentID string, recvCh
 				klog.V(5).InfoS("CLOSE_RSP sent to frontend", "connectionID", resp.ConnectID)
 			}
 
+		case client.PacketType_DRAIN:
+			klog.V(2).InfoS("Received DRAIN; no longer preferring agent for new dials", "agentID", agentID)
+			backend.setDraining()
+
+		case client.PacketType_HEARTBEAT:
+			klog.V(5).InfoS("Received HEARTBEAT", "agentID", agentID)
+
 		default:
 			klog.V(5).InfoS("Ignoring unrecognized packet from backend", "packet", pkt, "agentID", agentID)
 		}
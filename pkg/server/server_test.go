@@ -26,6 +26,10 @@ import (
 	"time"
 
 	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/mock/gomock"
 	"google.golang.org/grpc/metadata"
 
@@ -40,6 +44,7 @@ import (
 	client "sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
 	"sigs.k8s.io/apiserver-network-proxy/pkg/server/metrics"
 	metricstest "sigs.k8s.io/apiserver-network-proxy/pkg/testing/metrics"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/util"
 	agentmock "sigs.k8s.io/apiserver-network-proxy/proto/agent/mocks"
 	"sigs.k8s.io/apiserver-network-proxy/proto/header"
 )
@@ -726,6 +731,46 @@ func TestServerProxyNormalClose(t *testing.T) {
 	baseServerProxyTestWithBackend(t, validate)
 }
 
+func TestServerProxyPropagatesTraceContext(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	defer tp.Shutdown(context.Background())
+
+	frontendConn := prepareFrontendConn(ctrl)
+	proxyServer := NewProxyServer(uuid.New().String(), []ProxyStrategy{ProxyStrategyDefault}, 1, &AgentTokenAuthenticationOptions{})
+	proxyServer.TracerProvider = tp
+	agentConn, _ := prepareAgentConnMD(t, ctrl, proxyServer)
+
+	const dialID = 111
+	var sent *client.DialRequest
+	gomock.InOrder(
+		frontendConn.EXPECT().Recv().Return(dialReqPkt(dialID), nil).Times(1),
+		frontendConn.EXPECT().Recv().Return(nil, io.EOF).Times(1),
+	)
+	gomock.InOrder(
+		agentConn.EXPECT().Send(gomock.Any()).Do(func(pkt *client.Packet) {
+			sent = pkt.GetDialRequest()
+		}).Return(nil).Times(1),
+		agentConn.EXPECT().Send(dialClosePkt(dialID)).Return(nil).AnyTimes(),
+	)
+	proxyServer.Proxy(frontendConn)
+
+	spans := exporter.GetSpans()
+	if len(spans) != 1 {
+		t.Fatalf("expected a tunnel span, got %v", spans)
+	}
+	if sent == nil {
+		t.Fatal("expected the DIAL_REQ to be sent to the agent")
+	}
+	ctx := propagation.TraceContext{}.Extract(context.Background(), util.DialRequestCarrier{Request: sent})
+	if got := trace.SpanContextFromContext(ctx); got.TraceID() != spans[0].SpanContext.TraceID() || got.SpanID() != spans[0].SpanContext.SpanID() {
+		t.Errorf("expected the DIAL_REQ to carry the tunnel span context %v, got %v (traceparent %q)", spans[0].SpanContext, got, sent.Traceparent)
+	}
+}
+
 func TestServerProxyRecvChanFull(t *testing.T) {
 	validate := func(frontendConn, agentConn *agentmock.MockAgentService_ConnectServer) {
 		const dialID = 111
@@ -0,0 +1,126 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/metadata"
+
+	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/util"
+)
+
+// tracerName is the instrumentation scope of the tunnel spans.
+const tracerName = "sigs.k8s.io/apiserver-network-proxy/pkg/server"
+
+// tracePropagator reads the trace context propagated by the frontends, in
+// the W3C Trace Context format used by the Kubernetes API server.
+var tracePropagator propagation.TextMapPropagator = propagation.TraceContext{}
+
+// Names of the events added to a tunnel span.
+const (
+	traceEventDialResponse  = "DIAL_RSP"
+	traceEventDialClose     = "DIAL_CLS"
+	traceEventTransferStart = "data transfer start"
+	traceEventTransferEnd   = "data transfer end"
+	traceEventCloseRequest  = "CLOSE_REQ"
+)
+
+// metadataCarrier adapts gRPC metadata to a propagation.TextMapCarrier.
+type metadataCarrier metadata.MD
+
+func (mc metadataCarrier) Get(key string) string {
+	values := metadata.MD(mc).Get(key)
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+func (mc metadataCarrier) Set(key, value string) {
+	metadata.MD(mc).Set(key, value)
+}
+
+func (mc metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(mc))
+	for key := range mc {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// tracer returns the tracer for tunnel spans, from TracerProvider or, if it
+// is nil, the global one.
+func (s *ProxyServer) tracer() trace.Tracer {
+	tp := s.TracerProvider
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	return tp.Tracer(tracerName)
+}
+
+// startTunnelSpan starts the span of a tunnel dialing address, as a child
+// of the trace context propagated in ctx, if any.
+func (s *ProxyServer) startTunnelSpan(ctx context.Context, mode, address string, dialID int64) trace.Span {
+	_, span := s.tracer().Start(ctx, "konnectivity.tunnel",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("konnectivity.mode", mode),
+			attribute.String("konnectivity.dial_address", address),
+			attribute.Int64("konnectivity.dial_id", dialID),
+			attribute.String("konnectivity.server_id", s.serverID),
+		))
+	return span
+}
+
+// incomingTraceContext returns ctx with the trace context propagated in its
+// incoming gRPC metadata.
+func incomingTraceContext(ctx context.Context) context.Context {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ctx
+	}
+	return tracePropagator.Extract(ctx, metadataCarrier(md))
+}
+
+// injectTraceContext sets the trace context of span in dialReq, so that the
+// agent dialing it can continue the trace of the tunnel.
+func injectTraceContext(span trace.Span, dialReq *client.DialRequest) {
+	tracePropagator.Inject(trace.ContextWithSpan(context.Background(), span), util.DialRequestCarrier{Request: dialReq})
+}
+
+// addTraceEvent adds an event to the tunnel span of c, if it has one.
+func (c *ProxyClientConnection) addTraceEvent(name string, attrs ...attribute.KeyValue) {
+	if c.span == nil {
+		return
+	}
+	c.span.AddEvent(name, trace.WithAttributes(attrs...))
+}
+
+// failTrace marks the tunnel span of c, if it has one, as failed.
+func (c *ProxyClientConnection) failTrace(description string) {
+	if c.span == nil {
+		return
+	}
+	c.span.SetStatus(codes.Error, description)
+}
@@ -24,6 +24,10 @@ import (
 	"sync"
 	"time"
 
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 	"k8s.io/klog/v2"
 	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
 	"sigs.k8s.io/apiserver-network-proxy/pkg/server/metrics"
@@ -75,12 +79,20 @@ func (t *Tunnel) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		},
 	}
 
+	traceCtx := tracePropagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	span := t.Server.startTunnelSpan(traceCtx, ModeHTTPConnect, r.Host, random)
+	defer span.End()
+	injectTraceContext(span, dialRequest.GetDialRequest())
+
 	klog.V(4).Infof("Set pending(rand=%d) to %v", random, w)
 	backend, err := t.Server.getBackend(r.Host)
 	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(otelcodes.Error, "no backend")
 		http.Error(w, fmt.Sprintf("currently no tunnels available: %v", err), http.StatusInternalServerError)
 		return
 	}
+	span.SetAttributes(attribute.String("konnectivity.agent_id", backend.GetAgentID()))
 	closed := make(chan struct{})
 	connected := make(chan struct{})
 	connection := &ProxyClientConnection{
@@ -94,6 +106,7 @@ func (t *Tunnel) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		connected: connected,
 		start:     time.Now(),
 		backend:   backend,
+		span:      span,
 	}
 	t.Server.PendingDial.Add(random, connection)
 	if err := backend.Send(dialRequest); err != nil {
@@ -117,6 +130,7 @@ func (t *Tunnel) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	defer func() {
+		span.AddEvent(traceEventCloseRequest, trace.WithAttributes(attribute.Int64("konnectivity.connection_id", connection.connectID)))
 		packet := &client.Packet{
 			Type: client.PacketType_CLOSE_REQ,
 			Payload: &client.Packet_CloseRequest{
@@ -133,6 +147,8 @@ func (t *Tunnel) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}()
 
 	klog.V(3).InfoS("Starting proxy to host", "host", r.Host)
+	span.AddEvent(traceEventTransferStart, trace.WithAttributes(attribute.Int64("konnectivity.connection_id", connection.connectID)))
+	defer span.AddEvent(traceEventTransferEnd)
 	pkt := make([]byte, 1<<15) // Match GRPC Window size
 
 	connID := connection.connectID
@@ -0,0 +1,66 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
+)
+
+// W3C Trace Context keys carried by a DialRequest.
+const (
+	traceparentKey = "traceparent"
+	tracestateKey  = "tracestate"
+)
+
+// DialRequestCarrier adapts the trace context fields of a DialRequest to a
+// propagation.TextMapCarrier, so that the server can propagate the trace of
+// a tunnel to the agent which dials it. Keys other than traceparent and
+// tracestate are dropped.
+type DialRequestCarrier struct {
+	Request *client.DialRequest
+}
+
+func (c DialRequestCarrier) Get(key string) string {
+	switch key {
+	case traceparentKey:
+		return c.Request.GetTraceparent()
+	case tracestateKey:
+		return c.Request.GetTracestate()
+	default:
+		return ""
+	}
+}
+
+func (c DialRequestCarrier) Set(key, value string) {
+	switch key {
+	case traceparentKey:
+		c.Request.Traceparent = value
+	case tracestateKey:
+		c.Request.Tracestate = value
+	}
+}
+
+func (c DialRequestCarrier) Keys() []string {
+	var keys []string
+	if c.Request.GetTraceparent() != "" {
+		keys = append(keys, traceparentKey)
+	}
+	if c.Request.GetTracestate() != "" {
+		keys = append(keys, tracestateKey)
+	}
+	return keys
+}
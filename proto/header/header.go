@@ -27,6 +27,10 @@ const (
 	ServerID         = "serverID"
 	AgentID          = "agentID"
 	AgentIdentifiers = "agentIdentifiers"
+	// ServerIDHint is sent by an agent connecting to a specific proxy
+	// server. It is a hint only; the agent checks the ServerID returned by
+	// the server.
+	ServerIDHint = "serverIDHint"
 	// AuthenticationTokenContextKey will be used as a key to store authentication tokens in grpc call
 	// (https://tools.ietf.org/html/rfc6750#section-2.1)
 	AuthenticationTokenContextKey = "Authorization"
@@ -47,6 +51,9 @@ type Identifiers struct {
 	Host         []string
 	CIDR         []string
 	DefaultRoute bool
+	// QoSClass is the agent's tunnel scheduling class, e.g. "system" or
+	// "default". Empty if the agent did not set one.
+	QoSClass string
 }
 
 type IdentifierType string
@@ -58,6 +65,16 @@ const (
 	CIDR         IdentifierType = "cidr"
 	UID          IdentifierType = "uid"
 	DefaultRoute IdentifierType = "default-route"
+
+	// Zone, Region and Node describe the topology of the agent's pod. They
+	// are informational and are not used by the server to choose agents.
+	Zone   IdentifierType = "zone"
+	Region IdentifierType = "region"
+	Node   IdentifierType = "node"
+
+	// QoS is the agent's QoS class, which the server uses to prioritize
+	// agents when several match a request.
+	QoS IdentifierType = "qos"
 )
 
 // GenAgentIdentifiers generates an Identifiers based on the input string, the
@@ -83,6 +100,9 @@ func GenAgentIdentifiers(addrs string) (Identifiers, error) {
 			if err == nil && defaultRouteIdentifier {
 				agentIdents.DefaultRoute = true
 			}
+		case QoS:
+			// The first entry is used.
+			agentIdents.QoSClass = ids[0]
 		default:
 			// To support binary skew with agents that send new identifier type,
 			// fail open. The better place to validate more strictly is within the agent.
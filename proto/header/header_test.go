@@ -103,6 +103,14 @@ func TestGenAgentIdentifiers(t *testing.T) {
 				DefaultRoute: true,
 			},
 		},
+		{
+			desc: "qos",
+			// The first entry is used.
+			idents: "qos=system&qos=default",
+			want: Identifiers{
+				QoSClass: "system",
+			},
+		},
 		{
 			// UID is passed via header AgentID, not AgentIdentifers.
 			desc:   "ignore IdentifierType UID",
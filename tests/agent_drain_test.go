@@ -0,0 +1,87 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tests
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"k8s.io/apimachinery/pkg/util/wait"
+
+	"sigs.k8s.io/apiserver-network-proxy/tests/framework"
+)
+
+func TestProxy_DrainingAgentNotPicked(t *testing.T) {
+	ctx := context.Background()
+	server := httptest.NewServer(newEchoServer("hello"))
+	defer server.Close()
+
+	ps := runGRPCProxyServer(t)
+	defer ps.Stop()
+
+	// The draining agent stays connected while it has a tunnel open.
+	draining, err := Framework.AgentRunner.Start(t, framework.AgentOpts{
+		AgentID:          uuid.New().String(),
+		ServerAddr:       ps.AgentAddr(),
+		DrainGracePeriod: wait.ForeverTestTimeout,
+	})
+	if err != nil {
+		t.Fatalf("Failed to start agent: %v", err)
+	}
+	defer draining.Stop()
+	waitForConnectedAgentCount(t, 1, ps)
+
+	tunnel, err := createSingleUseGrpcTunnel(ctx, ps.FrontAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := tunnel.DialContext(ctx, "tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	a := runAgent(t, ps.AgentAddr())
+	defer a.Stop()
+	waitForConnectedAgentCount(t, 2, ps)
+
+	draining.Drain()
+	if err := wait.PollImmediate(100*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		count, err := ps.DrainingBackends()
+		return count == 1, err
+	}); err != nil {
+		t.Fatalf("server never saw the agent draining: %v", err)
+	}
+	if count, err := ps.ConnectedBackends(); err != nil || count != 2 {
+		t.Fatalf("expected the draining agent to remain connected, got %d backends (err: %v)", count, err)
+	}
+
+	// The draining agent rejects dials, so they only succeed if every one
+	// is routed to the other agent.
+	for i := 0; i < 10; i++ {
+		c, err := createGrpcTunnelClient(ctx, ps.FrontAddr(), server.URL)
+		if err != nil {
+			t.Fatalf("error obtaining client: %v", err)
+		}
+		if _, err := clientRequest(c, server.URL); err != nil {
+			t.Errorf("request %d: expected no error on proxy request, got %v", i, err)
+		}
+	}
+}
@@ -27,6 +27,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"sync"
+	"syscall"
 	"testing"
 	"time"
 
@@ -44,6 +45,8 @@ import (
 type AgentOpts struct {
 	AgentID    string
 	ServerAddr string
+	// DrainGracePeriod is how long a draining agent keeps open connections.
+	DrainGracePeriod time.Duration
 }
 
 type AgentRunner interface {
@@ -53,6 +56,8 @@ type AgentRunner interface {
 type Agent interface {
 	GetConnectedServerCount() (int, error)
 	Ready() bool
+	// Drain starts draining the agent, as on the first SIGTERM.
+	Drain()
 	Stop()
 	Metrics() metricstest.AgentTester
 }
@@ -66,9 +71,9 @@ func (*InProcessAgentRunner) Start(t testing.TB, opts AgentOpts) (Agent, error)
 	}
 
 	ctx, cancel := context.WithCancel(context.Background())
-	stopCh := make(chan struct{})
+	drainCh, stopCh := make(chan struct{}), make(chan struct{})
 	go func() {
-		if err := a.Run(o, stopCh); err != nil {
+		if err := a.Run(o, drainCh, stopCh); err != nil {
 			log.Printf("ERROR running agent: %v", err)
 			cancel()
 		}
@@ -84,6 +89,7 @@ func (*InProcessAgentRunner) Start(t testing.TB, opts AgentOpts) (Agent, error)
 
 	pa := &inProcessAgent{
 		client:     a.ClientSet(),
+		drainCh:    drainCh,
 		stopCh:     stopCh,
 		healthAddr: healthAddr,
 	}
@@ -94,12 +100,21 @@ func (*InProcessAgentRunner) Start(t testing.TB, opts AgentOpts) (Agent, error)
 type inProcessAgent struct {
 	client *agent.ClientSet
 
+	drainOnce sync.Once
+	drainCh   chan struct{}
+
 	stopOnce sync.Once
 	stopCh   chan struct{}
 
 	healthAddr string
 }
 
+func (a *inProcessAgent) Drain() {
+	a.drainOnce.Do(func() {
+		close(a.drainCh)
+	})
+}
+
 func (a *inProcessAgent) Stop() {
 	a.stopOnce.Do(func() {
 		close(a.stopCh)
@@ -160,7 +175,16 @@ type externalAgent struct {
 	cmd                   *exec.Cmd
 	metrics               *metricstest.Tester
 
-	stopOnce sync.Once
+	drainOnce sync.Once
+	stopOnce  sync.Once
+}
+
+func (a *externalAgent) Drain() {
+	a.drainOnce.Do(func() {
+		if err := a.cmd.Process.Signal(syscall.SIGTERM); err != nil {
+			log.Fatalf("Error draining agent process: %v", err)
+		}
+	})
 }
 
 func (a *externalAgent) Stop() {
@@ -224,6 +248,7 @@ func agentOptions(t testing.TB, opts AgentOpts) (*agentopts.GrpcProxyAgentOption
 	o.SyncInterval = 100 * time.Millisecond
 	o.SyncIntervalCap = 1 * time.Second
 	o.ProbeInterval = 100 * time.Millisecond
+	o.DrainGracePeriod = opts.DrainGracePeriod
 
 	o.AgentCert = filepath.Join(CertsDir, TestAgentCertFile)
 	o.AgentKey = filepath.Join(CertsDir, TestAgentKeyFile)
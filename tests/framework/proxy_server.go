@@ -28,6 +28,7 @@ import (
 	"time"
 
 	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/trace"
 	"k8s.io/apimachinery/pkg/util/wait"
 	serverapp "sigs.k8s.io/apiserver-network-proxy/cmd/server/app"
 	serveropts "sigs.k8s.io/apiserver-network-proxy/cmd/server/app/options"
@@ -39,6 +40,8 @@ type ProxyServerOpts struct {
 	ServerCount int
 	Mode        string
 	AgentPort   int // Defaults to random port.
+	// TracerProvider, if set, records the tunnel spans of the server.
+	TracerProvider trace.TracerProvider
 }
 
 type ProxyServerRunner interface {
@@ -47,6 +50,9 @@ type ProxyServerRunner interface {
 
 type ProxyServer interface {
 	ConnectedBackends() (int, error)
+	// DrainingBackends returns the number of connected backends which have
+	// reported that they are draining.
+	DrainingBackends() (int, error)
 	AgentAddr() string
 	FrontAddr() string
 	Ready() bool
@@ -57,7 +63,7 @@ type ProxyServer interface {
 type InProcessProxyServerRunner struct{}
 
 func (*InProcessProxyServerRunner) Start(t testing.TB, opts ProxyServerOpts) (ProxyServer, error) {
-	s := &serverapp.Proxy{}
+	s := &serverapp.Proxy{TracerProvider: opts.TracerProvider}
 	o, err := serverOptions(t, opts)
 	if err != nil {
 		return nil, fmt.Errorf("error building server options: %w", err)
@@ -127,6 +133,14 @@ func (ps *inProcessProxyServer) ConnectedBackends() (int, error) {
 	return numBackends, nil
 }
 
+func (ps *inProcessProxyServer) DrainingBackends() (int, error) {
+	numBackends := 0
+	for _, bm := range ps.proxyServer.BackendManagers {
+		numBackends += bm.NumDrainingBackends()
+	}
+	return numBackends, nil
+}
+
 func (ps *inProcessProxyServer) Ready() bool {
 	return checkReadiness(ps.healthAddr)
 }
@@ -155,7 +169,7 @@ func serverOptions(t testing.TB, opts ProxyServerOpts) (*serveropts.ProxyRunOpti
 	o.HealthBindAddress = localhost
 	o.AdminBindAddress = localhost
 
-	ports, err := FreePorts(3)
+	ports, err := FreePorts(4)
 	if err != nil {
 		return nil, err
 	}
@@ -166,6 +180,7 @@ func serverOptions(t testing.TB, opts ProxyServerOpts) (*serveropts.ProxyRunOpti
 	}
 	o.HealthPort = ports[1]
 	o.AdminPort = ports[2]
+	o.AdminGRPCPort = ports[3]
 
 	return o, nil
 }
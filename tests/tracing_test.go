@@ -0,0 +1,127 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tests
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"google.golang.org/grpc/metadata"
+	"k8s.io/apimachinery/pkg/util/wait"
+
+	"sigs.k8s.io/apiserver-network-proxy/pkg/server"
+	"sigs.k8s.io/apiserver-network-proxy/tests/framework"
+)
+
+func TestTunnelTracing_GRPC(t *testing.T) {
+	expectCleanShutdown(t)
+
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	defer tp.Shutdown(context.Background())
+
+	echo := httptest.NewServer(newEchoServer("hello"))
+	defer echo.Close()
+
+	ps, err := Framework.ProxyServerRunner.Start(t, framework.ProxyServerOpts{
+		Mode:           server.ModeGRPC,
+		ServerCount:    1,
+		TracerProvider: tp,
+	})
+	if err != nil {
+		t.Fatalf("Failed to start gRPC proxy server: %v", err)
+	}
+	defer ps.Stop()
+
+	a := runAgent(t, ps.AgentAddr())
+	defer a.Stop()
+	waitForConnectedServerCount(t, 1, a)
+
+	// Propagate the trace context of the request the way the API server's
+	// gRPC instrumentation does, in the metadata of the tunnel stream.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ctx, parent := tp.Tracer("test").Start(ctx, "request")
+	carrier := propagation.MapCarrier{}
+	propagation.TraceContext{}.Inject(ctx, carrier)
+	tunnel, err := createSingleUseGrpcTunnel(metadata.NewOutgoingContext(ctx, metadata.New(carrier)), ps.FrontAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Close the connection from the client side, so that the tunnel ends
+	// with a CLOSE_REQ.
+	conn, err := tunnel.DialContext(ctx, "tcp", echo.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest("GET", echo.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := req.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+	r, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello" {
+		t.Errorf("expect %v; got %v", "hello", string(data))
+	}
+	conn.Close()
+	parent.End()
+
+	var span tracetest.SpanStub
+	if err := wait.PollImmediate(10*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		for _, s := range exporter.GetSpans() {
+			if s.Name == "konnectivity.tunnel" {
+				span = s
+				return true, nil
+			}
+		}
+		return false, nil
+	}); err != nil {
+		t.Fatalf("expected a tunnel span, got %v", exporter.GetSpans())
+	}
+
+	if span.Parent.SpanID() != parent.SpanContext().SpanID() || span.Parent.TraceID() != parent.SpanContext().TraceID() {
+		t.Errorf("expected the tunnel span to be a child of the request span %v, got parent %v", parent.SpanContext(), span.Parent)
+	}
+	var events []string
+	for _, event := range span.Events {
+		events = append(events, event.Name)
+	}
+	expected := []string{"DIAL_RSP", "data transfer start", "CLOSE_REQ", "data transfer end"}
+	if !reflect.DeepEqual(events, expected) {
+		t.Errorf("expected events %v, got %v", expected, events)
+	}
+}
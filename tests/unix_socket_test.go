@@ -0,0 +1,118 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tests
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"k8s.io/apimachinery/pkg/util/wait"
+
+	"sigs.k8s.io/apiserver-network-proxy/pkg/agent"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/util"
+	"sigs.k8s.io/apiserver-network-proxy/tests/framework"
+)
+
+// serveUnixRelay relays the connections accepted on a UNIX socket in a
+// temporary directory to addr, and returns the socket path.
+func serveUnixRelay(t testing.TB, addr string) string {
+	t.Helper()
+	// t.TempDir may exceed the maximum length of a socket path.
+	dir, err := os.MkdirTemp("", "anp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	socket := filepath.Join(dir, "agent.sock")
+	lis, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { lis.Close() })
+
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				upstream, err := net.Dial("tcp", addr)
+				if err != nil {
+					return
+				}
+				defer upstream.Close()
+				go io.Copy(upstream, conn)
+				io.Copy(conn, upstream)
+			}()
+		}
+	}()
+	return socket
+}
+
+func TestAgent_UnixSocket(t *testing.T) {
+	ps := runGRPCProxyServer(t)
+	defer ps.Stop()
+
+	// The proxy server only listens for agents over TCP, so its agent port
+	// is reached through a UNIX socket relay.
+	socket := serveUnixRelay(t, ps.AgentAddr())
+
+	host, _, err := net.SplitHostPort(ps.AgentAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig, err := util.GetClientTLSConfig(
+		filepath.Join(framework.CertsDir, framework.TestCAFile),
+		filepath.Join(framework.CertsDir, framework.TestAgentCertFile),
+		filepath.Join(framework.CertsDir, framework.TestAgentKeyFile),
+		host, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc := &agent.ClientSetConfig{
+		Address:           socket,
+		TransportProtocol: agent.TransportUnix,
+		AgentID:           uuid.New().String(),
+		SyncInterval:      100 * time.Millisecond,
+		SyncIntervalCap:   time.Second,
+		ProbeInterval:     100 * time.Millisecond,
+		DialOptions:       []grpc.DialOption{grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig))},
+	}
+	cs, err := cc.NewAgentClientSetChecked(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs.Serve()
+	defer cs.Stop(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), wait.ForeverTestTimeout)
+	defer cancel()
+	if err := cs.WaitForHealthy(ctx, 1); err != nil {
+		t.Fatalf("expected the agent to connect over the UNIX socket: %v", err)
+	}
+	waitForConnectedAgentCount(t, 1, ps)
+}